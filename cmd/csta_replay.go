@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/avaya"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/genericcsta"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/osbiz"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	cstaReplayPBXType        string
+	cstaReplayRequestTimeout time.Duration
+	cstaReplayMaxDelay       time.Duration
+)
+
+func init() {
+	cstaReplayCmd.Flags().StringVarP(&cstaReplayPBXType, "pbx-type", "p", "", "PBX implementation to replay the trace against (default: pbx_type of the configuration)")
+	cstaReplayCmd.Flags().DurationVar(&cstaReplayRequestTimeout, "request-timeout", 5*time.Second, "how long to wait for a request of the trace to be sent")
+	cstaReplayCmd.Flags().DurationVar(&cstaReplayMaxDelay, "max-delay", time.Second, "upper limit for the recorded pauses between messages")
+	rootCmd.AddCommand(cstaReplayCmd)
+}
+
+var cstaReplayCmd = &cobra.Command{
+	Use:   "csta-replay <trace>",
+	Short: "Play a CSTA trace back against a PBX implementation",
+	Long: "Connects the PBX implementation to a fake switching function that answers with the messages received in the trace.\n" +
+		"Requests are matched to the trace by message type, the monitored devices are taken from the local configuration.\n" +
+		"The connection is closed after the last message of the trace.\n" +
+		"The replay works on a copy of the configuration database and discards all recordings, nothing is uploaded.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open trace: %w", err)
+		}
+		trace, err := csta.ReadTrace(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		// Keep status updates and queued recordings out of the real database
+		directory, err := os.MkdirTemp("", "csta-replay")
+		if err != nil {
+			return fmt.Errorf("failed to create a temporary directory: %w", err)
+		}
+		defer os.RemoveAll(directory)
+
+		err = copyDatabase(viper.GetString("config_path"), filepath.Join(directory, "config.db"))
+		if err != nil {
+			return err
+		}
+		viper.Set("config_path", filepath.Join(directory, "config.db"))
+
+		pbxType := cstaReplayPBXType
+		if pbxType == "" {
+			pbxType = viper.GetString("pbx_type")
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		defer listener.Close()
+
+		// Point the PBX implementation to the fake switching function
+		viper.Set(pbxType+".server_addresses", []string{listener.Addr().String()})
+		viper.Set(pbxType+".tls.enabled", false)
+		viper.Set(pbxType+".trace.enabled", false)
+
+		type replayResult struct {
+			report *csta.ReplayReport
+			err    error
+		}
+		result := make(chan replayResult, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				result <- replayResult{err: err}
+				return
+			}
+			defer conn.Close()
+
+			report, err := csta.Replay(conn, trace, &csta.ReplayOptions{
+				RequestTimeout: cstaReplayRequestTimeout,
+				MaxDelay:       cstaReplayMaxDelay,
+			})
+			result <- replayResult{report: report, err: err}
+		}()
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+
+		(&callRecordingAgentService{}).registerPBXImplementations()
+		implementation, err := pbx.New(pbxType, ctx)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate PBX implementation: %w", err)
+		}
+
+		switch implementation := implementation.(type) {
+		case *avaya.AvayaAES:
+			implementation.OnRecordingFinished = discardRecording
+		case *genericcsta.GenericCSTA:
+			implementation.OnRecordingFinished = discardRecording
+		case *osbiz.OSBiz:
+			implementation.OnRecordingFinished = discardRecording
+		}
+
+		recorderPool, err := rtp.NewRecorderPool(viper.GetUint("rtp.recorder_count"), ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create the recorder pool: %w", err)
+		}
+		go recorderPool.Start()
+
+		_, err = implementation.Connect()
+		if err == nil {
+			// Returns when the replay closed the connection
+			err = implementation.Serve(recorderPool)
+		}
+		if err != nil {
+			fmt.Printf("PBX implementation returned: %s\n", err)
+		}
+
+		// In case the implementation never connected
+		listener.Close()
+
+		r := <-result
+		if r.report != nil {
+			fmt.Printf("%d messages sent, %d received, %d deviations from the trace\n", r.report.Sent, r.report.Received, len(r.report.Deviations))
+			for _, deviation := range r.report.Deviations {
+				fmt.Printf("  %s\n", deviation)
+			}
+		}
+		if r.err != nil {
+			return fmt.Errorf("replay failed: %w", r.err)
+		}
+
+		return nil
+	},
+}
+
+// copyDatabase copies the configuration database at path to copyPath, a missing database is left to be created empty
+func copyDatabase(path string, copyPath string) error {
+	source, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open the configuration database: %w", err)
+	}
+	defer source.Close()
+
+	target, err := os.Create(copyPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy the configuration database: %w", err)
+	}
+
+	_, err = io.Copy(target, source)
+	if err != nil {
+		target.Close()
+		return fmt.Errorf("failed to copy the configuration database: %w", err)
+	}
+
+	return target.Close()
+}
+
+// discardRecording removes a recording of the replay instead of queueing it for upload
+func discardRecording(record *models.UploadRecord) {
+	fmt.Printf("Discarding recording of call <%s>\n", record.CallID)
+	os.Remove(record.FilePath)
+}
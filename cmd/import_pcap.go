@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/passive_monitoring"
+	"github.com/psco-tech/gw-coach-recording-agent/uploader"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importPcapOutputDirectory string
+	importPcapUpload          bool
+)
+
+func init() {
+	importPcapCmd.Flags().StringVarP(&importPcapOutputDirectory, "output-dir", "o", "", "directory the recordings are written to (default: the uploads directory)")
+	importPcapCmd.Flags().BoolVarP(&importPcapUpload, "upload", "u", false, "queue the recordings for upload")
+	rootCmd.AddCommand(importPcapCmd)
+}
+
+var importPcapCmd = &cobra.Command{
+	Use:   "import-pcap <file>",
+	Short: "Record the calls contained in a pcap or pcapng capture file",
+	Long: "Reconstructs the SIP dialogs and their RTP streams from a capture file the same way passive monitoring does,\n" +
+		"writing one recording per dialog. Begin and end of each recording are taken from the packet timestamps.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open capture file: %w", err)
+		}
+		defer file.Close()
+
+		source, linkType, err := openCaptureFile(file)
+		if err != nil {
+			return err
+		}
+
+		outputDirectory := importPcapOutputDirectory
+		if outputDirectory == "" {
+			outputDirectory, err = uploader.GetUploadsDirectory()
+			if err != nil {
+				return err
+			}
+		}
+
+		recordings := 0
+		recorder, err := passive_monitoring.NewPassiveRecorder(source, linkType, &passive_monitoring.RecorderOptions{
+			OutputDirectory: outputDirectory,
+			OnRecordingFinished: func(record *models.UploadRecord) {
+				recordings++
+				fmt.Printf("%s: %s - %s\n", record.FilePath, record.Begin.Format("2006-01-02 15:04:05.000"), record.End.Format("2006-01-02 15:04:05.000"))
+
+				if importPcapUpload {
+					err := uploader.Enqueue(record)
+					if err != nil {
+						log.Printf("ERROR: failed to queue %s for upload: %s\n", record.FilePath, err)
+					}
+				}
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to setup recorder: %w", err)
+		}
+
+		err = recorder.ListenAndRecord(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d recording(s) imported from %s\n", recordings, args[0])
+		return nil
+	},
+}
+
+// pcapngMagic is the block type of the section header block every pcapng file starts with
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// openCaptureFile returns a packet source for r, which may either be in pcap or pcapng format
+func openCaptureFile(r io.Reader) (gopacket.PacketDataSource, layers.LinkType, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read capture file: %w", err)
+	}
+
+	if bytes.Equal(magic, pcapngMagic) {
+		reader, err := pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read pcapng file: %w", err)
+		}
+		return reader, reader.LinkType(), nil
+	}
+
+	reader, err := pcapgo.NewReader(buffered)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read pcap file: %w", err)
+	}
+	return reader, reader.LinkType(), nil
+}
@@ -51,14 +51,14 @@ func (p *program) run() {
 	fmt.Println("Executable path: " + executablePath)
 	c := *exec.Command(executablePath)
 	if err != nil {
-		fmt.Println("Error getting executable path: %v", err.Error())
+		fmt.Printf("Error getting executable path: %v\n", err.Error())
 	}
 
 	fmt.Println("Executable path: " + c.Path)
 
 	logdir, err := logsDir()
 	if err != nil {
-		fmt.Println("Error opening logdir: %v", err.Error())
+		fmt.Printf("Error opening logdir: %v\n", err.Error())
 	}
 	fmt.Println("Logdir: " + logdir)
 	f, err := os.OpenFile(filepath.Join(logdir, "gw-error_log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0777)
@@ -79,7 +79,7 @@ func (p *program) run() {
 
 	err = c.Run()
 	if err != nil {
-		fmt.Println("Error running: %v", err.Error())
+		fmt.Printf("Error running: %v\n", err.Error())
 	}
 
 	fmt.Println("Service started")
@@ -11,11 +11,16 @@ import (
 	"github.com/google/gopacket/pcap"
 	"github.com/judwhite/go-svc"
 	"github.com/psco-tech/gw-coach-recording-agent/configserver"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
 	"github.com/psco-tech/gw-coach-recording-agent/passive_monitoring"
 	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/asterisk"
 	"github.com/psco-tech/gw-coach-recording-agent/pbx/avaya"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/freeswitch"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/genericcsta"
 	"github.com/psco-tech/gw-coach-recording-agent/pbx/osbiz"
 	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/psco-tech/gw-coach-recording-agent/siprec"
 	"github.com/psco-tech/gw-coach-recording-agent/uploader"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -58,6 +63,7 @@ type callRecordingAgentService struct {
 	pbx          pbx.PBX
 
 	passiveRecorder passive_monitoring.Recorder
+	siprecRecorder  siprec.Recorder
 }
 
 func (c *callRecordingAgentService) Init(env svc.Environment) error {
@@ -76,10 +82,15 @@ func (c *callRecordingAgentService) Init(env svc.Environment) error {
 			return fmt.Errorf("failed to open interface for listening: %s", err)
 		}
 
-		c.passiveRecorder, err = passive_monitoring.NewPassiveRecorder(handle)
+		c.passiveRecorder, err = passive_monitoring.NewPassiveRecorder(handle, handle.LinkType(), nil)
 		if err != nil {
 			return fmt.Errorf("failed to setup recorder: %s", err)
 		}
+	} else if pbxType == siprec.PBXType {
+		c.siprecRecorder, err = siprec.NewRecordingServer(viper.GetString("siprec.listen_address"))
+		if err != nil {
+			return fmt.Errorf("failed to setup SIPREC recording server: %w", err)
+		}
 	} else {
 		// Create the recorder pool
 		c.recorderPool, err = rtp.NewRecorderPool(viper.GetUint("rtp.recorder_count"), c.ctx)
@@ -93,6 +104,21 @@ func (c *callRecordingAgentService) Init(env svc.Environment) error {
 		if err != nil {
 			return fmt.Errorf("failed to instantiate PBX implementation: %w", err)
 		}
+
+		// OpenScape Business calls are captured passively and attributed to the monitored devices by CSTA
+		if o, ok := c.pbx.(*osbiz.OSBiz); ok && viper.GetBool("osbiz.passive_capture") {
+			handle, err := pcap.OpenLive(viper.GetString("passive_monitoring.interface_name"), viper.GetInt32("passive_monitoring.mtu_size"), true, pcap.BlockForever)
+			if err != nil {
+				return fmt.Errorf("failed to open interface for listening: %s", err)
+			}
+
+			c.passiveRecorder, err = passive_monitoring.NewPassiveRecorder(handle, handle.LinkType(), &passive_monitoring.RecorderOptions{
+				OnRecordingFinished: o.RecordingCaptured,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to setup recorder: %s", err)
+			}
+		}
 	}
 
 	return nil
@@ -109,6 +135,15 @@ func (c *callRecordingAgentService) Start() error {
 				log.Printf("Passive recorder error: %s\n", err)
 			}
 		}()
+	} else if pbxType == siprec.PBXType {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			err := c.siprecRecorder.ListenAndRecord(c.ctx)
+			if err != nil {
+				log.Printf("SIPREC recorder error: %s\n", err)
+			}
+		}()
 	} else {
 		// Start the RecorderPool first so the PBX will never request from it without it running
 		c.wg.Add(1)
@@ -120,6 +155,17 @@ func (c *callRecordingAgentService) Start() error {
 			}
 		}()
 
+		if c.passiveRecorder != nil {
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				err := c.passiveRecorder.ListenAndRecord(c.ctx)
+				if err != nil {
+					log.Printf("Passive recorder error: %s\n", err)
+				}
+			}()
+		}
+
 		// Connect to the PBX
 		c.wg.Add(1)
 		go func() {
@@ -166,6 +212,9 @@ func readInConfiguration() {
 func (c *callRecordingAgentService) registerPBXImplementations() error {
 	pbx.RegisterImplementation("osbiz", &osbiz.OSBiz{})
 	pbx.RegisterImplementation("avaya_aes", &avaya.AvayaAES{})
+	pbx.RegisterImplementation("generic_csta", &genericcsta.GenericCSTA{})
+	pbx.RegisterImplementation("asterisk", &asterisk.Asterisk{})
+	pbx.RegisterImplementation("freeswitch", &freeswitch.FreeSWITCH{})
 
 	return nil
 }
@@ -198,10 +247,20 @@ func (c *callRecordingAgentService) reestablishPBXConnection() error {
 			}
 
 			log.Printf("Successfully connected to PBX\n")
+			connectedAt := time.Now()
+			c.saveConnectionStatus(connectedAt)
 			err = c.pbx.Serve(c.recorderPool)
+			c.saveConnectionStatus(time.Time{})
 
 			// When Serve() returns an err the connection is lost or closed
 			if err != nil {
+				// Fail over to another node or back to the primary one right away,
+				// unless the connection keeps getting lost
+				if time.Since(connectedAt) >= connectionRetryTimeout {
+					log.Printf("PBX connection closed, reconnecting: %s\n", err)
+					continue
+				}
+
 				log.Printf("PBX connection closed, reconnect in %ds: %s\n", connectionRetryTimeout/time.Second, err)
 
 				select {
@@ -219,3 +278,28 @@ func (c *callRecordingAgentService) reestablishPBXConnection() error {
 		}
 	}
 }
+
+// saveConnectionStatus stores the node the PBX is connected to for the overview page,
+// a zero connectedAt marks the PBX as disconnected
+func (c *callRecordingAgentService) saveConnectionStatus(connectedAt time.Time) {
+	db, err := models.NewDatabase()
+	if err != nil {
+		log.Printf("Failed to save the PBX connection status: %s\n", err)
+		return
+	}
+
+	pbxType := viper.GetString("pbx_type")
+	status, _ := db.GetPBXConnectionStatus()
+	status.PbxType = pbxType
+	status.ActiveAddress = ""
+	status.Primary = false
+	status.ConnectedAt = connectedAt
+
+	if !connectedAt.IsZero() {
+		status.ActiveAddress = pbx.ActiveEndpoint(pbxType)
+		endpoints := pbx.CSTAEndpoints(pbxType)
+		status.Primary = len(endpoints) > 0 && endpoints[0] == status.ActiveAddress
+	}
+
+	db.Save(&status)
+}
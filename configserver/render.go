@@ -25,6 +25,7 @@ var navItems = []NavItem{
 	{Path: "/uploads", Title: "Data Uploads", IconClass: "bi-cloud-upload"},
 	{Path: "/connect-audio", Title: "Connect Audio", IconClass: "bi-telephone"},
 	{Path: "/cad", Title: "CAD", IconClass: "bi-database"},
+	{Path: "/recording-devices", Title: "Recording Stations", IconClass: "bi-record-circle"},
 	//{Path: "/devices", Title: "Devices", IconClass: ""},
 }
 
@@ -18,6 +18,7 @@ type AppOverview struct {
 	AgentInfoErr              string
 	UploadStorageDirectory    string
 	UploadStorageDirectoryErr string
+	PBXConnection             models.PBXConnectionStatus
 }
 
 type YTUpload struct {
@@ -64,7 +65,7 @@ func Start() {
 			log.Printf("Could not get app Config: %s", err.Error())
 			appConfig = *new(models.AppConfig)
 		}
-		log.Printf("FOUND CONFIG: %s", appConfig)
+		log.Printf("FOUND CONFIG: %+v", appConfig)
 
 		if err := c.BodyParser(&parsedConfig); err != nil {
 			log.Printf("Could not parse app config from body: %s", err.Error())
@@ -103,6 +104,8 @@ func Start() {
 			overview.UploadStorageDirectory = uploadDir
 		}
 
+		overview.PBXConnection, _ = database.GetPBXConnectionStatus()
+
 		return render(c.Response().BodyWriter(), "overview.html", "/", overview)
 	}
 	app.Get("/overview", overview)
@@ -137,7 +140,7 @@ func Start() {
 			log.Printf("Could not parse PBX connection credentials from body: %s", err.Error())
 			return renderWithError(c.Response().BodyWriter(), "avaya-pbx-connect.html", "/connection", pbxConn, fmt.Sprintf("Could not save connection: %s", err.Error()))
 		}
-		log.Printf("Parse creds: %s", pbxConn)
+		log.Printf("Parse creds: %+v", pbxConn)
 		database.Save(&pbxConn)
 
 		return render(c.Response().BodyWriter(), "avaya-pbx-connect.html", "/connection", pbxConn)
@@ -145,7 +148,7 @@ func Start() {
 
 	app.Get("/devices", func(c *fiber.Ctx) error {
 		devices := database.GetAllDevices()
-		log.Printf("Devices: %s", devices)
+		log.Printf("Devices: %+v", devices)
 		return render(c.Response().BodyWriter(), "devices.html", "/devices", devices)
 	})
 
@@ -159,7 +162,7 @@ func Start() {
 			log.Printf("Could not parse Add Device from body: %s", err.Error())
 			return renderWithError(c.Response().BodyWriter(), "add-device.html", "/devices", nil, fmt.Sprintf("Could not add device: %s", err.Error()))
 		}
-		log.Printf("Parse Device: %s", dev)
+		log.Printf("Parse Device: %+v", dev)
 
 		if dev.Extension == "" {
 			return renderWithError(c.Response().BodyWriter(), "add-device.html", "/devices", nil, fmt.Sprintf("Must set an extension"))
@@ -198,6 +201,11 @@ func Start() {
 		return c.Redirect("/devices")
 	})
 
+	app.Get("/recording-devices", func(c *fiber.Ctx) error {
+		recordingDevices := database.GetAESRecordingDevices()
+		return render(c.Response().BodyWriter(), "recording-devices.html", "/recording-devices", recordingDevices)
+	})
+
 	app.Get("/uploads", func(c *fiber.Ctx) error {
 		uploads, _ := database.GetRecentUploads()
 		return render(c.Response().BodyWriter(), "uploads.html", "/uploads", uploads)
@@ -218,15 +226,13 @@ func Start() {
 		}
 
 		ur := *new(models.UploadRecord)
-		ur.Status = models.UploadStatusQueued
 		ur.ContentType = "video/mp4"
 		ur.FilePath = outputFile
 		ur.Type = models.UploadRecordTypeCFS_AUDIO
-		database.Save(&ur)
 
-		cha := uploader.GetUploadRecordChannel()
-
-		cha <- ur
+		if err := uploader.Enqueue(&ur); err != nil {
+			log.Printf("Could not queue upload: %s", err.Error())
+		}
 
 		return c.Redirect("/uploads")
 	})
@@ -234,8 +240,13 @@ func Start() {
 	app.Post("/uploads/:recordId/retry", func(c *fiber.Ctx) error {
 		var recId, _ = strconv.Atoi(c.Params("recordId"))
 		ur := database.GetUploadRecordById(recId)
-		cha := uploader.GetUploadRecordChannel()
-		cha <- ur
+		if ur.ID < 1 {
+			return c.Redirect("/uploads")
+		}
+
+		if err := uploader.Enqueue(&ur); err != nil {
+			log.Printf("Could not queue upload: %s", err.Error())
+		}
 		return c.Redirect("/uploads")
 	})
 
@@ -21,7 +21,7 @@ func DownloadYouTubeVideo(videoURL string, outputDir string) (string, error) {
 	}
 
 	format = *getSmallestFileSizeFormat(video.Formats)
-	fmt.Printf("Downloading Format %s\n", format)
+	fmt.Printf("Downloading Format %+v\n", format)
 	stream, _, err := client.GetStream(video, &format)
 	if err != nil {
 		return "", fmt.Errorf("get stream: %v", err)
@@ -105,11 +105,13 @@ func (ResetApplicationSessionTimerNegResponse) Type() MessageType {
 }
 
 func (c *cstaConn) StartApplicationSession(applicationId string, applicationSpecificInfo interface{}, protocolVersion string, callback ...HandleFunc) error {
+	c.mutex.Lock()
 	if c.state != ConnectionStateIdle {
+		c.mutex.Unlock()
 		return fmt.Errorf("connection is not idle")
 	}
-
 	c.state = ConnectionStateStartingSession
+	c.mutex.Unlock()
 
 	// Send out a StartApplicationSession request
 	err := c.Request(StartApplicationSession{
@@ -121,12 +123,14 @@ func (c *cstaConn) StartApplicationSession(applicationId string, applicationSpec
 		if ctx.Error == nil {
 			switch ctx.Message.Type() {
 			case MessageTypeStartApplicationSessionPosResponse:
+				c.mutex.Lock()
 				c.sessionId = ctx.Message.(*StartApplicationSessionPosResponse).SessionID
 				c.state = ConnectionStateActive
+				c.mutex.Unlock()
 				// TODO start periodic refresh
 
 			case MessageTypeStartApplicationSessionNegResponse:
-				c.state = ConnectionStateError
+				c.setState(ConnectionStateError)
 				c.Close()
 				ctx.Error = fmt.Errorf("received StartApplicationSessionNegResponse")
 			}
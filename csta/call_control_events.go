@@ -11,6 +11,17 @@ const (
 	MessageTypeDeliveredEvent         MessageType = "DeliveredEvent"
 	MessageTypeEstablishedEvent       MessageType = "EstablishedEvent"
 	MessageTypeConnectionClearedEvent MessageType = "ConnectionClearedEvent"
+	MessageTypeHeldEvent              MessageType = "HeldEvent"
+	MessageTypeRetrievedEvent         MessageType = "RetrievedEvent"
+	MessageTypeConferencedEvent       MessageType = "ConferencedEvent"
+	MessageTypeDivertedEvent          MessageType = "DivertedEvent"
+	MessageTypeFailedEvent            MessageType = "FailedEvent"
+	MessageTypeQueuedEvent            MessageType = "QueuedEvent"
+	MessageTypeCallClearedEvent       MessageType = "CallClearedEvent"
+	MessageTypeDigitsDissipatedEvent  MessageType = "DigitsDissipatedEvent"
+
+	// ECMA-323 spells the element with a single r
+	MessageTypeTransferredEvent MessageType = "TransferedEvent"
 )
 
 func init() {
@@ -19,6 +30,15 @@ func init() {
 	registerMessageType(MessageTypeDeliveredEvent, reflect.TypeOf(DeliveredEvent{}))
 	registerMessageType(MessageTypeEstablishedEvent, reflect.TypeOf(EstablishedEvent{}))
 	registerMessageType(MessageTypeConnectionClearedEvent, reflect.TypeOf(ConnectionClearedEvent{}))
+	registerMessageType(MessageTypeHeldEvent, reflect.TypeOf(HeldEvent{}))
+	registerMessageType(MessageTypeRetrievedEvent, reflect.TypeOf(RetrievedEvent{}))
+	registerMessageType(MessageTypeTransferredEvent, reflect.TypeOf(TransferredEvent{}))
+	registerMessageType(MessageTypeConferencedEvent, reflect.TypeOf(ConferencedEvent{}))
+	registerMessageType(MessageTypeDivertedEvent, reflect.TypeOf(DivertedEvent{}))
+	registerMessageType(MessageTypeFailedEvent, reflect.TypeOf(FailedEvent{}))
+	registerMessageType(MessageTypeQueuedEvent, reflect.TypeOf(QueuedEvent{}))
+	registerMessageType(MessageTypeCallClearedEvent, reflect.TypeOf(CallClearedEvent{}))
+	registerMessageType(MessageTypeDigitsDissipatedEvent, reflect.TypeOf(DigitsDissipatedEvent{}))
 }
 
 type ServiceInitiatedEvent struct {
@@ -27,7 +47,7 @@ type ServiceInitiatedEvent struct {
 	InitiatedConnection ConnectionID     `xml:"initiatedConnection"`
 	InititatingDevice   SubjectDeviceID  `xml:"initiatingDevice"`
 	LocalConnectionInfo string           `xml:"localConnectionInfo"`
-	Cause               string           `xml:"cause"`
+	Cause               EventCause       `xml:"cause"`
 	CallLinkageData     *CallLinkageData `xml:"callLinkageData,omitempty"`
 }
 
@@ -42,7 +62,7 @@ type OriginatedEvent struct {
 	CallingDevice        SubjectDeviceID `xml:"callingDevice"`
 	CalledDevice         SubjectDeviceID `xml:"calledDevice"`
 	LocalConnectionInfo  string          `xml:"localConnectionInfo"`
-	Cause                string          `xml:"cause"`
+	Cause                EventCause      `xml:"cause"`
 }
 
 func (OriginatedEvent) Type() MessageType {
@@ -59,7 +79,7 @@ type DeliveredEvent struct {
 	LastRedirectionDevice RedirectionDeviceID `xml:"lastRedirectionDevice"`
 	LocalConnectionInfo   string              `xml:"localConnectionInfo"`
 	CallLinkageData       *CallLinkageData    `xml:"callLinkageData,omitempty"`
-	Cause                 string              `xml:"cause"`
+	Cause                 EventCause          `xml:"cause"`
 }
 
 func (DeliveredEvent) Type() MessageType {
@@ -75,7 +95,7 @@ type EstablishedEvent struct {
 	CalledDevice          SubjectDeviceID     `xml:"calledDevice"`
 	LastRedirectionDevice RedirectionDeviceID `xml:"lastRedirectionDevice"`
 	LocalConnectionInfo   string              `xml:"localConnectionInfo"`
-	Cause                 string              `xml:"cause"`
+	Cause                 EventCause          `xml:"cause"`
 	CallLinkageData       *CallLinkageData    `xml:"callLinkageData,omitempty"`
 }
 
@@ -89,9 +109,152 @@ type ConnectionClearedEvent struct {
 	DroppedConnection   ConnectionID    `xml:"droppedConnection"`
 	ReleasingDevice     SubjectDeviceID `xml:"releasingDevice"`
 	LocalConnectionInfo string          `xml:"localConnectionInfo"`
-	Cause               string          `xml:"cause"`
+	Cause               EventCause      `xml:"cause"`
 }
 
 func (ConnectionClearedEvent) Type() MessageType {
 	return MessageTypeConnectionClearedEvent
 }
+
+type HeldEvent struct {
+	XMLName             xml.Name        `xml:"HeldEvent"`
+	MonitorCrossRefID   string          `xml:"monitorCrossRefID"`
+	HeldConnection      ConnectionID    `xml:"heldConnection"`
+	HoldingDevice       SubjectDeviceID `xml:"holdingDevice"`
+	LocalConnectionInfo string          `xml:"localConnectionInfo"`
+	Cause               EventCause      `xml:"cause"`
+}
+
+func (HeldEvent) Type() MessageType {
+	return MessageTypeHeldEvent
+}
+
+type RetrievedEvent struct {
+	XMLName             xml.Name        `xml:"RetrievedEvent"`
+	MonitorCrossRefID   string          `xml:"monitorCrossRefID"`
+	RetrievedConnection ConnectionID    `xml:"retrievedConnection"`
+	RetrievingDevice    SubjectDeviceID `xml:"retrievingDevice"`
+	LocalConnectionInfo string          `xml:"localConnectionInfo"`
+	Cause               EventCause      `xml:"cause"`
+}
+
+func (RetrievedEvent) Type() MessageType {
+	return MessageTypeRetrievedEvent
+}
+
+// TransferredEvent reports that the calls of the transferring device were merged,
+// TransferredConnections maps their connections to the ones of the resulting call
+type TransferredEvent struct {
+	XMLName                xml.Name         `xml:"TransferedEvent"`
+	MonitorCrossRefID      string           `xml:"monitorCrossRefID"`
+	PrimaryOldCall         ConnectionID     `xml:"primaryOldCall"`
+	SecondaryOldCall       *ConnectionID    `xml:"secondaryOldCall,omitempty"`
+	TransferringDevice     SubjectDeviceID  `xml:"transferringDevice"`
+	TransferredToDevice    SubjectDeviceID  `xml:"transferredToDevice"`
+	TransferredConnections ConnectionList   `xml:"transferredConnections"`
+	LocalConnectionInfo    string           `xml:"localConnectionInfo"`
+	Cause                  EventCause       `xml:"cause"`
+	CallLinkageData        *CallLinkageData `xml:"callLinkageData,omitempty"`
+}
+
+func (TransferredEvent) Type() MessageType {
+	return MessageTypeTransferredEvent
+}
+
+// ConferencedEvent reports that the calls of the conferencing device were merged,
+// ConferenceConnections maps their connections to the ones of the conference call
+type ConferencedEvent struct {
+	XMLName               xml.Name         `xml:"ConferencedEvent"`
+	MonitorCrossRefID     string           `xml:"monitorCrossRefID"`
+	PrimaryOldCall        ConnectionID     `xml:"primaryOldCall"`
+	SecondaryOldCall      *ConnectionID    `xml:"secondaryOldCall,omitempty"`
+	ConferencingDevice    SubjectDeviceID  `xml:"conferencingDevice"`
+	AddedParty            SubjectDeviceID  `xml:"addedParty"`
+	ConferenceConnections ConnectionList   `xml:"conferenceConnections"`
+	LocalConnectionInfo   string           `xml:"localConnectionInfo"`
+	Cause                 EventCause       `xml:"cause"`
+	CallLinkageData       *CallLinkageData `xml:"callLinkageData,omitempty"`
+}
+
+func (ConferencedEvent) Type() MessageType {
+	return MessageTypeConferencedEvent
+}
+
+type DivertedEvent struct {
+	XMLName               xml.Name            `xml:"DivertedEvent"`
+	MonitorCrossRefID     string              `xml:"monitorCrossRefID"`
+	Connection            ConnectionID        `xml:"connection"`
+	DivertingDevice       SubjectDeviceID     `xml:"divertingDevice"`
+	NewDestination        SubjectDeviceID     `xml:"newDestination"`
+	CallingDevice         SubjectDeviceID     `xml:"callingDevice"`
+	CalledDevice          SubjectDeviceID     `xml:"calledDevice"`
+	LastRedirectionDevice RedirectionDeviceID `xml:"lastRedirectionDevice"`
+	LocalConnectionInfo   string              `xml:"localConnectionInfo"`
+	Cause                 EventCause          `xml:"cause"`
+}
+
+func (DivertedEvent) Type() MessageType {
+	return MessageTypeDivertedEvent
+}
+
+type FailedEvent struct {
+	XMLName               xml.Name            `xml:"FailedEvent"`
+	MonitorCrossRefID     string              `xml:"monitorCrossRefID"`
+	FailedConnection      ConnectionID        `xml:"failedConnection"`
+	FailingDevice         SubjectDeviceID     `xml:"failingDevice"`
+	CallingDevice         SubjectDeviceID     `xml:"callingDevice"`
+	CalledDevice          SubjectDeviceID     `xml:"calledDevice"`
+	LastRedirectionDevice RedirectionDeviceID `xml:"lastRedirectionDevice"`
+	LocalConnectionInfo   string              `xml:"localConnectionInfo"`
+	Cause                 EventCause          `xml:"cause"`
+}
+
+func (FailedEvent) Type() MessageType {
+	return MessageTypeFailedEvent
+}
+
+type QueuedEvent struct {
+	XMLName               xml.Name            `xml:"QueuedEvent"`
+	MonitorCrossRefID     string              `xml:"monitorCrossRefID"`
+	QueuedConnection      ConnectionID        `xml:"queuedConnection"`
+	Queue                 SubjectDeviceID     `xml:"queue"`
+	CallingDevice         SubjectDeviceID     `xml:"callingDevice"`
+	CalledDevice          SubjectDeviceID     `xml:"calledDevice"`
+	LastRedirectionDevice RedirectionDeviceID `xml:"lastRedirectionDevice"`
+	NumberQueued          *int                `xml:"numberQueued,omitempty"`
+	LocalConnectionInfo   string              `xml:"localConnectionInfo"`
+	Cause                 EventCause          `xml:"cause"`
+}
+
+func (QueuedEvent) Type() MessageType {
+	return MessageTypeQueuedEvent
+}
+
+// CallClearedEvent reports that a call was cleared as a whole, unlike
+// ConnectionClearedEvent which is sent for each device leaving it
+type CallClearedEvent struct {
+	XMLName           xml.Name     `xml:"CallClearedEvent"`
+	MonitorCrossRefID string       `xml:"monitorCrossRefID"`
+	ClearedCall       ConnectionID `xml:"clearedCall"`
+	Cause             EventCause   `xml:"cause"`
+}
+
+func (CallClearedEvent) Type() MessageType {
+	return MessageTypeCallClearedEvent
+}
+
+type DigitsDissipatedEvent struct {
+	XMLName               xml.Name            `xml:"DigitsDissipatedEvent"`
+	MonitorCrossRefID     string              `xml:"monitorCrossRefID"`
+	DissipatingConnection ConnectionID        `xml:"dissipatingConnection"`
+	DissipatingDevice     SubjectDeviceID     `xml:"dissipatingDevice"`
+	CallingDevice         SubjectDeviceID     `xml:"callingDevice"`
+	CalledDevice          SubjectDeviceID     `xml:"calledDevice"`
+	LastRedirectionDevice RedirectionDeviceID `xml:"lastRedirectionDevice"`
+	LocalConnectionInfo   string              `xml:"localConnectionInfo"`
+	Cause                 EventCause          `xml:"cause"`
+}
+
+func (DigitsDissipatedEvent) Type() MessageType {
+	return MessageTypeDigitsDissipatedEvent
+}
@@ -0,0 +1,90 @@
+package csta
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Avaya AES samples (ECMA-323 ed3, device IDs <extension>:<switch>:<ip>:<instance>)
+var (
+	aesHeldEvent        = `<?xml version="1.0" encoding="UTF-8"?><HeldEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"><monitorCrossRefID>7</monitorCrossRefID><heldConnection><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></heldConnection><holdingDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceIdentifier></holdingDevice><localConnectionInfo>hold</localConnectionInfo><cause>normal</cause></HeldEvent>`
+	aesRetrievedEvent   = `<?xml version="1.0" encoding="UTF-8"?><RetrievedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"><monitorCrossRefID>7</monitorCrossRefID><retrievedConnection><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></retrievedConnection><retrievingDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceIdentifier></retrievingDevice><localConnectionInfo>connected</localConnectionInfo><cause>normal</cause></RetrievedEvent>`
+	aesTransferredEvent = `<?xml version="1.0" encoding="UTF-8"?><TransferedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"><monitorCrossRefID>7</monitorCrossRefID><primaryOldCall><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></primaryOldCall><secondaryOldCall><callID>1043</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></secondaryOldCall><transferringDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceIdentifier></transferringDevice><transferredToDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceIdentifier></transferredToDevice><transferredConnections><connectionListItem><newConnection><callID>1043</callID><deviceID typeOfNumber="other" mediaClass="notKnown">T1043#1</deviceID></newConnection><oldConnection><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">T1042#1</deviceID></oldConnection><endpoint><deviceID typeOfNumber="other" mediaClass="notKnown">T1043#1</deviceID></endpoint></connectionListItem><connectionListItem><newConnection><callID>1043</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceID></newConnection><endpoint><deviceID typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceID></endpoint></connectionListItem></transferredConnections><localConnectionInfo>null</localConnectionInfo><cause>transfer</cause></TransferedEvent>`
+	aesConferencedEvent = `<?xml version="1.0" encoding="UTF-8"?><ConferencedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"><monitorCrossRefID>7</monitorCrossRefID><primaryOldCall><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></primaryOldCall><secondaryOldCall><callID>1043</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></secondaryOldCall><conferencingDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceIdentifier></conferencingDevice><addedParty><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceIdentifier></addedParty><conferenceConnections><connectionListItem><newConnection><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></newConnection><endpoint><deviceID typeOfNumber="other" mediaClass="notKnown">4711:CM1:0.0.0.0:0</deviceID></endpoint></connectionListItem><connectionListItem><newConnection><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">T1042#1</deviceID></newConnection><endpoint><deviceID typeOfNumber="other" mediaClass="notKnown">T1042#1</deviceID></endpoint></connectionListItem><connectionListItem><newConnection><callID>1042</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceID></newConnection><oldConnection><callID>1043</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceID></oldConnection><endpoint><deviceID typeOfNumber="other" mediaClass="notKnown">4712:CM1:0.0.0.0:0</deviceID></endpoint></connectionListItem></conferenceConnections><localConnectionInfo>connected</localConnectionInfo><cause>conference</cause></ConferencedEvent>`
+	aesCallClearedEvent = `<?xml version="1.0" encoding="UTF-8"?><CallClearedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"><monitorCrossRefID>7</monitorCrossRefID><clearedCall><callID>1042</callID></clearedCall><cause>normalClearing</cause></CallClearedEvent>`
+	aesQueuedEvent      = `<?xml version="1.0" encoding="UTF-8"?><QueuedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"><monitorCrossRefID>9</monitorCrossRefID><queuedConnection><callID>1044</callID><deviceID typeOfNumber="other" mediaClass="notKnown">4800:CM1:0.0.0.0:0</deviceID></queuedConnection><queue><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4800:CM1:0.0.0.0:0</deviceIdentifier></queue><callingDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">T1044#1</deviceIdentifier></callingDevice><calledDevice><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">4800:CM1:0.0.0.0:0</deviceIdentifier></calledDevice><lastRedirectionDevice><notRequired/></lastRedirectionDevice><numberQueued>2</numberQueued><localConnectionInfo>queued</localConnectionInfo><cause>enteringDistribution</cause></QueuedEvent>`
+)
+
+// OpenScape Business samples (ECMA-323 ed4, dialing numbers)
+var (
+	osbizDivertedEvent         = `<?xml version="1.0" encoding="UTF-8"?><DivertedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed4"><monitorCrossRefID>2</monitorCrossRefID><connection><callID>0A2C</callID><deviceID typeOfNumber="dialingNumber">4711</deviceID></connection><divertingDevice><deviceIdentifier typeOfNumber="dialingNumber">4711</deviceIdentifier></divertingDevice><newDestination><deviceIdentifier typeOfNumber="dialingNumber">4712</deviceIdentifier></newDestination><callingDevice><deviceIdentifier typeOfNumber="dialingNumber">+4989700700</deviceIdentifier></callingDevice><calledDevice><deviceIdentifier typeOfNumber="dialingNumber">4711</deviceIdentifier></calledDevice><lastRedirectionDevice><numberDialed typeOfNumber="dialingNumber">4711</numberDialed></lastRedirectionDevice><localConnectionInfo>null</localConnectionInfo><cause>callForwardNoAnswer</cause></DivertedEvent>`
+	osbizFailedEvent           = `<?xml version="1.0" encoding="UTF-8"?><FailedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed4"><monitorCrossRefID>2</monitorCrossRefID><failedConnection><callID>0A2D</callID><deviceID typeOfNumber="dialingNumber">4713</deviceID></failedConnection><failingDevice><deviceIdentifier typeOfNumber="dialingNumber">4713</deviceIdentifier></failingDevice><callingDevice><deviceIdentifier typeOfNumber="dialingNumber">4711</deviceIdentifier></callingDevice><calledDevice><deviceIdentifier typeOfNumber="dialingNumber">4713</deviceIdentifier></calledDevice><lastRedirectionDevice><notRequired/></lastRedirectionDevice><localConnectionInfo>fail</localConnectionInfo><cause>busy</cause></FailedEvent>`
+	osbizDigitsDissipatedEvent = `<?xml version="1.0" encoding="UTF-8"?><DigitsDissipatedEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed4"><monitorCrossRefID>2</monitorCrossRefID><dissipatingConnection><callID>0A2E</callID><deviceID typeOfNumber="dialingNumber">4711</deviceID></dissipatingConnection><dissipatingDevice><deviceIdentifier typeOfNumber="dialingNumber">4711</deviceIdentifier></dissipatingDevice><callingDevice><deviceIdentifier typeOfNumber="dialingNumber">4711</deviceIdentifier></callingDevice><calledDevice><notKnown/></calledDevice><lastRedirectionDevice><notRequired/></lastRedirectionDevice><localConnectionInfo>null</localConnectionInfo><cause>normalClearing</cause></DigitsDissipatedEvent>`
+	osbizHeldEvent             = `<?xml version="1.0" encoding="UTF-8"?><HeldEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed4"><monitorCrossRefID>2</monitorCrossRefID><heldConnection><callID>0A2C</callID><deviceID typeOfNumber="dialingNumber">4711</deviceID></heldConnection><holdingDevice><deviceIdentifier typeOfNumber="dialingNumber">4711</deviceIdentifier></holdingDevice><localConnectionInfo>hold</localConnectionInfo><cause>normal</cause></HeldEvent>`
+)
+
+func TestUnmarshalCallControlEvents(t *testing.T) {
+	for body, check := range map[string]func(m Message) bool{
+		aesHeldEvent: func(m Message) bool {
+			e := m.(*HeldEvent)
+			return e.HeldConnection.CallID == "1042" && e.HoldingDevice.DeviceIdentifier.Device == "4711:CM1:0.0.0.0:0" && e.Cause == EventCauseNormal
+		},
+		aesRetrievedEvent: func(m Message) bool {
+			e := m.(*RetrievedEvent)
+			return e.RetrievedConnection.CallID == "1042" && e.RetrievingDevice.DeviceIdentifier.Device == "4711:CM1:0.0.0.0:0" && e.LocalConnectionInfo == "connected"
+		},
+		aesTransferredEvent: func(m Message) bool {
+			e := m.(*TransferredEvent)
+			items := e.TransferredConnections.Items
+			return e.PrimaryOldCall.CallID == "1042" && e.SecondaryOldCall.CallID == "1043" &&
+				e.TransferredToDevice.DeviceIdentifier.Device == "4712:CM1:0.0.0.0:0" && e.Cause == EventCauseTransfer &&
+				len(items) == 2 && items[0].OldConnection.CallID == "1042" && items[0].NewConnection.CallID == "1043" &&
+				items[1].OldConnection == nil && items[1].Endpoint.DeviceID.Device == "4712:CM1:0.0.0.0:0"
+		},
+		aesConferencedEvent: func(m Message) bool {
+			e := m.(*ConferencedEvent)
+			items := e.ConferenceConnections.Items
+			return e.PrimaryOldCall.CallID == "1042" && e.AddedParty.DeviceIdentifier.Device == "4712:CM1:0.0.0.0:0" &&
+				e.Cause == EventCauseConference && len(items) == 3 && items[2].OldConnection.CallID == "1043" && items[2].NewConnection.CallID == "1042"
+		},
+		aesCallClearedEvent: func(m Message) bool {
+			e := m.(*CallClearedEvent)
+			return e.ClearedCall.CallID == "1042" && e.ClearedCall.DeviceID == nil && e.Cause == EventCauseNormalClearing
+		},
+		aesQueuedEvent: func(m Message) bool {
+			e := m.(*QueuedEvent)
+			return e.QueuedConnection.CallID == "1044" && e.Queue.DeviceIdentifier.Device == "4800:CM1:0.0.0.0:0" &&
+				e.NumberQueued != nil && *e.NumberQueued == 2 && e.LastRedirectionDevice.NotRequired != nil && e.Cause == EventCauseEnteringDistribution
+		},
+		osbizDivertedEvent: func(m Message) bool {
+			e := m.(*DivertedEvent)
+			return e.Connection.CallID == "0A2C" && e.NewDestination.DeviceIdentifier.Device == "4712" &&
+				e.CallingDevice.DeviceIdentifier.Device == "+4989700700" && e.LastRedirectionDevice.NumberDialed.Device == "4711" &&
+				e.Cause == EventCauseCallForwardNoAnswer
+		},
+		osbizFailedEvent: func(m Message) bool {
+			e := m.(*FailedEvent)
+			return e.FailedConnection.CallID == "0A2D" && e.FailingDevice.DeviceIdentifier.Device == "4713" && e.Cause == EventCauseBusy
+		},
+		osbizDigitsDissipatedEvent: func(m Message) bool {
+			e := m.(*DigitsDissipatedEvent)
+			return e.DissipatingConnection.CallID == "0A2E" && e.DissipatingDevice.DeviceIdentifier.Device == "4711" && e.CalledDevice.NotKnown != nil
+		},
+		osbizHeldEvent: func(m Message) bool {
+			e := m.(*HeldEvent)
+			return e.HeldConnection.DeviceID.Device == "4711" && e.HeldConnection.DeviceID.TypeOfNumber == "dialingNumber"
+		},
+	} {
+		invokeId, message, err := ReadMessage(bytes.NewReader(frame(9999, body)))
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			continue
+		}
+
+		if invokeId != 9999 || !check(message) {
+			t.Logf("unexpected %s: %+v\n", message.Type(), message)
+			t.Fail()
+		}
+	}
+}
@@ -1,13 +1,27 @@
 package csta
 
-import "reflect"
+import (
+	"encoding/xml"
+	"reflect"
+)
 
 const (
-	MessageTypeMakeCall MessageType = "MakeCall"
+	MessageTypeMakeCall         MessageType = "MakeCall"
+	MessageTypeMakeCallResponse MessageType = "MakeCallResponse"
+
+	MessageTypeSingleStepConferenceCall         MessageType = "SingleStepConferenceCall"
+	MessageTypeSingleStepConferenceCallResponse MessageType = "SingleStepConferenceCallResponse"
+	MessageTypeClearConnection                  MessageType = "ClearConnection"
+	MessageTypeClearConnectionResponse          MessageType = "ClearConnectionResponse"
 )
 
 func init() {
 	registerMessageType(MessageTypeMakeCall, reflect.TypeOf(MakeCall{}))
+	registerMessageType(MessageTypeMakeCallResponse, reflect.TypeOf(MakeCallResponse{}))
+	registerMessageType(MessageTypeSingleStepConferenceCall, reflect.TypeOf(SingleStepConferenceCall{}))
+	registerMessageType(MessageTypeSingleStepConferenceCallResponse, reflect.TypeOf(SingleStepConferenceCallResponse{}))
+	registerMessageType(MessageTypeClearConnection, reflect.TypeOf(ClearConnection{}))
+	registerMessageType(MessageTypeClearConnectionResponse, reflect.TypeOf(ClearConnectionResponse{}))
 }
 
 type MakeCall struct {
@@ -19,3 +33,59 @@ type MakeCall struct {
 func (MakeCall) Type() MessageType {
 	return MessageTypeMakeCall
 }
+
+type MakeCallResponse struct {
+	XMLName       xml.Name     `xml:"MakeCallResponse"`
+	CallingDevice ConnectionID `xml:"callingDevice"`
+}
+
+func (MakeCallResponse) Type() MessageType {
+	return MessageTypeMakeCallResponse
+}
+
+type ParticipationType string
+
+const (
+	ParticipationTypeActive ParticipationType = "active"
+	ParticipationTypeSilent ParticipationType = "silent" // The joining device can listen but not be heard
+)
+
+// SingleStepConferenceCall adds a device to an existing call without consulting it first
+type SingleStepConferenceCall struct {
+	XMLName           xml.Name          `xml:"SingleStepConferenceCall"`
+	ActiveCall        ConnectionID      `xml:"activeCall"`
+	DeviceToJoin      string            `xml:"deviceToJoin"`
+	ParticipationType ParticipationType `xml:"participationType,omitempty"`
+}
+
+func (SingleStepConferenceCall) Type() MessageType {
+	return MessageTypeSingleStepConferenceCall
+}
+
+type SingleStepConferenceCallResponse struct {
+	XMLName         xml.Name       `xml:"SingleStepConferenceCallResponse"`
+	ConferencedCall ConnectionID   `xml:"conferencedCall"`
+	Connections     ConnectionList `xml:"connections"`
+}
+
+func (SingleStepConferenceCallResponse) Type() MessageType {
+	return MessageTypeSingleStepConferenceCallResponse
+}
+
+// ClearConnection releases a device from a call, the call goes on if other parties are left
+type ClearConnection struct {
+	XMLName               xml.Name     `xml:"ClearConnection"`
+	ConnectionToBeCleared ConnectionID `xml:"connectionToBeCleared"`
+}
+
+func (ClearConnection) Type() MessageType {
+	return MessageTypeClearConnection
+}
+
+type ClearConnectionResponse struct {
+	XMLName xml.Name `xml:"ClearConnectionResponse"`
+}
+
+func (ClearConnectionResponse) Type() MessageType {
+	return MessageTypeClearConnectionResponse
+}
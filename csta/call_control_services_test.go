@@ -0,0 +1,41 @@
+package csta
+
+import (
+	"bytes"
+	"testing"
+)
+
+var singleStepConferenceCallMessage = []byte("\x00\x00\x00\xde0001<SingleStepConferenceCall><activeCall><callID>42</callID><deviceID>4711:CM1::0</deviceID></activeCall><deviceToJoin>5001:CM1::0</deviceToJoin><participationType>silent</participationType></SingleStepConferenceCall>")
+
+func TestUnmarshalSingleStepConferenceCall(t *testing.T) {
+	_, m, err := ReadMessage(bytes.NewReader(singleStepConferenceCallMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, ok := m.(*SingleStepConferenceCall)
+	if !ok {
+		t.Fatalf("unexpected message %T", m)
+	}
+	if request.ActiveCall.CallID != "42" || request.ActiveCall.DeviceID.Device != "4711:CM1::0" ||
+		request.DeviceToJoin != "5001:CM1::0" || request.ParticipationType != ParticipationTypeSilent {
+		t.Fatalf("unexpected request %+v", request)
+	}
+}
+
+func TestMarshalClearConnection(t *testing.T) {
+	m := &ClearConnection{ConnectionToBeCleared: ConnectionID{CallID: "42", DeviceID: &LocalDeviceID{Device: "5001:CM1::0"}}}
+
+	marshalledMessage, err := marshal(1, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := ReadMessage(bytes.NewReader(marshalledMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := r.(*ClearConnection); !ok || c.ConnectionToBeCleared.CallID != "42" || c.ConnectionToBeCleared.DeviceID.Device != "5001:CM1::0" {
+		t.Fatalf("unexpected message %+v", r)
+	}
+}
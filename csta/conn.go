@@ -3,6 +3,7 @@ package csta
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/xml"
 	"errors"
@@ -20,11 +21,21 @@ const defaultDialTimeout = 30 * time.Second
 const defaultSessionDuration = 60
 const requestTimeout = 10 * time.Second
 
+// Invoke IDs 0000-8999 are used for requests, 9999 is reserved for events (ECMA-323 annex E)
+const maxInvokeID = 9000
+
 var defaultHandlers = map[MessageType]HandleFunc{
 	MessageTypeSystemStatus:                      acknowledgeSystemStatus,
 	MessageTypeStopApplicationSessionPosResponse: ignoreMessage,
 }
 
+// ErrConnectionClosed is returned for requests that are pending or sent while the connection is closed
+var ErrConnectionClosed = errors.New("CSTA connection closed")
+
+// ErrInvalidMessage is wrapped by the errors of messages that were read completely but
+// couldn't be unmarshalled, reading can go on with the next message
+var ErrInvalidMessage = errors.New("invalid CSTA message")
+
 type ConnectionState int
 
 const (
@@ -43,6 +54,12 @@ type Conn interface {
 	Close() error
 	Closed() <-chan struct{}
 
+	// Do sends a request and blocks until its response is received. The
+	// request fails when ctx is done, the connection is closed or no response
+	// is received within the request timeout. If the switching function
+	// rejected the request, the error is the Error of its CSTAErrorCode.
+	Do(ctx context.Context, request Message) (Message, error)
+
 	Handle(messageType MessageType, responseHandler HandleFunc)
 	RemoveHandler(messageType MessageType)
 
@@ -55,23 +72,34 @@ type Conn interface {
 
 type ConnectionOptions struct {
 	DisableImmediateFlushing bool
+
+	// TLS is used for the connection if set, otherwise it's plain TCP
+	TLS *TLSOptions
+
+	// Tracer gets every message sent or received, if set
+	Tracer Tracer
 }
 
 type cstaConn struct {
+	ctx     context.Context
+	timeout time.Duration
+	options *ConnectionOptions
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	closed  context.CancelFunc
+
+	// Serializes writes of complete messages
+	writeMutex sync.Mutex
+
+	// Guards everything below, which is shared by the read loop, handlers and callers
 	mutex        sync.Mutex
-	ctx          context.Context
 	lastInvokeId uint
-	timeout      time.Duration
-	options      *ConnectionOptions
-	conn         net.Conn
-	rw           *bufio.ReadWriter
 	state        ConnectionState
 	sessionId    string
-	closed       context.CancelFunc
-
-	handlers            map[MessageType]HandleFunc
-	transactions        map[uint]HandleFunc
-	transactionTimeouts map[uint]*time.Timer
+	handlers     map[MessageType]HandleFunc
+	transactions map[uint]chan *Context // Pending requests by invoke ID
+	dispatches   []dispatch             // Messages waiting for their handlers, in the order they were received
+	dispatched   chan struct{}          // Signals the dispatcher that dispatches were queued
 }
 
 type Context struct {
@@ -87,22 +115,37 @@ func (c *Context) error(err error) {
 
 type HandleFunc func(c *Context)
 
+// Handle sets the handler for messages of a type that aren't responses to a request. Handlers
+// run one at a time in the order the messages were received, a slow handler delays the others.
 func (c *cstaConn) Handle(messageType MessageType, responseHandler HandleFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.handlers[messageType] = responseHandler
 }
 
 func (c *cstaConn) RemoveHandler(messageType MessageType) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	delete(c.handlers, messageType)
 }
 
 // Write marshals and writes a CSTA message to the underlying connection
 func (c *cstaConn) Write(invokeId uint, message Message) error {
-	msg, err := marshal(invokeId, message)
+	frame, err := marshal(invokeId, message)
 	if err != nil {
 		return fmt.Errorf("failed to marshal CSTA message: %w", err)
 	}
 
-	_, err = c.rw.Write(msg)
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.options.Tracer != nil {
+		c.options.Tracer.Trace(TraceDirectionSent, invokeId, frame[cstaHeaderSize:])
+	}
+
+	_, err = c.rw.Write(frame)
 	if err != nil {
 		return fmt.Errorf("failed to write CSTA message: %w", err)
 	}
@@ -116,16 +159,69 @@ func (c *cstaConn) Write(invokeId uint, message Message) error {
 
 // Read reads a complete CSTA message from the connection and unmarshals it
 func (c *cstaConn) Read() (uint, Message, error) {
+	invokeId, frame, err := readFrame(c.rw)
+	if err != nil {
+		// Pass down EOF
+		if errors.Is(err, io.EOF) {
+			c.setState(ConnectionStateClosed)
+		}
+		return invokeId, nil, err
+	}
+
+	if c.options != nil && c.options.Tracer != nil {
+		c.options.Tracer.Trace(TraceDirectionReceived, invokeId, frame[cstaHeaderSize:])
+	}
+
+	message, err := parseFrame(frame)
+	if err != nil {
+		return invokeId, nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	return invokeId, message, nil
+}
+
+// WriteMessage marshals a CSTA message and writes it to w, including the CSTA header
+func WriteMessage(w io.Writer, invokeId uint, message Message) error {
+	msg, err := marshal(invokeId, message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CSTA message: %w", err)
+	}
+
+	_, err = w.Write(msg)
+	if err != nil {
+		return fmt.Errorf("failed to write CSTA message: %w", err)
+	}
+
+	return nil
+}
+
+// ReadMessage reads a complete CSTA message from r and unmarshals it into
+// the registered type of its root element. It returns io.EOF unwrapped if r
+// ended before the next message.
+func ReadMessage(r io.Reader) (uint, Message, error) {
+	invokeId, frame, err := readFrame(r)
+	if err != nil {
+		return invokeId, nil, err
+	}
+
+	message, err := parseFrame(frame)
+	if err != nil {
+		return invokeId, nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	return invokeId, message, nil
+}
+
+// readFrame reads a complete CSTA message including its header, without parsing the body
+func readFrame(r io.Reader) (uint, []byte, error) {
 	// Read a CSTA header
-	cstaHeader := make([]byte, 8)
-	_, err := io.ReadFull(c.rw, cstaHeader)
+	cstaHeader := make([]byte, cstaHeaderSize)
+	_, err := io.ReadFull(r, cstaHeader)
 	if err != nil {
 		// Pass down EOF
 		if errors.Is(err, io.EOF) {
-			c.state = ConnectionStateClosed
 			return 0, nil, err
 		}
-		c.state = ConnectionStateError
 		return 0, nil, fmt.Errorf("failed to read CSTA header: %w", err)
 	}
 
@@ -133,7 +229,7 @@ func (c *cstaConn) Read() (uint, Message, error) {
 	length := binary.BigEndian.Uint16(cstaHeader[2:4])
 
 	// Quick sanity check for the message length
-	if length <= 8 {
+	if length <= cstaHeaderSize {
 		return 0, nil, fmt.Errorf("invalid message length")
 	}
 
@@ -143,40 +239,55 @@ func (c *cstaConn) Read() (uint, Message, error) {
 	}
 	invokeId := uint(iid)
 
-	// Allocate a buffer for the message body
-	body := make([]byte, length-8)
+	// Allocate a buffer for the complete message
+	frame := make([]byte, length)
+	copy(frame, cstaHeader)
 
 	// Read the message body from the wire
-	_, err = io.ReadFull(c.rw, body)
+	_, err = io.ReadFull(r, frame[cstaHeaderSize:])
 	if err != nil {
 		return invokeId, nil, fmt.Errorf("failed to read the message body: %w", err)
 	}
 
-	// Generic message to get the root element
-	cstaMessage := struct {
-		XMLName xml.Name
-	}{}
+	return invokeId, frame, nil
+}
 
-	err = xml.Unmarshal(body, &cstaMessage)
+// parseFrame unmarshals a complete CSTA message into the registered type of its root element
+func parseFrame(frame []byte) (Message, error) {
+	messageType, err := typeOf(frame[cstaHeaderSize:])
 	if err != nil {
-		return invokeId, nil, fmt.Errorf("failed to get the message type: %w", err)
+		return nil, err
 	}
 
 	// Try to get an instance of the message type to unmarshal
-	if messageType, ok := messageTypes[MessageType(cstaMessage.XMLName.Local)]; ok {
-		instance := reflect.New(messageType).Interface()
-		m := instance.(Message)
+	if implementation, ok := messageTypes[messageType]; ok {
+		m := reflect.New(implementation).Interface().(Message)
 
 		// Unmarshal into message type
-		err = unmarshal(append(cstaHeader, body...), m)
+		err = unmarshal(frame, m)
 		if err != nil {
-			return invokeId, nil, fmt.Errorf("failed to unmarshal message: %w", err)
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
 		}
 
-		return invokeId, m, nil
+		return m, nil
 	}
 
-	return invokeId, nil, fmt.Errorf("unhandled message type: %s", cstaMessage.XMLName.Local)
+	return nil, fmt.Errorf("unhandled message type: %s", messageType)
+}
+
+// typeOf returns the message type of a message body, which is the name of its root element
+func typeOf(body []byte) (MessageType, error) {
+	// Generic message to get the root element
+	cstaMessage := struct {
+		XMLName xml.Name
+	}{}
+
+	err := xml.Unmarshal(body, &cstaMessage)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the message type: %w", err)
+	}
+
+	return MessageType(cstaMessage.XMLName.Local), nil
 }
 
 // Dial establishes a new connection to a switching function with default timeout paramters
@@ -193,7 +304,17 @@ func DialTimeout(network string, address string, timeout time.Duration, ctx cont
 	dialContext, cancelDialing := context.WithTimeout(ctx, timeout)
 	defer cancelDialing()
 
-	var cstaDialer net.Dialer
+	var cstaDialer interface {
+		DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+	} = &net.Dialer{}
+
+	if options.TLS != nil {
+		config, err := options.TLS.Config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS options: %w", err)
+		}
+		cstaDialer = &tls.Dialer{Config: config}
+	}
 
 	// Establish a connection with the switching function
 	tcpConn, err := cstaDialer.DialContext(dialContext, network, address)
@@ -203,6 +324,11 @@ func DialTimeout(network string, address string, timeout time.Duration, ctx cont
 
 	ctx, closed := context.WithCancel(ctx)
 
+	handlers := make(map[MessageType]HandleFunc, len(defaultHandlers))
+	for messageType, handler := range defaultHandlers {
+		handlers[messageType] = handler
+	}
+
 	conn := cstaConn{
 		timeout:      timeout,
 		ctx:          ctx,
@@ -210,11 +336,13 @@ func DialTimeout(network string, address string, timeout time.Duration, ctx cont
 		options:      options,
 		conn:         tcpConn, // Keep a reference to the underlying net.Conn
 		rw:           bufio.NewReadWriter(bufio.NewReader(tcpConn), bufio.NewWriter(tcpConn)),
-		handlers:     defaultHandlers,
-		transactions: make(map[uint]HandleFunc),
+		handlers:     handlers,
+		transactions: make(map[uint]chan *Context),
+		dispatched:   make(chan struct{}, 1),
 	}
 
 	go conn.messageHandler()
+	go conn.dispatcher()
 
 	return &conn, nil
 }
@@ -223,15 +351,24 @@ func (c *cstaConn) messageHandler() {
 	for {
 		invokeId, message, err := c.Read()
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				log.Printf("PBX connection lost: %s\n", err)
-				c.state = ConnectionStateClosed
-				c.Close()
+			if errors.Is(err, net.ErrClosed) {
+				// Closed locally
 				return
 			}
-			c.state = ConnectionStateError
-			log.Printf("Failed to Read() from CSTA connection: %s\n", err)
-			continue
+			if errors.Is(err, ErrInvalidMessage) {
+				// The next message starts right after this one
+				log.Printf("Failed to Read() from CSTA connection: %s\n", err)
+				continue
+			}
+
+			// The stream can't be trusted after transport and framing errors, e.g. a
+			// failed TLS connection keeps returning the same error on every read
+			if !errors.Is(err, io.EOF) {
+				c.setState(ConnectionStateError)
+			}
+			log.Printf("PBX connection lost: %s\n", err)
+			c.Close()
+			return
 		}
 
 		messageContext := &Context{
@@ -240,23 +377,29 @@ func (c *cstaConn) messageHandler() {
 			InvokeID: invokeId,
 		}
 
-		// If there is a handler for this specific request, run it
-		if tx, ok := c.transactions[invokeId]; ok {
-			go tx(messageContext)
+		c.mutex.Lock()
+		transaction, isResponse := c.transactions[invokeId]
+		if isResponse {
 			delete(c.transactions, invokeId)
-
-			if timeout, ok := c.transactionTimeouts[invokeId]; ok {
-				timeout.Stop()
-				delete(c.transactionTimeouts, invokeId)
+		}
+		handler, hasHandler := c.handlers[message.Type()]
+		c.mutex.Unlock()
+
+		// If there is a pending request with this invoke ID, it gets the response
+		if isResponse {
+			// Tell the requester that its request was rejected
+			if errorCode, ok := message.(*CSTAErrorCode); ok {
+				messageContext.Error = errorCode.Err()
 			}
 
+			// Buffered, the requester is the only receiver
+			transaction <- messageContext
 			continue
 		}
 
-		// If there is a handler for this message type, run it
-		if handler, ok := c.handlers[message.Type()]; ok {
-			go handler(messageContext)
-
+		// If there is a handler for this message type, queue it, the reader must not wait for handlers
+		if hasHandler {
+			c.dispatch(handler, messageContext)
 			continue
 		}
 
@@ -268,12 +411,52 @@ func (c *cstaConn) messageHandler() {
 	}
 }
 
-type Error struct {
+// dispatch is a received message waiting for its handler
+type dispatch struct {
+	handler HandleFunc
+	context *Context
 }
 
-type Response struct {
-	Message *Message
-	Error   error
+// dispatch queues a message for its handler
+func (c *cstaConn) dispatch(handler HandleFunc, messageContext *Context) {
+	c.mutex.Lock()
+	c.dispatches = append(c.dispatches, dispatch{handler: handler, context: messageContext})
+	c.mutex.Unlock()
+
+	select {
+	case c.dispatched <- struct{}{}:
+	default:
+	}
+}
+
+// dispatcher runs the handlers of received messages one after another in the order the
+// messages were received, e.g. the events of a call must not overtake each other.
+// Handlers that are still queued when the connection is closed are run before it returns.
+func (c *cstaConn) dispatcher() {
+	for {
+		c.mutex.Lock()
+		dispatches := c.dispatches
+		c.dispatches = nil
+		c.mutex.Unlock()
+
+		for _, d := range dispatches {
+			d.handler(d.context)
+		}
+		if len(dispatches) > 0 {
+			continue
+		}
+
+		select {
+		case <-c.dispatched:
+		case <-c.ctx.Done():
+			c.mutex.Lock()
+			done := len(c.dispatches) == 0
+			c.mutex.Unlock()
+			if done {
+				return
+			}
+		}
+	}
 }
 
 func (c *cstaConn) Close() error {
@@ -283,69 +466,133 @@ func (c *cstaConn) Close() error {
 	}
 
 	// Preserve the error state
+	c.mutex.Lock()
 	if c.state != ConnectionStateError {
 		c.state = ConnectionStateClosed
 	}
+	c.mutex.Unlock()
 
-	// Notify listeners that we're closed
+	// Notify listeners and pending requests that we're closed
 	c.closed()
 
 	return nil
 }
 
+// Request sends a request and calls responseHandler with its response from another
+// goroutine. A failed, timed out or cancelled request is passed with an Error.
 func (c *cstaConn) Request(request Message, responseHandler HandleFunc) error {
-	// Get a free invoke ID
-	requestId := c.nextInvokeID()
+	invokeId, response, err := c.send(request)
+	if err != nil {
+		return err
+	}
 
-	// Register a handler for the response
-	c.transactions[requestId] = responseHandler
+	go func() {
+		responseHandler(c.wait(c.ctx, invokeId, response))
+	}()
 
+	return nil
+}
+
+func (c *cstaConn) Do(ctx context.Context, request Message) (Message, error) {
+	invokeId, response, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	messageContext := c.wait(ctx, invokeId, response)
+	return messageContext.Message, messageContext.Error
+}
+
+// send registers a transaction for a request under a free invoke ID and writes it
+func (c *cstaConn) send(request Message) (uint, <-chan *Context, error) {
+	c.mutex.Lock()
+	if c.ctx.Err() != nil {
+		c.mutex.Unlock()
+		return 0, nil, ErrConnectionClosed
+	}
+	invokeId, err := c.nextInvokeID()
+	if err != nil {
+		c.mutex.Unlock()
+		return 0, nil, err
+	}
+	response := make(chan *Context, 1)
+	c.transactions[invokeId] = response
+	c.mutex.Unlock()
+
+	err = c.Write(invokeId, request)
+	if err != nil {
+		c.endTransaction(invokeId)
+		return 0, nil, err
+	}
+
+	return invokeId, response, nil
+}
+
+// wait waits for the response to a request sent with send until ctx is done,
+// the connection is closed or the request timed out
+func (c *cstaConn) wait(ctx context.Context, invokeId uint, response <-chan *Context) *Context {
 	timeout := time.NewTimer(requestTimeout)
-	if c.transactionTimeouts == nil {
-		c.transactionTimeouts = make(map[uint]*time.Timer)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case messageContext := <-response:
+		return messageContext
+	case <-timeout.C:
+		err = fmt.Errorf("transaction timed out")
+	case <-ctx.Done():
+		err = fmt.Errorf("transaction cancelled: %w", ctx.Err())
+	case <-c.ctx.Done():
+		err = ErrConnectionClosed
 	}
-	c.transactionTimeouts[requestId] = timeout
 
-	// Handle timeouts/cancellation of requests
-	go func() {
-		// Wait for timeout or context close
-		var cancelCause string
-		select {
-		case <-timeout.C:
-			cancelCause = "transaction timed out"
-		case <-c.ctx.Done():
-			cancelCause = "transaction cancelled"
-		}
+	c.endTransaction(invokeId)
 
-		timeout.Stop()
-		delete(c.transactionTimeouts, requestId)
+	// The response may have arrived in the meantime
+	select {
+	case messageContext := <-response:
+		return messageContext
+	default:
+	}
 
-		// If the transaction still exists, notify the handler it timed out
-		if transaction, ok := c.transactions[requestId]; ok {
-			transaction(&Context{
-				Error: fmt.Errorf(cancelCause),
-			})
-			delete(c.transactions, requestId)
-		}
-	}()
+	return &Context{conn: c, InvokeID: invokeId, Error: err}
+}
 
-	// Send out the request
-	return c.Write(requestId, request)
+// endTransaction frees the invoke ID of a request that won't be answered
+func (c *cstaConn) endTransaction(invokeId uint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.transactions, invokeId)
 }
 
 func (c *cstaConn) State() ConnectionState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.state
 }
 
-func (c *cstaConn) nextInvokeID() uint {
+func (c *cstaConn) setState(state ConnectionState) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.lastInvokeId += 1
-	if c.lastInvokeId >= 9000 {
-		c.lastInvokeId = 0
+	c.state = state
+}
+
+// nextInvokeID allocates the next invoke ID that isn't used by a pending request,
+// the mutex must be held
+func (c *cstaConn) nextInvokeID() (uint, error) {
+	for i := 0; i < maxInvokeID; i++ {
+		c.lastInvokeId += 1
+		if c.lastInvokeId >= maxInvokeID {
+			c.lastInvokeId = 0
+		}
+		if _, inFlight := c.transactions[c.lastInvokeId]; !inFlight {
+			return c.lastInvokeId, nil
+		}
 	}
-	return c.lastInvokeId
+	return 0, fmt.Errorf("no free invoke ID, %d requests pending", len(c.transactions))
 }
 
 func dispatchCallbacks(ctx *Context, callbacks ...HandleFunc) {
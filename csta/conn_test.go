@@ -3,8 +3,14 @@ package csta
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRead(t *testing.T) {
@@ -49,10 +55,14 @@ func TestWrite(t *testing.T) {
 
 func TestRequest(t *testing.T) {
 	mockData := new(bytes.Buffer)
+	ctx, closed := context.WithCancel(context.Background())
+	defer closed()
 	conn := cstaConn{
+		ctx:          ctx,
+		closed:       closed,
 		options:      &ConnectionOptions{},
 		rw:           bufio.NewReadWriter(bufio.NewReader(mockData), bufio.NewWriter(mockData)),
-		transactions: make(map[uint]HandleFunc),
+		transactions: make(map[uint]chan *Context),
 	}
 
 	conn.Request(StartApplicationSession{
@@ -70,10 +80,14 @@ func TestRequest(t *testing.T) {
 
 func TestStartApplicationSession(t *testing.T) {
 	mockData := new(bytes.Buffer)
+	ctx, closed := context.WithCancel(context.Background())
+	defer closed()
 	conn := cstaConn{
+		ctx:          ctx,
+		closed:       closed,
 		options:      &ConnectionOptions{},
 		rw:           bufio.NewReadWriter(bufio.NewReader(mockData), bufio.NewWriter(mockData)),
-		transactions: make(map[uint]HandleFunc),
+		transactions: make(map[uint]chan *Context),
 	}
 	err := conn.StartApplicationSession("testApplicationId", struct {
 		Username string `xml:"userName"`
@@ -91,10 +105,308 @@ func TestStartApplicationSession(t *testing.T) {
 
 func TestClose(t *testing.T) {
 	mockData := new(bytes.Buffer)
+	ctx, closed := context.WithCancel(context.Background())
+	defer closed()
 	conn := cstaConn{
+		ctx:          ctx,
+		closed:       closed,
 		options:      &ConnectionOptions{},
 		rw:           bufio.NewReadWriter(bufio.NewReader(mockData), bufio.NewWriter(mockData)),
-		transactions: make(map[uint]HandleFunc),
+		transactions: make(map[uint]chan *Context),
 	}
 	conn.Close()
 }
+
+// serve runs a switching function on a local port that answers every request with
+// the result of respond, a nil result leaves the request unanswered
+func serve(t *testing.T, respond func(invokeId uint, request Message) Message) Conn {
+	return serveWithOptions(t, nil, respond)
+}
+
+// serveWithOptions is serve with options for the client connection
+func serveWithOptions(t *testing.T, options *ConnectionOptions, respond func(invokeId uint, request Message) Message) Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		switchingFunction := &cstaConn{
+			options: &ConnectionOptions{},
+			rw:      bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		}
+		for {
+			invokeId, request, err := switchingFunction.Read()
+			if err != nil {
+				return
+			}
+			// Answer concurrently, so that responses can arrive out of order
+			go func() {
+				if response := respond(invokeId, request); response != nil {
+					switchingFunction.Write(invokeId, response)
+				}
+			}()
+		}
+	}()
+
+	conn, err := DialTimeout("tcp", listener.Addr().String(), 5*time.Second, context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestDoConcurrently(t *testing.T) {
+	conn := serve(t, func(invokeId uint, request Message) Message {
+		// Answer later requests first
+		time.Sleep(time.Duration(100-invokeId) * time.Millisecond)
+		return MonitorStartResponse{MonitorCrossRefID: request.(*MonitorStart).MonitorObject.DeviceObject.Device}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(device string) {
+			defer wg.Done()
+
+			response, err := conn.Do(context.Background(), MonitorStart{
+				MonitorObject: CSTAObject{DeviceObject: &DeviceID{Device: device}},
+				MonitorType:   MonitorTypeDevice,
+			})
+			if err != nil {
+				t.Log(err)
+				t.Fail()
+				return
+			}
+			if crossRefId := response.(*MonitorStartResponse).MonitorCrossRefID; crossRefId != device {
+				t.Logf("request for <%s> got the response for <%s>\n", device, crossRefId)
+				t.Fail()
+			}
+		}(fmt.Sprintf("%d", 4700+i))
+	}
+	wg.Wait()
+}
+
+func TestDoRejected(t *testing.T) {
+	conn := serve(t, func(uint, Message) Message {
+		return CSTAErrorCode{Operation: "invalidDeviceID"}
+	})
+
+	response, err := conn.Do(context.Background(), GetDeviceId{SwitchName: "CM1", Extension: "4711"})
+	var operationError *OperationError
+	if !errors.As(err, &operationError) {
+		t.Logf("unexpected error: %v\n", err)
+		t.Fail()
+	}
+	if _, ok := response.(*CSTAErrorCode); !ok {
+		t.Fail()
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	conn := serve(t, func(uint, Message) Message {
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := conn.Do(ctx, GetDeviceId{SwitchName: "CM1", Extension: "4711"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("unexpected error: %v\n", err)
+		t.Fail()
+	}
+
+	// The invoke ID is free again
+	c := conn.(*cstaConn)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.transactions) != 0 {
+		t.Fail()
+	}
+}
+
+func TestDoClosed(t *testing.T) {
+	conn := serve(t, func(uint, Message) Message {
+		return nil
+	})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	_, err := conn.Do(context.Background(), GetDeviceId{SwitchName: "CM1", Extension: "4711"})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Logf("unexpected error: %v\n", err)
+		t.Fail()
+	}
+
+	_, err = conn.Do(context.Background(), GetDeviceId{SwitchName: "CM1", Extension: "4711"})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Logf("unexpected error: %v\n", err)
+		t.Fail()
+	}
+}
+
+func TestNextInvokeID(t *testing.T) {
+	conn := cstaConn{
+		lastInvokeId: 8998,
+		transactions: map[uint]chan *Context{
+			8999: nil,
+			0:    nil,
+			2:    nil,
+		},
+	}
+
+	// Pending invoke IDs are skipped after the wraparound
+	for _, expected := range []uint{1, 3} {
+		invokeId, err := conn.nextInvokeID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invokeId != expected {
+			t.Logf("expected invoke ID %d, got %d\n", expected, invokeId)
+			t.Fail()
+		}
+		conn.transactions[invokeId] = nil
+	}
+
+	for invokeId := uint(0); invokeId < maxInvokeID; invokeId++ {
+		conn.transactions[invokeId] = nil
+	}
+	if _, err := conn.nextInvokeID(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestHandlersPerConnection(t *testing.T) {
+	respond := func(uint, Message) Message { return nil }
+	first := serve(t, respond).(*cstaConn)
+	second := serve(t, respond).(*cstaConn)
+
+	first.Handle(MessageTypeEstablishedEvent, ignoreMessage)
+	first.RemoveHandler(MessageTypeSystemStatus)
+
+	if _, ok := second.handlers[MessageTypeEstablishedEvent]; ok {
+		t.Fail()
+	}
+	if _, ok := second.handlers[MessageTypeSystemStatus]; !ok {
+		t.Fail()
+	}
+	if _, ok := defaultHandlers[MessageTypeSystemStatus]; !ok {
+		t.Fail()
+	}
+}
+
+// serveFrames runs a switching function on a local port that sends the raw frames to
+// the client, the messages the client sends back are passed to replies
+func serveFrames(t *testing.T, frames ...[]byte) (*cstaConn, <-chan Message) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	replies := make(chan Message, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for _, frame := range frames {
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+		for {
+			_, message, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			replies <- message
+		}
+	}()
+
+	conn, err := DialTimeout("tcp", listener.Addr().String(), 5*time.Second, context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.(*cstaConn), replies
+}
+
+func TestInvalidMessageSkipped(t *testing.T) {
+	conn, replies := serveFrames(t,
+		encodeFrame(9999, []byte(`<UnknownEvent xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"/>`)),
+		encodeFrame(9999, []byte(`<EstablishedEvent`)),
+		encodeFrame(42, []byte(`<SystemStatus xmlns="http://www.ecma-international.org/standards/ecma-323/csta/ed3"/>`)),
+	)
+
+	// The system status after the invalid messages is still acknowledged
+	select {
+	case reply := <-replies:
+		if _, ok := reply.(*SystemStatusResponse); !ok {
+			t.Fail()
+		}
+	case <-conn.Closed():
+		t.Fatal("connection closed after an invalid message")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply received")
+	}
+	if conn.State() == ConnectionStateError {
+		t.Fail()
+	}
+}
+
+func TestFramingErrorCloses(t *testing.T) {
+	// The invoke ID isn't a number
+	frame := encodeFrame(9999, []byte(`<SystemStatus/>`))
+	copy(frame[4:8], "abcd")
+
+	conn, _ := serveFrames(t, frame)
+
+	select {
+	case <-conn.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after a framing error")
+	}
+	if conn.State() != ConnectionStateError {
+		t.Fail()
+	}
+}
+
+func TestDispatchInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &cstaConn{ctx: ctx, dispatched: make(chan struct{}, 1)}
+
+	handled := make([]uint, 0)
+	handler := func(c *Context) {
+		// Earlier messages take longer to handle
+		time.Sleep(time.Duration(10-c.InvokeID) * time.Millisecond)
+		handled = append(handled, c.InvokeID)
+	}
+	for invokeId := uint(0); invokeId < 10; invokeId++ {
+		conn.dispatch(handler, &Context{InvokeID: invokeId})
+	}
+
+	// Queued handlers still run after the connection was closed
+	cancel()
+	conn.dispatcher()
+
+	if fmt.Sprint(handled) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("handled out of order: %v", handled)
+	}
+}
@@ -0,0 +1,469 @@
+// Package cstatest provides a fake CSTA switching function for testing PBX
+// integrations without access to a real Avaya AES or OpenScape Business.
+package cstatest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+)
+
+// Invoke ID of unsolicited events in CSTA over TCP (ECMA-323 annex E)
+const eventInvokeID = 9999
+
+// Responder answers a request received by the Switch. It returns the response
+// to send, e.g. a *csta.CSTAErrorCode to reject the request, or nil to not
+// answer at all.
+type Responder func(request csta.Message) csta.Message
+
+// Switch is a fake switching function listening on a local port. It answers
+// the requests a PBX implementation sends from a script and pushes events on
+// demand. All requests are recorded so that tests can check what was sent.
+type Switch struct {
+	listener net.Listener
+
+	mutex      sync.Mutex
+	changed    chan struct{} // Closed and replaced whenever requests or connections change
+	responders map[csta.MessageType]Responder
+	conns      map[net.Conn]bool
+	requests   []csta.Message
+
+	sessions  int
+	monitors  int
+	calls     int
+	closed    bool
+	waitGroup sync.WaitGroup
+}
+
+// NewSwitch starts a Switch on a random local port. It answers StartApplicationSession,
+// StopApplicationSession, ResetApplicationSessionTimer, MonitorStart, GetDeviceId,
+// RegisterTerminalRequest, UnregisterTerminalRequest, MakeCall, SingleStepConferenceCall and
+// ClearConnection positively until the script is changed with Handle.
+func NewSwitch() (*Switch, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Switch{
+		listener:   listener,
+		changed:    make(chan struct{}),
+		responders: make(map[csta.MessageType]Responder),
+		conns:      make(map[net.Conn]bool),
+		requests:   make([]csta.Message, 0),
+	}
+
+	s.responders[csta.MessageTypeStartApplicationSession] = s.startApplicationSession
+	s.responders[csta.MessageTypeStopApplicationSession] = func(csta.Message) csta.Message {
+		return &csta.StopApplicationSessionPosResponse{}
+	}
+	s.responders[csta.MessageTypeResetApplicationSessionTimer] = func(request csta.Message) csta.Message {
+		return &csta.ResetApplicationSessionTimerPosResponse{
+			ActualSessionDuration: request.(*csta.ResetApplicationSessionTimer).RequestedSessionDuration,
+		}
+	}
+	s.responders[csta.MessageTypeMonitorStart] = s.monitorStart
+	s.responders[csta.MessageTypeGetDeviceId] = getDeviceID
+	s.responders[csta.MessageTypeRegisterTerminalRequest] = registerTerminal
+	s.responders[csta.MessageTypeUnregisterTerminalRequest] = func(request csta.Message) csta.Message {
+		return &csta.UnregisterTerminalResponse{Device: request.(*csta.UnregisterTerminalRequest).Device}
+	}
+	s.responders[csta.MessageTypeMakeCall] = s.makeCall
+	s.responders[csta.MessageTypeSingleStepConferenceCall] = singleStepConferenceCall
+	s.responders[csta.MessageTypeClearConnection] = func(csta.Message) csta.Message {
+		return &csta.ClearConnectionResponse{}
+	}
+
+	s.waitGroup.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Addr returns the address the Switch listens on
+func (s *Switch) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Handle replaces the responder for a request type, a nil responder leaves
+// requests of the type unanswered
+func (s *Switch) Handle(messageType csta.MessageType, responder Responder) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.responders[messageType] = responder
+}
+
+// Requests returns all requests of a type received so far, in order
+func (s *Switch) Requests(messageType csta.MessageType) []csta.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	requests := make([]csta.Message, 0)
+	for _, request := range s.requests {
+		if request.Type() == messageType {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// WaitForRequest waits until the Switch received n requests of a type in total and returns the last one
+func (s *Switch) WaitForRequest(messageType csta.MessageType, n int, timeout time.Duration) (csta.Message, error) {
+	var request csta.Message
+	err := s.wait(timeout, func() bool {
+		count := 0
+		for _, r := range s.requests {
+			if r.Type() == messageType {
+				count++
+				request = r
+			}
+		}
+		return count >= n
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for %d %s requests: %w", n, messageType, err)
+	}
+	return request, nil
+}
+
+// Connections returns the number of clients currently connected
+func (s *Switch) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.conns)
+}
+
+// WaitForConnections waits until n clients are connected
+func (s *Switch) WaitForConnections(n int, timeout time.Duration) error {
+	err := s.wait(timeout, func() bool {
+		return len(s.conns) == n
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for %d connections: %w", n, err)
+	}
+	return nil
+}
+
+// Send pushes an event to all connected clients
+func (s *Switch) Send(event csta.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.conns) == 0 {
+		return fmt.Errorf("no client connected")
+	}
+
+	for conn := range s.conns {
+		err := csta.WriteMessage(conn, eventInvokeID, event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delivered sends a DeliveredEvent for a call from calling that is alerting at called
+func (s *Switch) Delivered(crossRefID string, callID string, calling string, called string) error {
+	return s.Send(&csta.DeliveredEvent{
+		MonitorCrossRefID:   crossRefID,
+		Connection:          connectionID(callID, called),
+		AlertingDevice:      subjectDeviceID(called),
+		CallingDevice:       subjectDeviceID(calling),
+		CalledDevice:        subjectDeviceID(called),
+		LocalConnectionInfo: "alerting",
+		Cause:               "newCall",
+	})
+}
+
+// Established sends an EstablishedEvent for a call from calling that was answered by called
+func (s *Switch) Established(crossRefID string, callID string, calling string, called string) error {
+	return s.Send(&csta.EstablishedEvent{
+		MonitorCrossRefID:     crossRefID,
+		EstablishedConnection: connectionID(callID, called),
+		AnsweringDevice:       subjectDeviceID(called),
+		CallingDevice:         subjectDeviceID(calling),
+		CalledDevice:          subjectDeviceID(called),
+		LocalConnectionInfo:   "connected",
+		Cause:                 "normal",
+	})
+}
+
+// ConnectionCleared sends a ConnectionClearedEvent for releasing hanging up the call
+func (s *Switch) ConnectionCleared(crossRefID string, callID string, releasing string) error {
+	return s.Send(&csta.ConnectionClearedEvent{
+		MonitorCrossRefID:   crossRefID,
+		DroppedConnection:   connectionID(callID, releasing),
+		ReleasingDevice:     subjectDeviceID(releasing),
+		LocalConnectionInfo: "null",
+		Cause:               "normalClearing",
+	})
+}
+
+// Originated sends an OriginatedEvent for a call that calling makes to called
+func (s *Switch) Originated(crossRefID string, callID string, calling string, called string) error {
+	return s.Send(&csta.OriginatedEvent{
+		MonitorCrossRefID:    crossRefID,
+		OriginatedConnection: connectionID(callID, calling),
+		CallingDevice:        subjectDeviceID(calling),
+		CalledDevice:         subjectDeviceID(called),
+		LocalConnectionInfo:  "connected",
+		Cause:                "newCall",
+	})
+}
+
+// Held sends a HeldEvent for holding putting a call on hold
+func (s *Switch) Held(crossRefID string, callID string, holding string) error {
+	return s.Send(&csta.HeldEvent{
+		MonitorCrossRefID:   crossRefID,
+		HeldConnection:      connectionID(callID, holding),
+		HoldingDevice:       subjectDeviceID(holding),
+		LocalConnectionInfo: "hold",
+		Cause:               "normal",
+	})
+}
+
+// Retrieved sends a RetrievedEvent for retrieving taking a call off hold
+func (s *Switch) Retrieved(crossRefID string, callID string, retrieving string) error {
+	return s.Send(&csta.RetrievedEvent{
+		MonitorCrossRefID:   crossRefID,
+		RetrievedConnection: connectionID(callID, retrieving),
+		RetrievingDevice:    subjectDeviceID(retrieving),
+		LocalConnectionInfo: "connected",
+		Cause:               "normal",
+	})
+}
+
+// Transferred sends a TransferredEvent for transferring joining the held call heldCallID
+// with the consultation call consultCallID, which the remaining parties stay connected to
+func (s *Switch) Transferred(crossRefID string, heldCallID string, consultCallID string, transferring string, parties ...string) error {
+	secondary := connectionID(consultCallID, transferring)
+	event := &csta.TransferredEvent{
+		MonitorCrossRefID:   crossRefID,
+		PrimaryOldCall:      connectionID(heldCallID, transferring),
+		SecondaryOldCall:    &secondary,
+		TransferringDevice:  subjectDeviceID(transferring),
+		LocalConnectionInfo: "null",
+		Cause:               "transfer",
+	}
+	if len(parties) > 0 {
+		event.TransferredToDevice = subjectDeviceID(parties[len(parties)-1])
+	}
+	for _, party := range parties {
+		connection := connectionID(consultCallID, party)
+		event.TransferredConnections.Items = append(event.TransferredConnections.Items, csta.ConnectionListItem{
+			NewConnection: &connection,
+			Endpoint:      &csta.Endpoint{DeviceID: &csta.DeviceID{Device: party, TypeOfNumber: "dialingNumber"}},
+		})
+	}
+	return s.Send(event)
+}
+
+// Disconnect closes the connections of all clients, the Switch keeps accepting new ones
+func (s *Switch) Disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops listening and disconnects all clients
+func (s *Switch) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.Disconnect()
+	s.waitGroup.Wait()
+	return err
+}
+
+func (s *Switch) accept() {
+	defer s.waitGroup.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.notify()
+		s.mutex.Unlock()
+
+		s.waitGroup.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests of one client until it disconnects
+func (s *Switch) serve(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.notify()
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := &errorReader{reader: bufio.NewReader(conn)}
+	for {
+		invokeId, request, err := csta.ReadMessage(reader)
+		if reader.err != nil {
+			// Disconnected
+			return
+		}
+		if err != nil {
+			// Unknown message types can't be answered, but the stream is still in sync
+			continue
+		}
+
+		s.mutex.Lock()
+		s.requests = append(s.requests, request)
+		s.notify()
+		responder := s.responders[request.Type()]
+		s.mutex.Unlock()
+
+		if responder == nil {
+			continue
+		}
+
+		if response := responder(request); response != nil {
+			s.mutex.Lock()
+			csta.WriteMessage(conn, invokeId, response)
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// notify wakes up everyone waiting for a change, the mutex must be held
+func (s *Switch) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until condition, which is called with the mutex held, becomes true
+func (s *Switch) wait(timeout time.Duration, condition func() bool) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mutex.Lock()
+		done := condition()
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+}
+
+func (s *Switch) startApplicationSession(request csta.Message) csta.Message {
+	s.mutex.Lock()
+	s.sessions++
+	sessionID := fmt.Sprintf("session-%d", s.sessions)
+	s.mutex.Unlock()
+
+	start := request.(*csta.StartApplicationSession)
+	return &csta.StartApplicationSessionPosResponse{
+		SessionID:             sessionID,
+		ActualProtocolVersion: start.ProtocolVersion,
+		ActualSessionDuration: start.RequestedSessionDuration,
+	}
+}
+
+func (s *Switch) monitorStart(csta.Message) csta.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.monitors++
+	return &csta.MonitorStartResponse{MonitorCrossRefID: fmt.Sprintf("%d", s.monitors)}
+}
+
+func (s *Switch) makeCall(request csta.Message) csta.Message {
+	s.mutex.Lock()
+	s.calls++
+	callID := fmt.Sprintf("%d", s.calls)
+	s.mutex.Unlock()
+
+	return &csta.MakeCallResponse{
+		CallingDevice: connectionID(callID, request.(*csta.MakeCall).CallingDevice),
+	}
+}
+
+func singleStepConferenceCall(request csta.Message) csta.Message {
+	conference := request.(*csta.SingleStepConferenceCall)
+	return &csta.SingleStepConferenceCallResponse{
+		ConferencedCall: connectionID(conference.ActiveCall.CallID, conference.DeviceToJoin),
+	}
+}
+
+// getDeviceID answers with a device ID in the format of Avaya AES, <extension>:<switch>::0
+func getDeviceID(request csta.Message) csta.Message {
+	getDeviceId := request.(*csta.GetDeviceId)
+	return &csta.GetDeviceIdResponse{
+		Device: csta.DeviceID{
+			Device:       fmt.Sprintf("%s:%s::0", getDeviceId.Extension, getDeviceId.SwitchName),
+			TypeOfNumber: "other",
+			MediaClass:   "notKnown",
+		},
+	}
+}
+
+func registerTerminal(request csta.Message) csta.Message {
+	response := &csta.RegisterTerminalResponse{Code: csta.RegistrationCodeNormal}
+	response.Device.Device = request.(*csta.RegisterTerminalRequest).Device
+	return response
+}
+
+func connectionID(callID string, device string) csta.ConnectionID {
+	return csta.ConnectionID{
+		CallID:   callID,
+		DeviceID: &csta.LocalDeviceID{Device: device, TypeOfNumber: "dialingNumber"},
+	}
+}
+
+func subjectDeviceID(device string) csta.SubjectDeviceID {
+	return csta.SubjectDeviceID{
+		ExtendedDeviceID: csta.ExtendedDeviceID{
+			DeviceIdentifier: csta.DeviceID{Device: device, TypeOfNumber: "dialingNumber"},
+		},
+	}
+}
+
+// errorReader remembers the first error of the underlying reader, to tell a lost
+// connection apart from a message that couldn't be parsed
+type errorReader struct {
+	reader *bufio.Reader
+	err    error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
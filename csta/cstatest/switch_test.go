@@ -0,0 +1,96 @@
+package cstatest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestSwitch(t *testing.T) {
+	s, err := NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := csta.DialTimeout("tcp", s.Addr(), testTimeout, context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := make(chan *csta.Context, 1)
+	err = conn.StartApplicationSession("test", nil, "http://www.ecma-international.org/standards/ecma-323/csta/ed4", func(c *csta.Context) {
+		responses <- c
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := receive(t, responses); response.Error != nil || response.Message.(*csta.StartApplicationSessionPosResponse).SessionID != "session-1" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	// Scripted rejection
+	s.Handle(csta.MessageTypeMonitorStart, func(csta.Message) csta.Message {
+		return &csta.CSTAErrorCode{Operation: "invalidDeviceID"}
+	})
+	err = conn.MonitorStart(csta.CSTAObject{DeviceObject: &csta.DeviceID{Device: "4711"}}, csta.MonitorTypeDevice, func(c *csta.Context) {
+		responses <- c
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var operationError *csta.OperationError
+	if response := receive(t, responses); !errors.As(response.Error, &operationError) {
+		t.Fatalf("expected an operation error, got %+v", response)
+	}
+
+	request, err := s.WaitForRequest(csta.MessageTypeMonitorStart, 1, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.(*csta.MonitorStart).MonitorObject.DeviceObject.Device != "4711" {
+		t.Fail()
+	}
+
+	// Events on demand
+	events := make(chan *csta.Context, 1)
+	conn.Handle(csta.MessageTypeDeliveredEvent, func(c *csta.Context) {
+		events <- c
+	})
+	err = s.Delivered("1", "42", "100", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(t, events).Message.(*csta.DeliveredEvent); event.Connection.CallID != "42" || event.CallingDevice.DeviceIdentifier.Device != "100" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// Dropping the connection closes the client
+	s.Disconnect()
+	select {
+	case <-conn.Closed():
+	case <-time.After(testTimeout):
+		t.Fatal("connection wasn't closed")
+	}
+
+	err = s.WaitForConnections(0, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, c <-chan *csta.Context) *csta.Context {
+	select {
+	case ctx := <-c:
+		return ctx
+	case <-time.After(testTimeout):
+		t.Fatal("nothing received")
+		return nil
+	}
+}
@@ -10,13 +10,24 @@ const (
 	MessageTypeRegisterTerminalResponse MessageType = "RegisterTerminalResponse"
 	MessageTypeGetDeviceId              MessageType = "GetDeviceId"
 	MessageTypeGetDeviceIdResponse      MessageType = "GetDeviceIdResponse"
+
+	MessageTypeUnregisterTerminalRequest  MessageType = "UnregisterTerminalRequest"
+	MessageTypeUnregisterTerminalResponse MessageType = "UnregisterTerminalResponse"
+	MessageTypeTerminalUnregisteredEvent  MessageType = "TerminalUnregisteredEvent"
 )
 
+// RegistrationCodeNormal is the code of a RegisterTerminalResponse for a successful registration,
+// any other code is the reason why it failed
+const RegistrationCodeNormal = "1"
+
 func init() {
 	registerMessageType(MessageTypeRegisterTerminalRequest, reflect.TypeOf(RegisterTerminalRequest{}))
 	registerMessageType(MessageTypeRegisterTerminalResponse, reflect.TypeOf(RegisterTerminalResponse{}))
 	registerMessageType(MessageTypeGetDeviceId, reflect.TypeOf(GetDeviceId{}))
 	registerMessageType(MessageTypeGetDeviceIdResponse, reflect.TypeOf(GetDeviceIdResponse{}))
+	registerMessageType(MessageTypeUnregisterTerminalRequest, reflect.TypeOf(UnregisterTerminalRequest{}))
+	registerMessageType(MessageTypeUnregisterTerminalResponse, reflect.TypeOf(UnregisterTerminalResponse{}))
+	registerMessageType(MessageTypeTerminalUnregisteredEvent, reflect.TypeOf(TerminalUnregisteredEvent{}))
 }
 
 type LoginInfo struct {
@@ -74,6 +85,7 @@ type RegisterTerminalResponse struct {
 	} `xml:"device"`
 	SignallingEncryption string `xml:"signallingEncryption"`
 	Code                 string `xml:"code"`
+	Reason               string `xml:"reason"`
 }
 
 func (RegisterTerminalResponse) Type() MessageType {
@@ -99,3 +111,35 @@ type GetDeviceIdResponse struct {
 func (GetDeviceIdResponse) Type() MessageType {
 	return MessageTypeGetDeviceIdResponse
 }
+
+type UnregisterTerminalRequest struct {
+	XMLName xml.Name `xml:"http://www.avaya.com/csta UnregisterTerminalRequest"`
+	Device  DeviceID `xml:"device"`
+}
+
+func (UnregisterTerminalRequest) Type() MessageType {
+	return MessageTypeUnregisterTerminalRequest
+}
+
+type UnregisterTerminalResponse struct {
+	XMLName xml.Name `xml:"http://www.avaya.com/csta UnregisterTerminalResponse"`
+	Device  DeviceID `xml:"device"`
+}
+
+func (UnregisterTerminalResponse) Type() MessageType {
+	return MessageTypeUnregisterTerminalResponse
+}
+
+// TerminalUnregisteredEvent reports that the registration of a terminal was lost,
+// e.g. because the gatekeeper restarted or another endpoint force-registered it
+type TerminalUnregisteredEvent struct {
+	XMLName           xml.Name `xml:"http://www.avaya.com/csta TerminalUnregisteredEvent"`
+	MonitorCrossRefID string   `xml:"monitorCrossRefID"`
+	Device            DeviceID `xml:"device"`
+	Reason            string   `xml:"reason"`
+	Code              string   `xml:"code"`
+}
+
+func (TerminalUnregisteredEvent) Type() MessageType {
+	return MessageTypeTerminalUnregisteredEvent
+}
@@ -0,0 +1,40 @@
+package csta
+
+import (
+	"bytes"
+	"testing"
+)
+
+var terminalUnregisteredEvent = `<?xml version="1.0" encoding="UTF-8"?><TerminalUnregisteredEvent xmlns="http://www.avaya.com/csta"><monitorCrossRefID>12</monitorCrossRefID><device typeOfNumber="other" mediaClass="notKnown" bitRate="constant">5001:CM1:0.0.0.0:0</device><reason>The gatekeeper unregistered the terminal</reason><code>-3</code></TerminalUnregisteredEvent>`
+
+var registerTerminalFailedResponse = `<?xml version="1.0" encoding="UTF-8"?><RegisterTerminalResponse xmlns="http://www.avaya.com/csta"><device><deviceIdentifier typeOfNumber="other" mediaClass="notKnown">5001:CM1::0</deviceIdentifier></device><code>-2</code><reason>Invalid password</reason></RegisterTerminalResponse>`
+
+func TestUnmarshalTerminalUnregisteredEvent(t *testing.T) {
+	_, m, err := ReadMessage(bytes.NewReader(frame(9999, terminalUnregisteredEvent)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, ok := m.(*TerminalUnregisteredEvent)
+	if !ok {
+		t.Fatalf("unexpected message %T", m)
+	}
+	if event.Device.Device != "5001:CM1:0.0.0.0:0" || event.Code != "-3" || event.Reason == "" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestUnmarshalRegisterTerminalResponse(t *testing.T) {
+	_, m, err := ReadMessage(bytes.NewReader(frame(1, registerTerminalFailedResponse)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, ok := m.(*RegisterTerminalResponse)
+	if !ok {
+		t.Fatalf("unexpected message %T", m)
+	}
+	if response.Code == RegistrationCodeNormal || response.Code != "-2" || response.Reason != "Invalid password" || response.Device.Device.Device != "5001:CM1::0" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+}
@@ -2,7 +2,9 @@ package csta
 
 import (
 	"encoding/xml"
+	"fmt"
 	"reflect"
+	"strings"
 )
 
 const (
@@ -13,11 +15,140 @@ func init() {
 	registerMessageType(MessageTypeCSTAErrorCode, reflect.TypeOf(CSTAErrorCode{}))
 }
 
+// CSTAErrorCode is the negative response to a request (ECMA-269 section 9.3), exactly
+// one of the error categories is set
 type CSTAErrorCode struct {
-	XMLName   xml.Name `xml:"CSTAErrorCode"`
-	Operation string   `xml:"operation,omitempty"`
+	XMLName                        xml.Name     `xml:"CSTAErrorCode"`
+	Operation                      string       `xml:"operation,omitempty"`
+	Security                       string       `xml:"security,omitempty"`
+	StateIncompatibility           string       `xml:"stateIncompatibility,omitempty"`
+	SystemResourceAvailability     string       `xml:"systemResourceAvailability,omitempty"`
+	SubscribedResourceAvailability string       `xml:"subscribedResourceAvailability,omitempty"`
+	PerformanceManagement          string       `xml:"performanceManagement,omitempty"`
+	PrivateData                    *PrivateData `xml:"privateData,omitempty"`
+	Unspecified                    *string      `xml:"unspecified,omitempty"`
 }
 
 func (CSTAErrorCode) Type() MessageType {
 	return MessageTypeCSTAErrorCode
 }
+
+// PrivateData holds manufacturer specific XML, e.g. an Avaya specific error
+type PrivateData struct {
+	Contents string `xml:",innerxml"`
+}
+
+// Err returns the error of the category that is set
+func (m *CSTAErrorCode) Err() Error {
+	switch {
+	case m.Operation != "":
+		return &OperationError{Value: m.Operation}
+	case m.Security != "":
+		return &SecurityError{Value: m.Security}
+	case m.StateIncompatibility != "":
+		return &StateIncompatibilityError{Value: m.StateIncompatibility}
+	case m.SystemResourceAvailability != "":
+		return &SystemResourceAvailabilityError{Value: m.SystemResourceAvailability}
+	case m.SubscribedResourceAvailability != "":
+		return &SubscribedResourceAvailabilityError{Value: m.SubscribedResourceAvailability}
+	case m.PerformanceManagement != "":
+		return &PerformanceManagementError{Value: m.PerformanceManagement}
+	case m.PrivateData != nil:
+		return &PrivateDataError{Contents: strings.TrimSpace(m.PrivateData.Contents)}
+	}
+
+	value := ""
+	if m.Unspecified != nil {
+		value = *m.Unspecified
+	}
+	return &UnspecifiedError{Value: value}
+}
+
+// Error is an error reported by the switching function in a CSTAErrorCode. Use
+// errors.As with one of the category types to get at the error value, e.g.
+//
+//	var operationError *csta.OperationError
+//	if errors.As(err, &operationError) && operationError.Value == "invalidDeviceID" {
+type Error interface {
+	error
+
+	// Category is the name of the ECMA-269 error category, e.g. "operation"
+	Category() string
+}
+
+// OperationError reports a problem with the request itself, e.g. "invalidDeviceID"
+type OperationError struct {
+	Value string
+}
+
+func (e *OperationError) Category() string { return "operation" }
+func (e *OperationError) Error() string    { return errorString(e, e.Value) }
+
+// SecurityError reports a request that was refused for security reasons, e.g. "requestNotAllowed"
+type SecurityError struct {
+	Value string
+}
+
+func (e *SecurityError) Category() string { return "security" }
+func (e *SecurityError) Error() string    { return errorString(e, e.Value) }
+
+// StateIncompatibilityError reports a request that doesn't fit the state of the
+// call or device, e.g. "invalidConnectionState"
+type StateIncompatibilityError struct {
+	Value string
+}
+
+func (e *StateIncompatibilityError) Category() string { return "stateIncompatibility" }
+func (e *StateIncompatibilityError) Error() string    { return errorString(e, e.Value) }
+
+// SystemResourceAvailabilityError reports a lack of resources in the switching
+// function, e.g. "resourceBusy"
+type SystemResourceAvailabilityError struct {
+	Value string
+}
+
+func (e *SystemResourceAvailabilityError) Category() string { return "systemResourceAvailability" }
+func (e *SystemResourceAvailabilityError) Error() string    { return errorString(e, e.Value) }
+
+// SubscribedResourceAvailabilityError reports a resource the application isn't
+// subscribed to, e.g. "objectMonitorLimitExceeded"
+type SubscribedResourceAvailabilityError struct {
+	Value string
+}
+
+func (e *SubscribedResourceAvailabilityError) Category() string {
+	return "subscribedResourceAvailability"
+}
+func (e *SubscribedResourceAvailabilityError) Error() string { return errorString(e, e.Value) }
+
+// PerformanceManagementError reports a switching function that is overloaded,
+// e.g. "performanceLimitExceeded"
+type PerformanceManagementError struct {
+	Value string
+}
+
+func (e *PerformanceManagementError) Category() string { return "performanceManagement" }
+func (e *PerformanceManagementError) Error() string    { return errorString(e, e.Value) }
+
+// PrivateDataError is a manufacturer specific error
+type PrivateDataError struct {
+	Contents string
+}
+
+func (e *PrivateDataError) Category() string { return "privateData" }
+func (e *PrivateDataError) Error() string    { return errorString(e, e.Contents) }
+
+// UnspecifiedError is an error the switching function doesn't give any details on
+type UnspecifiedError struct {
+	Value string
+}
+
+func (e *UnspecifiedError) Category() string { return "unspecified" }
+func (e *UnspecifiedError) Error() string    { return errorString(e, e.Value) }
+
+func errorString(e Error, value string) string {
+	if value == "" {
+		return fmt.Sprintf("CSTA %s error", e.Category())
+	}
+	return fmt.Sprintf("CSTA %s error: %s", e.Category(), value)
+}
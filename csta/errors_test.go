@@ -0,0 +1,100 @@
+package csta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalCSTAErrorCode(t *testing.T) {
+	for body, expected := range map[string]string{
+		"<CSTAErrorCode><operation>invalidDeviceID</operation></CSTAErrorCode>":                                                      "CSTA operation error: invalidDeviceID",
+		"<CSTAErrorCode><security>requestNotAllowed</security></CSTAErrorCode>":                                                      "CSTA security error: requestNotAllowed",
+		"<CSTAErrorCode><stateIncompatibility>invalidConnectionState</stateIncompatibility></CSTAErrorCode>":                         "CSTA stateIncompatibility error: invalidConnectionState",
+		"<CSTAErrorCode><systemResourceAvailability>resourceBusy</systemResourceAvailability></CSTAErrorCode>":                       "CSTA systemResourceAvailability error: resourceBusy",
+		"<CSTAErrorCode><subscribedResourceAvailability>objectMonitorLimitExceeded</subscribedResourceAvailability></CSTAErrorCode>": "CSTA subscribedResourceAvailability error: objectMonitorLimitExceeded",
+		"<CSTAErrorCode><performanceManagement>performanceLimitExceeded</performanceManagement></CSTAErrorCode>":                     "CSTA performanceManagement error: performanceLimitExceeded",
+		"<CSTAErrorCode><privateData><private><code>42</code></private></privateData></CSTAErrorCode>":                               "CSTA privateData error: <private><code>42</code></private>",
+		"<CSTAErrorCode><unspecified>unspecified</unspecified></CSTAErrorCode>":                                                      "CSTA unspecified error: unspecified",
+	} {
+		message := CSTAErrorCode{}
+		err := unmarshal(frame(1, body), &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Err().Error() != expected {
+			t.Logf("expected %q, got %q\n", expected, message.Err())
+			t.Fail()
+		}
+	}
+}
+
+// frame adds the CSTA header to a message body
+func frame(invokeId uint, body string) []byte {
+	msg := new(bytes.Buffer)
+	msg.Write([]byte{0x00, 0x00})
+	binary.Write(msg, binary.BigEndian, uint16(len(body)+cstaHeaderSize))
+	fmt.Fprintf(msg, "%04d%s", invokeId, body)
+	return msg.Bytes()
+}
+
+func TestRequestRejected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Reject every request with an operation error
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		switchingFunction := &cstaConn{
+			options: &ConnectionOptions{},
+			rw:      bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		}
+		for {
+			invokeId, _, err := switchingFunction.Read()
+			if err != nil {
+				return
+			}
+			switchingFunction.Write(invokeId, CSTAErrorCode{Operation: "invalidDeviceID"})
+		}
+	}()
+
+	conn, err := DialTimeout("tcp", listener.Addr().String(), 5*time.Second, context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	result := make(chan error, 1)
+	err = conn.MonitorStart(CSTAObject{DeviceObject: &DeviceID{Device: "4711"}}, MonitorTypeDevice, func(c *Context) {
+		result <- c.Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-result:
+		var operationError *OperationError
+		if !errors.As(err, &operationError) || operationError.Value != "invalidDeviceID" {
+			t.Logf("unexpected error: %v\n", err)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response received")
+	}
+}
@@ -30,6 +30,13 @@ func registerMessageType(messageType MessageType, implementation reflect.Type) {
 	messageTypes[messageType] = implementation
 }
 
+// IsMessageType tells whether messages of a type can be decoded, e.g. to validate
+// message types named in the configuration
+func IsMessageType(messageType MessageType) bool {
+	_, ok := messageTypes[messageType]
+	return ok
+}
+
 // Generic marshal implementation, most messages can just call this to marshal themselves
 func marshal(invokeId uint, m Message) ([]byte, error) {
 	body, err := xml.Marshal(m)
@@ -37,6 +44,11 @@ func marshal(invokeId uint, m Message) ([]byte, error) {
 		return []byte{}, fmt.Errorf("failed to marshal CSTA message body: %w", err)
 	}
 
+	return encodeFrame(invokeId, body), nil
+}
+
+// encodeFrame adds the CSTA header to a message body
+func encodeFrame(invokeId uint, body []byte) []byte {
 	msg := new(bytes.Buffer)
 
 	msg.Write([]byte{0x00, 0x00}) // TCP without SOAP format indicator
@@ -44,7 +56,7 @@ func marshal(invokeId uint, m Message) ([]byte, error) {
 	msg.WriteString(fmt.Sprintf("%04d", invokeId))
 	msg.Write(body)
 
-	return msg.Bytes(), nil
+	return msg.Bytes()
 }
 
 // Generic unmarshal implementation that verifies a message
@@ -0,0 +1,180 @@
+package csta
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	defaultReplayRequestTimeout = 5 * time.Second
+	defaultReplayMaxDelay       = time.Second
+)
+
+// ReplayOptions control how a trace is played back, nil selects the defaults
+type ReplayOptions struct {
+	// RequestTimeout is how long to wait for the client to send a message of the trace
+	RequestTimeout time.Duration
+
+	// MaxDelay caps the pauses between messages, which are kept as recorded up to it
+	MaxDelay time.Duration
+}
+
+// ReplayReport summarizes how a client behaved during a replay
+type ReplayReport struct {
+	Sent       int      // Messages of the trace the client sent as well
+	Received   int      // Messages of the trace the client was sent
+	Deviations []string // Messages the client sent differently than in the trace
+}
+
+func (r *ReplayReport) deviate(format string, args ...interface{}) {
+	deviation := fmt.Sprintf(format, args...)
+	log.Printf("Replay deviation: %s\n", deviation)
+	r.Deviations = append(r.Deviations, deviation)
+}
+
+// replayedMessage is a message the client sent during a replay
+type replayedMessage struct {
+	invokeId    uint
+	messageType MessageType
+	err         error
+}
+
+// Replay plays the switching function's side of a trace back to the client
+// connected to conn. Messages received in the trace are sent to the client in
+// order, after the client sent the messages of the trace that preceded them.
+// Those are matched by message type only, so the client gets the recorded
+// responses no matter which devices it requests. Invoke IDs of responses are
+// rewritten to the ones the client used.
+func Replay(conn io.ReadWriter, trace []TraceRecord, options *ReplayOptions) (*ReplayReport, error) {
+	if options == nil {
+		options = &ReplayOptions{}
+	}
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = defaultReplayRequestTimeout
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = defaultReplayMaxDelay
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	messages := make(chan replayedMessage)
+	go func() {
+		for {
+			invokeId, frame, err := readFrame(conn)
+			message := replayedMessage{invokeId: invokeId, err: err}
+			if err == nil {
+				message.messageType, err = typeOf(frame[cstaHeaderSize:])
+				if err != nil {
+					// Reported as a deviation, the stream is still in sync
+					message.messageType = "invalid message"
+					err = nil
+				}
+			}
+
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	report := &ReplayReport{Deviations: make([]string, 0)}
+	invokeIds := make(map[uint]uint) // Invoke IDs of the trace to the ones the client used
+	skipped := make(map[uint]bool)   // Invoke IDs of the trace the client didn't send
+	var previous time.Time
+
+	for i, record := range trace {
+		messageType, err := record.Type()
+		if err != nil {
+			return report, fmt.Errorf("invalid trace record %d: %w", i+1, err)
+		}
+
+		if !previous.IsZero() {
+			delay := record.Time.Sub(previous)
+			if delay > options.MaxDelay {
+				delay = options.MaxDelay
+			}
+			if delay > 0 && record.Direction == TraceDirectionReceived {
+				time.Sleep(delay)
+			}
+		}
+		previous = record.Time
+
+		switch record.Direction {
+		case TraceDirectionSent:
+			invokeId, err := expect(messages, messageType, options.RequestTimeout, report)
+			if err != nil {
+				return report, err
+			}
+			if invokeId == nil {
+				report.deviate("%s wasn't sent (invoke ID %04d in the trace)", messageType, record.InvokeID)
+				skipped[record.InvokeID] = true
+				continue
+			}
+			invokeIds[record.InvokeID] = *invokeId
+			delete(skipped, record.InvokeID)
+			report.Sent++
+
+		case TraceDirectionReceived:
+			// Responses to requests the client didn't send are dropped
+			if skipped[record.InvokeID] {
+				delete(skipped, record.InvokeID)
+				continue
+			}
+
+			invokeId := record.InvokeID
+			if live, ok := invokeIds[record.InvokeID]; ok {
+				invokeId = live
+				delete(invokeIds, record.InvokeID)
+			}
+
+			_, err = conn.Write(encodeFrame(invokeId, []byte(record.XML)))
+			if err != nil {
+				return report, fmt.Errorf("failed to replay %s: %w", messageType, err)
+			}
+			report.Received++
+
+		default:
+			return report, fmt.Errorf("invalid trace record %d: unknown direction %q", i+1, record.Direction)
+		}
+	}
+
+	return report, nil
+}
+
+// expect waits for the client to send a message of a type and returns its invoke ID,
+// or nil if it didn't in time. Other messages are reported as deviations.
+func expect(messages <-chan replayedMessage, messageType MessageType, timeout time.Duration, report *ReplayReport) (*uint, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case message := <-messages:
+			if errors.Is(message.err, io.EOF) {
+				return nil, fmt.Errorf("client disconnected while waiting for %s: %w", messageType, message.err)
+			}
+			if message.err != nil {
+				return nil, fmt.Errorf("failed to read from the client: %w", message.err)
+			}
+			if message.messageType != messageType {
+				report.deviate("unexpected %s (invoke ID %04d) while waiting for %s", message.messageType, message.invokeId, messageType)
+				continue
+			}
+			return &message.invokeId, nil
+
+		case <-deadline.C:
+			return nil, nil
+		}
+	}
+}
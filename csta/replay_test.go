@@ -0,0 +1,90 @@
+package csta
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+)
+
+// traceRecord creates a trace record for a message
+func traceRecord(t *testing.T, direction TraceDirection, invokeId uint, message Message) TraceRecord {
+	body, err := xml.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return TraceRecord{Time: time.Now(), Direction: direction, InvokeID: invokeId, XML: string(body)}
+}
+
+func TestReplay(t *testing.T) {
+	trace := []TraceRecord{
+		traceRecord(t, TraceDirectionSent, 42, GetDeviceId{SwitchName: "CM1", Extension: "4711"}),
+		traceRecord(t, TraceDirectionReceived, 42, GetDeviceIdResponse{Device: DeviceID{Device: "4711:CM1::0"}}),
+		traceRecord(t, TraceDirectionReceived, 9999, DeliveredEvent{MonitorCrossRefID: "1"}),
+		traceRecord(t, TraceDirectionSent, 43, MonitorStart{MonitorType: MonitorTypeDevice}),
+		traceRecord(t, TraceDirectionReceived, 43, MonitorStartResponse{MonitorCrossRefID: "1"}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type replayResult struct {
+		report *ReplayReport
+		err    error
+	}
+	result := make(chan replayResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- replayResult{err: err}
+			return
+		}
+		defer conn.Close()
+
+		report, err := Replay(conn, trace, &ReplayOptions{RequestTimeout: 200 * time.Millisecond})
+		result <- replayResult{report: report, err: err}
+	}()
+
+	conn, err := DialTimeout("tcp", listener.Addr().String(), 5*time.Second, context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	events := make(chan *Context, 1)
+	conn.Handle(MessageTypeDeliveredEvent, func(c *Context) {
+		events <- c
+	})
+
+	// The recorded response arrives under the invoke ID of the request
+	response, err := conn.Do(context.Background(), GetDeviceId{SwitchName: "CM1", Extension: "4712"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.(*GetDeviceIdResponse).Device.Device != "4711:CM1::0" {
+		t.Fail()
+	}
+
+	select {
+	case event := <-events:
+		if event.Message.(*DeliveredEvent).MonitorCrossRefID != "1" {
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	// MonitorStart is never sent, so its response is dropped
+	r := <-result
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.report.Sent != 1 || r.report.Received != 2 || len(r.report.Deviations) != 1 {
+		t.Logf("unexpected report %+v\n", r.report)
+		t.Fail()
+	}
+}
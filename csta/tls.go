@@ -0,0 +1,59 @@
+package csta
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSOptions configure a TLS connection to the switching function, e.g. the
+// Avaya AES DMCC TLS port 4722
+type TLSOptions struct {
+	// PEM encoded CA certificates to verify the switching function with,
+	// the system roots are used if empty
+	CAFile string
+
+	// PEM encoded client certificate and key, for switching functions that
+	// authenticate their clients
+	CertFile string
+	KeyFile  string
+
+	// Name to verify the certificate of the switching function against,
+	// defaults to the host of the dialed address
+	ServerName string
+
+	// InsecureSkipVerify accepts any certificate, only meant for lab setups
+	// with self-signed certificates
+	InsecureSkipVerify bool
+}
+
+// Config builds the tls.Config for the options, loading the certificates from disk
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+		}
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,206 @@
+package csta
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a generated certificate and its key, written to PEM files
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certFile    string
+	keyFile     string
+}
+
+// generateCertificate creates a certificate for localhost signed by parent, or a CA if parent is nil
+func generateCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certFile:    filepath.Join(t.TempDir(), name+".pem"),
+		keyFile:     filepath.Join(t.TempDir(), name+".key"),
+	}
+
+	err = os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// listenTLS starts a TLS listener that sends a SystemStatus to every client and
+// passes the invoke ID and message of the client's reply to replies
+func listenTLS(t *testing.T, ca *testCertificate, server *testCertificate, requireClientCertificate bool) (string, <-chan Message) {
+	certificate, err := tls.LoadX509KeyPair(server.certFile, server.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if requireClientCertificate {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = x509.NewCertPool()
+		config.ClientCAs.AddCert(ca.certificate)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	replies := make(chan Message, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				switchingFunction := &cstaConn{
+					options: &ConnectionOptions{},
+					rw:      bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+				}
+
+				err := switchingFunction.Write(42, SystemStatus{})
+				if err != nil {
+					return
+				}
+
+				invokeId, message, err := switchingFunction.Read()
+				if err == nil && invokeId == 42 {
+					replies <- message
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), replies
+}
+
+func TestDialTLS(t *testing.T) {
+	ca := generateCertificate(t, "ca", nil)
+	server := generateCertificate(t, "server", ca)
+	client := generateCertificate(t, "client", ca)
+
+	address, replies := listenTLS(t, ca, server, true)
+
+	conn, err := DialTimeout("tcp", address, 5*time.Second, context.Background(), &ConnectionOptions{
+		TLS: &TLSOptions{
+			CAFile:     ca.certFile,
+			CertFile:   client.certFile,
+			KeyFile:    client.keyFile,
+			ServerName: "localhost",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The system status is acknowledged by the default handler over the TLS connection
+	select {
+	case reply := <-replies:
+		if _, ok := reply.(*SystemStatusResponse); !ok {
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply received")
+	}
+}
+
+func TestDialTLSVerification(t *testing.T) {
+	ca := generateCertificate(t, "ca", nil)
+	server := generateCertificate(t, "server", ca)
+
+	address, _ := listenTLS(t, ca, server, false)
+
+	for _, options := range []*TLSOptions{
+		// Signed by an unknown authority
+		{},
+		// Certificate doesn't match the name
+		{CAFile: ca.certFile, ServerName: "aes.example.com"},
+	} {
+		conn, err := DialTimeout("tcp", address, 5*time.Second, context.Background(), &ConnectionOptions{TLS: options})
+		if err == nil {
+			conn.Close()
+			t.Logf("Connected with %+v\n", options)
+			t.Fail()
+		}
+	}
+
+	conn, err := DialTimeout("tcp", address, 5*time.Second, context.Background(), &ConnectionOptions{
+		TLS: &TLSOptions{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, err = DialTimeout("tcp", address, 5*time.Second, context.Background(), &ConnectionOptions{
+		TLS: &TLSOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	})
+	if err == nil {
+		t.Fail()
+	}
+}
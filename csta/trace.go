@@ -0,0 +1,191 @@
+package csta
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTraceMaxSize  = 10 * 1024 * 1024
+	defaultTraceMaxFiles = 5
+
+	// Maximum size of a single line when reading a trace, CSTA messages are limited to 64 KiB anyway
+	maxTraceLineSize = 1024 * 1024
+)
+
+// Credentials in messages, e.g. the password of a StartApplicationSession, are replaced
+// by redactedCredential before they are written to a trace
+var credentialElements = regexp.MustCompile(`(?i)(<(?:[\w.-]+:)?(?:password|passwd|secret)(?:\s[^>]*)?>)[^<]*(</)`)
+
+const redactedCredential = "*****"
+
+type TraceDirection string
+
+const (
+	TraceDirectionSent     TraceDirection = "sent"
+	TraceDirectionReceived TraceDirection = "received"
+)
+
+// Tracer gets every message sent or received on a connection with its raw XML body
+type Tracer interface {
+	Trace(direction TraceDirection, invokeId uint, body []byte)
+}
+
+// TraceRecord is a single message in a trace file, which contains one JSON object per line
+type TraceRecord struct {
+	Time      time.Time      `json:"time"`
+	Direction TraceDirection `json:"direction"`
+	InvokeID  uint           `json:"invoke_id"`
+	XML       string         `json:"xml"`
+}
+
+// Type returns the message type of the record, which is the name of its root element
+func (r TraceRecord) Type() (MessageType, error) {
+	return typeOf([]byte(r.XML))
+}
+
+// TraceFile is a Tracer that writes to a file, which is rotated when it exceeds MaxSize.
+// Rotated files get the suffixes .1 (most recent) to .<MaxFiles>, older files are removed.
+type TraceFile struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// NewTraceFile creates a TraceFile that appends to path, the file is opened with the first message
+func NewTraceFile(path string, maxSize int64, maxFiles int) *TraceFile {
+	if maxSize <= 0 {
+		maxSize = defaultTraceMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultTraceMaxFiles
+	}
+
+	return &TraceFile{
+		Path:     path,
+		MaxSize:  maxSize,
+		MaxFiles: maxFiles,
+	}
+}
+
+func (t *TraceFile) Trace(direction TraceDirection, invokeId uint, body []byte) {
+	line, err := json.Marshal(TraceRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		InvokeID:  invokeId,
+		XML:       redactCredentials(string(body)),
+	})
+	if err != nil {
+		log.Printf("Failed to trace CSTA message: %s\n", err)
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	err = t.write(append(line, '\n'))
+	if err != nil {
+		log.Printf("Failed to trace CSTA message: %s\n", err)
+	}
+}
+
+// redactCredentials replaces the content of credential elements in a message body
+func redactCredentials(body string) string {
+	return credentialElements.ReplaceAllString(body, "${1}"+redactedCredential+"${2}")
+}
+
+// write writes a line to the current file, the mutex must be held
+func (t *TraceFile) write(line []byte) error {
+	if t.file != nil && t.size > 0 && t.size+int64(len(line)) > t.MaxSize {
+		err := t.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.file == nil {
+		file, err := os.OpenFile(t.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open trace file: %w", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to open trace file: %w", err)
+		}
+		t.file = file
+		t.size = info.Size()
+	}
+
+	n, err := t.file.Write(line)
+	t.size += int64(n)
+	return err
+}
+
+// rotate closes the current file and shifts it and the rotated files by one suffix
+func (t *TraceFile) rotate() error {
+	t.file.Close()
+	t.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", t.Path, t.MaxFiles))
+	for i := t.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", t.Path, i), fmt.Sprintf("%s.%d", t.Path, i+1))
+	}
+
+	err := os.Rename(t.Path, t.Path+".1")
+	if err != nil {
+		return fmt.Errorf("failed to rotate trace file: %w", err)
+	}
+	return nil
+}
+
+// Close closes the current file, it is opened again with the next message
+func (t *TraceFile) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil {
+		return nil
+	}
+
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// ReadTrace reads all records of a trace file
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	records := make([]TraceRecord, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxTraceLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record TraceRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trace record in line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,132 @@
+package csta
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraceConnection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "csta.trace")
+	tracer := NewTraceFile(path, 0, 0)
+	defer tracer.Close()
+
+	conn := serveWithOptions(t, &ConnectionOptions{Tracer: tracer}, func(uint, Message) Message {
+		return GetDeviceIdResponse{Device: DeviceID{Device: "4711:CM1::0"}}
+	})
+
+	_, err := conn.Do(context.Background(), GetDeviceId{SwitchName: "CM1", Extension: "4711"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records, err := ReadTrace(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	for i, expected := range []struct {
+		direction   TraceDirection
+		messageType MessageType
+	}{
+		{TraceDirectionSent, MessageTypeGetDeviceId},
+		{TraceDirectionReceived, MessageTypeGetDeviceIdResponse},
+	} {
+		messageType, err := records[i].Type()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records[i].Direction != expected.direction || messageType != expected.messageType || records[i].InvokeID != 1 {
+			t.Logf("unexpected record %+v\n", records[i])
+			t.Fail()
+		}
+		if records[i].Time.IsZero() || !strings.HasPrefix(records[i].XML, "<"+string(expected.messageType)) {
+			t.Logf("unexpected record %+v\n", records[i])
+			t.Fail()
+		}
+	}
+}
+
+func TestTraceFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "csta.trace")
+	tracer := NewTraceFile(path, 2500, 2)
+	defer tracer.Close()
+
+	// Each record is about 1100 bytes, so every file holds two of them
+	body := []byte("<SystemStatus>" + strings.Repeat(" ", 1000) + "</SystemStatus>")
+	for i := uint(0); i < 10; i++ {
+		tracer.Trace(TraceDirectionReceived, i, body)
+	}
+	tracer.Close()
+
+	for suffix, expectedInvokeIds := range map[string][]uint{
+		"":   {8, 9},
+		".1": {6, 7},
+		".2": {4, 5},
+	} {
+		file, err := os.Open(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := ReadTrace(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) != len(expectedInvokeIds) {
+			t.Fatalf("expected %d records in %s, got %d", len(expectedInvokeIds), path+suffix, len(records))
+		}
+		for i, record := range records {
+			if record.InvokeID != expectedInvokeIds[i] {
+				t.Logf("expected invoke ID %d in %s, got %d\n", expectedInvokeIds[i], path+suffix, record.InvokeID)
+				t.Fail()
+			}
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestTraceRedactsCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "csta.trace")
+	tracer := NewTraceFile(path, 0, 0)
+
+	tracer.Trace(TraceDirectionSent, 1, []byte(`<StartApplicationSession><applicationInfo><applicationSpecificInfo>`+
+		`<SessionLoginInfo><userName>cti</userName><password>s3cr3t</password></SessionLoginInfo>`+
+		`<ns1:Password type="plain">0815</ns1:Password><password/>`+
+		`</applicationSpecificInfo></applicationInfo></StartApplicationSession>`))
+	tracer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cr3t") || strings.Contains(string(data), "0815") {
+		t.Fatalf("credentials in the trace: %s", data)
+	}
+
+	records, err := ReadTrace(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<SessionLoginInfo><userName>cti</userName><password>*****</password></SessionLoginInfo>` +
+		`<ns1:Password type="plain">*****</ns1:Password><password/>`
+	if !strings.Contains(records[0].XML, expected) {
+		t.Logf("unexpected record %s\n", records[0].XML)
+		t.Fail()
+	}
+}
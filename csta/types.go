@@ -90,3 +90,95 @@ type GlobalCallLinkageID struct {
 	GloballyUniqueCallLinkageID string `xml:"globallyUniqueCallLinkageID,omitempty"`
 	SubDomainCallLinkageID      string `xml:"subDomainCallLinkageID,omitempty"`
 }
+
+// ConnectionList describes how connections changed when calls were merged,
+// e.g. by a transfer or conference
+type ConnectionList struct {
+	Items []ConnectionListItem `xml:"connectionListItem"`
+}
+
+type ConnectionListItem struct {
+	NewConnection *ConnectionID `xml:"newConnection,omitempty"`
+	OldConnection *ConnectionID `xml:"oldConnection,omitempty"`
+	Endpoint      *Endpoint     `xml:"endpoint,omitempty"`
+}
+
+type Endpoint struct {
+	DeviceID   *DeviceID `xml:"deviceID,omitempty"`
+	NotKnown   *Empty    `xml:"notKnown,omitempty"`
+	Restricted *Empty    `xml:"restricted,omitempty"`
+}
+
+// EventCause explains why an event occurred (ECMA-269 12.2.13)
+type EventCause string
+
+const (
+	EventCauseACDBusy                 EventCause = "aCDBusy"
+	EventCauseACDForward              EventCause = "aCDForward"
+	EventCauseACDSaturated            EventCause = "aCDSaturated"
+	EventCauseAlertTimeExpired        EventCause = "alertTimeExpired"
+	EventCauseAutoWork                EventCause = "autoWork"
+	EventCauseBlocked                 EventCause = "blocked"
+	EventCauseBusy                    EventCause = "busy"
+	EventCauseCallBack                EventCause = "callBack"
+	EventCauseCallCancelled           EventCause = "callCancelled"
+	EventCauseCallForward             EventCause = "callForward"
+	EventCauseCallForwardBusy         EventCause = "callForwardBusy"
+	EventCauseCallForwardImmediate    EventCause = "callForwardImmediate"
+	EventCauseCallForwardNoAnswer     EventCause = "callForwardNoAnswer"
+	EventCauseCallNotAnswered         EventCause = "callNotAnswered"
+	EventCauseCallPickup              EventCause = "callPickup"
+	EventCauseCampOn                  EventCause = "campOn"
+	EventCauseCharacterCountReached   EventCause = "characterCountReached"
+	EventCauseConference              EventCause = "conference"
+	EventCauseConsultation            EventCause = "consultation"
+	EventCauseDestDetected            EventCause = "destDetected"
+	EventCauseDestNotObtainable       EventCause = "destNotObtainable"
+	EventCauseDestOutOfOrder          EventCause = "destOutOfOrder"
+	EventCauseDistributed             EventCause = "distributed"
+	EventCauseDistributionDelay       EventCause = "distributionDelay"
+	EventCauseDoNotDisturb            EventCause = "doNotDisturb"
+	EventCauseDTMFDigitDetected       EventCause = "dTMFDigitDetected"
+	EventCauseEnteringDistribution    EventCause = "enteringDistribution"
+	EventCauseForcedPause             EventCause = "forcedPause"
+	EventCauseForcedTransition        EventCause = "forcedTransition"
+	EventCauseIncompatibleDestination EventCause = "incompatibleDestination"
+	EventCauseIntrude                 EventCause = "intrude"
+	EventCauseInvalidAccountCode      EventCause = "invalidAccountCode"
+	EventCauseInvalidNumberFormat     EventCause = "invalidNumberFormat"
+	EventCauseKeyOperation            EventCause = "keyOperation"
+	EventCauseLockout                 EventCause = "lockout"
+	EventCauseMaintenance             EventCause = "maintenance"
+	EventCauseMakeCall                EventCause = "makeCall"
+	EventCauseMultipleAlerting        EventCause = "multipleAlerting"
+	EventCauseMultipleQueuing         EventCause = "multipleQueuing"
+	EventCauseNetworkCongestion       EventCause = "networkCongestion"
+	EventCauseNetworkDialling         EventCause = "networkDialling"
+	EventCauseNetworkNotObtainable    EventCause = "networkNotObtainable"
+	EventCauseNetworkOutOfOrder       EventCause = "networkOutOfOrder"
+	EventCauseNetworkSignal           EventCause = "networkSignal"
+	EventCauseNewCall                 EventCause = "newCall"
+	EventCauseNextMessage             EventCause = "nextMessage"
+	EventCauseNoAvailableAgents       EventCause = "noAvailableAgents"
+	EventCauseNormal                  EventCause = "normal"
+	EventCauseNormalClearing          EventCause = "normalClearing"
+	EventCauseNumberChanged           EventCause = "numberChanged"
+	EventCauseOverflow                EventCause = "overflow"
+	EventCauseOverride                EventCause = "override"
+	EventCausePark                    EventCause = "park"
+	EventCauseQueueCleared            EventCause = "queueCleared"
+	EventCauseRecall                  EventCause = "recall"
+	EventCauseRedirected              EventCause = "redirected"
+	EventCauseRemainsInQueue          EventCause = "remainsInQueue"
+	EventCauseReorderTone             EventCause = "reorderTone"
+	EventCauseReserved                EventCause = "reserved"
+	EventCauseResourcesNotAvailable   EventCause = "resourcesNotAvailable"
+	EventCauseSilentParticipation     EventCause = "silentParticipation"
+	EventCauseSingleStepConference    EventCause = "singleStepConference"
+	EventCauseSingleStepTransfer      EventCause = "singleStepTransfer"
+	EventCauseTimeout                 EventCause = "timeout"
+	EventCauseTransfer                EventCause = "transfer"
+	EventCauseTrunksBusy              EventCause = "trunksBusy"
+	EventCauseUnknownOverflow         EventCause = "unknownOverflow"
+	EventCauseVoiceUnitInitiator      EventCause = "voiceUnitInitiator"
+)
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PBXConnectionStatus is the state of the connection to the PBX, maintained by the agent
+type PBXConnectionStatus struct {
+	gorm.Model
+
+	// The driver that is connected, e.g. avaya_aes
+	PbxType string
+
+	// The address of the node the agent is connected to, empty while disconnected
+	ActiveAddress string
+
+	// Whether the node is the primary one, the first of the configured addresses
+	Primary bool
+
+	// The time the connection to the node was established
+	ConnectedAt time.Time
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/glebarez/sqlite"
 	"github.com/spf13/viper"
@@ -16,9 +17,15 @@ type DB struct {
 	gormDB *gorm.DB
 }
 
-var database *DB
+var (
+	database      *DB
+	databaseMutex sync.Mutex
+)
 
 func NewDatabase() (*DB, error) {
+	databaseMutex.Lock()
+	defer databaseMutex.Unlock()
+
 	if database != nil {
 		return database, nil
 	}
@@ -30,14 +37,16 @@ func NewDatabase() (*DB, error) {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	err = db.AutoMigrate(&Device{}, &AESRecordingDevice{}, &PBXConnectionCredentials{}, &AppConfig{}, &UploadRecord{}, &PassiveMonitoringConfig{})
+	err = db.AutoMigrate(&Device{}, &AESRecordingDevice{}, &PBXConnectionCredentials{}, &AppConfig{}, &UploadRecord{}, &PassiveMonitoringConfig{}, &PBXConnectionStatus{})
 	if err != nil {
 		return nil, fmt.Errorf("database migration failed: %w", err)
 	}
 
-	return &DB{
+	database = &DB{
 		gormDB: db,
-	}, nil
+	}
+
+	return database, nil
 }
 
 // Get all devices that shall be monitored
@@ -67,12 +76,23 @@ func (db *DB) GetAESRecordingDevices() []AESRecordingDevice {
 	return devices
 }
 
+// Save the registration status of an AES recording device without touching its configuration
+func (db *DB) SaveRegistrationStatus(device *AESRecordingDevice) error {
+	return db.gormDB.Model(device).Select("RegistrationStatus", "LastError", "RegisteredAt").Updates(device).Error
+}
+
 func (db *DB) GetPBXConnectionCredentials() (PBXConnectionCredentials, error) {
 	var creds PBXConnectionCredentials
 	err := db.gormDB.First(&creds).Error
 	return creds, err
 }
 
+func (db *DB) GetPBXConnectionStatus() (PBXConnectionStatus, error) {
+	var status PBXConnectionStatus
+	err := db.gormDB.First(&status).Error
+	return status, err
+}
+
 func (db *DB) GetAppConfig() (AppConfig, error) {
 	var config AppConfig
 	err := db.gormDB.First(&config).Error
@@ -91,6 +111,18 @@ func (db *DB) GetRecentUploads() ([]UploadRecord, error) {
 	return records, err
 }
 
+// Get all upload records that have not been completely uploaded yet, oldest first
+func (db *DB) GetPendingUploads() ([]UploadRecord, error) {
+	var records []UploadRecord
+	err := db.gormDB.Where("status IN ?", []UploadStatus{
+		UploadStatusQueued,
+		UploadStatusStarting,
+		UploadStatusUploading,
+		UploadStatusUploadTransferred,
+	}).Order("created_at asc").Find(&records).Error
+	return records, err
+}
+
 func (db *DB) GetUploadRecordById(deviceId int) UploadRecord {
 	var record UploadRecord
 	db.gormDB.Where("id = ?", deviceId).First(&record)
@@ -6,6 +6,20 @@ import (
 	"gorm.io/gorm"
 )
 
+// RecordingMethod is how the calls of a device are recorded on Avaya AES
+type RecordingMethod string
+
+const (
+	// A virtual station dials the Service Observing feature code, this is the default
+	RecordingMethodServiceObserving RecordingMethod = "SERVICE_OBSERVING"
+
+	// A DMCC station is registered in shared control of the device and receives its media
+	RecordingMethodMultipleRegistration RecordingMethod = "MULTIPLE_REGISTRATION"
+
+	// A virtual station is conferenced silently into the calls of the device
+	RecordingMethodSingleStepConference RecordingMethod = "SINGLE_STEP_CONFERENCE"
+)
+
 // A Device holds information on Extensions that shall be monitored/recorded by
 // this service
 type Device struct {
@@ -20,6 +34,12 @@ type Device struct {
 	// Should this device be recorded?
 	RecordCalls bool
 
+	// How the calls of this device are recorded, empty selects service observing
+	RecordingMethod RecordingMethod
+
+	// The security code of the station, needed to register in shared control of it
+	Password string
+
 	// Last known CSTA cross reference ID
 	CrossReferenceID string
 
@@ -1,6 +1,19 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RegistrationStatus is the state of the registration of a virtual station at the PBX
+type RegistrationStatus string
+
+const (
+	RegistrationStatusRegistered   RegistrationStatus = "REGISTERED"
+	RegistrationStatusUnregistered RegistrationStatus = "UNREGISTERED"
+	RegistrationStatusFailed       RegistrationStatus = "FAILED"
+)
 
 // An AESRecordingDevice holds the configuration data for one
 // virtual station that is used internally to monitor the conversation
@@ -12,4 +25,13 @@ type AESRecordingDevice struct {
 
 	// The security code of the virtual station
 	Password string
+
+	// Whether the virtual station is registered and ready to record, maintained by the agent
+	RegistrationStatus RegistrationStatus
+
+	// Why the last registration failed or was lost
+	LastError string
+
+	// The time the virtual station was registered for the last time
+	RegisteredAt time.Time
 }
@@ -16,6 +16,7 @@ const (
 	UploadStatusUploading         UploadStatus = "UPLOADING"
 	UploadStatusUploadTransferred UploadStatus = "UPLOAD_TRANSFERRED"
 	UploadStatusUploadFinalized   UploadStatus = "UPLOAD_FINALIZED"
+	UploadStatusFailed            UploadStatus = "UPLOAD_FAILED"
 )
 
 const (
@@ -36,5 +37,38 @@ type UploadRecord struct {
 	Begin   time.Time
 	End     time.Time
 
+	// PBX call IDs of the recorded call, if the recording source knows them
+	CallID       string
+	GlobalCallID string
+
+	// Parties of the recorded call, if the recording source knows them
+	CallerName   string
+	CallerNumber string
+	CalleeName   string
+	CalleeNumber string
+
+	// Monitored extension the recording was made for, if the recording source knows it
+	Extension string
+
+	// Reception statistics of the recorded RTP streams, JSON encoded
+	StreamStats string
+
+	// DTMF digits received during the call and their offsets into the recording,
+	// JSON encoded. Digits masked for PCI compliance are not included.
+	DTMFEvents string
+
 	Type UploadRecordType
+
+	// Number of failed upload attempts so far
+	Attempts int
+
+	// Error of the last failed upload attempt
+	LastError string
+
+	// The upload will not be retried before this time
+	NextAttemptAt time.Time
+
+	// Key of the transferred file at the Coach Server, a transferred upload is resumed
+	// by finalizing it with this key
+	ObjectKey string
 }
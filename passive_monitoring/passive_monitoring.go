@@ -1,3 +1,10 @@
 package passive_monitoring
 
+import "github.com/spf13/viper"
+
 const PBXType = "passive_monitoring"
+
+func init() {
+	// TCP connections to or from these ports are reassembled and parsed as SIP
+	viper.SetDefault("passive_monitoring.sip_tcp_ports", []int{5060})
+}
@@ -2,45 +2,98 @@ package passive_monitoring
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"log"
-	"math"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/pd0mz/go-g711"
-	"github.com/pion/rtp"
+	"github.com/google/gopacket/reassembly"
+	pionrtp "github.com/pion/rtp"
 	"github.com/pion/sdp"
 	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
 	"github.com/psco-tech/gw-coach-recording-agent/uploader"
+	"github.com/spf13/viper"
 )
 
 type Recorder interface {
 	ListenAndRecord(ctx context.Context) error // Start listening for calls and record them
 }
 
-func NewPassiveRecorder(handle *pcap.Handle) (Recorder, error) {
+// RecorderOptions control where recordings go once a call has been reconstructed
+type RecorderOptions struct {
+	// OutputDirectory is the directory the recordings are written to,
+	// the system's temporary directory is used if empty
+	OutputDirectory string
+
+	// OnRecordingFinished is called with each finished recording,
+	// the default queues the recording for upload
+	OnRecordingFinished func(record *models.UploadRecord)
+}
+
+var defaultRecorderOptions = RecorderOptions{
+	OutputDirectory: os.TempDir(),
+	OnRecordingFinished: func(record *models.UploadRecord) {
+		err := uploader.Enqueue(record)
+		if err != nil {
+			log.Printf("ERROR: %s\n", err)
+		}
+	},
+}
+
+// NewPassiveRecorder creates a recorder that reconstructs calls from the packets read from source.
+// The source can either be a live capture handle or a capture file, options may be nil to use the defaults.
+func NewPassiveRecorder(source gopacket.PacketDataSource, linkType layers.LinkType, options *RecorderOptions) (Recorder, error) {
+	o := defaultRecorderOptions
+	if options != nil {
+		if options.OutputDirectory != "" {
+			o.OutputDirectory = options.OutputDirectory
+		}
+		if options.OnRecordingFinished != nil {
+			o.OnRecordingFinished = options.OnRecordingFinished
+		}
+	}
+
+	sipTCPPorts := make(map[layers.TCPPort]bool)
+	for _, port := range viper.GetIntSlice("passive_monitoring.sip_tcp_ports") {
+		sipTCPPorts[layers.TCPPort(port)] = true
+	}
+
 	return &passiveRecorder{
-		handle: handle,
-		calls:  make(map[string]*sipCall),
+		source:      source,
+		linkType:    linkType,
+		options:     o,
+		sipTCPPorts: sipTCPPorts,
+		calls:       make(map[string]*sipCall),
 	}, nil
 }
 
 type passiveRecorder struct {
-	handle *pcap.Handle
-	calls  map[string]*sipCall
+	source      gopacket.PacketDataSource
+	linkType    layers.LinkType
+	options     RecorderOptions
+	sipTCPPorts map[layers.TCPPort]bool
+	calls       map[string]*sipCall
 }
 
+// ListenAndRecord reads packets until the context is done or the source is exhausted,
+// e.g. at the end of a capture file. Calls still in progress at that point are finished
+// with the timestamp of the last packet seen.
 func (r *passiveRecorder) ListenAndRecord(ctx context.Context) error {
-	packetSource := gopacket.NewPacketSource(r.handle, r.handle.LinkType())
+	packetSource := gopacket.NewPacketSource(r.source, r.linkType)
 	defragger := ip4defrag.NewIPv4Defragmenter()
 
+	// SIP over TCP is reassembled and parsed by the sipStreams, which feed the
+	// messages into handleSIP just like the datagrams decoded by gopacket
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(&sipStreamFactory{recorder: r}))
+	assembler.MaxBufferedPagesPerConnection = maxBufferedPagesPerConnection
+
+	var lastTimestamp, lastFlush time.Time
+
 	for packet := range packetSource.Packets() {
 		select {
 		case <-ctx.Done():
@@ -48,6 +101,8 @@ func (r *passiveRecorder) ListenAndRecord(ctx context.Context) error {
 		default:
 		}
 
+		lastTimestamp = packet.Metadata().Timestamp
+
 		ip4Layer := packet.Layer(layers.LayerTypeIPv4)
 		if ip4Layer == nil {
 			continue
@@ -73,218 +128,235 @@ func (r *passiveRecorder) ListenAndRecord(ctx context.Context) error {
 		decoder.Decode(defragmentedIPv4.Payload, pb)
 
 		if sipLayer := packet.Layer(layers.LayerTypeSIP); sipLayer != nil {
-			// SIP packet
-			sip := sipLayer.(*layers.SIP)
-			switch sip.Method {
-			case layers.SIPMethodInvite:
-				// Create a new call for each invite
-				if sip.GetFirstHeader("content-type") == "application/sdp" {
-					if _, ok := r.calls[sip.GetCallID()]; !ok {
-						log.Printf("Call initiated: %s\n", sip.GetCallID())
-						r.calls[sip.GetCallID()] = &sipCall{
-							Invite: sip,
-							Begin:  time.Now(),
-						}
-					}
-				}
-			case layers.SIPMethodCancel:
-				if _, ok := r.calls[sip.GetCallID()]; ok {
-					delete(r.calls, sip.GetCallID())
-					log.Printf("Call cancelled: %s", sip.GetCallID())
-				}
-			case layers.SIPMethodBye:
-				if call, ok := r.calls[sip.GetCallID()]; ok {
-					delete(r.calls, sip.GetCallID())
-					call.End = time.Now()
-					log.Printf("\n\nCall cleared: %s\n%+v\n\n", sip.GetCallID(), call)
-					call.Recorder.Close()
-
-					// Enqueue uploading the newly recorded file
-					go func() {
-						uploader.GetUploadRecordChannel() <- models.UploadRecord{
-							FilePath:    call.Recorder.File.Name(),
-							Type:        models.UploadRecordTypeCFS_AUDIO,
-							ContentType: "audio/wav",
-							Details:     string(call.Invite.Contents),
-							Begin:       call.Begin,
-							End:         call.End,
-						}
-					}()
-				}
+			r.handleSIP(sipLayer.(*layers.SIP), lastTimestamp)
+		} else if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			tcp := tcpLayer.(*layers.TCP)
+			if r.sipTCPPorts[tcp.SrcPort] || r.sipTCPPorts[tcp.DstPort] {
+				ac := captureContext(packet.Metadata().CaptureInfo)
+				assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, &ac)
 			}
 
-			if sip.IsResponse && sip.ResponseCode == 200 {
-				if sip.GetFirstHeader("content-type") == "application/sdp" {
-					// Find the matching initiated call
-					if call, ok := r.calls[sip.GetCallID()]; ok {
-						log.Printf("Call established: %s\n", sip.GetCallID())
-						call.OK = sip
-
-						// Create the flows from the endpoints
-
-						caller := sdp.SessionDescription{}
-						err := caller.Unmarshal(string(call.Invite.Payload()))
-						if err != nil {
-							log.Printf("ERROR parsing SDP: %s\n", err)
-							delete(r.calls, sip.GetCallID())
-							continue
-						}
-
-						callee := sdp.SessionDescription{}
-						err = callee.Unmarshal(string(call.OK.Payload()))
-						if err != nil {
-							log.Printf("ERROR parsing SDP: %s\n", err)
-							delete(r.calls, sip.GetCallID())
-							continue
-						}
-
-						call.ToCallee = rtpFlow{
-							Endpoint: layers.NewIPEndpoint(callee.ConnectionInformation.Address.IP),
-							Port:     layers.UDPPort(callee.MediaDescriptions[0].MediaName.Port.Value),
-						}
-
-						call.ToCaller = rtpFlow{
-							Endpoint: layers.NewIPEndpoint(caller.ConnectionInformation.Address.IP),
-							Port:     layers.UDPPort(caller.MediaDescriptions[0].MediaName.Port.Value),
-						}
-
-						recordingFile, err := os.CreateTemp(os.TempDir(), "*.wav")
-
-						if err != nil {
-							log.Printf("Failed to open file for recording: %s\n", err)
-							delete(r.calls, sip.GetCallID())
-							continue
-						}
-
-						call.Recorder = newRecorder(recordingFile, 2)
-					}
-				}
+			if lastTimestamp.Sub(lastFlush) > tcpFlushTimeout {
+				assembler.FlushCloseOlderThan(lastTimestamp.Add(-tcpFlushTimeout))
+				lastFlush = lastTimestamp
 			}
 		} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
 			// UDP but not SIP
-			udp := udpLayer.(*layers.UDP)
-
-			// Check if this belongs to any of the active calls RTP streams
-			for _, call := range r.calls {
-				if packet.NetworkLayer().NetworkFlow().Dst() == call.ToCaller.Endpoint && udp.DstPort == call.ToCaller.Port {
-					err := call.Recorder.recordPacket(packet, 0)
-					if err != nil {
-						log.Printf("ERROR: %s\n", err)
-					}
-				} else if packet.NetworkLayer().NetworkFlow().Dst() == call.ToCallee.Endpoint && udp.DstPort == call.ToCallee.Port {
-					err := call.Recorder.recordPacket(packet, 1)
-					if err != nil {
-						log.Printf("ERROR: %s\n", err)
-					}
-				}
-			}
+			r.handleRTP(packet.NetworkLayer().NetworkFlow().Dst(), udpLayer.(*layers.UDP), lastTimestamp)
+		}
+	}
+
+	// Hand out whatever is still buffered in the TCP streams
+	assembler.FlushAll()
+
+	for callID, call := range r.calls {
+		if call.Recorder == nil {
+			// Never answered
+			delete(r.calls, callID)
+			continue
 		}
+		log.Printf("Capture ended during call: %s\n", callID)
+		r.finishCall(callID, call, lastTimestamp)
 	}
 
 	return nil
 }
 
-type rtpFlow struct {
-	Endpoint gopacket.Endpoint
-	Port     layers.UDPPort
-}
+// handleSIP tracks the dialogs, timestamp is the capture time of the packet carrying the message
+func (r *passiveRecorder) handleSIP(sip *layers.SIP, timestamp time.Time) {
+	switch sip.Method {
+	case layers.SIPMethodInvite:
+		// Create a new call for each invite, responses carry the method of their CSeq
+		if !sip.IsResponse && sip.GetFirstHeader("content-type") == "application/sdp" {
+			if _, ok := r.calls[sip.GetCallID()]; !ok {
+				log.Printf("Call initiated: %s\n", sip.GetCallID())
+				r.calls[sip.GetCallID()] = &sipCall{
+					Invite: sip,
+					Begin:  timestamp,
+				}
+			}
+		}
+	case layers.SIPMethodCancel:
+		if _, ok := r.calls[sip.GetCallID()]; ok {
+			delete(r.calls, sip.GetCallID())
+			log.Printf("Call cancelled: %s\n", sip.GetCallID())
+		}
+	case layers.SIPMethodBye:
+		if call, ok := r.calls[sip.GetCallID()]; ok {
+			if call.Recorder == nil {
+				delete(r.calls, sip.GetCallID())
+				return
+			}
+			r.finishCall(sip.GetCallID(), call, timestamp)
+		}
+	}
 
-type sipCall struct {
-	Invite *layers.SIP
-	OK     *layers.SIP
+	if sip.IsResponse && sip.ResponseCode == 200 {
+		if sip.GetFirstHeader("content-type") == "application/sdp" {
+			// Find the matching initiated call
+			call, ok := r.calls[sip.GetCallID()]
+			if !ok || call.Recorder != nil {
+				return
+			}
 
-	ToCaller rtpFlow
-	ToCallee rtpFlow
+			log.Printf("Call established: %s\n", sip.GetCallID())
+			call.OK = sip
 
-	Recorder *multichannelRecorder
+			// Create the flows from the endpoints
 
-	Begin time.Time
-	End   time.Time
-}
+			caller := sdp.SessionDescription{}
+			err := caller.Unmarshal(string(call.Invite.Payload()))
+			if err != nil {
+				log.Printf("ERROR parsing SDP: %s\n", err)
+				delete(r.calls, sip.GetCallID())
+				return
+			}
 
-func newRecorder(file *os.File, channels int) *multichannelRecorder {
-	recorder := &multichannelRecorder{
-		Encoder: wav.NewEncoder(file, 8000, 16, channels, 1),
-		File:    file,
-		buffers: make([]*audio.IntBuffer, channels),
-	}
+			callee := sdp.SessionDescription{}
+			err = callee.Unmarshal(string(call.OK.Payload()))
+			if err != nil {
+				log.Printf("ERROR parsing SDP: %s\n", err)
+				delete(r.calls, sip.GetCallID())
+				return
+			}
 
-	for i := 0; i < channels; i++ {
-		recorder.buffers[i] = &audio.IntBuffer{
-			Data:           make([]int, 0),
-			Format:         &audio.Format{NumChannels: 1, SampleRate: 8000},
-			SourceBitDepth: 16,
-		}
-	}
+			call.ToCallee = rtpFlow{
+				Endpoint: layers.NewIPEndpoint(callee.ConnectionInformation.Address.IP),
+				Port:     layers.UDPPort(callee.MediaDescriptions[0].MediaName.Port.Value),
+			}
 
-	return recorder
-}
+			call.ToCaller = rtpFlow{
+				Endpoint: layers.NewIPEndpoint(caller.ConnectionInformation.Address.IP),
+				Port:     layers.UDPPort(caller.MediaDescriptions[0].MediaName.Port.Value),
+			}
 
-type multichannelRecorder struct {
-	Encoder *wav.Encoder
-	File    *os.File
+			recordingFile, err := os.CreateTemp(r.options.OutputDirectory, "*.wav")
 
-	buffers []*audio.IntBuffer
-}
+			if err != nil {
+				log.Printf("Failed to open file for recording: %s\n", err)
+				delete(r.calls, sip.GetCallID())
+				return
+			}
 
-func (r *multichannelRecorder) recordPacket(packet gopacket.Packet, channel int) error {
-	rtp := rtp.Packet{}
-	err := rtp.Unmarshal(packet.ApplicationLayer().Payload())
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal RTP packet: %s", err)
+			// Each side declares the payload types it receives
+			call.Recorder = rtp.NewMultichannelRecorder(recordingFile, 2)
+			call.Recorder.SetPayloadTypes(0, rtp.PayloadTypesFromSDP(caller.MediaDescriptions[0]))
+			call.Recorder.SetPayloadTypes(1, rtp.PayloadTypesFromSDP(callee.MediaDescriptions[0]))
+		}
 	}
+}
 
-	// Write new samples into according buffers
-	switch rtp.PayloadType {
-	case 0: // PCMU
-		decodedSamples := g711.MLawDecode(rtp.Payload)
-		newSamples := make([]int, len(decodedSamples))
-		for i := 0; i < len(newSamples); i++ {
-			newSamples[i] = int(decodedSamples[i])
+// handleRTP records the datagram if it belongs to any of the active calls RTP streams
+func (r *passiveRecorder) handleRTP(dst gopacket.Endpoint, udp *layers.UDP, timestamp time.Time) {
+	for _, call := range r.calls {
+		if call.Recorder == nil {
+			continue
 		}
 
-		r.buffers[channel].Data = append(r.buffers[channel].Data, newSamples...)
-	case 8: // PCMA
-		decodedSamples := g711.ALawDecode(rtp.Payload)
-		newSamples := make([]int, len(decodedSamples))
-		for i := 0; i < len(newSamples); i++ {
-			newSamples[i] = int(decodedSamples[i])
+		channel := -1
+		if dst == call.ToCaller.Endpoint && udp.DstPort == call.ToCaller.Port {
+			channel = 0
+		} else if dst == call.ToCallee.Endpoint && udp.DstPort == call.ToCallee.Port {
+			channel = 1
 		}
 
-		r.buffers[channel].Data = append(r.buffers[channel].Data, newSamples...)
-	}
+		if channel < 0 {
+			continue
+		}
+
+		rtpPacket := &pionrtp.Packet{}
+		err := rtpPacket.Unmarshal(udp.Payload)
+		if err != nil {
+			log.Printf("ERROR: failed to unmarshal RTP packet: %s\n", err)
+			continue
+		}
 
-	n, samples := r.interleave(r.buffers)
-	for _, b := range r.buffers {
-		b.Data = b.Data[n:]
+		err = call.Recorder.RecordPacket(rtpPacket, channel, timestamp)
+		if err != nil {
+			log.Printf("ERROR: %s\n", err)
+		}
 	}
-	return r.Encoder.Write(samples)
 }
 
-func (r *multichannelRecorder) interleave(channels []*audio.IntBuffer) (int, *audio.IntBuffer) {
-	samples := math.MaxInt
-	for _, channel := range channels {
-		if len(channel.Data) < samples {
-			samples = len(channel.Data)
-		}
+// finishCall closes the recording of an established call and hands it on
+func (r *passiveRecorder) finishCall(callID string, call *sipCall, end time.Time) {
+	delete(r.calls, callID)
+	call.End = end
+	log.Printf("Call cleared: %s\n", callID)
+
+	err := call.Recorder.Close()
+	if err != nil {
+		log.Printf("ERROR: failed to close recording: %s\n", err)
+		return
+	}
+
+	stats, err := json.Marshal(call.Recorder.Stats())
+	if err != nil {
+		log.Printf("ERROR: failed to encode stream statistics: %s\n", err)
 	}
 
-	interleaved := &audio.IntBuffer{
-		Data:           make([]int, 0),
-		Format:         &audio.Format{NumChannels: len(channels), SampleRate: 8000},
-		SourceBitDepth: 16,
+	dtmf, err := json.Marshal(call.Recorder.DTMFEvents())
+	if err != nil {
+		log.Printf("ERROR: failed to encode DTMF events: %s\n", err)
 	}
 
-	for i := 0; i < samples; i++ {
-		for c := 0; c < len(channels); c++ {
-			interleaved.Data = append(interleaved.Data, channels[c].Data[i])
+	callerName, callerNumber := sipParty(call.Invite.GetFrom())
+	calleeName, calleeNumber := sipParty(call.Invite.GetTo())
+
+	r.options.OnRecordingFinished(&models.UploadRecord{
+		FilePath:     call.Recorder.File.Name(),
+		Type:         models.UploadRecordTypeCFS_AUDIO,
+		ContentType:  "audio/wav",
+		Details:      string(call.Invite.Contents),
+		Begin:        call.Begin,
+		End:          call.End,
+		CallerName:   callerName,
+		CallerNumber: callerNumber,
+		CalleeName:   calleeName,
+		CalleeNumber: calleeNumber,
+		StreamStats:  string(stats),
+		DTMFEvents:   string(dtmf),
+	})
+}
+
+// sipParty returns the display name and the user part of the URI of a From or To header,
+// e.g. "Dispatch" and 100 for "Dispatch" <sip:100@192.0.2.1>;tag=a1
+func sipParty(header string) (string, string) {
+	name, uri := "", header
+	if start := strings.Index(header, "<"); start >= 0 {
+		name = strings.Trim(strings.TrimSpace(header[:start]), `"`)
+		uri = header[start+1:]
+		if end := strings.Index(uri, ">"); end >= 0 {
+			uri = uri[:end]
 		}
+	} else if i := strings.Index(uri, ";"); i >= 0 {
+		// Without angle brackets the parameters belong to the header
+		uri = uri[:i]
 	}
 
-	return samples, interleaved
+	_, user, ok := strings.Cut(strings.TrimSpace(uri), ":")
+	if !ok {
+		return name, ""
+	}
+	user, _, _ = strings.Cut(user, "@")
+	user, _, _ = strings.Cut(user, ";")
+	return name, user
 }
 
-func (r *multichannelRecorder) Close() error {
-	r.Encoder.Close()
-	return r.File.Close()
+type rtpFlow struct {
+	Endpoint gopacket.Endpoint
+	Port     layers.UDPPort
+}
+
+type sipCall struct {
+	Invite *layers.SIP
+	OK     *layers.SIP
+
+	ToCaller rtpFlow
+	ToCallee rtpFlow
+
+	Recorder *rtp.MultichannelRecorder
+
+	Begin time.Time
+	End   time.Time
 }
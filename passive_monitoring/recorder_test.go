@@ -0,0 +1,354 @@
+package passive_monitoring
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	pionrtp "github.com/pion/rtp"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+)
+
+var (
+	callerIP = net.IPv4(192, 0, 2, 1)
+	calleeIP = net.IPv4(192, 0, 2, 2)
+)
+
+var captureInvite = []byte("INVITE sip:4711@192.0.2.2 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-1\r\n" +
+	"From: <sip:100@192.0.2.1>;tag=a1\r\n" +
+	"To: <sip:4711@192.0.2.2>\r\n" +
+	"Call-ID: capture-1@192.0.2.1\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"Content-Length: 88\r\n" +
+	"\r\n" +
+	"v=0\r\n" +
+	"o=- 1 1 IN IP4 192.0.2.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 10000 RTP/AVP 0\r\n")
+
+var captureOK = []byte("SIP/2.0 200 OK\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-1\r\n" +
+	"From: <sip:100@192.0.2.1>;tag=a1\r\n" +
+	"To: <sip:4711@192.0.2.2>;tag=b2\r\n" +
+	"Call-ID: capture-1@192.0.2.1\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"Content-Length: 127\r\n" +
+	"\r\n" +
+	"v=0\r\n" +
+	"o=- 2 2 IN IP4 192.0.2.2\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.2\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 20000 RTP/AVP 0 101\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\n")
+
+var captureBye = []byte("BYE sip:4711@192.0.2.2 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-2\r\n" +
+	"From: <sip:100@192.0.2.1>;tag=a1\r\n" +
+	"To: <sip:4711@192.0.2.2>;tag=b2\r\n" +
+	"Call-ID: capture-1@192.0.2.1\r\n" +
+	"CSeq: 2 BYE\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n")
+
+// captureWriter writes UDP datagrams into an in-memory pcap file
+type captureWriter struct {
+	t      *testing.T
+	buffer bytes.Buffer
+	writer *pcapgo.Writer
+}
+
+func newCaptureWriter(t *testing.T) *captureWriter {
+	w := &captureWriter{t: t}
+	w.writer = pcapgo.NewWriter(&w.buffer)
+	err := w.writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func (w *captureWriter) writeUDP(timestamp time.Time, src net.IP, srcPort int, dst net.IP, dstPort int, payload []byte) {
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+	w.writePacket(timestamp, src, dst, layers.IPProtocolUDP, udp, payload)
+}
+
+func (w *captureWriter) writeTCP(timestamp time.Time, src net.IP, srcPort int, dst net.IP, dstPort int, seq uint32, payload []byte) {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     seq,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	w.writePacket(timestamp, src, dst, layers.IPProtocolTCP, tcp, payload)
+}
+
+type transportLayer interface {
+	gopacket.SerializableLayer
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}
+
+func (w *captureWriter) writePacket(timestamp time.Time, src net.IP, dst net.IP, protocol layers.IPProtocol, transport transportLayer, payload []byte) {
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+		SrcIP:    src,
+		DstIP:    dst,
+	}
+	transport.SetNetworkLayerForChecksum(ip)
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ethernet, ip, transport, gopacket.Payload(payload))
+	if err != nil {
+		w.t.Fatal(err)
+	}
+
+	data := buffer.Bytes()
+	err = w.writer.WritePacket(gopacket.CaptureInfo{Timestamp: timestamp, CaptureLength: len(data), Length: len(data)}, data)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func (w *captureWriter) writeRTP(timestamp time.Time, src net.IP, dst net.IP, dstPort int, seq int) {
+	w.writeRTPPacket(timestamp, src, dst, dstPort, &pionrtp.Packet{
+		Header:  pionrtp.Header{Version: 2, PayloadType: 0, SequenceNumber: uint16(seq), Timestamp: uint32(seq * 160)},
+		Payload: make([]byte, 160),
+	})
+}
+
+func (w *captureWriter) writeRTPPacket(timestamp time.Time, src net.IP, dst net.IP, dstPort int, packet *pionrtp.Packet) {
+	data, err := packet.Marshal()
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	w.writeUDP(timestamp, src, 30000, dst, dstPort, data)
+}
+
+func recordCapture(t *testing.T, capture *captureWriter) []*models.UploadRecord {
+	reader, err := pcapgo.NewReader(bytes.NewReader(capture.buffer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([]*models.UploadRecord, 0)
+	recorder, err := NewPassiveRecorder(reader, reader.LinkType(), &RecorderOptions{
+		OutputDirectory: t.TempDir(),
+		OnRecordingFinished: func(record *models.UploadRecord) {
+			records = append(records, record)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recorder.ListenAndRecord(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func TestRecordCapture(t *testing.T) {
+	begin := time.Date(2023, 5, 4, 12, 0, 0, 0, time.UTC)
+	end := begin.Add(10 * time.Second)
+
+	capture := newCaptureWriter(t)
+	capture.writeUDP(begin, callerIP, 5060, calleeIP, 5060, captureInvite)
+	capture.writeUDP(begin.Add(time.Second), calleeIP, 5060, callerIP, 5060, captureOK)
+	for i := 0; i < 50; i++ {
+		ts := begin.Add(time.Second + time.Duration(i)*20*time.Millisecond)
+		capture.writeRTP(ts, callerIP, calleeIP, 20000, i)
+		capture.writeRTP(ts, calleeIP, callerIP, 10000, i)
+	}
+	capture.writeUDP(end, callerIP, 5060, calleeIP, 5060, captureBye)
+
+	records := recordCapture(t, capture)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(records))
+	}
+
+	record := records[0]
+	if !record.Begin.Equal(begin) || !record.End.Equal(end) {
+		t.Logf("recording from %s to %s\n", record.Begin, record.End)
+		t.Fail()
+	}
+	if record.CallerNumber != "100" || record.CalleeNumber != "4711" {
+		t.Logf("recording from <%s> to <%s>\n", record.CallerNumber, record.CalleeNumber)
+		t.Fail()
+	}
+
+	info, err := os.Stat(record.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WAV header plus 50 packets of 160 stereo 16 bit samples
+	if info.Size() != 44+50*160*2*2 {
+		t.Logf("Recording has %d bytes\n", info.Size())
+		t.Fail()
+	}
+}
+
+func TestRecordCaptureEndsMidCall(t *testing.T) {
+	begin := time.Date(2023, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	capture := newCaptureWriter(t)
+	capture.writeUDP(begin, callerIP, 5060, calleeIP, 5060, captureInvite)
+	capture.writeUDP(begin.Add(time.Second), calleeIP, 5060, callerIP, 5060, captureOK)
+	last := begin.Add(time.Second)
+	for i := 0; i < 10; i++ {
+		last = begin.Add(time.Second + time.Duration(i)*20*time.Millisecond)
+		capture.writeRTP(last, callerIP, calleeIP, 20000, i)
+	}
+
+	records := recordCapture(t, capture)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(records))
+	}
+
+	if !records[0].End.Equal(last) {
+		t.Logf("recording ended at %s, expected %s\n", records[0].End, last)
+		t.Fail()
+	}
+}
+
+func TestRecordCaptureDTMF(t *testing.T) {
+	begin := time.Date(2023, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	capture := newCaptureWriter(t)
+	capture.writeUDP(begin, callerIP, 5060, calleeIP, 5060, captureInvite)
+	capture.writeUDP(begin.Add(time.Second), calleeIP, 5060, callerIP, 5060, captureOK)
+
+	seq := 0
+	for i := 0; i < 50; i++ {
+		ts := begin.Add(time.Second + time.Duration(i)*20*time.Millisecond)
+		capture.writeRTPPacket(ts, callerIP, calleeIP, 20000, &pionrtp.Packet{
+			Header:  pionrtp.Header{Version: 2, PayloadType: 0, SequenceNumber: uint16(seq), Timestamp: uint32(i * 160)},
+			Payload: make([]byte, 160),
+		})
+		seq++
+
+		if i == 25 {
+			// Digit 5 for 60ms, the last packet ends the event
+			for _, payload := range [][]byte{{5, 10, 0, 160}, {5, 10, 1, 64}, {5, 0x8a, 1, 224}} {
+				capture.writeRTPPacket(ts, callerIP, calleeIP, 20000, &pionrtp.Packet{
+					Header:  pionrtp.Header{Version: 2, PayloadType: 101, SequenceNumber: uint16(seq), Timestamp: uint32(i * 160)},
+					Payload: payload,
+				})
+				seq++
+			}
+		}
+	}
+	capture.writeUDP(begin.Add(3*time.Second), callerIP, 5060, calleeIP, 5060, captureBye)
+
+	records := recordCapture(t, capture)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(records))
+	}
+
+	expected := `[{"digit":"5","channel":1,"offset_ms":500,"duration_ms":60}]`
+	if records[0].DTMFEvents != expected {
+		t.Logf("expected %s, got %s\n", expected, records[0].DTMFEvents)
+		t.Fail()
+	}
+}
+
+var captureOptions = []byte("OPTIONS sip:4711@192.0.2.2 SIP/2.0\r\n" +
+	"Via: SIP/2.0/TCP 192.0.2.1:5060;branch=z9hG4bK-3\r\n" +
+	"From: <sip:100@192.0.2.1>;tag=c3\r\n" +
+	"To: <sip:4711@192.0.2.2>\r\n" +
+	"Call-ID: options-1@192.0.2.1\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"l: 0\r\n" +
+	"\r\n")
+
+func TestRecordCaptureSIPOverTCP(t *testing.T) {
+	begin := time.Date(2023, 5, 4, 12, 0, 0, 0, time.UTC)
+	end := begin.Add(10 * time.Second)
+
+	// The caller's connection starts in the middle of a message we did not see completely
+	callerSeq := uint32(1000)
+	garbage := []byte("a=sendrecv\r\n\r\n")
+	invite := []byte(strings.Replace(string(captureInvite), "UDP", "TCP", 1))
+	pipelined := append(append([]byte("\r\n\r\n"), captureOptions...), captureBye...)
+
+	capture := newCaptureWriter(t)
+	capture.writeTCP(begin.Add(-time.Second), callerIP, 40000, calleeIP, 5060, callerSeq, garbage)
+	callerSeq += uint32(len(garbage))
+
+	// The INVITE is split across two segments which arrive out of order
+	capture.writeTCP(begin, callerIP, 40000, calleeIP, 5060, callerSeq+100, invite[100:])
+	capture.writeTCP(begin, callerIP, 40000, calleeIP, 5060, callerSeq, invite[:100])
+	callerSeq += uint32(len(invite))
+
+	capture.writeTCP(begin.Add(time.Second), calleeIP, 5060, callerIP, 40000, 5000, captureOK)
+	for i := 0; i < 50; i++ {
+		ts := begin.Add(time.Second + time.Duration(i)*20*time.Millisecond)
+		capture.writeRTP(ts, callerIP, calleeIP, 20000, i)
+		capture.writeRTP(ts, calleeIP, callerIP, 10000, i)
+	}
+
+	// Keep-alive, an unrelated request and the BYE in a single segment
+	capture.writeTCP(end, callerIP, 40000, calleeIP, 5060, callerSeq, pipelined)
+
+	records := recordCapture(t, capture)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(records))
+	}
+
+	record := records[0]
+	if !record.Begin.Equal(begin) || !record.End.Equal(end) {
+		t.Logf("recording from %s to %s\n", record.Begin, record.End)
+		t.Fail()
+	}
+
+	info, err := os.Stat(record.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 44+50*160*2*2 {
+		t.Logf("Recording has %d bytes\n", info.Size())
+		t.Fail()
+	}
+}
+
+func TestSIPParty(t *testing.T) {
+	for header, expected := range map[string][2]string{
+		"<sip:100@192.0.2.1>;tag=a1":                      {"", "100"},
+		`"Dispatch 1" <sip:4711@192.0.2.2;transport=tcp>`: {"Dispatch 1", "4711"},
+		"Caller <tel:+4989123;phone-context=example>":     {"Caller", "+4989123"},
+		"sip:4711@192.0.2.2;tag=b2":                       {"", "4711"},
+		"anonymous":                                       {"", ""},
+	} {
+		name, number := sipParty(header)
+		if name != expected[0] || number != expected[1] {
+			t.Errorf("sipParty(%q) = %q, %q, expected %q, %q", header, name, number, expected[0], expected[1])
+		}
+	}
+}
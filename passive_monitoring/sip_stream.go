@@ -0,0 +1,217 @@
+package passive_monitoring
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	// Upper limit for a single SIP message on a stream transport
+	maxSIPMessageSize = 65535
+
+	// Out-of-order segments buffered per connection before the assembler gives up on a gap
+	maxBufferedPagesPerConnection = 64
+
+	// Gaps in a TCP stream that have not been filled after this time (in packet time) are skipped
+	tcpFlushTimeout = 2 * time.Minute
+)
+
+// captureContext passes the capture time of a packet into the assembler
+type captureContext gopacket.CaptureInfo
+
+func (c *captureContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return gopacket.CaptureInfo(*c)
+}
+
+// sipStreamFactory creates a sipStream for each TCP connection carrying SIP
+type sipStreamFactory struct {
+	recorder *passiveRecorder
+}
+
+func (f *sipStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
+	stream := &sipStream{
+		recorder: f.recorder,
+	}
+	stream.halves[0].flow = fmt.Sprintf("%s:%s", netFlow, tcpFlow)
+	stream.halves[1].flow = fmt.Sprintf("%s:%s", netFlow.Reverse(), tcpFlow.Reverse())
+
+	// We can't tell where a message starts until we see a start line
+	stream.halves[0].synchronizing = true
+	stream.halves[1].synchronizing = true
+
+	return stream
+}
+
+// sipStream splits the reassembled bytes of a TCP connection into
+// SIP messages (RFC 3261 section 18.3) and hands them to the recorder
+type sipStream struct {
+	recorder *passiveRecorder
+	halves   [2]sipStreamHalf
+}
+
+// sipStreamHalf is one direction of a sipStream
+type sipStreamHalf struct {
+	flow   string
+	buffer []byte
+
+	// Set while looking for the start of the next message, e.g. after data was lost
+	synchronizing bool
+}
+
+func (s *sipStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	// SIP connections are long lived and usually established before the capture
+	// was started, so start reassembling without having seen the handshake
+	*start = true
+	return true
+}
+
+func (s *sipStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, _, skip := sg.Info()
+	half := &s.halves[0]
+	if dir == reassembly.TCPDirServerToClient {
+		half = &s.halves[1]
+	}
+
+	if skip != 0 {
+		// Data was lost, whatever is buffered can't be completed anymore
+		half.buffer = half.buffer[:0]
+		half.synchronizing = true
+	}
+
+	length, _ := sg.Lengths()
+	half.buffer = append(half.buffer, sg.Fetch(length)...)
+
+	for _, sip := range half.parse() {
+		s.recorder.handleSIP(sip, ac.GetCaptureInfo().Timestamp)
+	}
+}
+
+func (s *sipStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	return true
+}
+
+// parse extracts all complete messages from the buffer
+func (h *sipStreamHalf) parse() []*layers.SIP {
+	messages := make([]*layers.SIP, 0)
+
+	for {
+		if h.synchronizing {
+			start := findStartLine(h.buffer)
+			if start < 0 {
+				// Only keep the last, possibly incomplete line
+				if i := bytes.LastIndexByte(h.buffer, '\n'); i >= 0 {
+					h.buffer = append(h.buffer[:0], h.buffer[i+1:]...)
+				}
+				return messages
+			}
+			h.buffer = append(h.buffer[:0], h.buffer[start:]...)
+			h.synchronizing = false
+		}
+
+		// Skip keep-alive CRLFs between messages (RFC 5626)
+		if trimmed := bytes.TrimLeft(h.buffer, "\r\n"); len(trimmed) != len(h.buffer) {
+			h.buffer = append(h.buffer[:0], trimmed...)
+		}
+
+		length, err := sipMessageLength(h.buffer)
+		if err != nil {
+			log.Printf("ERROR: Invalid SIP message on %s: %s\n", h.flow, err)
+			// Drop the start line of the broken message and look for the next one
+			if i := bytes.IndexByte(h.buffer, '\n'); i >= 0 {
+				h.buffer = append(h.buffer[:0], h.buffer[i+1:]...)
+			} else {
+				h.buffer = h.buffer[:0]
+			}
+			h.synchronizing = true
+			continue
+		}
+		if length == 0 {
+			// Wait for more data
+			return messages
+		}
+
+		message := make([]byte, length)
+		copy(message, h.buffer)
+		h.buffer = append(h.buffer[:0], h.buffer[length:]...)
+
+		sip := layers.NewSIP()
+		err = sip.DecodeFromBytes(message, gopacket.NilDecodeFeedback)
+		if err != nil {
+			log.Printf("ERROR: Failed to decode SIP message on %s: %s\n", h.flow, err)
+			continue
+		}
+
+		messages = append(messages, sip)
+	}
+}
+
+// sipMessageLength returns the length of the message at the start of data including its body,
+// or 0 if data does not contain the complete message yet
+func sipMessageLength(data []byte) (int, error) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		if len(data) > maxSIPMessageSize {
+			return 0, fmt.Errorf("no end of headers within %d bytes", maxSIPMessageSize)
+		}
+		return 0, nil
+	}
+
+	// Content-Length is mandatory on stream transports
+	contentLength := 0
+	for _, line := range strings.Split(string(data[:headerEnd]), "\r\n")[1:] {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "content-length" || name == "l" {
+				length, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil || length < 0 {
+					return 0, fmt.Errorf("invalid Content-Length: %s", value)
+				}
+				contentLength = length
+			}
+		}
+	}
+
+	length := headerEnd + 4 + contentLength
+	if length > maxSIPMessageSize {
+		return 0, fmt.Errorf("message exceeds %d bytes", maxSIPMessageSize)
+	}
+	if len(data) < length {
+		return 0, nil
+	}
+
+	return length, nil
+}
+
+// findStartLine returns the offset of the first complete line in data that is a SIP
+// request or status line, or -1 if there is none
+func findStartLine(data []byte) int {
+	offset := 0
+	for {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			return -1
+		}
+
+		if isStartLine(strings.TrimRight(string(data[offset:offset+end]), "\r")) {
+			return offset
+		}
+		offset += end + 1
+	}
+}
+
+func isStartLine(line string) bool {
+	if strings.HasPrefix(line, "SIP/2.0 ") {
+		return true
+	}
+
+	fields := strings.Fields(line)
+	return len(fields) == 3 && fields[2] == "SIP/2.0"
+}
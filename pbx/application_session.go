@@ -0,0 +1,99 @@
+package pbx
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+)
+
+// ApplicationSession is the application session a driver starts on each of its CSTA connections
+type ApplicationSession struct {
+	ApplicationID           string
+	ApplicationSpecificInfo interface{} // e.g. the login of the driver
+	ProtocolVersion         string
+}
+
+// Start starts the application session on a connection and waits for the switching
+// function to accept it, it returns the session ID
+func (s *ApplicationSession) Start(conn csta.Conn) (string, error) {
+	responses := make(chan *csta.Context, 1)
+	err := conn.StartApplicationSession(s.ApplicationID, s.ApplicationSpecificInfo, s.ProtocolVersion, func(c *csta.Context) {
+		responses <- c
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to start the application session: %w", err)
+	}
+
+	c := <-responses
+	if c.Error != nil {
+		return "", fmt.Errorf("failed to start the application session: %w", c.Error)
+	}
+	response, ok := c.Message.(*csta.StartApplicationSessionPosResponse)
+	if !ok {
+		return "", fmt.Errorf("failed to start the application session: unexpected response %s", c.Message.Type())
+	}
+
+	return response.SessionID, nil
+}
+
+// Stop ends an application session, the connection stays open
+func (s *ApplicationSession) Stop(ctx context.Context, conn csta.Conn, sessionID string, reason string) error {
+	_, err := conn.Do(ctx, csta.StopApplicationSession{
+		SessionID:        sessionID,
+		SessionEndReason: reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop the application session: %w", err)
+	}
+	return nil
+}
+
+// KeepAlive resets the timer of an application session every interval to prevent the session
+// from expiring, until the connection is closed or ctx is done. A rejected reset means the
+// session is gone, the connection is closed so that the driver reconnects.
+func (s *ApplicationSession) KeepAlive(ctx context.Context, conn csta.Conn, sessionID string, interval time.Duration) {
+	timer := time.NewTicker(interval)
+	defer timer.Stop()
+
+	// The session has to outlast the interval in case a reset is late
+	duration := uint(60)
+	if seconds := uint(2 * interval / time.Second); seconds > duration {
+		duration = seconds
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			conn.Request(csta.ResetApplicationSessionTimer{
+				SessionID:                sessionID,
+				RequestedSessionDuration: duration,
+			}, func(c *csta.Context) {
+				if c.Error != nil {
+					log.Printf("Failed to reset the application session timer: %s\n", c.Error)
+				} else if c.Message.Type() == csta.MessageTypeResetApplicationSessionTimerNegResponse {
+					log.Printf("Failed to reset the application session timer: rejected by the switch, closing the connection\n")
+					conn.Close()
+				}
+			})
+		case <-conn.Closed():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops the application session if the connection is still up and closes the connection
+func (s *ApplicationSession) Close(conn csta.Conn, sessionID string) error {
+	if conn.State() == csta.ConnectionStateActive {
+		err := s.Stop(context.Background(), conn, sessionID, "Application Shutdown")
+		if err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+
+	return conn.Close()
+}
@@ -0,0 +1,237 @@
+// Package ami implements a client of the Asterisk Manager Interface, a line based
+// TCP protocol that reports channel events and accepts actions.
+package ami
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEventBufferSize = 100
+
+// Message is an action, response or event, a block of "Key: Value" lines ended by an empty line
+type Message map[string]string
+
+// Event returns the name of an event, or an empty string for responses
+func (m Message) Event() string {
+	return m["Event"]
+}
+
+// ReadMessage reads the next message, keys that occur more than once keep their last value
+func ReadMessage(r *bufio.Reader) (Message, error) {
+	m := make(Message)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && len(m) > 0 {
+				return m, nil
+			}
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(m) == 0 {
+				// Blank lines between messages
+				continue
+			}
+			return m, nil
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed AMI line %q", line)
+		}
+		m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+}
+
+// WriteMessage writes a message, Action, Response and Event come first as AMI requires
+func WriteMessage(w io.Writer, m Message) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if key != "Action" && key != "Response" && key != "Event" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range []string{"Action", "Response", "Event"} {
+		if value, ok := m[key]; ok {
+			fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+		}
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, m[key])
+	}
+	b.WriteString("\r\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Conn is a connection to the Asterisk Manager Interface
+type Conn struct {
+	conn   net.Conn
+	events chan Message
+	closed chan struct{}
+
+	mutex     sync.Mutex // Guards writes, actionID and pending
+	actionID  int
+	pending   map[string]chan Message
+	closeOnce sync.Once
+}
+
+// Dial connects to the manager interface and reads its greeting
+func Dial(address string, timeout time.Duration) (*Conn, error) {
+	netConn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to AMI <%s>: %w", address, err)
+	}
+
+	reader := bufio.NewReader(netConn)
+	netConn.SetReadDeadline(time.Now().Add(timeout))
+	greeting, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(greeting, "Asterisk Call Manager") {
+		netConn.Close()
+		return nil, fmt.Errorf("unexpected AMI greeting %q: %v", greeting, err)
+	}
+	netConn.SetReadDeadline(time.Time{})
+
+	c := &Conn{
+		conn:    netConn,
+		events:  make(chan Message, defaultEventBufferSize),
+		closed:  make(chan struct{}),
+		pending: make(map[string]chan Message),
+	}
+	go c.read(reader)
+
+	return c, nil
+}
+
+// Login authenticates the connection, only call events are subscribed
+func (c *Conn) Login(ctx context.Context, username string, secret string) error {
+	_, err := c.Do(ctx, Message{
+		"Action":   "Login",
+		"Username": username,
+		"Secret":   secret,
+		"Events":   "call",
+	})
+	return err
+}
+
+// Do sends an action and waits for its response, error responses are returned as errors
+func (c *Conn) Do(ctx context.Context, action Message) (Message, error) {
+	response := make(chan Message, 1)
+
+	c.mutex.Lock()
+	c.actionID++
+	actionID := strconv.Itoa(c.actionID)
+	c.pending[actionID] = response
+
+	m := make(Message, len(action)+1)
+	for key, value := range action {
+		m[key] = value
+	}
+	m["ActionID"] = actionID
+	err := WriteMessage(c.conn, m)
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, actionID)
+		c.mutex.Unlock()
+	}()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to send AMI action %s: %w", action["Action"], err)
+	}
+
+	select {
+	case r := <-response:
+		if r["Response"] == "Error" {
+			return r, fmt.Errorf("AMI action %s failed: %s", action["Action"], r["Message"])
+		}
+		return r, nil
+	case <-c.closed:
+		return nil, fmt.Errorf("AMI connection closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Events returns the channel that receives all events in the order they were sent
+func (c *Conn) Events() <-chan Message {
+	return c.events
+}
+
+// Closed is closed when the connection is lost or closed
+func (c *Conn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Close logs off and closes the connection
+func (c *Conn) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	c.Do(ctx, Message{"Action": "Logoff"})
+	cancel()
+
+	c.close()
+	return nil
+}
+
+func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		log.Printf("Closing AMI connection\n")
+		c.conn.Close()
+		close(c.closed)
+	})
+}
+
+// read passes responses to the actions waiting for them and queues events
+func (c *Conn) read(reader *bufio.Reader) {
+	defer c.close()
+
+	for {
+		m, err := ReadMessage(reader)
+		if err != nil {
+			return
+		}
+
+		if _, ok := m["Response"]; ok {
+			c.mutex.Lock()
+			response, ok := c.pending[m["ActionID"]]
+			c.mutex.Unlock()
+			if ok {
+				response <- m
+			}
+			continue
+		}
+
+		if m.Event() == "" {
+			continue
+		}
+
+		select {
+		case c.events <- m:
+		case <-c.closed:
+			return
+		}
+	}
+}
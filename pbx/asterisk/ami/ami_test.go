@@ -0,0 +1,46 @@
+package ami
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("\r\nEvent: Hangup\r\nChannel: PJSIP/4711-00000002\r\nAccountCode: \r\nCause-txt: Normal Clearing\r\n\r\nResponse: Success\r\nActionID: 1\r\n\r\n"))
+
+	m, err := ReadMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Event() != "Hangup" || m["Channel"] != "PJSIP/4711-00000002" || m["AccountCode"] != "" || m["Cause-txt"] != "Normal Clearing" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	m, err = ReadMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Event() != "" || m["Response"] != "Success" || m["ActionID"] != "1" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	_, err = ReadMessage(bufio.NewReader(strings.NewReader("Event Hangup\r\n\r\n")))
+	if err == nil {
+		t.Fatal("malformed line accepted")
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	var b bytes.Buffer
+	err := WriteMessage(&b, Message{"Secret": "secret", "Username": "recording", "Action": "Login", "ActionID": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Action: Login\r\nActionID: 1\r\nSecret: secret\r\nUsername: recording\r\n\r\n"
+	if b.String() != expected {
+		t.Fatalf("unexpected message %q", b.String())
+	}
+}
@@ -0,0 +1,242 @@
+// Package ari implements the parts of the Asterisk REST Interface that are needed to
+// get the media of calls, snoop channels and external media channels joined by a bridge.
+package ari
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const defaultRequestTimeout = 10 * time.Second
+
+type Channel struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+type Bridge struct {
+	ID         string `json:"id"`
+	BridgeType string `json:"bridge_type"`
+}
+
+// Client sends requests to the REST interface of an Asterisk server, e.g. http://pbx:8088/ari.
+// Channels it creates are placed in its Stasis application.
+type Client struct {
+	baseURL     string
+	username    string
+	password    string
+	application string
+	http        *http.Client
+}
+
+func NewClient(baseURL string, username string, password string, application string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		username:    username,
+		password:    password,
+		application: application,
+		http:        &http.Client{Timeout: defaultRequestTimeout},
+	}
+}
+
+// Snoop creates a channel that receives the media a channel sends and receives
+func (c *Client) Snoop(ctx context.Context, channelID string) (*Channel, error) {
+	channel := &Channel{}
+	err := c.request(ctx, http.MethodPost, "/channels/"+url.PathEscape(channelID)+"/snoop", url.Values{
+		"spy": {"both"},
+		"app": {c.application},
+	}, channel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snoop on channel <%s>: %w", channelID, err)
+	}
+	return channel, nil
+}
+
+// ExternalMedia creates a channel that sends its media over RTP to host, e.g. 192.168.1.10:40000
+func (c *Client) ExternalMedia(ctx context.Context, host string, format string) (*Channel, error) {
+	channel := &Channel{}
+	err := c.request(ctx, http.MethodPost, "/channels/externalMedia", url.Values{
+		"app":           {c.application},
+		"external_host": {host},
+		"format":        {format},
+		"encapsulation": {"rtp"},
+		"transport":     {"udp"},
+	}, channel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create external media channel to <%s>: %w", host, err)
+	}
+	return channel, nil
+}
+
+// CreateBridge creates a bridge that mixes the media of its channels
+func (c *Client) CreateBridge(ctx context.Context) (*Bridge, error) {
+	bridge := &Bridge{}
+	err := c.request(ctx, http.MethodPost, "/bridges", url.Values{"type": {"mixing"}}, bridge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bridge: %w", err)
+	}
+	return bridge, nil
+}
+
+// AddChannels adds channels to a bridge
+func (c *Client) AddChannels(ctx context.Context, bridgeID string, channelIDs ...string) error {
+	err := c.request(ctx, http.MethodPost, "/bridges/"+url.PathEscape(bridgeID)+"/addChannel", url.Values{
+		"channel": {strings.Join(channelIDs, ",")},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to add channels to bridge <%s>: %w", bridgeID, err)
+	}
+	return nil
+}
+
+// Hangup hangs up a channel, channels that are gone already are ignored
+func (c *Client) Hangup(ctx context.Context, channelID string) error {
+	err := c.request(ctx, http.MethodDelete, "/channels/"+url.PathEscape(channelID), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to hang up channel <%s>: %w", channelID, err)
+	}
+	return nil
+}
+
+// DestroyBridge shuts a bridge down, bridges that are gone already are ignored
+func (c *Client) DestroyBridge(ctx context.Context, bridgeID string) error {
+	err := c.request(ctx, http.MethodDelete, "/bridges/"+url.PathEscape(bridgeID), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to destroy bridge <%s>: %w", bridgeID, err)
+	}
+	return nil
+}
+
+// StatusError is returned for requests Asterisk didn't accept
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("ARI responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	statusError, ok := err.(*StatusError)
+	return ok && statusError.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) request(ctx context.Context, method string, path string, query url.Values, result interface{}) error {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(c.username, c.password)
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		statusError := &StatusError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(body))}
+
+		var message struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &message) == nil && message.Message != "" {
+			statusError.Message = message.Message
+		}
+		return statusError
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// Events is the websocket that registers the Stasis application with Asterisk, channels
+// can only be placed in an application while it is connected
+type Events struct {
+	conn      *websocket.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Connect connects the event websocket of the application
+func (c *Client) Connect() (*Events, error) {
+	u, err := url.Parse(c.baseURL + "/events")
+	if err != nil {
+		return nil, err
+	}
+	origin := *u
+	origin.Path = "/"
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.RawQuery = url.Values{
+		"app":     {c.application},
+		"api_key": {c.username + ":" + c.password},
+	}.Encode()
+
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: defaultRequestTimeout}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect the ARI application %s: %w", c.application, err)
+	}
+
+	events := &Events{conn: conn, closed: make(chan struct{})}
+	go events.read()
+	return events, nil
+}
+
+// read discards the events, the calls are followed by the manager interface
+func (e *Events) read() {
+	defer e.Close()
+
+	for {
+		var message []byte
+		if err := websocket.Message.Receive(e.conn, &message); err != nil {
+			return
+		}
+	}
+}
+
+// Closed is closed when the websocket is lost or closed
+func (e *Events) Closed() <-chan struct{} {
+	return e.closed
+}
+
+func (e *Events) Close() error {
+	e.closeOnce.Do(func() {
+		log.Printf("Closing ARI event websocket\n")
+		e.conn.Close()
+		close(e.closed)
+	})
+	return nil
+}
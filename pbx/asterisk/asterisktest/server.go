@@ -0,0 +1,344 @@
+// Package asterisktest provides a fake Asterisk server for testing the Asterisk integration
+// without access to a real PBX. It accepts manager interface connections, replays event
+// sequences to them and answers the REST interface requests needed for recording.
+package asterisktest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/asterisk/ami"
+	"golang.org/x/net/websocket"
+)
+
+// Request is a request received by the REST interface
+type Request struct {
+	Method string
+	Path   string // Without the /ari prefix, e.g. /bridges
+	Query  url.Values
+}
+
+// Server is a fake Asterisk server listening on local ports. All manager actions and
+// REST requests are recorded so that tests can check what was sent.
+type Server struct {
+	listener net.Listener
+	ari      *httptest.Server
+
+	mutex        sync.Mutex
+	changed      chan struct{} // Closed and replaced whenever something was received or connected
+	conns        map[net.Conn]bool
+	applications map[*websocket.Conn]bool
+	actions      []ami.Message
+	requests     []Request
+	channels     int
+	bridges      int
+	closed       bool
+	waitGroup    sync.WaitGroup
+}
+
+// NewServer starts a Server, it accepts every login and creates the snoop channels,
+// external media channels and bridges it is asked for
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		listener:     listener,
+		changed:      make(chan struct{}),
+		conns:        make(map[net.Conn]bool),
+		applications: make(map[*websocket.Conn]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/ari/events", websocket.Handler(s.application))
+	mux.HandleFunc("/ari/", s.rest)
+	s.ari = httptest.NewServer(mux)
+
+	s.waitGroup.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// AMIAddr returns the address the manager interface listens on
+func (s *Server) AMIAddr() string {
+	return s.listener.Addr().String()
+}
+
+// ARIURL returns the base URL of the REST interface
+func (s *Server) ARIURL() string {
+	return s.ari.URL + "/ari"
+}
+
+// Send pushes an event to all connected manager interface clients
+func (s *Server) Send(event ami.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.conns) == 0 {
+		return fmt.Errorf("no client connected")
+	}
+
+	for conn := range s.conns {
+		err := ami.WriteMessage(conn, event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay sends the events of a recorded sequence, blocks of "Key: Value" lines as
+// Asterisk sends them
+func (s *Server) Replay(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for {
+		event, err := ami.ReadMessage(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.Send(event); err != nil {
+			return err
+		}
+	}
+}
+
+// Actions returns the manager actions of a type received so far, e.g. Login
+func (s *Server) Actions(action string) []ami.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	actions := make([]ami.Message, 0)
+	for _, a := range s.actions {
+		if a["Action"] == action {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+// Requests returns the REST requests with a method to a path received so far
+func (s *Server) Requests(method string, path string) []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.matching(method, path)
+}
+
+// WaitForRequest waits until n requests with a method to a path were received and returns the nth
+func (s *Server) WaitForRequest(method string, path string, n int, timeout time.Duration) (Request, error) {
+	var request Request
+	err := s.wait(timeout, func() bool {
+		requests := s.matching(method, path)
+		if len(requests) < n {
+			return false
+		}
+		request = requests[n-1]
+		return true
+	})
+	if err != nil {
+		return Request{}, fmt.Errorf("%s %s wasn't received %d times: %w", method, path, n, err)
+	}
+	return request, nil
+}
+
+// WaitForApplications waits until n Stasis applications are connected to the event websocket
+func (s *Server) WaitForApplications(n int, timeout time.Duration) error {
+	return s.wait(timeout, func() bool {
+		return len(s.applications) == n
+	})
+}
+
+// Disconnect closes the connections of all clients, the Server keeps accepting new ones
+func (s *Server) Disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	for conn := range s.applications {
+		conn.Close()
+	}
+}
+
+// Close stops listening and disconnects all clients
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.Disconnect()
+	s.ari.Close()
+	s.waitGroup.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.waitGroup.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.notify()
+		s.mutex.Unlock()
+
+		s.waitGroup.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve answers the actions of one manager interface client until it disconnects
+func (s *Server) serve(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.notify()
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	s.mutex.Lock()
+	_, err := io.WriteString(conn, "Asterisk Call Manager/5.0.1\r\n")
+	s.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		action, err := ami.ReadMessage(reader)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.actions = append(s.actions, action)
+		s.notify()
+
+		response := ami.Message{"Response": "Success", "ActionID": action["ActionID"]}
+		switch action["Action"] {
+		case "Login":
+			response["Message"] = "Authentication accepted"
+		case "Logoff":
+			response["Response"] = "Goodbye"
+		}
+		ami.WriteMessage(conn, response)
+		s.mutex.Unlock()
+	}
+}
+
+// application keeps the event websocket of a Stasis application open until the client leaves
+func (s *Server) application(conn *websocket.Conn) {
+	s.mutex.Lock()
+	s.applications[conn] = true
+	s.notify()
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.applications, conn)
+		s.notify()
+		s.mutex.Unlock()
+	}()
+
+	var message []byte
+	for websocket.Message.Receive(conn, &message) == nil {
+	}
+}
+
+// rest answers the REST interface requests for snooping, external media and bridges
+func (s *Server) rest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/ari")
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: path, Query: r.URL.Query()})
+	s.notify()
+
+	var response string
+	switch {
+	case r.Method == http.MethodPost && path == "/channels/externalMedia":
+		s.channels++
+		response = fmt.Sprintf(`{"id":"media-%d","name":"UnicastRTP/%s-%d","state":"Up"}`, s.channels, r.URL.Query().Get("external_host"), s.channels)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/channels/") && strings.HasSuffix(path, "/snoop"):
+		s.channels++
+		response = fmt.Sprintf(`{"id":"snoop-%d","name":"Snoop/%s-%d","state":"Up"}`, s.channels, strings.Split(path, "/")[2], s.channels)
+	case r.Method == http.MethodPost && path == "/bridges":
+		s.bridges++
+		response = fmt.Sprintf(`{"id":"bridge-%d","bridge_type":"mixing"}`, s.bridges)
+	}
+	s.mutex.Unlock()
+
+	if response == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, response)
+}
+
+// matching returns the requests with a method to a path, the mutex must be held
+func (s *Server) matching(method string, path string) []Request {
+	requests := make([]Request, 0)
+	for _, r := range s.requests {
+		if r.Method == method && r.Path == path {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// notify wakes up everyone waiting for a change, the mutex must be held
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until condition, which is called with the mutex held, becomes true
+func (s *Server) wait(timeout time.Duration, condition func() bool) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mutex.Lock()
+		done := condition()
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+// Package asterisk records calls of Asterisk based PBXs, e.g. FreePBX. The channels of the
+// monitored extensions are followed through the events of the Asterisk Manager Interface,
+// their media is sent to the recorders by external media channels of the Asterisk REST Interface.
+package asterisk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/asterisk/ami"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/asterisk/ari"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("asterisk.ami_address", "127.0.0.1:5038")
+	viper.SetDefault("asterisk.ari_url", "http://127.0.0.1:8088/ari")
+	viper.SetDefault("asterisk.ari_application", "recording-agent")
+	viper.SetDefault("asterisk.media_format", "ulaw")
+	viper.SetDefault("asterisk.connect_timeout", 10*time.Second)
+}
+
+// Asterisk is configured in the asterisk section:
+//
+//	asterisk:
+//	  ami_address: freepbx.example.com:5038
+//	  ami_username: recording
+//	  ami_secret: secret
+//	  ari_url: http://freepbx.example.com:8088/ari
+//	  ari_username: recording
+//	  ari_password: secret
+//	  ari_application: recording-agent
+//	  media_address: 192.168.1.10  # address Asterisk sends the media to, default: rtp.recorder_address
+//	  media_format: ulaw
+type Asterisk struct {
+	ctx           context.Context
+	ami           *ami.Conn
+	ari           *ari.Client
+	application   *ari.Events
+	done          chan struct{} // Closed when the events of the connection are handled
+	monitorPoints pbx.MonitorPoints
+	mutex         sync.Mutex // Guards recorderPool, which the event handler reads
+	recorderPool  rtp.RecorderPool
+	tracker       *pbx.CallTracker
+
+	// Only accessed by the event handler
+	channels   map[string]*channel   // By unique ID
+	recordings map[string]*recording // By unique ID of the recorded channel
+
+	// OnRecordingFinished is called with each finished recording,
+	// the default queues the recording for upload
+	OnRecordingFinished func(record *models.UploadRecord)
+}
+
+// channel is a leg of a call in Asterisk, the calls are identified by the linked ID of their channels
+type channel struct {
+	uniqueID         string
+	linkedID         string
+	name             string
+	callerIDNum      string
+	connectedLineNum string
+	exten            string
+	connected        bool // Reported as established to the monitor point
+}
+
+type recording struct {
+	recorder rtp.Recorder
+	filePath string
+	snoopID  string
+	mediaID  string
+	bridgeID string
+	call     pbx.Call // Snapshot for calls the tracker forgot when the recording stops
+}
+
+func (a *Asterisk) SetContext(ctx context.Context) {
+	a.ctx = ctx
+}
+
+// Connect logs in to the manager interface and connects the Stasis application. Asterisk
+// isn't controlled through CSTA, the returned connection is always nil.
+func (a *Asterisk) Connect() (csta.Conn, error) {
+	amiConn, err := ami.Dial(viper.GetString("asterisk.ami_address"), viper.GetDuration("asterisk.connect_timeout"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = amiConn.Login(a.ctx, viper.GetString("asterisk.ami_username"), viper.GetString("asterisk.ami_secret"))
+	if err != nil {
+		amiConn.Close()
+		return nil, err
+	}
+
+	client := ari.NewClient(viper.GetString("asterisk.ari_url"), viper.GetString("asterisk.ari_username"),
+		viper.GetString("asterisk.ari_password"), viper.GetString("asterisk.ari_application"))
+	application, err := client.Connect()
+	if err != nil {
+		amiConn.Close()
+		return nil, err
+	}
+	log.Printf("Connected to Asterisk at <%s>\n", viper.GetString("asterisk.ami_address"))
+
+	// Channels of a previous connection are unknown, they are recorded from the next call on
+	a.monitorPoints.Reset()
+
+	if a.tracker == nil {
+		a.tracker = pbx.NewCallTracker()
+	} else {
+		a.tracker.Reset()
+	}
+
+	a.ami = amiConn
+	a.ari = client
+	a.application = application
+	a.channels = make(map[string]*channel)
+	a.recordings = make(map[string]*recording)
+	a.done = make(chan struct{})
+	go a.handleEvents(amiConn, application, a.done)
+
+	return nil, nil
+}
+
+func (a *Asterisk) ConnectionState() pbx.ConnectionState {
+	if a.ami == nil {
+		return pbx.ConnectionStateDisconnected
+	}
+
+	select {
+	case <-a.done:
+		return pbx.ConnectionStateDisconnected
+	default:
+		return pbx.ConnectionStateConnected
+	}
+}
+
+// Close logs off, the recordings going on are finished
+func (a *Asterisk) Close() error {
+	if a.ami == nil {
+		return nil
+	}
+
+	a.ami.Close()
+	a.application.Close()
+	<-a.done
+	return nil
+}
+
+// MonitorStart follows the channels of an extension, Asterisk reports the events of all
+// channels so the extension is its own cross reference ID
+func (a *Asterisk) MonitorStart(extension string) (pbx.MonitorPoint, error) {
+	mp := pbx.NewDeviceMonitorPoint(extension, pbx.MonitoredDevice{Extension: extension})
+	a.monitorPoints.Add(mp)
+	a.tracker.Monitor(extension, extension)
+
+	log.Printf("Monitoring <%s>\n", extension)
+
+	return mp, nil
+}
+
+func (a *Asterisk) Serve(recorderPool rtp.RecorderPool) error {
+	defer a.Close()
+	log.Printf("Handling PBX connection\n")
+
+	a.mutex.Lock()
+	a.recorderPool = recorderPool
+	a.mutex.Unlock()
+
+	// Get access to the persistence layer
+	db, err := models.NewDatabase()
+	if err != nil {
+		return err
+	}
+
+	monitoredDevices := db.GetMonitoredDevices()
+	log.Printf("%d devices are configured to be monitored\n", len(monitoredDevices))
+
+	for _, d := range monitoredDevices {
+		mp, err := a.MonitorStart(d.Extension)
+		if err != nil {
+			log.Printf("Failed to start monitoring <%s>: %s", d.Extension, err)
+			continue
+		}
+
+		d.CrossReferenceID = mp.CrossReferenceID()
+		db.Save(d)
+	}
+
+	// Events are handled in the background, wait for anything to fail/end
+	select {
+	case <-a.ctx.Done():
+		return nil
+	case <-a.done:
+		return io.EOF
+	}
+}
+
+// handleEvents handles the events of a connection in order until it is lost, the Stasis
+// application is needed for recording so losing it closes the connection as well
+func (a *Asterisk) handleEvents(amiConn *ami.Conn, application *ari.Events, done chan struct{}) {
+	defer close(done)
+	defer a.stopAllRecordings()
+
+	for {
+		select {
+		case event := <-amiConn.Events():
+			a.handleEvent(event)
+		case <-amiConn.Closed():
+			application.Close()
+			return
+		case <-application.Closed():
+			log.Printf("Lost the ARI application, closing the AMI connection\n")
+			amiConn.Close()
+			return
+		}
+	}
+}
+
+func (a *Asterisk) handleEvent(event ami.Message) {
+	uniqueID := event["Uniqueid"]
+
+	switch event.Event() {
+	case "Newchannel":
+		a.channels[uniqueID] = &channel{
+			uniqueID: uniqueID,
+			linkedID: event["Linkedid"],
+			name:     event["Channel"],
+			exten:    event["Exten"],
+		}
+		a.updateChannel(event)
+
+	// A channel that moves to another bridge, e.g. on a transfer, is still in its call
+	// and keeps being recorded with the snoop channel
+	case "Newstate", "NewCallerid", "NewConnectedLine", "DialBegin", "BridgeLeave":
+		a.updateChannel(event)
+
+	case "BridgeEnter":
+		if ch := a.updateChannel(event); ch != nil {
+			a.established(ch)
+		}
+
+	case "Hangup":
+		if ch := a.updateChannel(event); ch != nil {
+			a.cleared(ch)
+			delete(a.channels, uniqueID)
+		}
+	}
+}
+
+// updateChannel takes the caller ID and connected line of a channel from an event
+func (a *Asterisk) updateChannel(event ami.Message) *channel {
+	ch, ok := a.channels[event["Uniqueid"]]
+	if !ok {
+		return nil
+	}
+
+	if number := event["CallerIDNum"]; number != "" && number != "<unknown>" {
+		ch.callerIDNum = number
+	}
+	if number := event["ConnectedLineNum"]; number != "" && number != "<unknown>" {
+		ch.connectedLineNum = number
+	}
+	if linkedID := event["Linkedid"]; linkedID != "" {
+		ch.linkedID = linkedID
+	}
+	return ch
+}
+
+// established reports a channel of a monitored extension that joined its first bridge as
+// an established connection and starts recording it
+func (a *Asterisk) established(ch *channel) {
+	mp := a.monitorPoints.Get(endpoint(ch.name))
+	if mp == nil || ch.connected {
+		return
+	}
+	ch.connected = true
+
+	// The channel that started the call belongs to the calling device
+	calling, called := ch.connectedLineNum, mp.Extension()
+	if ch.uniqueID == ch.linkedID {
+		calling, called = mp.Extension(), ch.exten
+		if ch.connectedLineNum != "" {
+			called = ch.connectedLineNum
+		}
+	}
+
+	event := &csta.EstablishedEvent{
+		MonitorCrossRefID:     mp.CrossReferenceID(),
+		EstablishedConnection: connectionID(ch.linkedID, mp.Extension()),
+		AnsweringDevice:       subjectDeviceID(called),
+		CallingDevice:         subjectDeviceID(calling),
+		CalledDevice:          subjectDeviceID(called),
+		LocalConnectionInfo:   "connected",
+		Cause:                 csta.EventCauseNormal,
+	}
+	a.tracker.Handle(event)
+	mp.Publish(event)
+
+	a.startRecording(ch, mp)
+}
+
+// cleared reports a channel of a monitored extension that hung up as a cleared connection
+// and finishes its recording
+func (a *Asterisk) cleared(ch *channel) {
+	mp := a.monitorPoints.Get(endpoint(ch.name))
+	if mp == nil || !ch.connected {
+		return
+	}
+	ch.connected = false
+
+	call, ok := a.tracker.Call(ch.linkedID)
+	event := &csta.ConnectionClearedEvent{
+		MonitorCrossRefID:   mp.CrossReferenceID(),
+		DroppedConnection:   connectionID(ch.linkedID, mp.Extension()),
+		ReleasingDevice:     subjectDeviceID(mp.Extension()),
+		LocalConnectionInfo: "null",
+		Cause:               csta.EventCauseNormalClearing,
+	}
+	a.tracker.Handle(event)
+	mp.Publish(event)
+
+	if r, found := a.recordings[ch.uniqueID]; found {
+		delete(a.recordings, ch.uniqueID)
+		if !ok {
+			call = r.call
+		}
+		log.Printf("Stopping recording of call <%s> at <%s>\n", ch.linkedID, mp.Extension())
+		a.finishRecording(r, call)
+	}
+}
+
+// startRecording snoops on a channel and bridges the snoop channel with an external media
+// channel that sends the media to a recorder
+func (a *Asterisk) startRecording(ch *channel, mp *pbx.DeviceMonitorPoint) {
+	a.mutex.Lock()
+	recorderPool := a.recorderPool
+	a.mutex.Unlock()
+	if recorderPool == nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: no recorders available\n", ch.linkedID, mp.Extension())
+		return
+	}
+
+	recorder, err := recorderPool.GetRecorder()
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", ch.linkedID, mp.Extension(), err)
+		return
+	}
+
+	host, err := mediaHost(recorder)
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", ch.linkedID, mp.Extension(), err)
+		return
+	}
+
+	filePath, err := pbx.StartRecording(recorder)
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", ch.linkedID, mp.Extension(), err)
+		return
+	}
+
+	call, _ := a.tracker.Call(ch.linkedID)
+	r := &recording{recorder: recorder, filePath: filePath, call: call}
+
+	log.Printf("Recording call <%s> at <%s> with local recording endpoint <%s> in file \"%s\"\n",
+		ch.linkedID, mp.Extension(), host, filePath)
+	err = a.bridgeMedia(ch, r, host)
+	if err != nil {
+		log.Printf("Failed to get the media of call <%s> at <%s>: %s\n", ch.linkedID, mp.Extension(), err)
+		a.releaseMedia(r)
+		recorder.StopRecording()
+		os.Remove(filePath)
+		return
+	}
+
+	a.recordings[ch.uniqueID] = r
+}
+
+// bridgeMedia creates the channels and the bridge that send the media of a channel to a recorder
+func (a *Asterisk) bridgeMedia(ch *channel, r *recording, host string) error {
+	snoop, err := a.ari.Snoop(a.ctx, ch.uniqueID)
+	if err != nil {
+		return err
+	}
+	r.snoopID = snoop.ID
+
+	media, err := a.ari.ExternalMedia(a.ctx, host, viper.GetString("asterisk.media_format"))
+	if err != nil {
+		return err
+	}
+	r.mediaID = media.ID
+
+	bridge, err := a.ari.CreateBridge(a.ctx)
+	if err != nil {
+		return err
+	}
+	r.bridgeID = bridge.ID
+
+	return a.ari.AddChannels(a.ctx, bridge.ID, snoop.ID, media.ID)
+}
+
+// releaseMedia hangs up the channels and destroys the bridge of a recording
+func (a *Asterisk) releaseMedia(r *recording) {
+	// Not bound to the application context, the channels have to go on shutdown as well
+	ctx := context.Background()
+
+	for _, channelID := range []string{r.snoopID, r.mediaID} {
+		if channelID == "" {
+			continue
+		}
+		if err := a.ari.Hangup(ctx, channelID); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+	if r.bridgeID != "" {
+		if err := a.ari.DestroyBridge(ctx, r.bridgeID); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+}
+
+// stopAllRecordings finishes all recordings, e.g. when the connection to Asterisk is lost
+func (a *Asterisk) stopAllRecordings() {
+	for uniqueID, r := range a.recordings {
+		delete(a.recordings, uniqueID)
+
+		call := r.call
+		if ch, ok := a.channels[uniqueID]; ok {
+			if tracked, ok := a.tracker.Call(ch.linkedID); ok {
+				call = tracked
+			}
+		}
+		a.finishRecording(r, call)
+	}
+}
+
+// finishRecording releases the media of a recording, stops its recorder and passes the
+// recording on to be uploaded
+func (a *Asterisk) finishRecording(r *recording, call pbx.Call) {
+	a.releaseMedia(r)
+
+	pbx.FinishRecording(r.recorder, r.filePath, call, a.OnRecordingFinished)
+}
+
+// endpoint returns the extension of a channel name, e.g. 4711 for PJSIP/4711-0000002a.
+// Local channels don't belong to an extension.
+func endpoint(channelName string) string {
+	technology, resource, ok := strings.Cut(channelName, "/")
+	if !ok || technology == "Local" {
+		return ""
+	}
+	if i := strings.LastIndex(resource, "-"); i > 0 {
+		resource = resource[:i]
+	}
+	return resource
+}
+
+// mediaHost returns the address Asterisk sends the media of a recorder to
+func mediaHost(recorder rtp.Recorder) (string, error) {
+	addr, ok := recorder.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", fmt.Errorf("recorder doesn't listen on UDP")
+	}
+
+	host := viper.GetString("asterisk.media_address")
+	if host == "" {
+		if addr.IP.IsUnspecified() {
+			return "", fmt.Errorf("recorders listen on all addresses, asterisk.media_address must be set")
+		}
+		host = addr.IP.String()
+	}
+	return net.JoinHostPort(host, fmt.Sprintf("%d", addr.Port)), nil
+}
+
+func connectionID(callID string, device string) csta.ConnectionID {
+	return csta.ConnectionID{
+		CallID:   callID,
+		DeviceID: &csta.LocalDeviceID{Device: device, TypeOfNumber: "dialingNumber"},
+	}
+}
+
+func subjectDeviceID(device string) csta.SubjectDeviceID {
+	return csta.SubjectDeviceID{
+		ExtendedDeviceID: csta.ExtendedDeviceID{
+			DeviceIdentifier: csta.DeviceID{Device: device, TypeOfNumber: "dialingNumber"},
+		},
+	}
+}
@@ -0,0 +1,213 @@
+package asterisk
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/asterisk/asterisktest"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/pbxtest"
+	"github.com/spf13/viper"
+)
+
+// connectTestServer connects an Asterisk to a server, finished recordings are sent to records
+func connectTestServer(t *testing.T, s *asterisktest.Server, ctx context.Context) (*Asterisk, *pbxtest.Recorder, pbxtest.Records) {
+	viper.Set("asterisk.ami_address", s.AMIAddr())
+	viper.Set("asterisk.ami_username", "recording")
+	viper.Set("asterisk.ami_secret", "secret")
+	viper.Set("asterisk.ari_url", s.ARIURL())
+	viper.Set("asterisk.media_address", "")
+
+	records := pbxtest.NewRecords()
+	recorder := pbxtest.NewRecorder()
+	a := &Asterisk{
+		recorderPool:        &pbxtest.RecorderPool{Recorder: recorder},
+		OnRecordingFinished: records.Finish,
+	}
+	a.SetContext(ctx)
+
+	_, err := a.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := s.Actions("Login")
+	if len(login) != 1 || login[0]["Username"] != "recording" || login[0]["Secret"] != "secret" {
+		t.Fatalf("unexpected login %+v", login)
+	}
+	if err := s.WaitForApplications(1, pbxtest.Timeout); err != nil {
+		t.Fatal(err)
+	}
+	return a, recorder, records
+}
+
+// replay sends the events of a file in testdata
+func replay(t *testing.T, s *asterisktest.Server, name string) {
+	t.Helper()
+
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := s.Replay(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordInboundCall(t *testing.T) {
+	s, err := asterisktest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, recorder, records := connectTestServer(t, s, ctx)
+	defer a.Close()
+
+	mp, err := a.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := mp.Events()
+
+	replay(t, s, "inbound_call.ami")
+
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1700000000.1" || record.CallerNumber != "5551234" || record.CalleeNumber != "4711" || record.End.Before(record.Begin) {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	if recorder.IsRecording() {
+		t.Fail()
+	}
+
+	// The channel of the extension was snooped on and its media sent to the recorder
+	snoop := s.Requests("POST", "/channels/1700000000.2/snoop")
+	if len(snoop) != 1 || snoop[0].Query.Get("app") != "recording-agent" || snoop[0].Query.Get("spy") != "both" {
+		t.Fatalf("unexpected snoop requests %+v", snoop)
+	}
+	media := s.Requests("POST", "/channels/externalMedia")
+	if len(media) != 1 || media[0].Query.Get("external_host") != "127.0.0.1:40000" || media[0].Query.Get("format") != "ulaw" {
+		t.Fatalf("unexpected external media requests %+v", media)
+	}
+	add := s.Requests("POST", "/bridges/bridge-1/addChannel")
+	if len(add) != 1 || add[0].Query.Get("channel") != "snoop-1,media-2" {
+		t.Fatalf("unexpected bridge requests %+v", add)
+	}
+
+	// The channels and the bridge are released with the recording
+	for _, path := range []string{"/channels/snoop-1", "/channels/media-2", "/bridges/bridge-1"} {
+		if len(s.Requests("DELETE", path)) != 1 {
+			t.Fatalf("%s wasn't released", path)
+		}
+	}
+
+	// The monitor point sees the call as CSTA events
+	for _, messageType := range []csta.MessageType{csta.MessageTypeEstablishedEvent, csta.MessageTypeConnectionClearedEvent} {
+		select {
+		case event := <-events:
+			if event.Type() != messageType {
+				t.Fatalf("unexpected event %+v", event)
+			}
+		case <-time.After(pbxtest.Timeout):
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func TestRecordAcrossBridges(t *testing.T) {
+	s, err := asterisktest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, _, records := connectTestServer(t, s, ctx)
+	defer a.Close()
+
+	_, err = a.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The call moves to another bridge before it ends
+	replay(t, s, "bridge_change.ami")
+
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1700000000.1" || record.CallerNumber != "5551234" {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	select {
+	case record := <-records:
+		t.Fatalf("call was split into another recording %+v", record)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if snoop := s.Requests("POST", "/channels/1700000000.2/snoop"); len(snoop) != 1 {
+		t.Fatalf("unexpected snoop requests %+v", snoop)
+	}
+}
+
+func TestRecordOutboundCallUntilDisconnect(t *testing.T) {
+	s, err := asterisktest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, recorder, records := connectTestServer(t, s, ctx)
+
+	_, err = a.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay(t, s, "outbound_call.ami")
+
+	_, err = s.WaitForRequest("POST", "/bridges/bridge-1/addChannel", 1, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recorder.IsRecording() {
+		t.Fail()
+	}
+
+	// Losing the connection finishes the recording
+	s.Disconnect()
+
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1700000100.3" || record.CallerNumber != "4711" || record.CalleeNumber != "5559876" {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+
+	select {
+	case <-a.done:
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("connection wasn't closed")
+	}
+	a.Close()
+}
+
+func TestEndpoint(t *testing.T) {
+	for name, expected := range map[string]string{
+		"PJSIP/4711-0000002a":             "4711",
+		"SIP/dispatch-1-00000001":         "dispatch-1",
+		"Local/4711@from-internal-0001;1": "",
+		"IAX2/trunk":                      "trunk",
+	} {
+		if e := endpoint(name); e != expected {
+			t.Errorf("endpoint(%q) = %q, expected %q", name, e, expected)
+		}
+	}
+}
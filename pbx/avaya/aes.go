@@ -6,7 +6,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"sync"
 	"time"
@@ -18,14 +17,22 @@ import (
 	"github.com/spf13/viper"
 )
 
-const defaultEventBufferSize = 100
+// keepaliveInterval is how often the timer of the application session is reset
+var keepaliveInterval = 30 * time.Second
 
 type AvayaAES struct {
 	ctx           context.Context
 	sessionId     string
 	conn          csta.Conn
-	monitorPoints map[string]*monitorPoint
+	mutex         sync.Mutex // Guards registrations, which event handlers access concurrently
+	monitorPoints pbx.MonitorPoints
 	recorders     []*recorderTerminal
+	tracker       *pbx.CallTracker
+	db            *models.DB
+
+	// OnRecordingFinished is called with each finished recording,
+	// the default queues the recording for upload
+	OnRecordingFinished func(record *models.UploadRecord)
 }
 
 func (aes *AvayaAES) SetContext(ctx context.Context) {
@@ -34,81 +41,49 @@ func (aes *AvayaAES) SetContext(ctx context.Context) {
 
 // Connect dials the connection and establishes an application session
 func (aes *AvayaAES) Connect() (csta.Conn, error) {
-	cstaConn, err := csta.Dial("tcp", viper.GetString("avaya_aes.server_address"), aes.ctx, nil)
-	if err != nil {
-		return nil, err
+	type sessionLoginInfo struct {
+		Username            string `xml:"userName"`
+		Password            string `xml:"password"`
+		SessionCleanupDelay int    `xml:"sessionCleanupDelay"`
 	}
 
-	aes.conn = cstaConn
-
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	err = cstaConn.StartApplicationSession(viper.GetString("application_id"), struct {
-		SessionLoginInfo struct {
-			Username            string `xml:"userName"`
-			Password            string `xml:"password"`
-			SessionCleanupDelay int    `xml:"sessionCleanupDelay"`
-		} `xml:"SessionLoginInfo"`
-	}{
-		SessionLoginInfo: struct {
-			Username            string "xml:\"userName\""
-			Password            string "xml:\"password\""
-			SessionCleanupDelay int    "xml:\"sessionCleanupDelay\""
+	session := &pbx.ApplicationSession{
+		ApplicationID: viper.GetString("application_id"),
+		ApplicationSpecificInfo: struct {
+			SessionLoginInfo sessionLoginInfo `xml:"SessionLoginInfo"`
 		}{
-			Username:            viper.GetString("avaya_aes.username"),
-			Password:            viper.GetString("avaya_aes.password"),
-			SessionCleanupDelay: 60,
+			SessionLoginInfo: sessionLoginInfo{
+				Username:            viper.GetString("avaya_aes.username"),
+				Password:            viper.GetString("avaya_aes.password"),
+				SessionCleanupDelay: 60,
+			},
 		},
-	},
-		"http://www.ecma-international.org/standards/ecma-323/csta/ed3/priv5",
-		func(ctx *csta.Context) {
-			if ctx.Error != nil {
-				err = ctx.Error
-			}
-			if r, ok := ctx.Message.(*csta.StartApplicationSessionPosResponse); ok {
-				log.Printf("Application session started with session id <%s>\n", r.SessionID)
-				aes.sessionId = r.SessionID
-			}
-			wg.Done()
-		})
+		ProtocolVersion: "http://www.ecma-international.org/standards/ecma-323/csta/ed3/priv5",
+	}
 
+	cstaConn, sessionId, err := pbx.DialCSTA("avaya_aes", aes.ctx, session)
 	if err != nil {
 		return nil, err
 	}
+	log.Printf("Application session started with session id <%s>\n", sessionId)
 
-	wg.Wait()
+	// Monitor points of a previous connection are gone, possibly with the node they were started on
+	aes.monitorPoints.Reset()
 
-	go aes.applicationSessionTimer(aes.ctx)
+	aes.conn = cstaConn
+	aes.sessionId = sessionId
+	if aes.tracker == nil {
+		aes.tracker = pbx.NewCallTracker()
+		go aes.handleCalls(aes.tracker.Subscribe(aes.ctx))
+	} else {
+		// Finish the recordings of calls that were going on with the previous connection
+		aes.tracker.Reset()
+	}
+	aes.setupHandlers(cstaConn)
 
-	return cstaConn, nil
-}
+	go session.KeepAlive(aes.ctx, cstaConn, sessionId, keepaliveInterval)
 
-// applicationSessionTimer handles resetting the application session timer every so often
-// to prevent sessions from expiring
-func (aes *AvayaAES) applicationSessionTimer(ctx context.Context) {
-	timer := time.NewTicker(30 * time.Second)
-
-	for {
-		select {
-		case <-timer.C:
-			log.Printf("Resetting application session timer\n")
-			aes.conn.Request(csta.ResetApplicationSessionTimer{
-				SessionID:                aes.sessionId,
-				RequestedSessionDuration: 60,
-			}, func(c *csta.Context) {
-				// TODO handle negative response
-			})
-		case <-aes.conn.Closed():
-			timer.Stop()
-			log.Printf("Conection closed, stopping application session timer\n")
-			return
-		case <-ctx.Done():
-			timer.Stop()
-			log.Printf("Application shutdown, stopping application session timer\n")
-			return
-		}
-	}
+	return cstaConn, nil
 }
 
 func (aes *AvayaAES) ConnectionState() pbx.ConnectionState {
@@ -122,102 +97,82 @@ func (aes *AvayaAES) ConnectionState() pbx.ConnectionState {
 	return pbx.ConnectionStateDisconnected
 }
 
-// Close closes the TCP connection after it stopped the application session
+// Close closes the TCP connection after it unregistered the terminals and stopped the application session
 func (aes *AvayaAES) Close() error {
-
 	if aes.conn.State() == csta.ConnectionStateActive {
-		var wg sync.WaitGroup
-		wg.Add(1)
+		aes.unregisterRecorders()
 
-		aes.conn.Request(csta.StopApplicationSession{
+		_, err := aes.conn.Do(context.Background(), csta.StopApplicationSession{
 			SessionID:        aes.sessionId,
 			SessionEndReason: "Application Shutdown",
-		}, func(c *csta.Context) {
-			wg.Done()
 		})
-		wg.Wait()
+		if err != nil {
+			log.Printf("Failed to stop the application session: %s\n", err)
+		}
 	}
 
 	return aes.conn.Close()
 }
 
 // MonitorStart gets hold of a device ID and calls MonitorStart on it
-func (aes *AvayaAES) MonitorStart(extension string) (mp pbx.MonitorPoint, err error) {
+func (aes *AvayaAES) MonitorStart(extension string) (pbx.MonitorPoint, error) {
+	return aes.monitorStart(extension, models.RecordingMethodServiceObserving)
+}
+
+// monitorStart starts monitoring an extension whose calls are recorded with a recording method
+func (aes *AvayaAES) monitorStart(extension string, recordingMethod models.RecordingMethod) (*pbx.DeviceMonitorPoint, error) {
 	deviceId, err := aes.GetDeviceID(extension)
 	if err != nil {
 		return nil, err
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	aes.conn.MonitorStart(
-		csta.CSTAObject{
+	response, err := aes.conn.Do(aes.ctx, csta.MonitorStart{
+		MonitorObject: csta.CSTAObject{
 			DeviceObject: &csta.DeviceID{
 				Device:       deviceId,
 				TypeOfNumber: "other",
 				MediaClass:   "notKnown",
 			},
 		},
-		csta.MonitorTypeDevice,
-		func(c *csta.Context) {
-			defer wg.Done()
+		MonitorType: csta.MonitorTypeDevice,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start monitoring for extension <%s>: %w", extension, err)
+	}
 
-			if c.Error != nil {
-				err = c.Error
-				return
-			}
+	resp, ok := response.(*csta.MonitorStartResponse)
+	if !ok {
+		return nil, fmt.Errorf("failed to start monitoring for extension <%s>, unexpected response %s", extension, response.Type())
+	}
 
-			if resp, ok := (c.Message).(*csta.MonitorStartResponse); ok {
-				if aes.monitorPoints == nil {
-					aes.monitorPoints = make(map[string]*monitorPoint)
-				}
-				aes.monitorPoints[resp.MonitorCrossRefID] = &monitorPoint{
-					crossReferenceID: resp.MonitorCrossRefID,
-					device: &device{
-						extension: extension,
-						deviceId:  deviceId,
-					},
-				}
-				mp = aes.monitorPoints[resp.MonitorCrossRefID]
-				return
-			} else {
-				err = fmt.Errorf("failed to start monitoring for extension <%s>", extension)
-			}
-		},
-	)
-	wg.Wait()
+	mp := pbx.NewDeviceMonitorPoint(resp.MonitorCrossRefID, pbx.MonitoredDevice{
+		Extension:       extension,
+		ID:              deviceId,
+		RecordingMethod: recordingMethod,
+	})
+	aes.monitorPoints.Add(mp)
+	aes.tracker.Monitor(resp.MonitorCrossRefID, deviceId)
 
-	if err == nil && mp != nil {
-		log.Printf("Monitoring <%s (%s)> with CrossRefID <%s>\n", extension, deviceId, mp.CrossReferenceID())
-	}
+	log.Printf("Monitoring <%s (%s)> with CrossRefID <%s>\n", extension, deviceId, mp.CrossReferenceID())
 
-	return
+	return mp, nil
 }
 
 // GetDeviceID gets the internal device ID for an extension
-func (aes *AvayaAES) GetDeviceID(extension string) (deviceId string, err error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	aes.conn.Request(csta.GetDeviceId{
+func (aes *AvayaAES) GetDeviceID(extension string) (string, error) {
+	response, err := aes.conn.Do(aes.ctx, csta.GetDeviceId{
 		SwitchName: viper.GetString("avaya_aes.switch_name"),
 		Extension:  extension,
-	}, func(c *csta.Context) {
-		defer wg.Done()
-		if r, ok := c.Message.(*csta.GetDeviceIdResponse); ok {
-			deviceId = r.Device.Device
-		} else {
-			err = fmt.Errorf("failed to get device id for extension <%s>", extension)
-		}
 	})
-	wg.Wait()
+	if err != nil {
+		return "", fmt.Errorf("failed to get device id for extension <%s>: %w", extension, err)
+	}
 
-	if len(deviceId) == 0 {
-		err = fmt.Errorf("failed to get device id for extension <%s>", extension)
+	if r, ok := response.(*csta.GetDeviceIdResponse); ok && len(r.Device.Device) > 0 {
+		return r.Device.Device, nil
 	}
 
-	return
+	return "", fmt.Errorf("failed to get device id for extension <%s>", extension)
 }
 
 func (aes *AvayaAES) Serve(recorderPool rtp.RecorderPool) error {
@@ -239,28 +194,73 @@ func (aes *AvayaAES) Serve(recorderPool rtp.RecorderPool) error {
 		return fmt.Errorf("not enough recorders configured to service all recording devices")
 	}
 
-	aes.recorders = make([]*recorderTerminal, 0)
+	terminals := make([]*recorderTerminal, 0)
+	aes.db = db
+
+	for i := range recordingDevices {
+		rd := &recordingDevices[i]
+		t := &recorderTerminal{
+			Extension: rd.Extension,
+			Password:  rd.Password,
+			Device:    rd,
+			Recorder:  recorders[i],
+		}
+		terminals = append(terminals, t)
 
-	for i, rd := range recordingDevices {
-		log.Printf("Registering AES recording device <%s> with local recording endpoint <%s>", rd.Extension, recorders[i].LocalAddr().String())
-		err := aes.RegisterTerminal(rd.Extension, rd.Password, recorders[i].LocalAddr().(*net.UDPAddr))
+		log.Printf("Registering AES recording device <%s> with local recording endpoint <%s>\n", rd.Extension, recorders[i].LocalAddr().String())
+		err := aes.registerRecorder(t)
 		if err != nil {
 			log.Printf("Failed to register AES recording device: %s\n", err)
-			continue
+			aes.startReregistration(t, reregistrationInterval)
 		}
-		aes.recorders = append(aes.recorders, &recorderTerminal{
-			Extension: rd.Extension,
-			Recorder:  recorders[i],
-		})
 	}
 
 	// Get devices to be monitored
 	monitoredDevices := db.GetMonitoredDevices()
 	log.Printf("%d devices are configured to be monitored\n", len(monitoredDevices))
 
+	// Devices recorded by multiple registration get a recorder of their own
+	next := len(recordingDevices)
+	for _, d := range monitoredDevices {
+		if d.RecordingMethod != models.RecordingMethodMultipleRegistration {
+			continue
+		}
+		if next >= len(recorders) {
+			log.Printf("No recorder left to register in shared control of <%s>\n", d.Extension)
+			continue
+		}
+
+		t := &recorderTerminal{
+			Extension:     d.Extension,
+			Password:      d.Password,
+			Recorder:      recorders[next],
+			SharedControl: d.Extension,
+		}
+		terminals = append(terminals, t)
+		next++
+
+		log.Printf("Registering in shared control of <%s> with local recording endpoint <%s>\n", d.Extension, t.Recorder.LocalAddr().String())
+		err := aes.registerRecorder(t)
+		if err != nil {
+			log.Printf("Failed to register in shared control: %s\n", err)
+			aes.startReregistration(t, reregistrationInterval)
+		}
+	}
+
+	aes.mutex.Lock()
+	aes.recorders = terminals
+	aes.mutex.Unlock()
+
+	// Virtual stations conferenced into calls aren't parties of them
+	for _, t := range terminals {
+		if t.SharedControl == "" {
+			aes.tracker.Ignore(t.Extension)
+		}
+	}
+
 	// Run MonitorStart on all of the monitored devices
 	for _, d := range monitoredDevices {
-		mp, err := aes.MonitorStart(d.Extension)
+		mp, err := aes.monitorStart(d.Extension, d.RecordingMethod)
 		if err != nil {
 			log.Printf("Failed to start monitoring <%s>: %s", d.Extension, err)
 			continue
@@ -271,8 +271,6 @@ func (aes *AvayaAES) Serve(recorderPool rtp.RecorderPool) error {
 	}
 
 	// Add additional actions to do on newly established PBX connection here
-	aes.conn.Handle(csta.MessageTypeEstablishedEvent, aes.onEstablishedEvent)
-	aes.conn.Handle(csta.MessageTypeConnectionClearedEvent, aes.onConnectionClearedEvent)
 
 	// Handlers will run in the background, wait for anything to fail/end
 	select {
@@ -283,134 +281,217 @@ func (aes *AvayaAES) Serve(recorderPool rtp.RecorderPool) error {
 	}
 }
 
-// RegisterTerminal will force-register a virtual station and instruct the Gateway to
-// send any audio data to the specified local endpoint
-func (aes *AvayaAES) RegisterTerminal(extension string, password string, localRtpEndpoint *net.UDPAddr) error {
-	// Get the actual device ID for this extension
-	deviceId, err := aes.GetDeviceID(extension)
-	if err != nil {
-		return err
+func (aes *AvayaAES) setupHandlers(conn csta.Conn) {
+	for _, messageType := range []csta.MessageType{
+		csta.MessageTypeServiceInitiatedEvent,
+		csta.MessageTypeOriginatedEvent,
+		csta.MessageTypeDeliveredEvent,
+		csta.MessageTypeEstablishedEvent,
+		csta.MessageTypeConnectionClearedEvent,
+		csta.MessageTypeHeldEvent,
+		csta.MessageTypeRetrievedEvent,
+		csta.MessageTypeTransferredEvent,
+		csta.MessageTypeConferencedEvent,
+		csta.MessageTypeDivertedEvent,
+		csta.MessageTypeFailedEvent,
+		csta.MessageTypeQueuedEvent,
+		csta.MessageTypeCallClearedEvent,
+	} {
+		conn.Handle(messageType, aes.onCallControlEvent)
 	}
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	aes.conn.Request(csta.RegisterTerminalRequest{
-		Device: csta.DeviceID{Device: deviceId, TypeOfNumber: "other", MediaClass: "notKnown"},
-		LoginInfo: csta.LoginInfo{
-			ForceLogin:     true,
-			SharedControl:  false,
-			Password:       password,
-			MediaMode:      csta.MediaModeClient,
-			DependencyMode: csta.DependencyModeMain,
-		},
-		LocalMediaInfo: &csta.LocalMediaInfo{
-			RTPAddress: &csta.NetworkEndpoint{
-				Address: localRtpEndpoint.IP.String(),
-				Port:    localRtpEndpoint.Port,
-			},
-			RTCPAddress: &csta.NetworkEndpoint{
-				Address: localRtpEndpoint.IP.String(),
-				Port:    65000,
-			},
-			Codecs:         []string{"g711U"},
-			EncryptionList: []string{"none"},
-			PacketSize:     20,
-		},
-	}, func(c *csta.Context) {
-		defer wg.Done()
-	})
-
-	wg.Wait()
-	return nil
+	conn.Handle(csta.MessageTypeTerminalUnregisteredEvent, aes.onTerminalUnregistered)
 }
 
-type monitorPoint struct {
-	crossReferenceID string
-	device           *device
-	subscribers      []chan csta.Message
-}
+// onCallControlEvent updates the tracked calls and passes the event on to its monitor point
+func (aes *AvayaAES) onCallControlEvent(c *csta.Context) {
+	aes.tracker.Handle(c.Message)
 
-func (mp *monitorPoint) CrossReferenceID() string {
-	return mp.crossReferenceID
+	if crossRefID, ok := pbx.MonitorCrossRefID(c.Message); ok {
+		if mp := aes.monitorPoints.Get(crossRefID); mp != nil {
+			mp.Publish(c.Message)
+		}
+	}
 }
 
-func (mp *monitorPoint) Device() pbx.Device {
-	return mp.device
+// handleCalls records the connections of monitored devices to calls while they are answered.
+// A device can be connected to several calls at once, e.g. when it consults another device
+// while holding a call, each of those connections gets a recorder of its own.
+func (aes *AvayaAES) handleCalls(events <-chan pbx.CallEvent) {
+	for event := range events {
+		if event.Type == pbx.CallEventTransferred || event.Type == pbx.CallEventConferenced {
+			aes.moveRecordings(event)
+		}
+		aes.updateRecordings(event.Call)
+	}
 }
 
-func (mp *monitorPoint) Events() <-chan csta.Message {
-	if mp.subscribers == nil {
-		mp.subscribers = make([]chan csta.Message, 0)
+// moveRecordings keeps recording connections of merged calls as part of the resulting call
+func (aes *AvayaAES) moveRecordings(event pbx.CallEvent) {
+	for _, callID := range event.PreviousCallIDs {
+		for _, recorder := range aes.GetRecordersByCall(callID) {
+			_, deviceID := aes.recording(recorder)
+			if _, err := aes.GetRecorderByConnection(event.Call.ID, deviceID); err == nil {
+				// The device was connected to both calls, e.g. the conferencing device
+				previous := event.Call
+				previous.ID = callID
+				aes.stopRecording(recorder, previous)
+				continue
+			}
+			aes.mutex.Lock()
+			recorder.CurrentCall = event.Call.ID
+			aes.mutex.Unlock()
+		}
 	}
-	subscriberChannel := make(chan csta.Message, defaultEventBufferSize)
-	mp.subscribers = append(mp.subscribers, subscriberChannel)
-	return subscriberChannel
 }
 
-func (mp *monitorPoint) dispatchEvent(e csta.Message) {
-	for _, subscriber := range mp.subscribers {
-		subscriber <- e
+// updateRecordings starts recording monitored devices connected to a call and stops
+// recording those whose connection was cleared
+func (aes *AvayaAES) updateRecordings(call pbx.Call) {
+	for _, recorder := range aes.GetRecordersByCall(call.ID) {
+		if _, deviceID := aes.recording(recorder); call.State == pbx.CallStateEnded || call.Party(deviceID) == nil {
+			aes.stopRecording(recorder, call)
+		}
+	}
+
+	if call.State != pbx.CallStateConnected && call.State != pbx.CallStateHeld {
+		return
 	}
-}
 
-type device struct {
-	extension string
-	deviceId  string
+	for _, mp := range aes.getMonitoredParties(call) {
+		if party := call.Party(mp.Device().DeviceID()); party.State != pbx.PartyStateConnected {
+			continue
+		}
+		if _, err := aes.GetRecorderByConnection(call.ID, mp.Device().DeviceID()); err == nil {
+			continue
+		}
+		aes.startRecording(call, mp)
+	}
 }
 
-func (d *device) DeviceID() string {
-	return d.deviceId
+// getMonitoredParties returns the monitor points of the parties of a call
+func (aes *AvayaAES) getMonitoredParties(call pbx.Call) []*pbx.DeviceMonitorPoint {
+	monitorPoints := make([]*pbx.DeviceMonitorPoint, 0)
+	for _, mp := range aes.monitorPoints.All() {
+		if call.Party(mp.Device().DeviceID()) != nil {
+			monitorPoints = append(monitorPoints, mp)
+		}
+	}
+	return monitorPoints
 }
 
-func (aes *AvayaAES) onEstablishedEvent(c *csta.Context) {
-	// Check for the correct event data type
-	if event, ok := (c.Message).(*csta.EstablishedEvent); ok {
-		// Get a free recording device
-		recorder, err := aes.GetRecorder()
-		if err != nil {
-			log.Printf("Failed to start recording of established call: %s\n", err)
+func (aes *AvayaAES) startRecording(call pbx.Call, mp *pbx.DeviceMonitorPoint) {
+	var recorder *recorderTerminal
+	if mp.MonitoredDevice().RecordingMethod == models.RecordingMethodMultipleRegistration {
+		// The media of the device is delivered to its own recorder, which only
+		// carries the connection that is active at the station
+		recorder = aes.GetSharedControlRecorder(mp.Extension())
+		if recorder == nil {
+			log.Printf("Failed to start recording of call <%s> at <%s>: not registered in shared control\n", call.ID, mp.Extension())
 			return
 		}
-
-		file, err := ioutil.TempFile(os.TempDir(), "*.wav")
+		if !aes.registered(recorder) {
+			log.Printf("Failed to start recording of call <%s> at <%s>: shared control isn't registered\n", call.ID, mp.Extension())
+			return
+		}
+		if recorder.Recorder.IsRecording() {
+			recordedCall, _ := aes.recording(recorder)
+			log.Printf("Not recording call <%s> at <%s>, the media of call <%s> is recorded already\n", call.ID, mp.Extension(), recordedCall)
+			return
+		}
+	} else {
+		// Get a free recording device
+		var err error
+		recorder, err = aes.GetRecorder()
 		if err != nil {
-			log.Printf("Failed to create a temporary recording file: %s\n", err)
+			log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", call.ID, mp.Extension(), err)
 			return
 		}
+	}
 
-		log.Printf("Starting call recording for device at cross reference ID <%s> in file \"%s\"\n", event.MonitorCrossRefID, file.Name())
-		recorder.StartRecording(file, event.MonitorCrossRefID)
-
-		if mp, ok := aes.monitorPoints[event.MonitorCrossRefID]; ok {
-			log.Printf("Initiating observation of <%s> by <%s>\n", mp.device.extension, recorder.Extension)
-			aes.conn.Request(csta.MakeCall{
-				CallingDevice:         recorder.Extension,
-				CalledDirectoryNumber: fmt.Sprintf("%s%s", viper.GetString("avaya_aes.srv_obsrv_feature_code"), mp.device.extension),
-			}, func(c *csta.Context) {})
+	file, err := ioutil.TempFile(os.TempDir(), "*.wav")
+	if err != nil {
+		log.Printf("Failed to create a temporary recording file: %s\n", err)
+		return
+	}
 
-			mp.dispatchEvent(event)
-		}
+	log.Printf("Starting recording of call <%s> at <%s> in file \"%s\"\n", call.ID, mp.Extension(), file.Name())
+	err = aes.startRecorder(recorder, file, call.ID, mp.Device().DeviceID())
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", call.ID, mp.Extension(), err)
+		file.Close()
+		aes.abortRecording(recorder, call.ID)
+		return
 	}
-}
 
-func (aes *AvayaAES) onConnectionClearedEvent(c *csta.Context) {
-	// Check for the correct event data type
-	if event, ok := (c.Message).(*csta.ConnectionClearedEvent); ok {
+	switch mp.MonitoredDevice().RecordingMethod {
+	case models.RecordingMethodMultipleRegistration:
+		return
+
+	case models.RecordingMethodSingleStepConference:
+		aes.conferenceRecorder(recorder, call.ID, mp)
 
-		log.Printf("Stopping call recording for device at cross reference ID <%s>\n", event.MonitorCrossRefID)
+	default:
+		log.Printf("Initiating observation of <%s> by <%s>\n", mp.Extension(), recorder.Extension)
+		aes.conn.Request(csta.MakeCall{
+			CallingDevice:         recorder.Extension,
+			CalledDirectoryNumber: fmt.Sprintf("%s%s", viper.GetString("avaya_aes.srv_obsrv_feature_code"), mp.Extension()),
+		}, func(c *csta.Context) {
+			if c.Error != nil {
+				log.Printf("Failed to observe <%s> by <%s>: %s\n", mp.Extension(), recorder.Extension, c.Error)
+				aes.abortRecording(recorder, call.ID)
+			}
+		})
+	}
+}
 
-		// Get the recording device responsible for this call
-		recorder, err := aes.GetRecorderByCallReference(event.MonitorCrossRefID)
+// conferenceRecorder joins the virtual station of a recorder silently into the call of a
+// monitored device, the switch drops it when the call ends
+func (aes *AvayaAES) conferenceRecorder(recorder *recorderTerminal, callID string, mp *pbx.DeviceMonitorPoint) {
+	deviceId := aes.terminalDeviceID(recorder)
+	if deviceId == "" {
+		var err error
+		deviceId, err = aes.GetDeviceID(recorder.Extension)
 		if err != nil {
-			log.Printf("Failed to stop recording of established call (%s): %s\n", event.MonitorCrossRefID, err)
+			log.Printf("Failed to conference <%s> into call <%s>: %s\n", recorder.Extension, callID, err)
+			aes.abortRecording(recorder, callID)
 			return
 		}
+		aes.mutex.Lock()
+		recorder.DeviceID = deviceId
+		aes.mutex.Unlock()
+	}
 
-		recorder.StopRecording()
-
-		// Get the monitor point this event is for
-		if mp, ok := aes.monitorPoints[event.MonitorCrossRefID]; ok {
-			mp.dispatchEvent(event)
+	log.Printf("Conferencing <%s> into call <%s> at <%s>\n", recorder.Extension, callID, mp.Extension())
+	aes.mutex.Lock()
+	recorder.Conferenced = true
+	aes.mutex.Unlock()
+	aes.conn.Request(csta.SingleStepConferenceCall{
+		ActiveCall:        csta.ConnectionID{CallID: callID, DeviceID: &csta.LocalDeviceID{Device: mp.Device().DeviceID()}},
+		DeviceToJoin:      deviceId,
+		ParticipationType: csta.ParticipationTypeSilent,
+	}, func(c *csta.Context) {
+		if c.Error != nil {
+			log.Printf("Failed to conference <%s> into call <%s>: %s\n", recorder.Extension, callID, c.Error)
+			aes.abortRecording(recorder, callID)
 		}
+	})
+}
+
+func (aes *AvayaAES) stopRecording(recorder *recorderTerminal, call pbx.Call) {
+	released := aes.releaseRecorder(recorder)
+	log.Printf("Stopping recording of call <%s> at <%s>\n", call.ID, released.CurrentDevice)
+	filePath := released.FilePath
+
+	// A conferenced recorder stays in a call that goes on without the monitored device
+	if released.Conferenced && call.State != pbx.CallStateEnded {
+		aes.conn.Request(csta.ClearConnection{
+			ConnectionToBeCleared: csta.ConnectionID{CallID: released.CurrentCall, DeviceID: &csta.LocalDeviceID{Device: released.DeviceID}},
+		}, func(c *csta.Context) {
+			if c.Error != nil {
+				log.Printf("Failed to drop <%s> from call <%s>: %s\n", recorder.Extension, call.ID, c.Error)
+			}
+		})
 	}
+
+	pbx.FinishRecording(recorder.Recorder, filePath, call, aes.OnRecordingFinished)
 }
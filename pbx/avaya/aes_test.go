@@ -0,0 +1,455 @@
+package avaya
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/csta/cstatest"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/pbxtest"
+	"github.com/spf13/viper"
+)
+
+// connectTestAES connects an AvayaAES to a switch, finished recordings are sent to records
+func connectTestAES(t *testing.T, s *cstatest.Switch, ctx context.Context) (*AvayaAES, pbxtest.Records) {
+	viper.Set("avaya_aes.server_address", s.Addr())
+	viper.Set("avaya_aes.switch_name", "CM1")
+	viper.Set("avaya_aes.srv_obsrv_feature_code", "*99")
+
+	records := pbxtest.NewRecords()
+	aes := &AvayaAES{OnRecordingFinished: records.Finish}
+	aes.SetContext(ctx)
+
+	_, err := aes.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aes.sessionId != "session-1" {
+		t.Fatalf("unexpected session ID <%s>", aes.sessionId)
+	}
+	return aes, records
+}
+
+func TestRecordMonitoredCall(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+
+	// Register the recording station
+	recorder := pbxtest.NewRecorder()
+	err = aes.RegisterTerminal("5001", "1234", recorder.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes.recorders = []*recorderTerminal{{Extension: "5001", Recorder: recorder}}
+
+	register := s.Requests(csta.MessageTypeRegisterTerminalRequest)
+	if len(register) != 1 || register[0].(*csta.RegisterTerminalRequest).Device.Device != "5001:CM1::0" {
+		t.Fatalf("unexpected registration %+v", register)
+	}
+
+	mp, err := aes.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp.Device().DeviceID() != "4711:CM1::0" {
+		t.Fail()
+	}
+
+	// An answered call is observed by the recording station
+	err = s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := s.WaitForRequest(csta.MessageTypeMakeCall, 1, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if makeCall := request.(*csta.MakeCall); makeCall.CallingDevice != "5001" || makeCall.CalledDirectoryNumber != "*994711" {
+		t.Fatalf("unexpected observation %+v", makeCall)
+	}
+	if !recorder.IsRecording() {
+		t.Fail()
+	}
+
+	err = s.ConnectionCleared(mp.CrossReferenceID(), "1", "100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-recorder.Stopped():
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("recording wasn't stopped")
+	}
+
+	// The recording is annotated with the call
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1" || record.CallerNumber != "100" || record.CalleeNumber != "4711" || record.End.Before(record.Begin) {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+}
+
+func TestRecordHeldCall(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+	recorder := pbxtest.NewRecorder()
+	aes.recorders = []*recorderTerminal{{Extension: "5001", Recorder: recorder}}
+
+	mp, err := aes.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	if _, err := s.WaitForRequest(csta.MessageTypeMakeCall, 1, pbxtest.Timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holding and retrieving the call keeps the recording going
+	s.Held(mp.CrossReferenceID(), "1", "4711")
+	s.Retrieved(mp.CrossReferenceID(), "1", "4711")
+
+	s.ConnectionCleared(mp.CrossReferenceID(), "1", "100")
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1" || recorder.IsRecording() {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	if len(s.Requests(csta.MessageTypeMakeCall)) != 1 {
+		t.Fatal("recording was interrupted")
+	}
+}
+
+func TestRecordConsultationAndTransfer(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+	recorders := []*pbxtest.Recorder{pbxtest.NewRecorder(), pbxtest.NewRecorder(), pbxtest.NewRecorder()}
+	aes.recorders = []*recorderTerminal{
+		{Extension: "5001", Recorder: recorders[0]},
+		{Extension: "5002", Recorder: recorders[1]},
+		{Extension: "5003", Recorder: recorders[2]},
+	}
+
+	agent, err := aes.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	supervisor, err := aes.MonitorStart("4712")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent answers an external call and puts it on hold
+	s.Established(agent.CrossReferenceID(), "1", "100", "4711")
+	if _, err := s.WaitForRequest(csta.MessageTypeMakeCall, 1, pbxtest.Timeout); err != nil {
+		t.Fatal(err)
+	}
+	s.Held(agent.CrossReferenceID(), "1", "4711")
+
+	// The consultation call with the supervisor records both of them
+	s.Originated(agent.CrossReferenceID(), "2", "4711", "4712")
+	s.Established(supervisor.CrossReferenceID(), "2", "4711", "4712")
+	if _, err := s.WaitForRequest(csta.MessageTypeMakeCall, 3, pbxtest.Timeout); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recorders {
+		if !r.IsRecording() {
+			t.Fatal("consultation call isn't recorded")
+		}
+	}
+
+	// The agent leaves both calls by transferring the caller to the supervisor
+	s.Transferred(agent.CrossReferenceID(), "1", "2", "4711", "100", "4712")
+	finished := records.Wait(t, 2)
+	if finished[0].CallID != "1" || finished[1].CallID != "2" {
+		t.Fatalf("unexpected upload records %+v, %+v", finished[0], finished[1])
+	}
+	if recorders[0].IsRecording() || recorders[1].IsRecording() == recorders[2].IsRecording() {
+		t.Fatal("unexpected recordings after the transfer")
+	}
+
+	// The supervisor's recording ends with the transferred call
+	s.ConnectionCleared(supervisor.CrossReferenceID(), "2", "100")
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "2" || record.CallerNumber != "100" || recorders[1].IsRecording() || recorders[2].IsRecording() {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+}
+
+func TestRecordSharedControl(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+
+	observer, sharedControl := pbxtest.NewRecorder(), pbxtest.NewRecorder()
+	err = aes.RegisterSharedControl("4711", "4711", sharedControl.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes.recorders = []*recorderTerminal{
+		{Extension: "5001", Recorder: observer},
+		{Extension: "4711", Recorder: sharedControl, SharedControl: "4711"},
+	}
+
+	register := s.Requests(csta.MessageTypeRegisterTerminalRequest)
+	if len(register) != 1 {
+		t.Fatalf("unexpected registrations %+v", register)
+	}
+	if login := register[0].(*csta.RegisterTerminalRequest).LoginInfo; !login.SharedControl || login.ForceLogin || login.DependencyMode != csta.DependencyModeDependent {
+		t.Fatalf("unexpected login %+v", login)
+	}
+
+	mp, err := aes.monitorStart("4711", models.RecordingMethodMultipleRegistration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The call is recorded from the shared control registration without observing the station
+	s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	deadline := time.Now().Add(pbxtest.Timeout)
+	for !sharedControl.IsRecording() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !sharedControl.IsRecording() || observer.IsRecording() {
+		t.Fatal("call isn't recorded by the shared control registration")
+	}
+
+	s.ConnectionCleared(mp.CrossReferenceID(), "1", "100")
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1" || sharedControl.IsRecording() {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	if len(s.Requests(csta.MessageTypeMakeCall)) != 0 {
+		t.Fatal("station was observed")
+	}
+}
+
+func TestRecordSingleStepConference(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+	recorder := pbxtest.NewRecorder()
+	aes.recorders = []*recorderTerminal{{Extension: "5001", Recorder: recorder}}
+	aes.tracker.Ignore("5001")
+
+	mp, err := aes.monitorStart("4711", models.RecordingMethodSingleStepConference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recording station joins the answered call silently
+	s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	request, err := s.WaitForRequest(csta.MessageTypeSingleStepConferenceCall, 1, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conference := request.(*csta.SingleStepConferenceCall)
+	if conference.ActiveCall.CallID != "1" || conference.ActiveCall.DeviceID.Device != "4711:CM1::0" ||
+		conference.DeviceToJoin != "5001:CM1::0" || conference.ParticipationType != csta.ParticipationTypeSilent {
+		t.Fatalf("unexpected conference %+v", conference)
+	}
+	if !recorder.IsRecording() || len(s.Requests(csta.MessageTypeMakeCall)) != 0 {
+		t.Fatal("call isn't recorded by conference")
+	}
+
+	// The recording station isn't a party that keeps the call going
+	s.Send(&csta.ConferencedEvent{
+		MonitorCrossRefID:  mp.CrossReferenceID(),
+		PrimaryOldCall:     csta.ConnectionID{CallID: "1", DeviceID: &csta.LocalDeviceID{Device: "4711"}},
+		ConferencingDevice: csta.SubjectDeviceID{ExtendedDeviceID: csta.ExtendedDeviceID{DeviceIdentifier: csta.DeviceID{Device: "4711"}}},
+		AddedParty:         csta.SubjectDeviceID{ExtendedDeviceID: csta.ExtendedDeviceID{DeviceIdentifier: csta.DeviceID{Device: "5001"}}},
+		ConferenceConnections: csta.ConnectionList{Items: []csta.ConnectionListItem{
+			{NewConnection: &csta.ConnectionID{CallID: "1"}, Endpoint: &csta.Endpoint{DeviceID: &csta.DeviceID{Device: "5001"}}},
+		}},
+	})
+	s.ConnectionCleared(mp.CrossReferenceID(), "1", "100")
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "1" || recorder.IsRecording() {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+
+	// The switch drops the recording station with the call
+	if len(s.Requests(csta.MessageTypeClearConnection)) != 0 {
+		t.Fatal("recording station was dropped from an ended call")
+	}
+}
+
+func TestRecordSingleStepConferenceLeft(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+	aes.recorders = []*recorderTerminal{{Extension: "5001", Recorder: pbxtest.NewRecorder()}}
+
+	mp, err := aes.monitorStart("4711", models.RecordingMethodSingleStepConference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A colleague joins the call and the monitored station hangs up
+	s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	if _, err := s.WaitForRequest(csta.MessageTypeSingleStepConferenceCall, 1, pbxtest.Timeout); err != nil {
+		t.Fatal(err)
+	}
+	s.Established(mp.CrossReferenceID(), "1", "100", "4712")
+	deadline := time.Now().Add(pbxtest.Timeout)
+	for time.Now().Before(deadline) {
+		if call, _ := aes.tracker.Call("1"); len(call.Parties) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.ConnectionCleared(mp.CrossReferenceID(), "1", "4711")
+
+	records.Wait(t, 1)
+	request, err := s.WaitForRequest(csta.MessageTypeClearConnection, 1, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clear := request.(*csta.ClearConnection); clear.ConnectionToBeCleared.CallID != "1" || clear.ConnectionToBeCleared.DeviceID.Device != "5001:CM1::0" {
+		t.Fatalf("unexpected request %+v", clear)
+	}
+}
+
+func TestRecordersConcurrently(t *testing.T) {
+	aes := &AvayaAES{}
+	recorder := &recorderTerminal{Extension: "5001", Recorder: pbxtest.NewRecorder()}
+	aes.recorders = []*recorderTerminal{recorder}
+
+	// Recorders are looked up while they are replaced and assigned, e.g. by Serve and event handlers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			aes.mutex.Lock()
+			aes.recorders = []*recorderTerminal{recorder}
+			aes.mutex.Unlock()
+			aes.releaseRecorder(recorder)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		aes.GetRecorder()
+		aes.GetRecordersByCall("1")
+		aes.GetRecorderByConnection("1", "4711")
+		aes.GetSharedControlRecorder("4711")
+	}
+	<-done
+}
+
+func TestRecordSingleStepConferenceRejected(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, records := connectTestAES(t, s, ctx)
+	recorder := pbxtest.NewRecorder()
+	aes.recorders = []*recorderTerminal{{Extension: "5001", Recorder: recorder}}
+	aes.tracker.Ignore("5001")
+
+	s.Handle(csta.MessageTypeSingleStepConferenceCall, func(csta.Message) csta.Message {
+		return csta.CSTAErrorCode{Operation: "invalidCallID"}
+	})
+
+	mp, err := aes.monitorStart("4711", models.RecordingMethodSingleStepConference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorder is released without a recording when the station can't join
+	s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	select {
+	case <-recorder.Stopped():
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("recording wasn't stopped")
+	}
+	if _, err := aes.GetRecorder(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.ConnectionCleared(mp.CrossReferenceID(), "1", "100")
+	select {
+	case record := <-records:
+		t.Fatalf("unexpected upload record %+v", record)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRejectedKeepalive(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interval := keepaliveInterval
+	keepaliveInterval = 10 * time.Millisecond
+	defer func() { keepaliveInterval = interval }()
+
+	// The switch forgot the session, the driver has to reconnect
+	s.Handle(csta.MessageTypeResetApplicationSessionTimer, func(request csta.Message) csta.Message {
+		return &csta.ResetApplicationSessionTimerNegResponse{}
+	})
+	aes, _ := connectTestAES(t, s, ctx)
+
+	select {
+	case <-aes.conn.Closed():
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("connection wasn't closed")
+	}
+}
@@ -2,41 +2,147 @@ package avaya
 
 import (
 	"fmt"
+	"log"
 	"os"
 
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
 	"github.com/psco-tech/gw-coach-recording-agent/rtp"
 )
 
 type recorderTerminal struct {
-	Extension   string
-	CurrentCall string
-	Recorder    rtp.Recorder
+	Extension string
+	Recorder  rtp.Recorder
+
+	// Connection being recorded, guarded by AvayaAES.mutex as recorders are looked up
+	// and released by event handlers and the responses to requests
+	CurrentCall   string // ID of the call being recorded
+	CurrentDevice string // Monitored device whose connection to the call is recorded
+	FilePath      string
+
+	// Security code of the terminal and the recording device it belongs to, nil for shared control
+	Password string
+	Device   *models.AESRecordingDevice
+
+	// Device ID of the terminal, guarded by AvayaAES.mutex as it is set when registering
+	DeviceID string
+
+	// The virtual station was conferenced into the call being recorded, guarded by AvayaAES.mutex
+	Conferenced bool
+
+	// Monitored extension the terminal is registered in shared control of, its recorder
+	// only records that extension. Empty for virtual stations that use service observing.
+	SharedControl string
+
+	lost          bool // The registration failed or was lost, guarded by AvayaAES.mutex
+	reregistering bool // Guarded by AvayaAES.mutex
 }
 
+// GetRecorder returns an idle recorder of a virtual station for service observing
 func (aes *AvayaAES) GetRecorder() (*recorderTerminal, error) {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
 	for _, r := range aes.recorders {
-		if !r.Recorder.IsRecording() {
+		if r.SharedControl == "" && !r.lost && r.CurrentCall == "" && !r.Recorder.IsRecording() {
 			return r, nil
 		}
 	}
 	return nil, fmt.Errorf("no idle RTP receiver available")
 }
 
-func (aes *AvayaAES) GetRecorderByCallReference(callReference string) (*recorderTerminal, error) {
+// GetSharedControlRecorder returns the recorder registered in shared control of an extension, or nil
+func (aes *AvayaAES) GetSharedControlRecorder(extension string) *recorderTerminal {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	for _, r := range aes.recorders {
+		if r.SharedControl != "" && r.SharedControl == extension {
+			return r
+		}
+	}
+	return nil
+}
+
+// GetRecorderByConnection returns the recorder of the connection of a monitored device to a call
+func (aes *AvayaAES) GetRecorderByConnection(callID string, deviceID string) (*recorderTerminal, error) {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
 	for _, r := range aes.recorders {
-		if r.CurrentCall == callReference {
+		if r.CurrentCall == callID && pbx.SameDevice(r.CurrentDevice, deviceID) {
 			return r, nil
 		}
 	}
-	return nil, fmt.Errorf("no recorder for call reference <%s>", callReference)
+	return nil, fmt.Errorf("no recorder for the connection of <%s> to call <%s>", deviceID, callID)
+}
+
+// GetRecordersByCall returns the recorders of all connections to a call
+func (aes *AvayaAES) GetRecordersByCall(callID string) []*recorderTerminal {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	recorders := make([]*recorderTerminal, 0)
+	for _, r := range aes.recorders {
+		if r.CurrentCall == callID && callID != "" {
+			recorders = append(recorders, r)
+		}
+	}
+	return recorders
 }
 
-func (r *recorderTerminal) StartRecording(writer *os.File, callReference string) error {
-	r.CurrentCall = callReference
+// recording returns the connection a recorder is assigned to
+func (aes *AvayaAES) recording(r *recorderTerminal) (callID string, deviceID string) {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	return r.CurrentCall, r.CurrentDevice
+}
+
+// startRecorder assigns a recorder to the connection of a device to a call and starts recording into writer
+func (aes *AvayaAES) startRecorder(r *recorderTerminal, writer *os.File, callID string, deviceID string) error {
+	aes.mutex.Lock()
+	r.CurrentCall = callID
+	r.CurrentDevice = deviceID
+	r.FilePath = writer.Name()
+	aes.mutex.Unlock()
+
 	return r.Recorder.StartRecording(writer)
 }
 
-func (r *recorderTerminal) StopRecording() error {
+// releaseRecorder frees a recorder from its connection and returns the recorder as it was before.
+// The recorder is only handed out again once its recording is stopped.
+func (aes *AvayaAES) releaseRecorder(r *recorderTerminal) recorderTerminal {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	released := *r
+	r.CurrentCall = ""
+	r.CurrentDevice = ""
+	r.Conferenced = false
+	return released
+}
+
+// abortRecording stops recording a connection that can't be recorded, e.g. because the switch
+// rejected the request for its media, and discards the file. Nothing happens if the recorder
+// isn't recording the call anymore.
+func (aes *AvayaAES) abortRecording(r *recorderTerminal, callID string) {
+	aes.mutex.Lock()
+	if r.CurrentCall != callID {
+		aes.mutex.Unlock()
+		return
+	}
+	filePath := r.FilePath
 	r.CurrentCall = ""
-	return r.Recorder.StopRecording()
+	r.CurrentDevice = ""
+	r.Conferenced = false
+	aes.mutex.Unlock()
+
+	if r.Recorder.IsRecording() {
+		err := r.Recorder.StopRecording()
+		if err != nil {
+			log.Printf("Failed to stop recording of call <%s>: %s\n", callID, err)
+		}
+	}
+	os.Remove(filePath)
 }
@@ -0,0 +1,279 @@
+package avaya
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+)
+
+// How long to wait between attempts to register a terminal again
+var reregistrationInterval = 10 * time.Second
+
+// RegisterTerminal will force-register a virtual station and instruct the Gateway to
+// send any audio data to the specified local endpoint
+func (aes *AvayaAES) RegisterTerminal(extension string, password string, localRtpEndpoint *net.UDPAddr) error {
+	_, err := aes.registerTerminal(extension, terminalLoginInfo(password), localRtpEndpoint)
+	return err
+}
+
+// RegisterSharedControl registers a DMCC station in shared control of a physical station,
+// which has the Gateway send the audio of its calls to the specified local endpoint.
+// The registration depends on the one of the station and doesn't affect it.
+func (aes *AvayaAES) RegisterSharedControl(extension string, password string, localRtpEndpoint *net.UDPAddr) error {
+	_, err := aes.registerTerminal(extension, sharedControlLoginInfo(password), localRtpEndpoint)
+	return err
+}
+
+// UnregisterTerminal releases the registration of a virtual station or shared control
+func (aes *AvayaAES) UnregisterTerminal(extension string) error {
+	deviceId, err := aes.GetDeviceID(extension)
+	if err != nil {
+		return err
+	}
+	return aes.unregisterTerminal(extension, deviceId)
+}
+
+func terminalLoginInfo(password string) csta.LoginInfo {
+	return csta.LoginInfo{
+		ForceLogin:     true,
+		SharedControl:  false,
+		Password:       password,
+		MediaMode:      csta.MediaModeClient,
+		DependencyMode: csta.DependencyModeMain,
+	}
+}
+
+func sharedControlLoginInfo(password string) csta.LoginInfo {
+	return csta.LoginInfo{
+		ForceLogin:     false,
+		SharedControl:  true,
+		Password:       password,
+		MediaMode:      csta.MediaModeClient,
+		DependencyMode: csta.DependencyModeDependent,
+	}
+}
+
+// registerTerminal registers a terminal and returns its device ID, which is known
+// even if the registration failed after looking it up
+func (aes *AvayaAES) registerTerminal(extension string, loginInfo csta.LoginInfo, localRtpEndpoint *net.UDPAddr) (string, error) {
+	// Get the actual device ID for this extension
+	deviceId, err := aes.GetDeviceID(extension)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := aes.conn.Do(aes.ctx, csta.RegisterTerminalRequest{
+		Device:    csta.DeviceID{Device: deviceId, TypeOfNumber: "other", MediaClass: "notKnown"},
+		LoginInfo: loginInfo,
+		LocalMediaInfo: &csta.LocalMediaInfo{
+			// Only RTP is announced, recorders have no RTCP socket and a guessed RTCP port
+			// may belong to the RTP socket of another recorder
+			RTPAddress: &csta.NetworkEndpoint{
+				Address: localRtpEndpoint.IP.String(),
+				Port:    localRtpEndpoint.Port,
+			},
+			Codecs:         []string{"g711U"},
+			EncryptionList: []string{"none"},
+			PacketSize:     20,
+		},
+	})
+	if err != nil {
+		return deviceId, fmt.Errorf("failed to register terminal <%s>: %w", extension, err)
+	}
+
+	r, ok := response.(*csta.RegisterTerminalResponse)
+	if !ok {
+		return deviceId, fmt.Errorf("failed to register terminal <%s>, unexpected response %s", extension, response.Type())
+	}
+	if r.Code != csta.RegistrationCodeNormal {
+		return deviceId, fmt.Errorf("failed to register terminal <%s>: code %s: %s", extension, r.Code, r.Reason)
+	}
+
+	return deviceId, nil
+}
+
+func (aes *AvayaAES) unregisterTerminal(extension string, deviceId string) error {
+	_, err := aes.conn.Do(context.Background(), csta.UnregisterTerminalRequest{
+		Device: csta.DeviceID{Device: deviceId, TypeOfNumber: "other", MediaClass: "notKnown"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unregister terminal <%s>: %w", extension, err)
+	}
+	return nil
+}
+
+// registerRecorder registers the terminal of a recorder and keeps track of its status
+func (aes *AvayaAES) registerRecorder(t *recorderTerminal) error {
+	loginInfo := terminalLoginInfo(t.Password)
+	if t.SharedControl != "" {
+		loginInfo = sharedControlLoginInfo(t.Password)
+	}
+
+	deviceId, err := aes.registerTerminal(t.Extension, loginInfo, t.Recorder.LocalAddr().(*net.UDPAddr))
+
+	aes.mutex.Lock()
+	if deviceId != "" {
+		t.DeviceID = deviceId
+	}
+	t.lost = err != nil
+	var status *models.AESRecordingDevice
+	if err != nil {
+		status = aes.setRegistrationStatus(t, models.RegistrationStatusFailed, err.Error())
+	} else {
+		status = aes.setRegistrationStatus(t, models.RegistrationStatusRegistered, "")
+	}
+	aes.mutex.Unlock()
+
+	aes.saveRegistrationStatus(t, status)
+	return err
+}
+
+// setRegistrationStatus updates the status of an AES recording device, the mutex must be held.
+// A successful registration clears the last error. It returns a copy of the device to be passed
+// to saveRegistrationStatus once the mutex is released, or nil if there is nothing to save.
+func (aes *AvayaAES) setRegistrationStatus(t *recorderTerminal, status models.RegistrationStatus, lastError string) *models.AESRecordingDevice {
+	if t.Device == nil {
+		return nil
+	}
+
+	t.Device.RegistrationStatus = status
+	if lastError != "" {
+		t.Device.LastError = lastError
+	}
+	if status == models.RegistrationStatusRegistered {
+		t.Device.LastError = ""
+		t.Device.RegisteredAt = time.Now()
+	}
+
+	device := *t.Device
+	return &device
+}
+
+// saveRegistrationStatus persists a status returned by setRegistrationStatus, the mutex must not be held
+func (aes *AvayaAES) saveRegistrationStatus(t *recorderTerminal, device *models.AESRecordingDevice) {
+	if device == nil || aes.db == nil {
+		return
+	}
+
+	err := aes.db.SaveRegistrationStatus(device)
+	if err != nil {
+		log.Printf("Failed to save the registration status of <%s>: %s\n", t.Extension, err)
+	}
+}
+
+// startReregistration registers a terminal again after a delay and keeps trying
+// until it succeeds, unless that is going on already
+func (aes *AvayaAES) startReregistration(t *recorderTerminal, delay time.Duration) {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	if t.reregistering {
+		return
+	}
+	t.reregistering = true
+	go aes.reregister(t, delay)
+}
+
+func (aes *AvayaAES) reregister(t *recorderTerminal, delay time.Duration) {
+	defer func() {
+		aes.mutex.Lock()
+		t.reregistering = false
+		aes.mutex.Unlock()
+	}()
+
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-aes.conn.Closed():
+			timer.Stop()
+			return
+		case <-aes.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		err := aes.registerRecorder(t)
+		if err == nil {
+			log.Printf("Registered terminal <%s> again\n", t.Extension)
+			return
+		}
+		log.Printf("Failed to register terminal <%s> again: %s\n", t.Extension, err)
+		delay = reregistrationInterval
+	}
+}
+
+// onTerminalUnregistered registers a recorder's terminal again after its registration was lost
+func (aes *AvayaAES) onTerminalUnregistered(c *csta.Context) {
+	e, ok := c.Message.(*csta.TerminalUnregisteredEvent)
+	if !ok {
+		return
+	}
+
+	aes.mutex.Lock()
+	var terminal *recorderTerminal
+	for _, t := range aes.recorders {
+		if t.DeviceID != "" && pbx.SameDevice(t.DeviceID, e.Device.Device) {
+			terminal = t
+			break
+		}
+	}
+	if terminal == nil {
+		aes.mutex.Unlock()
+		return
+	}
+	terminal.lost = true
+	status := aes.setRegistrationStatus(terminal, models.RegistrationStatusUnregistered, fmt.Sprintf("registration lost: code %s: %s", e.Code, e.Reason))
+	aes.mutex.Unlock()
+	aes.saveRegistrationStatus(terminal, status)
+
+	log.Printf("Registration of terminal <%s> was lost (code %s: %s), registering it again\n", terminal.Extension, e.Code, e.Reason)
+	aes.startReregistration(terminal, 0)
+}
+
+// unregisterRecorders releases the registrations of all recorders' terminals
+func (aes *AvayaAES) unregisterRecorders() {
+	aes.mutex.Lock()
+	terminals := make([]*recorderTerminal, 0, len(aes.recorders))
+	for _, t := range aes.recorders {
+		if t.DeviceID != "" && !t.lost {
+			terminals = append(terminals, t)
+		}
+	}
+	aes.mutex.Unlock()
+
+	for _, t := range terminals {
+		err := aes.unregisterTerminal(t.Extension, t.DeviceID)
+		if err != nil {
+			log.Printf("%s\n", err)
+			continue
+		}
+
+		aes.mutex.Lock()
+		t.lost = true
+		status := aes.setRegistrationStatus(t, models.RegistrationStatusUnregistered, "")
+		aes.mutex.Unlock()
+		aes.saveRegistrationStatus(t, status)
+	}
+}
+
+// registered tells whether the terminal of a recorder is ready to record
+func (aes *AvayaAES) registered(t *recorderTerminal) bool {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	return !t.lost
+}
+
+func (aes *AvayaAES) terminalDeviceID(t *recorderTerminal) string {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+
+	return t.DeviceID
+}
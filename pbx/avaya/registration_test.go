@@ -0,0 +1,155 @@
+package avaya
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/csta/cstatest"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/pbxtest"
+)
+
+// registrationStatus returns the status of a recording device while the driver may update it
+func registrationStatus(aes *AvayaAES, t *recorderTerminal) models.AESRecordingDevice {
+	aes.mutex.Lock()
+	defer aes.mutex.Unlock()
+	return *t.Device
+}
+
+func TestRegisterTerminal(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aes, _ := connectTestAES(t, s, ctx)
+
+	err = aes.RegisterTerminal("5001", "1234", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40002})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	register := s.Requests(csta.MessageTypeRegisterTerminalRequest)[0].(*csta.RegisterTerminalRequest)
+	if media := register.LocalMediaInfo; media.RTPAddress.Port != 40002 || media.RTCPAddress != nil {
+		t.Fatalf("unexpected media endpoints %+v, %+v", media.RTPAddress, media.RTCPAddress)
+	}
+
+	// Rejected registrations are reported with their reason
+	s.Handle(csta.MessageTypeRegisterTerminalRequest, func(request csta.Message) csta.Message {
+		return &csta.RegisterTerminalResponse{Code: "-2", Reason: "Invalid password"}
+	})
+	err = aes.RegisterTerminal("5001", "4321", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40002})
+	if err == nil || !strings.Contains(err.Error(), "Invalid password") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err = aes.UnregisterTerminal("5001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unregister := s.Requests(csta.MessageTypeUnregisterTerminalRequest)
+	if len(unregister) != 1 || unregister[0].(*csta.UnregisterTerminalRequest).Device.Device != "5001:CM1::0" {
+		t.Fatalf("unexpected unregistration %+v", unregister)
+	}
+}
+
+func TestReregisterTerminal(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interval := reregistrationInterval
+	reregistrationInterval = 10 * time.Millisecond
+	defer func() { reregistrationInterval = interval }()
+
+	aes, _ := connectTestAES(t, s, ctx)
+	terminal := &recorderTerminal{
+		Extension: "5001",
+		Password:  "1234",
+		Device:    &models.AESRecordingDevice{Extension: "5001", Password: "1234"},
+		Recorder:  pbxtest.NewRecorder(),
+	}
+	aes.recorders = []*recorderTerminal{terminal}
+
+	// Rejected registrations are reported with their reason
+	s.Handle(csta.MessageTypeRegisterTerminalRequest, func(request csta.Message) csta.Message {
+		return &csta.RegisterTerminalResponse{Code: "-2", Reason: "Invalid password"}
+	})
+	err = aes.registerRecorder(terminal)
+	if status := registrationStatus(aes, terminal); err == nil || status.RegistrationStatus != models.RegistrationStatusFailed || !strings.Contains(status.LastError, "Invalid password") {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	s.Handle(csta.MessageTypeRegisterTerminalRequest, func(request csta.Message) csta.Message {
+		return &csta.RegisterTerminalResponse{Code: csta.RegistrationCodeNormal}
+	})
+	err = aes.registerRecorder(terminal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := registrationStatus(aes, terminal); status.RegistrationStatus != models.RegistrationStatusRegistered || status.RegisteredAt.IsZero() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// The gatekeeper rejects the first attempt to register again
+	var mutex sync.Mutex
+	attempts := 0
+	s.Handle(csta.MessageTypeRegisterTerminalRequest, func(request csta.Message) csta.Message {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		response := &csta.RegisterTerminalResponse{Code: csta.RegistrationCodeNormal}
+		if attempts == 1 {
+			response.Code, response.Reason = "-1", "Gatekeeper unavailable"
+		}
+		return response
+	})
+
+	err = s.Send(&csta.TerminalUnregisteredEvent{
+		Device: csta.DeviceID{Device: "5001:CM1:0.0.0.0:0"},
+		Reason: "The gatekeeper unregistered the terminal",
+		Code:   "-3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.WaitForRequest(csta.MessageTypeRegisterTerminalRequest, 3, pbxtest.Timeout); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(pbxtest.Timeout)
+	for registrationStatus(aes, terminal).RegistrationStatus != models.RegistrationStatusRegistered && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The error of the failed attempt is cleared by the successful one
+	if status := registrationStatus(aes, terminal); status.RegistrationStatus != models.RegistrationStatusRegistered || status.LastError != "" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if _, err := aes.GetRecorder(); err != nil {
+		t.Fatal("registered recorder isn't available")
+	}
+
+	// Terminals are unregistered when the connection is closed
+	aes.Close()
+	unregister := s.Requests(csta.MessageTypeUnregisterTerminalRequest)
+	if len(unregister) != 1 || unregister[0].(*csta.UnregisterTerminalRequest).Device.Device != "5001:CM1::0" {
+		t.Fatalf("unexpected unregistration %+v", unregister)
+	}
+	if status := registrationStatus(aes, terminal); status.RegistrationStatus != models.RegistrationStatusUnregistered {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,719 @@
+package pbx
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+)
+
+type CallState string
+
+const (
+	CallStateInitiated CallState = "initiated"
+	CallStateAlerting  CallState = "alerting"
+	CallStateConnected CallState = "connected"
+	CallStateHeld      CallState = "held"
+	CallStateEnded     CallState = "ended"
+)
+
+// PartyState is the state of the connection of a device to a call
+type PartyState string
+
+const (
+	PartyStateInitiated PartyState = "initiated"
+	PartyStateAlerting  PartyState = "alerting"
+	PartyStateConnected PartyState = "connected"
+	PartyStateHeld      PartyState = "held"
+	PartyStateQueued    PartyState = "queued"
+	PartyStateFailed    PartyState = "failed"
+)
+
+// CallDirection is the direction of a call from the point of view of the monitored devices
+type CallDirection string
+
+const (
+	CallDirectionUnknown  CallDirection = ""
+	CallDirectionInbound  CallDirection = "inbound"
+	CallDirectionOutbound CallDirection = "outbound"
+	CallDirectionInternal CallDirection = "internal"
+)
+
+type CallEventType string
+
+const (
+	CallEventAlerting    CallEventType = "alerting"
+	CallEventConnected   CallEventType = "connected"
+	CallEventHeld        CallEventType = "held"
+	CallEventRetrieved   CallEventType = "retrieved"
+	CallEventTransferred CallEventType = "transferred"
+	CallEventConferenced CallEventType = "conferenced"
+	CallEventLeft        CallEventType = "left" // A party left a call that goes on
+	CallEventEnded       CallEventType = "ended"
+)
+
+type Party struct {
+	DeviceID string
+	State    PartyState
+}
+
+// Call is a snapshot of a call tracked by a CallTracker
+type Call struct {
+	ID            string
+	GlobalCallID  string
+	State         CallState
+	Direction     CallDirection
+	CallingDevice string
+	CalledDevice  string
+	Parties       []Party // In the order they joined the call
+
+	Started  time.Time
+	Answered time.Time // Zero if the call was never answered
+	Ended    time.Time // Zero while the call is going on
+}
+
+// Party returns the party of a device, devices are compared by their dialing number
+func (c *Call) Party(deviceID string) *Party {
+	for i := range c.Parties {
+		if SameDevice(c.Parties[i].DeviceID, deviceID) {
+			return &c.Parties[i]
+		}
+	}
+	return nil
+}
+
+// Annotate adds the metadata of the call to the upload record of its recording
+func (c *Call) Annotate(record *models.UploadRecord) {
+	record.CallID = c.ID
+	record.GlobalCallID = c.GlobalCallID
+	record.CallerNumber = deviceNumber(c.CallingDevice)
+	record.CalleeNumber = deviceNumber(c.CalledDevice)
+
+	record.Begin = c.Started
+	if !c.Answered.IsZero() {
+		record.Begin = c.Answered
+	}
+	record.End = c.Ended
+	if record.End.IsZero() {
+		record.End = time.Now()
+	}
+}
+
+func (c *Call) copy() Call {
+	snapshot := *c
+	snapshot.Parties = append([]Party(nil), c.Parties...)
+	return snapshot
+}
+
+// CallEvent reports a change in the lifecycle of a call
+type CallEvent struct {
+	Type CallEventType
+	Call Call
+
+	// Device that caused the event, e.g. the holding or transferring device
+	Device            string
+	Cause             csta.EventCause
+	MonitorCrossRefID string
+
+	// Calls that were merged into Call by a transfer or conference
+	PreviousCallIDs []string
+}
+
+// CallTracker maintains the state of calls from the CSTA call control events of
+// any PBX. Events seen by several monitor points are only reported once. The
+// events must be handled in the order they were sent.
+type CallTracker struct {
+	mutex       sync.Mutex // Guards the calls, devices and subscribers, serializes publishing
+	calls       map[string]*Call
+	monitored   map[string]string // Dialing numbers of the monitored devices by cross reference ID
+	ignored     map[string]bool   // Dialing numbers of devices that aren't parties of calls
+	subscribers map[*callSubscription]bool
+	now         func() time.Time
+}
+
+// callSubscription queues the call events of a subscriber without bound, the drivers keep
+// their recordings in step with the calls and must not lose any event
+type callSubscription struct {
+	events chan CallEvent
+	mutex  sync.Mutex // Guards queue
+	queue  []CallEvent
+	queued chan struct{} // Signals the delivery that events were queued
+}
+
+func NewCallTracker() *CallTracker {
+	return &CallTracker{
+		calls:       make(map[string]*Call),
+		monitored:   make(map[string]string),
+		ignored:     make(map[string]bool),
+		subscribers: make(map[*callSubscription]bool),
+		now:         time.Now,
+	}
+}
+
+// Monitor tells the tracker which device a monitor point observes, which
+// determines the direction of its calls
+func (t *CallTracker) Monitor(crossReferenceID string, deviceID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.monitored[crossReferenceID] = deviceNumber(deviceID)
+}
+
+// Ignore keeps a device out of the parties of calls, e.g. a recording station that
+// is conferenced into them
+func (t *CallTracker) Ignore(deviceID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.ignored[deviceNumber(deviceID)] = true
+}
+
+// Reset ends all calls and forgets the monitored devices, e.g. when the connection to the
+// PBX was lost and the events of the calls with it
+func (t *CallTracker) Reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, c := range t.calls {
+		t.publish(t.end(c, "", "", ""))
+	}
+	t.monitored = make(map[string]string)
+}
+
+// Events returns a channel that receives all call events from now on
+func (t *CallTracker) Events() <-chan CallEvent {
+	return t.Subscribe(context.Background())
+}
+
+// Subscribe returns a channel that receives all call events from now on until the context
+// is done, then it is closed. Events are queued for a subscriber that falls behind, handling
+// never waits for it and it never loses an event.
+func (t *CallTracker) Subscribe(ctx context.Context) <-chan CallEvent {
+	s := &callSubscription{
+		events: make(chan CallEvent),
+		queued: make(chan struct{}, 1),
+	}
+
+	t.mutex.Lock()
+	t.subscribers[s] = true
+	t.mutex.Unlock()
+
+	go t.deliver(ctx, s)
+	return s.events
+}
+
+// deliver passes the queued events of a subscription on in order until the context is done
+func (t *CallTracker) deliver(ctx context.Context, s *callSubscription) {
+	defer func() {
+		t.mutex.Lock()
+		delete(t.subscribers, s)
+		t.mutex.Unlock()
+		close(s.events)
+	}()
+
+	for {
+		s.mutex.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mutex.Unlock()
+
+		for _, event := range queue {
+			select {
+			case s.events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(queue) > 0 {
+			continue
+		}
+
+		select {
+		case <-s.queued:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publish queues an event for all subscribers, the mutex must be held
+func (t *CallTracker) publish(event CallEvent) {
+	for s := range t.subscribers {
+		s.mutex.Lock()
+		s.queue = append(s.queue, event)
+		s.mutex.Unlock()
+
+		select {
+		case s.queued <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Call returns a snapshot of a call that is going on
+func (t *CallTracker) Call(callID string) (Call, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if c, ok := t.calls[callID]; ok {
+		return c.copy(), true
+	}
+	return Call{}, false
+}
+
+// Calls returns snapshots of all calls that are going on
+func (t *CallTracker) Calls() []Call {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	calls := make([]Call, 0, len(t.calls))
+	for _, c := range t.calls {
+		calls = append(calls, c.copy())
+	}
+	return calls
+}
+
+// Handle updates the calls with a CSTA event, other messages are ignored
+func (t *CallTracker) Handle(message csta.Message) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Published with the mutex held, so that concurrent handlers can't reorder the events
+	for _, event := range t.handle(message) {
+		t.publish(event)
+	}
+}
+
+// handle applies an event and returns the resulting call events, the mutex must be held
+func (t *CallTracker) handle(message csta.Message) []CallEvent {
+	crossRefID, _ := MonitorCrossRefID(message)
+
+	switch e := message.(type) {
+	case *csta.ServiceInitiatedEvent:
+		c := t.call(e.InitiatedConnection.CallID, e.CallLinkageData)
+		t.join(c, e.InititatingDevice.DeviceIdentifier.Device, PartyStateInitiated)
+		return t.update(c, crossRefID, e.Cause)
+
+	case *csta.OriginatedEvent:
+		c := t.call(e.OriginatedConnection.CallID, nil)
+		t.setDevices(c, e.CallingDevice, e.CalledDevice)
+		t.join(c, e.CallingDevice.DeviceIdentifier.Device, PartyStateConnected)
+		return t.update(c, crossRefID, e.Cause)
+
+	case *csta.DeliveredEvent:
+		c := t.call(e.Connection.CallID, e.CallLinkageData)
+		t.setDevices(c, e.CallingDevice, e.CalledDevice)
+		t.add(c, e.CallingDevice.DeviceIdentifier.Device, PartyStateConnected)
+		t.join(c, e.AlertingDevice.DeviceIdentifier.Device, PartyStateAlerting)
+		return t.update(c, crossRefID, e.Cause)
+
+	case *csta.EstablishedEvent:
+		c := t.call(e.EstablishedConnection.CallID, e.CallLinkageData)
+		t.setDevices(c, e.CallingDevice, e.CalledDevice)
+		t.add(c, e.CallingDevice.DeviceIdentifier.Device, PartyStateConnected)
+		t.join(c, e.AnsweringDevice.DeviceIdentifier.Device, PartyStateConnected)
+		return t.update(c, crossRefID, e.Cause)
+
+	case *csta.HeldEvent:
+		c, ok := t.calls[e.HeldConnection.CallID]
+		if !ok || !t.join(c, e.HoldingDevice.DeviceIdentifier.Device, PartyStateHeld) {
+			return nil
+		}
+		t.update(c, crossRefID, e.Cause)
+		return []CallEvent{t.event(CallEventHeld, c, e.HoldingDevice.DeviceIdentifier.Device, crossRefID, e.Cause)}
+
+	case *csta.RetrievedEvent:
+		c, ok := t.calls[e.RetrievedConnection.CallID]
+		if !ok || !t.join(c, e.RetrievingDevice.DeviceIdentifier.Device, PartyStateConnected) {
+			return nil
+		}
+		t.update(c, crossRefID, e.Cause)
+		return []CallEvent{t.event(CallEventRetrieved, c, e.RetrievingDevice.DeviceIdentifier.Device, crossRefID, e.Cause)}
+
+	case *csta.TransferredEvent:
+		return t.merge(CallEventTransferred, mergedCalls(e.PrimaryOldCall, e.SecondaryOldCall, e.TransferredConnections),
+			e.TransferredConnections, e.TransferringDevice.DeviceIdentifier.Device, false, e.CallLinkageData, crossRefID, e.Cause)
+
+	case *csta.ConferencedEvent:
+		return t.merge(CallEventConferenced, mergedCalls(e.PrimaryOldCall, e.SecondaryOldCall, e.ConferenceConnections),
+			e.ConferenceConnections, e.ConferencingDevice.DeviceIdentifier.Device, true, e.CallLinkageData, crossRefID, e.Cause)
+
+	case *csta.DivertedEvent:
+		c, ok := t.calls[e.Connection.CallID]
+		if !ok {
+			return nil
+		}
+		diverting := e.DivertingDevice.DeviceIdentifier.Device
+		if !t.leave(c, diverting) {
+			return nil
+		}
+		return append(t.update(c, crossRefID, e.Cause), t.event(CallEventLeft, c, diverting, crossRefID, e.Cause))
+
+	case *csta.FailedEvent:
+		c := t.call(e.FailedConnection.CallID, nil)
+		t.setDevices(c, e.CallingDevice, e.CalledDevice)
+		t.join(c, e.FailingDevice.DeviceIdentifier.Device, PartyStateFailed)
+		return t.update(c, crossRefID, e.Cause)
+
+	case *csta.QueuedEvent:
+		c := t.call(e.QueuedConnection.CallID, nil)
+		t.setDevices(c, e.CallingDevice, e.CalledDevice)
+		t.add(c, e.CallingDevice.DeviceIdentifier.Device, PartyStateConnected)
+		t.join(c, e.Queue.DeviceIdentifier.Device, PartyStateQueued)
+		return t.update(c, crossRefID, e.Cause)
+
+	case *csta.ConnectionClearedEvent:
+		c, ok := t.calls[e.DroppedConnection.CallID]
+		if !ok {
+			return nil
+		}
+		dropped := e.ReleasingDevice.DeviceIdentifier.Device
+		if e.DroppedConnection.DeviceID != nil {
+			dropped = e.DroppedConnection.DeviceID.Device
+		}
+		left := t.leave(c, dropped)
+
+		// A single party left isn't a call anymore
+		if len(c.Parties) < 2 {
+			return []CallEvent{t.end(c, dropped, crossRefID, e.Cause)}
+		}
+		if !left {
+			return nil
+		}
+		return append(t.update(c, crossRefID, e.Cause), t.event(CallEventLeft, c, dropped, crossRefID, e.Cause))
+
+	case *csta.CallClearedEvent:
+		c, ok := t.calls[e.ClearedCall.CallID]
+		if !ok {
+			return nil
+		}
+		return []CallEvent{t.end(c, "", crossRefID, e.Cause)}
+	}
+
+	return nil
+}
+
+// call returns the call with an ID, a new call is created for unknown IDs
+func (t *CallTracker) call(callID string, linkage *csta.CallLinkageData) *Call {
+	c, ok := t.calls[callID]
+	if !ok {
+		c = &Call{
+			ID:      callID,
+			State:   CallStateInitiated,
+			Parties: make([]Party, 0),
+			Started: t.now(),
+		}
+		t.calls[callID] = c
+	}
+
+	if linkage != nil && c.GlobalCallID == "" {
+		c.GlobalCallID = linkage.GlobalCallData.GlobalCallLinkageID.GloballyUniqueCallLinkageID
+	}
+
+	return c
+}
+
+func (t *CallTracker) setDevices(c *Call, calling csta.SubjectDeviceID, called csta.SubjectDeviceID) {
+	if c.CallingDevice == "" {
+		c.CallingDevice = calling.DeviceIdentifier.Device
+	}
+	if c.CalledDevice == "" {
+		c.CalledDevice = called.DeviceIdentifier.Device
+	}
+
+	if c.Direction == CallDirectionUnknown && c.CallingDevice != "" && c.CalledDevice != "" {
+		callingMonitored, calledMonitored := t.isMonitored(c.CallingDevice), t.isMonitored(c.CalledDevice)
+		switch {
+		case callingMonitored && calledMonitored:
+			c.Direction = CallDirectionInternal
+		case callingMonitored:
+			c.Direction = CallDirectionOutbound
+		case calledMonitored:
+			c.Direction = CallDirectionInbound
+		}
+	}
+}
+
+func (t *CallTracker) isMonitored(deviceID string) bool {
+	number := deviceNumber(deviceID)
+	for _, monitored := range t.monitored {
+		if monitored == number {
+			return true
+		}
+	}
+	return false
+}
+
+// join adds a party to a call or changes its state, it returns false if nothing changed
+func (t *CallTracker) join(c *Call, deviceID string, state PartyState) bool {
+	if deviceID == "" || t.ignored[deviceNumber(deviceID)] {
+		return false
+	}
+
+	if party := c.Party(deviceID); party != nil {
+		if party.State == state {
+			return false
+		}
+		party.State = state
+		return true
+	}
+
+	c.Parties = append(c.Parties, Party{DeviceID: deviceID, State: state})
+	return true
+}
+
+// add adds a party that is implied by an event, e.g. the calling device, unless it is known already
+func (t *CallTracker) add(c *Call, deviceID string, state PartyState) {
+	if deviceID != "" && !t.ignored[deviceNumber(deviceID)] && c.Party(deviceID) == nil {
+		c.Parties = append(c.Parties, Party{DeviceID: deviceID, State: state})
+	}
+}
+
+// leave removes a party from a call, it returns false if the device wasn't a party
+func (t *CallTracker) leave(c *Call, deviceID string) bool {
+	for i := range c.Parties {
+		if SameDevice(c.Parties[i].DeviceID, deviceID) {
+			c.Parties = append(c.Parties[:i], c.Parties[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// update derives the state of a call from its parties and reports alerting and connected calls
+func (t *CallTracker) update(c *Call, crossRefID string, cause csta.EventCause) []CallEvent {
+	connected, alerting, held := 0, 0, 0
+	for _, party := range c.Parties {
+		switch party.State {
+		case PartyStateConnected:
+			connected++
+		case PartyStateAlerting, PartyStateQueued:
+			alerting++
+		case PartyStateHeld:
+			held++
+		}
+	}
+
+	previous := c.State
+	switch {
+	case held > 0 && connected+held >= 2:
+		c.State = CallStateHeld
+	case connected >= 2:
+		c.State = CallStateConnected
+	case alerting > 0:
+		c.State = CallStateAlerting
+	}
+
+	if c.State == previous {
+		return nil
+	}
+
+	switch c.State {
+	case CallStateAlerting:
+		return []CallEvent{t.event(CallEventAlerting, c, "", crossRefID, cause)}
+	case CallStateConnected:
+		if previous == CallStateHeld {
+			// Reported as retrieved
+			return nil
+		}
+		if c.Answered.IsZero() {
+			c.Answered = t.now()
+		}
+		return []CallEvent{t.event(CallEventConnected, c, "", crossRefID, cause)}
+	}
+	return nil
+}
+
+// merger are the calls a transfer or conference merged and the resulting call
+type merger struct {
+	oldCallIDs []string
+	resultID   string
+}
+
+// mergedCalls determines the calls of a transfer or conference from its old calls and new connections
+func mergedCalls(primary csta.ConnectionID, secondary *csta.ConnectionID, connections csta.ConnectionList) merger {
+	oldCallIDs := []string{primary.CallID}
+	if secondary != nil && secondary.CallID != "" && secondary.CallID != primary.CallID {
+		oldCallIDs = append(oldCallIDs, secondary.CallID)
+	}
+
+	// The resulting call is the one of the new connections
+	resultID := oldCallIDs[len(oldCallIDs)-1]
+	for _, item := range connections.Items {
+		if item.NewConnection != nil && item.NewConnection.CallID != "" {
+			resultID = item.NewConnection.CallID
+			break
+		}
+	}
+	return merger{oldCallIDs: oldCallIDs, resultID: resultID}
+}
+
+// MergedCalls returns the IDs of the calls a TransferredEvent or ConferencedEvent merged
+// and the ID of the resulting call, ok is false for other messages
+func MergedCalls(message csta.Message) (previousCallIDs []string, callID string, ok bool) {
+	var m merger
+	switch e := message.(type) {
+	case *csta.TransferredEvent:
+		m = mergedCalls(e.PrimaryOldCall, e.SecondaryOldCall, e.TransferredConnections)
+	case *csta.ConferencedEvent:
+		m = mergedCalls(e.PrimaryOldCall, e.SecondaryOldCall, e.ConferenceConnections)
+	default:
+		return nil, "", false
+	}
+
+	for _, id := range m.oldCallIDs {
+		if id != m.resultID {
+			previousCallIDs = append(previousCallIDs, id)
+		}
+	}
+	return previousCallIDs, m.resultID, true
+}
+
+// merge joins the calls of a transfer or conference into the resulting call
+func (t *CallTracker) merge(eventType CallEventType, m merger, connections csta.ConnectionList,
+	device string, stays bool, linkage *csta.CallLinkageData, crossRefID string, cause csta.EventCause) []CallEvent {
+	oldCallIDs, resultID := m.oldCallIDs, m.resultID
+
+	// Late events of calls that ended already
+	_, known := t.calls[resultID]
+	for _, id := range oldCallIDs {
+		if _, ok := t.calls[id]; ok {
+			known = true
+		}
+	}
+	if !known {
+		return nil
+	}
+
+	result := &Call{
+		ID:      resultID,
+		Parties: make([]Party, 0),
+	}
+	previousCallIDs := make([]string, 0)
+	for _, id := range oldCallIDs {
+		old, ok := t.calls[id]
+		if !ok {
+			continue
+		}
+		if id != resultID {
+			previousCallIDs = append(previousCallIDs, id)
+		}
+		delete(t.calls, id)
+
+		if result.Started.IsZero() || old.Started.Before(result.Started) {
+			result.Started = old.Started
+		}
+		if !old.Answered.IsZero() && (result.Answered.IsZero() || old.Answered.Before(result.Answered)) {
+			result.Answered = old.Answered
+		}
+		if result.CallingDevice == "" {
+			result.CallingDevice, result.CalledDevice = old.CallingDevice, old.CalledDevice
+			result.Direction = old.Direction
+			result.GlobalCallID = old.GlobalCallID
+		}
+		for _, party := range old.Parties {
+			t.add(result, party.DeviceID, party.State)
+		}
+	}
+
+	// Events of the resulting call may have arrived before
+	if existing, ok := t.calls[resultID]; ok {
+		for _, party := range existing.Parties {
+			t.add(result, party.DeviceID, party.State)
+		}
+		if result.Started.IsZero() {
+			result.Started = existing.Started
+		}
+	}
+	if result.Started.IsZero() {
+		result.Started = t.now()
+	}
+	result.State = CallStateConnected
+	t.calls[resultID] = result
+
+	t.call(resultID, linkage)
+	for _, item := range connections.Items {
+		if item.Endpoint != nil && item.Endpoint.DeviceID != nil {
+			t.join(result, item.Endpoint.DeviceID.Device, PartyStateConnected)
+		}
+	}
+	if stays {
+		t.join(result, device, PartyStateConnected)
+	} else {
+		t.leave(result, device)
+	}
+
+	t.update(result, crossRefID, cause)
+	event := t.event(eventType, result, device, crossRefID, cause)
+	event.PreviousCallIDs = previousCallIDs
+	return []CallEvent{event}
+}
+
+func (t *CallTracker) end(c *Call, deviceID string, crossRefID string, cause csta.EventCause) CallEvent {
+	c.State = CallStateEnded
+	c.Ended = t.now()
+	delete(t.calls, c.ID)
+
+	return t.event(CallEventEnded, c, deviceID, crossRefID, cause)
+}
+
+func (t *CallTracker) event(eventType CallEventType, c *Call, deviceID string, crossRefID string, cause csta.EventCause) CallEvent {
+	return CallEvent{
+		Type:              eventType,
+		Call:              c.copy(),
+		Device:            deviceID,
+		Cause:             cause,
+		MonitorCrossRefID: crossRefID,
+	}
+}
+
+// MonitorCrossRefID returns the cross reference ID of the monitor point an event was sent for
+func MonitorCrossRefID(message csta.Message) (string, bool) {
+	switch e := message.(type) {
+	case *csta.ServiceInitiatedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.OriginatedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.DeliveredEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.EstablishedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.ConnectionClearedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.HeldEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.RetrievedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.TransferredEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.ConferencedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.DivertedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.FailedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.QueuedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.CallClearedEvent:
+		return e.MonitorCrossRefID, true
+	case *csta.DigitsDissipatedEvent:
+		return e.MonitorCrossRefID, true
+	}
+	return "", false
+}
+
+// deviceNumber returns the dialing number of a device ID. AES device IDs have
+// the form <extension>:<switch>:<address>:<instance>.
+func deviceNumber(deviceID string) string {
+	number, _, _ := strings.Cut(deviceID, ":")
+	return number
+}
+
+// SameDevice tells whether two device IDs refer to the same device, e.g. an AES
+// device ID and the dialing number of the extension
+func SameDevice(a string, b string) bool {
+	return deviceNumber(a) == deviceNumber(b)
+}
@@ -0,0 +1,265 @@
+package pbx
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+)
+
+func subjectDevice(device string) csta.SubjectDeviceID {
+	return csta.SubjectDeviceID{ExtendedDeviceID: csta.ExtendedDeviceID{DeviceIdentifier: csta.DeviceID{Device: device}}}
+}
+
+func connection(callID string, device string) csta.ConnectionID {
+	return csta.ConnectionID{CallID: callID, DeviceID: &csta.LocalDeviceID{Device: device}}
+}
+
+// expectEvents checks the call events emitted so far, which are delivered in the background
+func expectEvents(t *testing.T, events <-chan CallEvent, expected ...CallEventType) []CallEvent {
+	t.Helper()
+
+	received := make([]CallEvent, 0)
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(expected) {
+		select {
+		case event := <-events:
+			received = append(received, event)
+			continue
+		case <-timeout:
+		}
+		break
+	}
+
+	// Events beyond the expected ones are delivered right after them
+	select {
+	case event := <-events:
+		received = append(received, event)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if len(received) != len(expected) {
+		t.Fatalf("expected events %v, got %+v", expected, received)
+	}
+	for i := range expected {
+		if received[i].Type != expected[i] {
+			t.Fatalf("expected events %v, got %+v", expected, received)
+		}
+	}
+	return received
+}
+
+func TestCallTrackerInboundCall(t *testing.T) {
+	tracker := NewCallTracker()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	// AES device IDs differ between MonitorStart and events
+	tracker.Monitor("1", "4711:CM1::0")
+	tracker.Monitor("2", "4712:CM1::0")
+	events := tracker.Events()
+
+	delivered := &csta.DeliveredEvent{
+		MonitorCrossRefID: "1",
+		Connection:        connection("42", "4711:CM1:0.0.0.0:0"),
+		AlertingDevice:    subjectDevice("4711:CM1:0.0.0.0:0"),
+		CallingDevice:     subjectDevice("T42#1"),
+		CalledDevice:      subjectDevice("4711:CM1:0.0.0.0:0"),
+		CallLinkageData: &csta.CallLinkageData{GlobalCallData: csta.GlobalCallData{
+			GlobalCallLinkageID: csta.GlobalCallLinkageID{GloballyUniqueCallLinkageID: "00FF0A2C"},
+		}},
+		Cause: csta.EventCauseNewCall,
+	}
+	tracker.Handle(delivered)
+	e := expectEvents(t, events, CallEventAlerting)
+	if e[0].Call.Direction != CallDirectionInbound || e[0].Call.GlobalCallID != "00FF0A2C" || e[0].MonitorCrossRefID != "1" {
+		t.Fatalf("unexpected call %+v", e[0].Call)
+	}
+
+	now = now.Add(5 * time.Second)
+	established := &csta.EstablishedEvent{
+		MonitorCrossRefID:     "1",
+		EstablishedConnection: connection("42", "4711:CM1:0.0.0.0:0"),
+		AnsweringDevice:       subjectDevice("4711:CM1:0.0.0.0:0"),
+		CallingDevice:         subjectDevice("T42#1"),
+		CalledDevice:          subjectDevice("4711:CM1:0.0.0.0:0"),
+	}
+	tracker.Handle(established)
+	// The same event seen by another monitor point is no news
+	tracker.Handle(established)
+	e = expectEvents(t, events, CallEventConnected)
+	if !e[0].Call.Answered.Equal(now) || e[0].Call.Party("4711:CM1::0").State != PartyStateConnected {
+		t.Fatalf("unexpected call %+v", e[0].Call)
+	}
+
+	tracker.Handle(&csta.HeldEvent{MonitorCrossRefID: "1", HeldConnection: connection("42", "4711:CM1:0.0.0.0:0"), HoldingDevice: subjectDevice("4711:CM1:0.0.0.0:0")})
+	e = expectEvents(t, events, CallEventHeld)
+	if e[0].Call.State != CallStateHeld || e[0].Device != "4711:CM1:0.0.0.0:0" {
+		t.Fatalf("unexpected call %+v", e[0].Call)
+	}
+
+	tracker.Handle(&csta.RetrievedEvent{MonitorCrossRefID: "1", RetrievedConnection: connection("42", "4711:CM1:0.0.0.0:0"), RetrievingDevice: subjectDevice("4711:CM1:0.0.0.0:0")})
+	e = expectEvents(t, events, CallEventRetrieved)
+	if e[0].Call.State != CallStateConnected {
+		t.Fatalf("unexpected call %+v", e[0].Call)
+	}
+
+	now = now.Add(time.Minute)
+	tracker.Handle(&csta.ConnectionClearedEvent{MonitorCrossRefID: "1", DroppedConnection: connection("42", "T42#1"), ReleasingDevice: subjectDevice("T42#1")})
+	e = expectEvents(t, events, CallEventEnded)
+	if e[0].Call.State != CallStateEnded || !e[0].Call.Ended.Equal(now) {
+		t.Fatalf("unexpected call %+v", e[0].Call)
+	}
+
+	if _, ok := tracker.Call("42"); ok {
+		t.Fail()
+	}
+
+	// Late events of ended calls are ignored
+	tracker.Handle(&csta.ConnectionClearedEvent{MonitorCrossRefID: "1", DroppedConnection: connection("42", "4711:CM1:0.0.0.0:0")})
+	expectEvents(t, events)
+}
+
+func TestCallTrackerTransfer(t *testing.T) {
+	tracker := NewCallTracker()
+	tracker.Monitor("1", "4711")
+	events := tracker.Events()
+
+	// 4711 talks to an external caller, puts the call on hold and consults 4712
+	for _, event := range []csta.Message{
+		&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection("1", "4711"), AnsweringDevice: subjectDevice("4711"), CallingDevice: subjectDevice("+4989700700"), CalledDevice: subjectDevice("4711")},
+		&csta.HeldEvent{MonitorCrossRefID: "1", HeldConnection: connection("1", "4711"), HoldingDevice: subjectDevice("4711")},
+		&csta.OriginatedEvent{MonitorCrossRefID: "1", OriginatedConnection: connection("2", "4711"), CallingDevice: subjectDevice("4711"), CalledDevice: subjectDevice("4712")},
+		&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection("2", "4712"), AnsweringDevice: subjectDevice("4712"), CallingDevice: subjectDevice("4711"), CalledDevice: subjectDevice("4712")},
+	} {
+		tracker.Handle(event)
+	}
+	expectEvents(t, events, CallEventConnected, CallEventHeld, CallEventConnected)
+
+	secondary := connection("2", "4711")
+	tracker.Handle(&csta.TransferredEvent{
+		MonitorCrossRefID:  "1",
+		PrimaryOldCall:     connection("1", "4711"),
+		SecondaryOldCall:   &secondary,
+		TransferringDevice: subjectDevice("4711"),
+		TransferredConnections: csta.ConnectionList{Items: []csta.ConnectionListItem{
+			{NewConnection: &csta.ConnectionID{CallID: "2"}, OldConnection: &csta.ConnectionID{CallID: "1"}, Endpoint: &csta.Endpoint{DeviceID: &csta.DeviceID{Device: "+4989700700"}}},
+			{NewConnection: &csta.ConnectionID{CallID: "2"}, Endpoint: &csta.Endpoint{DeviceID: &csta.DeviceID{Device: "4712"}}},
+		}},
+		Cause: csta.EventCauseTransfer,
+	})
+
+	e := expectEvents(t, events, CallEventTransferred)
+	call := e[0].Call
+	if call.ID != "2" || len(e[0].PreviousCallIDs) != 1 || e[0].PreviousCallIDs[0] != "1" {
+		t.Fatalf("unexpected transfer %+v", e[0])
+	}
+	if call.Direction != CallDirectionInbound || call.CallingDevice != "+4989700700" || call.Party("4711") != nil || len(call.Parties) != 2 {
+		t.Fatalf("unexpected call %+v", call)
+	}
+	if call.Party("+4989700700").State != PartyStateConnected || call.State != CallStateConnected {
+		t.Fatalf("unexpected call %+v", call)
+	}
+
+	if len(tracker.Calls()) != 1 {
+		t.Fail()
+	}
+
+	tracker.Handle(&csta.CallClearedEvent{MonitorCrossRefID: "1", ClearedCall: csta.ConnectionID{CallID: "2"}})
+	expectEvents(t, events, CallEventEnded)
+}
+
+func TestCallTrackerPartyLeft(t *testing.T) {
+	tracker := NewCallTracker()
+	tracker.Monitor("1", "4711")
+	events := tracker.Events()
+
+	// A third party joins an answered call and hangs up again
+	tracker.Handle(&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection("1", "4711"), AnsweringDevice: subjectDevice("4711"), CallingDevice: subjectDevice("100"), CalledDevice: subjectDevice("4711")})
+	tracker.Handle(&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection("1", "4712"), AnsweringDevice: subjectDevice("4712"), CallingDevice: subjectDevice("100"), CalledDevice: subjectDevice("4711")})
+	expectEvents(t, events, CallEventConnected)
+
+	cleared := &csta.ConnectionClearedEvent{MonitorCrossRefID: "1", DroppedConnection: connection("1", "4712"), ReleasingDevice: subjectDevice("4712")}
+	tracker.Handle(cleared)
+	tracker.Handle(cleared)
+	e := expectEvents(t, events, CallEventLeft)
+	if e[0].Device != "4712" || e[0].Call.State != CallStateConnected || len(e[0].Call.Parties) != 2 {
+		t.Fatalf("unexpected event %+v", e[0])
+	}
+}
+
+func TestCallTrackerReset(t *testing.T) {
+	tracker := NewCallTracker()
+	tracker.Monitor("1", "4711")
+	events := tracker.Events()
+
+	tracker.Handle(&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection("1", "4711"), AnsweringDevice: subjectDevice("4711"), CallingDevice: subjectDevice("100"), CalledDevice: subjectDevice("4711")})
+	expectEvents(t, events, CallEventConnected)
+
+	// The calls of a lost connection end
+	tracker.Reset()
+	e := expectEvents(t, events, CallEventEnded)
+	if e[0].Call.ID != "1" || len(tracker.Calls()) != 0 {
+		t.Fatalf("unexpected event %+v", e[0])
+	}
+}
+
+func TestCallTrackerSlowSubscriber(t *testing.T) {
+	tracker := NewCallTracker()
+	tracker.Monitor("1", "4711")
+	events := tracker.Events()
+
+	// Handling never waits for a subscriber that doesn't receive
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			callID := strconv.Itoa(i)
+			tracker.Handle(&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection(callID, "4711"), AnsweringDevice: subjectDevice("4711"), CallingDevice: subjectDevice("100"), CalledDevice: subjectDevice("4711")})
+		}
+		tracker.Reset()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracker blocked on a slow subscriber")
+	}
+
+	// No event is lost
+	for i := 0; i < 400; i++ {
+		select {
+		case e := <-events:
+			if i == 0 && (e.Type != CallEventConnected || e.Call.ID != "0") {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of 400 events received", i)
+		}
+	}
+}
+
+func TestCallTrackerUnsubscribe(t *testing.T) {
+	tracker := NewCallTracker()
+	tracker.Monitor("1", "4711")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := tracker.Subscribe(ctx)
+	tracker.Handle(&csta.EstablishedEvent{MonitorCrossRefID: "1", EstablishedConnection: connection("1", "4711"), AnsweringDevice: subjectDevice("4711"), CallingDevice: subjectDevice("100"), CalledDevice: subjectDevice("4711")})
+
+	// The channel is closed when the context is done, pending events may be lost
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("events weren't closed")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pbx
+
+import (
+	"sync"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/spf13/viper"
+)
+
+// Trace files by section, kept across reconnects so that rotation continues where it left off
+var (
+	tracers      = make(map[string]*csta.TraceFile)
+	tracersMutex sync.Mutex
+)
+
+// CSTAConnectionOptions returns the options for a CSTA connection configured in the
+// section of a driver, e.g. "avaya_aes". TLS is used if <section>.tls.enabled is set:
+//
+//	avaya_aes:
+//	  tls:
+//	    enabled: true
+//	    ca_file: /etc/cra/aes-ca.pem
+//	    cert_file: /etc/cra/client.pem
+//	    key_file: /etc/cra/client.key
+//	    server_name: aes.example.com
+//	    insecure_skip_verify: false
+//
+// Every message is written to a rotating trace file if <section>.trace.enabled is set,
+// which can be played back with the csta-replay command:
+//
+//	avaya_aes:
+//	  trace:
+//	    enabled: true
+//	    file: avaya_aes.trace  # default: <section>.trace
+//	    max_size: 10485760     # bytes per file
+//	    max_files: 5           # rotated files to keep
+func CSTAConnectionOptions(section string) *csta.ConnectionOptions {
+	options := &csta.ConnectionOptions{}
+
+	if viper.GetBool(section + ".tls.enabled") {
+		options.TLS = &csta.TLSOptions{
+			CAFile:             viper.GetString(section + ".tls.ca_file"),
+			CertFile:           viper.GetString(section + ".tls.cert_file"),
+			KeyFile:            viper.GetString(section + ".tls.key_file"),
+			ServerName:         viper.GetString(section + ".tls.server_name"),
+			InsecureSkipVerify: viper.GetBool(section + ".tls.insecure_skip_verify"),
+		}
+	}
+
+	if viper.GetBool(section + ".trace.enabled") {
+		options.Tracer = tracer(section)
+	}
+
+	return options
+}
+
+func tracer(section string) *csta.TraceFile {
+	tracersMutex.Lock()
+	defer tracersMutex.Unlock()
+
+	path := viper.GetString(section + ".trace.file")
+	if path == "" {
+		path = section + ".trace"
+	}
+
+	if t, ok := tracers[section]; ok {
+		if t.Path == path {
+			return t
+		}
+		t.Close()
+	}
+
+	t := csta.NewTraceFile(path, viper.GetInt64(section+".trace.max_size"), viper.GetInt(section+".trace.max_files"))
+	tracers[section] = t
+	return t
+}
@@ -0,0 +1,179 @@
+package pbx
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/spf13/viper"
+)
+
+// OverflowPolicy decides what happens to a subscriber of an EventBus whose queue is full
+type OverflowPolicy string
+
+const (
+	// The oldest queued event is dropped to make room for the new one
+	OverflowPolicyDropOldest OverflowPolicy = "drop_oldest"
+
+	// The subscription is ended, its channel is closed
+	OverflowPolicyDisconnect OverflowPolicy = "disconnect"
+)
+
+func init() {
+	viper.SetDefault("monitor_events.buffer_size", 100)
+	viper.SetDefault("monitor_events.overflow_policy", string(OverflowPolicyDropOldest))
+}
+
+// EventBus passes the events of a monitor point to its subscribers without ever blocking
+// the publisher. Every subscriber has a bounded queue, slow subscribers lose events
+// according to the overflow policy.
+type EventBus struct {
+	bufferSize int
+	policy     OverflowPolicy
+
+	mutex       sync.Mutex // Guards subscribers and dropped, serializes publishing and closing channels
+	subscribers map[<-chan csta.Message]*subscription
+	dropped     uint64
+}
+
+type subscription struct {
+	events  chan csta.Message
+	dropped uint64
+	stop    chan struct{} // Closed when the subscription ends, stops watching its context
+}
+
+// NewEventBus creates an EventBus configured by monitor_events.buffer_size and
+// monitor_events.overflow_policy
+func NewEventBus() *EventBus {
+	bufferSize := viper.GetInt("monitor_events.buffer_size")
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	policy := OverflowPolicy(viper.GetString("monitor_events.overflow_policy"))
+	if policy != OverflowPolicyDropOldest && policy != OverflowPolicyDisconnect {
+		log.Printf("Unknown monitor_events.overflow_policy <%s>, dropping the oldest events\n", policy)
+		policy = OverflowPolicyDropOldest
+	}
+
+	return NewEventBusWithPolicy(bufferSize, policy)
+}
+
+// NewEventBusWithPolicy creates an EventBus with queues of bufferSize events per subscriber
+func NewEventBusWithPolicy(bufferSize int, policy OverflowPolicy) *EventBus {
+	return &EventBus{
+		bufferSize:  bufferSize,
+		policy:      policy,
+		subscribers: make(map[<-chan csta.Message]*subscription),
+	}
+}
+
+// Events returns a channel that receives all events from now on until it is unsubscribed
+func (b *EventBus) Events() <-chan csta.Message {
+	return b.Subscribe(context.Background())
+}
+
+// Subscribe returns a channel that receives all events from now on until the context is
+// done or the channel is unsubscribed. The channel is closed when the subscription ends.
+func (b *EventBus) Subscribe(ctx context.Context) <-chan csta.Message {
+	s := &subscription{
+		events: make(chan csta.Message, b.bufferSize),
+		stop:   make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	b.subscribers[s.events] = s
+	b.mutex.Unlock()
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				b.Unsubscribe(s.events)
+			case <-s.stop:
+			}
+		}()
+	}
+
+	return s.events
+}
+
+// Unsubscribe ends the subscription of a channel returned by Events or Subscribe and closes it
+func (b *EventBus) Unsubscribe(events <-chan csta.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s, ok := b.subscribers[events]; ok {
+		b.remove(s)
+	}
+}
+
+// Publish queues an event for all subscribers
+func (b *EventBus) Publish(e csta.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, s := range b.subscribers {
+		select {
+		case s.events <- e:
+			continue
+		default:
+		}
+
+		s.dropped++
+		b.dropped++
+
+		if b.policy == OverflowPolicyDisconnect {
+			log.Printf("Subscriber of monitor point events can't keep up, unsubscribing it\n")
+			b.remove(s)
+			continue
+		}
+
+		// The subscriber may have made room in the meantime, it only ever receives
+		select {
+		case <-s.events:
+		default:
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of events all subscribers lost so far
+func (b *EventBus) Dropped() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.dropped
+}
+
+// DroppedFor returns the number of events a subscriber lost so far
+func (b *EventBus) DroppedFor(events <-chan csta.Message) uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s, ok := b.subscribers[events]; ok {
+		return s.dropped
+	}
+	return 0
+}
+
+// Close ends all subscriptions
+func (b *EventBus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, s := range b.subscribers {
+		b.remove(s)
+	}
+}
+
+// remove ends a subscription, the mutex must be held
+func (b *EventBus) remove(s *subscription) {
+	delete(b.subscribers, s.events)
+	close(s.stop)
+	close(s.events)
+}
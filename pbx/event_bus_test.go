@@ -0,0 +1,113 @@
+package pbx
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+)
+
+func established(callID string) csta.Message {
+	return &csta.EstablishedEvent{EstablishedConnection: connection(callID, "4711")}
+}
+
+func callID(t *testing.T, message csta.Message) string {
+	t.Helper()
+
+	e, ok := message.(*csta.EstablishedEvent)
+	if !ok {
+		t.Fatalf("unexpected event %+v", message)
+	}
+	return e.EstablishedConnection.CallID
+}
+
+// waitForClose waits until a subscription channel is closed, events still queued are skipped
+func waitForClose(t *testing.T, events <-chan csta.Message) {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("subscription wasn't closed")
+		}
+	}
+}
+
+func TestEventBusDropsOldest(t *testing.T) {
+	bus := NewEventBusWithPolicy(2, OverflowPolicyDropOldest)
+	slow := bus.Events()
+	fast := bus.Events()
+
+	// Publishing never waits for the subscribers
+	for _, id := range []string{"1", "2", "3", "4"} {
+		bus.Publish(established(id))
+		if id == "1" || id == "3" {
+			<-fast
+		}
+	}
+
+	if bus.DroppedFor(slow) != 2 || bus.DroppedFor(fast) != 0 || bus.Dropped() != 2 {
+		t.Fatalf("unexpected drop counts %d, %d, %d", bus.DroppedFor(slow), bus.DroppedFor(fast), bus.Dropped())
+	}
+	if first, second := callID(t, <-slow), callID(t, <-slow); first != "3" || second != "4" {
+		t.Fatalf("expected the newest events, got <%s> and <%s>", first, second)
+	}
+	if first, second := callID(t, <-fast), callID(t, <-fast); first != "3" || second != "4" {
+		t.Fatalf("unexpected events <%s> and <%s>", first, second)
+	}
+}
+
+func TestEventBusDisconnects(t *testing.T) {
+	bus := NewEventBusWithPolicy(1, OverflowPolicyDisconnect)
+	slow := bus.Events()
+	fast := bus.Events()
+
+	bus.Publish(established("1"))
+	<-fast
+	bus.Publish(established("2"))
+
+	if bus.Dropped() != 1 {
+		t.Fatalf("unexpected drop count %d", bus.Dropped())
+	}
+	if callID(t, <-slow) != "1" {
+		t.Fail()
+	}
+	waitForClose(t, slow)
+
+	// The others keep receiving events
+	if callID(t, <-fast) != "2" {
+		t.Fail()
+	}
+	bus.Publish(established("3"))
+	if callID(t, <-fast) != "3" || bus.Dropped() != 1 {
+		t.Fail()
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBusWithPolicy(10, OverflowPolicyDropOldest)
+	events := bus.Events()
+
+	bus.Unsubscribe(events)
+	waitForClose(t, events)
+
+	// Unsubscribing again and publishing afterwards are fine
+	bus.Unsubscribe(events)
+	bus.Publish(established("1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scoped := bus.Subscribe(ctx)
+	bus.Publish(established("2"))
+	cancel()
+	waitForClose(t, scoped)
+
+	remaining := bus.Events()
+	bus.Close()
+	waitForClose(t, remaining)
+}
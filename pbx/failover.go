@@ -0,0 +1,163 @@
+package pbx
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultConnectTimeout   = 10 * time.Second
+	defaultFailbackInterval = time.Minute
+)
+
+type activeEndpoint struct {
+	conn    csta.Conn
+	address string
+}
+
+// Nodes the drivers are connected to by section
+var (
+	activeEndpoints      = make(map[string]activeEndpoint)
+	activeEndpointsMutex sync.Mutex
+)
+
+// CSTAEndpoints returns the addresses of the CSTA servers configured in the section of
+// a driver, in the order of preference. The first one is the primary node:
+//
+//	avaya_aes:
+//	  server_addresses:
+//	    - aes1.example.com:4721
+//	    - aes2.example.com:4721
+//	  connect_timeout: 10s      # per node
+//	  failback_interval: 1m     # how often to try the primary while connected to another node
+//
+// A single server_address is still supported if no list is configured.
+func CSTAEndpoints(section string) []string {
+	addresses := viper.GetStringSlice(section + ".server_addresses")
+	if len(addresses) == 0 && viper.GetString(section+".server_address") != "" {
+		addresses = []string{viper.GetString(section + ".server_address")}
+	}
+	return addresses
+}
+
+// DialCSTA connects to the first node of the section that accepts the connection and the
+// application session, and returns the connection with the ID of the session. While connected
+// to another node than the primary one, a session with the primary is tried regularly and the
+// connection is closed once that succeeds, so that the driver reconnects to the primary.
+func DialCSTA(section string, ctx context.Context, session *ApplicationSession) (csta.Conn, string, error) {
+	addresses := CSTAEndpoints(section)
+	if len(addresses) == 0 {
+		return nil, "", fmt.Errorf("no server address configured for %s", section)
+	}
+
+	timeout := viper.GetDuration(section + ".connect_timeout")
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	options := CSTAConnectionOptions(section)
+
+	var err error
+	for i, address := range addresses {
+		var conn csta.Conn
+		var sessionID string
+		conn, sessionID, err = dialSession(ctx, address, timeout, options, session)
+		if err != nil {
+			log.Printf("Failed to connect to %s node <%s>: %s\n", section, address, err)
+			continue
+		}
+
+		setActiveEndpoint(section, conn, address)
+
+		if i > 0 {
+			log.Printf("Connected to secondary %s node <%s>\n", section, address)
+			go failback(ctx, section, conn, addresses[0], timeout, options, session)
+		}
+		return conn, sessionID, nil
+	}
+
+	return nil, "", fmt.Errorf("failed to connect to any %s node: %w", section, err)
+}
+
+// dialSession connects to a node and starts the application session, the connection
+// is closed again if the session can't be started
+func dialSession(ctx context.Context, address string, timeout time.Duration, options *csta.ConnectionOptions, session *ApplicationSession) (csta.Conn, string, error) {
+	conn, err := csta.DialTimeout("tcp", address, timeout, ctx, options)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sessionID, err := session.Start(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	return conn, sessionID, nil
+}
+
+// failback closes a connection to a secondary node once an application session with the primary node succeeds
+func failback(ctx context.Context, section string, conn csta.Conn, primary string, timeout time.Duration, options *csta.ConnectionOptions, session *ApplicationSession) {
+	interval := viper.GetDuration(section + ".failback_interval")
+	if interval <= 0 {
+		interval = defaultFailbackInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			probe, sessionID, err := dialSession(ctx, primary, timeout, options, session)
+			if err != nil {
+				continue
+			}
+			stopContext, cancel := context.WithTimeout(ctx, timeout)
+			err = session.Stop(stopContext, probe, sessionID, "Failback check")
+			cancel()
+			if err != nil {
+				log.Printf("%s\n", err)
+			}
+			probe.Close()
+
+			log.Printf("Primary %s node <%s> accepts sessions again, failing back\n", section, primary)
+			conn.Close()
+			return
+		case <-conn.Closed():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ActiveEndpoint returns the address of the node a driver is connected to, or an empty string
+func ActiveEndpoint(section string) string {
+	activeEndpointsMutex.Lock()
+	defer activeEndpointsMutex.Unlock()
+
+	return activeEndpoints[section].address
+}
+
+// setActiveEndpoint remembers the node of a connection until it is closed
+func setActiveEndpoint(section string, conn csta.Conn, address string) {
+	activeEndpointsMutex.Lock()
+	activeEndpoints[section] = activeEndpoint{conn: conn, address: address}
+	activeEndpointsMutex.Unlock()
+
+	go func() {
+		<-conn.Closed()
+
+		activeEndpointsMutex.Lock()
+		defer activeEndpointsMutex.Unlock()
+		if activeEndpoints[section].conn == conn {
+			delete(activeEndpoints, section)
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+package pbx
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/csta/cstatest"
+	"github.com/spf13/viper"
+)
+
+// rejectSessions makes a switch reject application sessions until accept is called
+func rejectSessions(s *cstatest.Switch) (accept func()) {
+	var mutex sync.Mutex
+	accepted := false
+	s.Handle(csta.MessageTypeStartApplicationSession, func(request csta.Message) csta.Message {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !accepted {
+			return &csta.StartApplicationSessionNegResponse{}
+		}
+		return &csta.StartApplicationSessionPosResponse{SessionID: "primary"}
+	})
+
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		accepted = true
+	}
+}
+
+func TestDialCSTAFailover(t *testing.T) {
+	secondary, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+
+	// The primary node accepts connections but no sessions for now
+	primary, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	acceptSessions := rejectSessions(primary)
+
+	viper.Set("failover_test.server_addresses", []string{primary.Addr(), secondary.Addr()})
+	viper.Set("failover_test.connect_timeout", time.Second)
+	viper.Set("failover_test.failback_interval", 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, sessionID, err := DialCSTA("failover_test", ctx, &ApplicationSession{ApplicationID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if ActiveEndpoint("failover_test") != secondary.Addr() || sessionID != "session-1" {
+		t.Fatalf("connected to <%s> with session <%s>", ActiveEndpoint("failover_test"), sessionID)
+	}
+
+	// Reachable isn't enough to fail back
+	if _, err := primary.WaitForRequest(csta.MessageTypeStartApplicationSession, 3, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.Closed():
+		t.Fatal("failed back to a primary node that rejects sessions")
+	default:
+	}
+
+	// The connection to the secondary node is closed once the primary node accepts sessions again
+	acceptSessions()
+	select {
+	case <-conn.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't fail back to the primary node")
+	}
+
+	// The session of the check is stopped again
+	if _, err := primary.WaitForRequest(csta.MessageTypeStopApplicationSession, 1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ActiveEndpoint("failover_test") != "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ActiveEndpoint("failover_test") != "" {
+		t.Fail()
+	}
+}
+
+func TestDialCSTADown(t *testing.T) {
+	// Reserve an address for a node that is down
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	rejecting, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejecting.Close()
+	rejectSessions(rejecting)
+
+	viper.Set("down_test.server_addresses", []string{down, rejecting.Addr()})
+	viper.Set("down_test.connect_timeout", time.Second)
+
+	_, _, err = DialCSTA("down_test", context.Background(), &ApplicationSession{ApplicationID: "test"})
+	if err == nil || ActiveEndpoint("down_test") != "" {
+		t.Fatalf("connected without a session: %v", err)
+	}
+}
+
+func TestCSTAEndpoints(t *testing.T) {
+	viper.Set("endpoints_test.server_addresses", []string{})
+	viper.Set("endpoints_test.server_address", "aes1:4721")
+	if endpoints := CSTAEndpoints("endpoints_test"); len(endpoints) != 1 || endpoints[0] != "aes1:4721" {
+		t.Fatalf("unexpected endpoints %v", endpoints)
+	}
+
+	viper.Set("endpoints_test.server_addresses", []string{"aes2:4721", "aes3:4721"})
+	if endpoints := CSTAEndpoints("endpoints_test"); len(endpoints) != 2 || endpoints[0] != "aes2:4721" {
+		t.Fatalf("unexpected endpoints %v", endpoints)
+	}
+}
@@ -0,0 +1,351 @@
+// Package esl implements a client of the inbound FreeSWITCH Event Socket, which accepts
+// commands and reports channel events over a line based TCP protocol.
+package esl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultEventBufferSize = 100
+
+const (
+	ContentTypeAuthRequest      = "auth/request"
+	ContentTypeCommandReply     = "command/reply"
+	ContentTypeAPIResponse      = "api/response"
+	ContentTypeEventPlain       = "text/event-plain"
+	ContentTypeDisconnectNotice = "text/disconnect-notice"
+)
+
+// Message is a message of the event socket, headers followed by a body of Content-Length bytes
+type Message struct {
+	Headers map[string]string
+	Body    string
+}
+
+// Event is an event in plain format, the values are decoded
+type Event map[string]string
+
+// Name returns the name of an event, e.g. CHANNEL_ANSWER
+func (e Event) Name() string {
+	return e["Event-Name"]
+}
+
+// ReadHeaders reads "Key: Value" lines up to the next empty line, empty lines in front are skipped
+func ReadHeaders(r *bufio.Reader) (map[string]string, error) {
+	headers := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && len(headers) > 0 {
+				return headers, nil
+			}
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(headers) == 0 {
+				continue
+			}
+			return headers, nil
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed event socket header %q", line)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+}
+
+// ReadMessage reads the next message
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	headers, err := ReadHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{Headers: headers}
+	if length, ok := headers["Content-Length"]; ok {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid Content-Length %q", length)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		m.Body = string(body)
+	}
+	return m, nil
+}
+
+// WriteMessage writes a message, Content-Length is set from the body
+func WriteMessage(w io.Writer, m *Message) error {
+	keys := make([]string, 0, len(m.Headers))
+	for key := range m.Headers {
+		if key != "Content-Length" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	if m.Body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\n", len(m.Body))
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", key, m.Headers[key])
+	}
+	b.WriteString("\n")
+	b.WriteString(m.Body)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ParseEvent decodes the body of a text/event-plain message
+func ParseEvent(m *Message) (Event, error) {
+	headers, err := ReadHeaders(bufio.NewReader(strings.NewReader(m.Body)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+
+	event := make(Event, len(headers))
+	for key, value := range headers {
+		if decoded, err := url.PathUnescape(value); err == nil {
+			value = decoded
+		}
+		event[key] = value
+	}
+	return event, nil
+}
+
+// EncodeEvent encodes an event as the body of a text/event-plain message
+func EncodeEvent(event Event) *Message {
+	keys := make([]string, 0, len(event))
+	for key := range event {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", key, strings.ReplaceAll(url.QueryEscape(event[key]), "+", "%20"))
+	}
+	b.WriteString("\n")
+
+	return &Message{
+		Headers: map[string]string{"Content-Type": ContentTypeEventPlain},
+		Body:    b.String(),
+	}
+}
+
+// Conn is an authenticated connection to the event socket
+type Conn struct {
+	conn    net.Conn
+	timeout time.Duration // How long a command waits for its reply
+	replies chan *Message
+	events  chan Event
+	closed  chan struct{}
+
+	mutex     sync.Mutex // Serializes commands, their replies carry no IDs
+	closeOnce sync.Once
+
+	// Events that were read but not delivered yet, the reader never waits for the receiver
+	queueMutex sync.Mutex
+	queue      []Event
+	queued     chan struct{}
+}
+
+// Dial connects to the event socket and authenticates with its password. The timeout
+// applies to the connection setup and to the reply of each command.
+func Dial(address string, password string, timeout time.Duration) (*Conn, error) {
+	netConn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the event socket <%s>: %w", address, err)
+	}
+
+	reader := bufio.NewReader(netConn)
+	netConn.SetDeadline(time.Now().Add(timeout))
+
+	request, err := ReadMessage(reader)
+	if err != nil || request.Headers["Content-Type"] != ContentTypeAuthRequest {
+		netConn.Close()
+		return nil, fmt.Errorf("event socket <%s> didn't request authentication: %v", address, err)
+	}
+
+	_, err = fmt.Fprintf(netConn, "auth %s\n\n", password)
+	if err == nil {
+		var reply *Message
+		reply, err = ReadMessage(reader)
+		if err == nil && !strings.HasPrefix(reply.Headers["Reply-Text"], "+OK") {
+			err = fmt.Errorf("%s", reply.Headers["Reply-Text"])
+		}
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("failed to authenticate at the event socket <%s>: %w", address, err)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	c := &Conn{
+		conn:    netConn,
+		timeout: timeout,
+		replies: make(chan *Message, 1),
+		events:  make(chan Event, defaultEventBufferSize),
+		closed:  make(chan struct{}),
+		queued:  make(chan struct{}, 1),
+	}
+	go c.read(reader)
+	go c.deliver()
+
+	return c, nil
+}
+
+// Command sends a command and waits for its reply, e.g. "event plain CHANNEL_ANSWER". A reply
+// that doesn't arrive in time closes the connection, as later replies couldn't be matched
+// with their commands anymore.
+func (c *Conn) Command(command string) (*Message, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, err := fmt.Fprintf(c.conn, "%s\n\n", command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %q: %w", command, err)
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-c.replies:
+		if text := reply.Headers["Reply-Text"]; strings.HasPrefix(text, "-ERR") {
+			return reply, fmt.Errorf("%q failed: %s", command, text)
+		}
+		return reply, nil
+	case <-c.closed:
+		return nil, fmt.Errorf("event socket connection closed")
+	case <-timer.C:
+		c.Close()
+		return nil, fmt.Errorf("no reply to %q within %s", command, c.timeout)
+	}
+}
+
+// API runs an API command and returns its output, output starting with -ERR is returned as error
+func (c *Conn) API(command string) (string, error) {
+	reply, err := c.Command("api " + command)
+	if err != nil {
+		return "", err
+	}
+
+	output := strings.TrimSpace(reply.Body)
+	if strings.HasPrefix(output, "-ERR") {
+		return output, fmt.Errorf("%q failed: %s", command, output)
+	}
+	return output, nil
+}
+
+// Events returns the channel that receives all subscribed events in the order they were sent
+func (c *Conn) Events() <-chan Event {
+	return c.events
+}
+
+// Closed is closed when the connection is lost or closed
+func (c *Conn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		log.Printf("Closing event socket connection\n")
+		c.conn.Close()
+		close(c.closed)
+	})
+	return nil
+}
+
+// read passes replies to the command waiting for them and queues events, it never waits
+// for either so that commands can be sent while events are handled
+func (c *Conn) read(reader *bufio.Reader) {
+	defer c.Close()
+
+	for {
+		m, err := ReadMessage(reader)
+		if err != nil {
+			return
+		}
+
+		switch m.Headers["Content-Type"] {
+		case ContentTypeCommandReply, ContentTypeAPIResponse:
+			// Commands are serialized, the previous reply was taken before the next command was sent
+			select {
+			case c.replies <- m:
+			default:
+				log.Printf("Discarding event socket reply without a command\n")
+			}
+
+		case ContentTypeEventPlain:
+			event, err := ParseEvent(m)
+			if err != nil {
+				log.Printf("%s\n", err)
+				continue
+			}
+			c.enqueue(event)
+
+		case ContentTypeDisconnectNotice:
+			return
+		}
+	}
+}
+
+// enqueue adds an event to the ones waiting for delivery
+func (c *Conn) enqueue(event Event) {
+	c.queueMutex.Lock()
+	c.queue = append(c.queue, event)
+	c.queueMutex.Unlock()
+
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// deliver passes the queued events to the receiver in order until the connection is closed
+func (c *Conn) deliver() {
+	for {
+		select {
+		case <-c.queued:
+		case <-c.closed:
+			return
+		}
+
+		for {
+			c.queueMutex.Lock()
+			if len(c.queue) == 0 {
+				c.queueMutex.Unlock()
+				break
+			}
+			event := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.queueMutex.Unlock()
+
+			select {
+			case c.events <- event:
+			case <-c.closed:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package esl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCommand reads a command, a line followed by an empty line
+func readCommand(reader *bufio.Reader) (string, error) {
+	var command string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line == "" && command != "" {
+			return command, nil
+		}
+		command += line
+	}
+}
+
+// serveSocket accepts a single client with any password and runs serve with its connection
+func serveSocket(t *testing.T, serve func(conn net.Conn, reader *bufio.Reader)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		WriteMessage(conn, &Message{Headers: map[string]string{"Content-Type": ContentTypeAuthRequest}})
+		if _, err := readCommand(reader); err != nil {
+			return
+		}
+		WriteMessage(conn, &Message{Headers: map[string]string{"Content-Type": ContentTypeCommandReply, "Reply-Text": "+OK accepted"}})
+		serve(conn, reader)
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestReadMessage(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewBufferString("Content-Type: api/response\nContent-Length: 4\n\n+OK\n\nContent-Type: command/reply\nReply-Text: -ERR invalid\n\n"))
+
+	m, err := ReadMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Headers["Content-Type"] != ContentTypeAPIResponse || m.Body != "+OK\n" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	m, err = ReadMessage(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Headers["Reply-Text"] != "-ERR invalid" || m.Body != "" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestEncodeEvent(t *testing.T) {
+	event := Event{
+		"Event-Name":              "CHANNEL_ANSWER",
+		"Channel-Name":            "sofia/internal/1001@pbx.example.com",
+		"Caller-Caller-ID-Name":   "Dispatch 1 + 2",
+		"Caller-Caller-ID-Number": "+4989123",
+	}
+
+	var b bytes.Buffer
+	err := WriteMessage(&b, EncodeEvent(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadMessage(bufio.NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Headers["Content-Type"] != ContentTypeEventPlain {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	decoded, err := ParseEvent(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name() != "CHANNEL_ANSWER" || len(decoded) != len(event) {
+		t.Fatalf("unexpected event %+v", decoded)
+	}
+	for key, value := range event {
+		if decoded[key] != value {
+			t.Fatalf("%s is %q, expected %q", key, decoded[key], value)
+		}
+	}
+}
+
+func TestCommandWhileEventsPending(t *testing.T) {
+	// More events than the buffer holds arrive before the reply of a command
+	address := serveSocket(t, func(conn net.Conn, reader *bufio.Reader) {
+		if _, err := readCommand(reader); err != nil {
+			return
+		}
+		for i := 0; i < 3*defaultEventBufferSize; i++ {
+			WriteMessage(conn, EncodeEvent(Event{"Event-Name": "CHANNEL_ANSWER", "Unique-ID": fmt.Sprint(i)}))
+		}
+		WriteMessage(conn, &Message{Headers: map[string]string{"Content-Type": ContentTypeAPIResponse}, Body: "+OK\n"})
+		readCommand(reader)
+	})
+
+	c, err := Dial(address, "ClueCon", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.API("uuid_dump 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// None of the events were lost
+	for i := 0; i < 3*defaultEventBufferSize; i++ {
+		if event := <-c.Events(); event["Unique-ID"] != fmt.Sprint(i) {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	address := serveSocket(t, func(conn net.Conn, reader *bufio.Reader) {
+		readCommand(reader)
+		readCommand(reader)
+	})
+
+	c, err := Dial(address, "ClueCon", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.API("uuid_dump 1")
+	if err == nil {
+		t.Fatal("command didn't time out")
+	}
+	select {
+	case <-c.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+}
@@ -0,0 +1,310 @@
+// Package freeswitchtest provides a stand-in for the FreeSWITCH event socket for testing the
+// FreeSWITCH integration without FreeSWITCH installed. It replays event sequences to its
+// clients and answers their commands.
+package freeswitchtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/freeswitch/esl"
+)
+
+// APIResponder answers an API command with its output, e.g. "+OK"
+type APIResponder func(args string) string
+
+// Server is a fake event socket listening on a local port. All commands are recorded so
+// that tests can check what was sent.
+type Server struct {
+	listener net.Listener
+
+	mutex      sync.Mutex
+	password   string
+	changed    chan struct{} // Closed and replaced whenever commands or connections change
+	conns      map[net.Conn]bool
+	commands   []string
+	responders map[string]APIResponder
+	closed     bool
+	waitGroup  sync.WaitGroup
+}
+
+// NewServer starts a Server on a random local port. It accepts the password ClueCon and
+// answers all commands with +OK until changed with SetPassword and HandleAPI.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		password:   "ClueCon",
+		listener:   listener,
+		changed:    make(chan struct{}),
+		conns:      make(map[net.Conn]bool),
+		responders: make(map[string]APIResponder),
+	}
+
+	s.waitGroup.Add(1)
+	go s.accept()
+
+	return s, nil
+}
+
+// Addr returns the address the Server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// SetPassword changes the password clients have to authenticate with
+func (s *Server) SetPassword(password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.password = password
+}
+
+// HandleAPI replaces the responder for an API command, e.g. uuid_kill
+func (s *Server) HandleAPI(command string, responder APIResponder) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.responders[command] = responder
+}
+
+// SendEvent pushes an event to all connected clients
+func (s *Server) SendEvent(event esl.Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.conns) == 0 {
+		return fmt.Errorf("no client connected")
+	}
+
+	for conn := range s.conns {
+		err := esl.WriteMessage(conn, esl.EncodeEvent(event))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay sends the events of a recorded sequence, blocks of "Key: Value" lines with decoded values
+func (s *Server) Replay(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for {
+		headers, err := esl.ReadHeaders(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.SendEvent(esl.Event(headers)); err != nil {
+			return err
+		}
+	}
+}
+
+// Commands returns the commands starting with a prefix received so far, e.g. "api uuid_"
+func (s *Server) Commands(prefix string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.matching(prefix)
+}
+
+// WaitForCommand waits until n commands starting with a prefix were received and returns the nth
+func (s *Server) WaitForCommand(prefix string, n int, timeout time.Duration) (string, error) {
+	var command string
+	err := s.wait(timeout, func() bool {
+		commands := s.matching(prefix)
+		if len(commands) < n {
+			return false
+		}
+		command = commands[n-1]
+		return true
+	})
+	if err != nil {
+		return "", fmt.Errorf("%q wasn't received %d times: %w", prefix, n, err)
+	}
+	return command, nil
+}
+
+// Disconnect closes the connections of all clients, the Server keeps accepting new ones
+func (s *Server) Disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops listening and disconnects all clients
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.Disconnect()
+	s.waitGroup.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.waitGroup.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.mutex.Unlock()
+
+		s.waitGroup.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// serve authenticates a client and answers its commands until it disconnects
+func (s *Server) serve(conn net.Conn) {
+	defer s.waitGroup.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.notify()
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	err := esl.WriteMessage(conn, &esl.Message{Headers: map[string]string{"Content-Type": esl.ContentTypeAuthRequest}})
+	if err != nil {
+		return
+	}
+
+	command, err := readCommand(reader)
+	if err != nil {
+		return
+	}
+
+	// Events are only sent to authenticated clients
+	s.mutex.Lock()
+	if command != "auth "+s.password {
+		reply(conn, "-ERR invalid")
+		s.mutex.Unlock()
+		return
+	}
+	reply(conn, "+OK accepted")
+	s.conns[conn] = true
+	s.notify()
+	s.mutex.Unlock()
+
+	for {
+		command, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.commands = append(s.commands, command)
+		s.notify()
+
+		if api, ok := strings.CutPrefix(command, "api "); ok {
+			name, args, _ := strings.Cut(api, " ")
+			output := "+OK"
+			if responder, ok := s.responders[name]; ok {
+				output = responder(args)
+			}
+			esl.WriteMessage(conn, &esl.Message{
+				Headers: map[string]string{"Content-Type": esl.ContentTypeAPIResponse},
+				Body:    output + "\n",
+			})
+		} else {
+			reply(conn, "+OK")
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// readCommand reads a command, a line followed by an empty line
+func readCommand(reader *bufio.Reader) (string, error) {
+	var command string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if command == "" {
+				continue
+			}
+			return command, nil
+		}
+		command = line
+	}
+}
+
+func reply(conn net.Conn, text string) error {
+	return esl.WriteMessage(conn, &esl.Message{Headers: map[string]string{
+		"Content-Type": esl.ContentTypeCommandReply,
+		"Reply-Text":   text,
+	}})
+}
+
+// matching returns the commands starting with a prefix, the mutex must be held
+func (s *Server) matching(prefix string) []string {
+	commands := make([]string, 0)
+	for _, command := range s.commands {
+		if strings.HasPrefix(command, prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// notify wakes up everyone waiting for a change, the mutex must be held
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until condition, which is called with the mutex held, becomes true
+func (s *Server) wait(timeout time.Duration, condition func() bool) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mutex.Lock()
+		done := condition()
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+}
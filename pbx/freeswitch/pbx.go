@@ -0,0 +1,473 @@
+// Package freeswitch records calls of FreeSWITCH. The channels of the monitored extensions
+// are followed through the events of the inbound event socket, their media is forked to the
+// recorders by a configurable API command.
+//
+// Stock FreeSWITCH has no API command that sends the media of a channel to a remote RTP
+// address, uuid_record only writes files on the FreeSWITCH host. The media command has to
+// be provided by a third-party module installed on FreeSWITCH that streams a media bug of
+// the channel as RTP in the configured codec.
+package freeswitch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/freeswitch/esl"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("freeswitch.address", "127.0.0.1:8021")
+	viper.SetDefault("freeswitch.password", "ClueCon")
+	viper.SetDefault("freeswitch.connect_timeout", 10*time.Second)
+	viper.SetDefault("freeswitch.media.codec", "PCMU")
+}
+
+// FreeSWITCH is configured in the freeswitch section. The media commands are API commands
+// of the third-party media module with the placeholders {uuid}, {host}, {port} and {codec},
+// there is no default for start_command as it depends on the module. For a module that
+// provides uuid_rtp_fork:
+//
+//	freeswitch:
+//	  address: freeswitch.example.com:8021
+//	  password: ClueCon
+//	  media_address: 192.168.1.10  # address FreeSWITCH sends the media to, default: rtp.recorder_address
+//	  media:
+//	    start_command: uuid_rtp_fork {uuid} start {host} {port} {codec}
+//	    stop_command: uuid_rtp_fork {uuid} stop
+//	    codec: PCMU
+type FreeSWITCH struct {
+	ctx           context.Context
+	conn          *esl.Conn
+	done          chan struct{} // Closed when the events of the connection are handled
+	closing       chan struct{} // Closed by Close to let the event handler release the media
+	closeOnce     sync.Once
+	monitorPoints pbx.MonitorPoints
+	mutex         sync.Mutex // Guards recorderPool, which the event handler reads
+	recorderPool  rtp.RecorderPool
+	tracker       *pbx.CallTracker
+
+	// Only accessed by the event handler
+	channels   map[string]string     // Call IDs of the answered channels by their unique ID
+	recordings map[string]*recording // By unique ID of the recorded channel
+	forks      chan mediaFork        // Results of the media commands of the connection
+
+	// OnRecordingFinished is called with each finished recording,
+	// the default queues the recording for upload
+	OnRecordingFinished func(record *models.UploadRecord)
+}
+
+type recording struct {
+	recorder rtp.Recorder
+	filePath string
+	callID   string
+	call     pbx.Call // Snapshot for calls the tracker forgot when the recording stops
+	forking  bool     // The media command didn't reply yet
+	hungUp   bool     // The channel hung up while forking, the recording finishes with the reply
+}
+
+// mediaFork is the result of the command that forks the media of a channel to a recorder
+type mediaFork struct {
+	uniqueID  string
+	recording *recording
+	err       error
+}
+
+func (f *FreeSWITCH) SetContext(ctx context.Context) {
+	f.ctx = ctx
+}
+
+// Connect authenticates at the event socket and subscribes to the channel events. FreeSWITCH
+// isn't controlled through CSTA, the returned connection is always nil.
+func (f *FreeSWITCH) Connect() (csta.Conn, error) {
+	if viper.GetString("freeswitch.media.start_command") == "" {
+		return nil, fmt.Errorf("freeswitch.media.start_command isn't configured")
+	}
+
+	address := viper.GetString("freeswitch.address")
+	conn, err := esl.Dial(address, viper.GetString("freeswitch.password"), viper.GetDuration("freeswitch.connect_timeout"))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Command("event plain CHANNEL_ANSWER CHANNEL_HANGUP_COMPLETE")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to subscribe to channel events: %w", err)
+	}
+	log.Printf("Connected to FreeSWITCH at <%s>\n", address)
+
+	// Channels of a previous connection are unknown, they are recorded from the next call on
+	f.monitorPoints.Reset()
+
+	if f.tracker == nil {
+		f.tracker = pbx.NewCallTracker()
+	} else {
+		f.tracker.Reset()
+	}
+
+	f.conn = conn
+	f.channels = make(map[string]string)
+	f.recordings = make(map[string]*recording)
+	f.forks = make(chan mediaFork)
+	f.done = make(chan struct{})
+	f.closing = make(chan struct{})
+	f.closeOnce = sync.Once{}
+	go f.handleEvents(conn, f.closing, f.done)
+
+	return nil, nil
+}
+
+func (f *FreeSWITCH) ConnectionState() pbx.ConnectionState {
+	if f.conn == nil {
+		return pbx.ConnectionStateDisconnected
+	}
+
+	select {
+	case <-f.done:
+		return pbx.ConnectionStateDisconnected
+	default:
+		return pbx.ConnectionStateConnected
+	}
+}
+
+// Close stops forking the media of the channels being recorded and closes the connection,
+// the recordings going on are finished
+func (f *FreeSWITCH) Close() error {
+	if f.conn == nil {
+		return nil
+	}
+
+	f.closeOnce.Do(func() {
+		close(f.closing)
+	})
+	<-f.done
+	return nil
+}
+
+// MonitorStart follows the channels of an extension, the event socket reports the events of
+// all channels so the extension is its own cross reference ID
+func (f *FreeSWITCH) MonitorStart(extension string) (pbx.MonitorPoint, error) {
+	mp := pbx.NewDeviceMonitorPoint(extension, pbx.MonitoredDevice{Extension: extension})
+	f.monitorPoints.Add(mp)
+	f.tracker.Monitor(extension, extension)
+
+	log.Printf("Monitoring <%s>\n", extension)
+
+	return mp, nil
+}
+
+func (f *FreeSWITCH) Serve(recorderPool rtp.RecorderPool) error {
+	defer f.Close()
+	log.Printf("Handling PBX connection\n")
+
+	f.mutex.Lock()
+	f.recorderPool = recorderPool
+	f.mutex.Unlock()
+
+	// Get access to the persistence layer
+	db, err := models.NewDatabase()
+	if err != nil {
+		return err
+	}
+
+	monitoredDevices := db.GetMonitoredDevices()
+	log.Printf("%d devices are configured to be monitored\n", len(monitoredDevices))
+
+	for _, d := range monitoredDevices {
+		mp, err := f.MonitorStart(d.Extension)
+		if err != nil {
+			log.Printf("Failed to start monitoring <%s>: %s", d.Extension, err)
+			continue
+		}
+
+		d.CrossReferenceID = mp.CrossReferenceID()
+		db.Save(d)
+	}
+
+	// Events are handled in the background, wait for anything to fail/end
+	select {
+	case <-f.ctx.Done():
+		return nil
+	case <-f.done:
+		return io.EOF
+	}
+}
+
+// handleEvents handles the events of a connection in order until it is lost or closed. API
+// commands are sent by other goroutines while the connection is up, so that a slow reply
+// never holds up the events.
+func (f *FreeSWITCH) handleEvents(conn *esl.Conn, closing chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case event := <-conn.Events():
+			f.handleEvent(event)
+		case fork := <-f.forks:
+			f.forked(fork)
+		case <-conn.Closed():
+			f.stopAllRecordings(false)
+			return
+		case <-closing:
+			f.stopAllRecordings(true)
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (f *FreeSWITCH) handleEvent(event esl.Event) {
+	mp := f.monitorPoints.Get(endpoint(event["Channel-Name"]))
+	if mp == nil {
+		return
+	}
+
+	switch event.Name() {
+	case "CHANNEL_ANSWER":
+		f.answered(event, mp)
+	case "CHANNEL_HANGUP_COMPLETE":
+		f.hungUp(event, mp)
+	}
+}
+
+// answered reports an answered channel of a monitored extension as an established
+// connection and starts recording it
+func (f *FreeSWITCH) answered(event esl.Event, mp *pbx.DeviceMonitorPoint) {
+	uniqueID := event["Unique-ID"]
+	if _, ok := f.channels[uniqueID]; ok {
+		return
+	}
+
+	callID := callID(event)
+	f.channels[uniqueID] = callID
+	calling, called := event["Caller-Caller-ID-Number"], event["Caller-Destination-Number"]
+	established := &csta.EstablishedEvent{
+		MonitorCrossRefID:     mp.CrossReferenceID(),
+		EstablishedConnection: connectionID(callID, mp.Extension()),
+		AnsweringDevice:       subjectDeviceID(called),
+		CallingDevice:         subjectDeviceID(calling),
+		CalledDevice:          subjectDeviceID(called),
+		LocalConnectionInfo:   "connected",
+		Cause:                 csta.EventCauseNormal,
+	}
+	f.tracker.Handle(established)
+	mp.Publish(established)
+
+	f.startRecording(uniqueID, callID, mp)
+}
+
+// hungUp reports a hung up channel of a monitored extension as a cleared connection and
+// finishes its recording, the media fork ended with the channel
+func (f *FreeSWITCH) hungUp(event esl.Event, mp *pbx.DeviceMonitorPoint) {
+	uniqueID := event["Unique-ID"]
+	callID, found := f.channels[uniqueID]
+	if !found {
+		return
+	}
+	delete(f.channels, uniqueID)
+
+	call, ok := f.tracker.Call(callID)
+
+	cleared := &csta.ConnectionClearedEvent{
+		MonitorCrossRefID:   mp.CrossReferenceID(),
+		DroppedConnection:   connectionID(callID, mp.Extension()),
+		ReleasingDevice:     subjectDeviceID(mp.Extension()),
+		LocalConnectionInfo: "null",
+		Cause:               csta.EventCauseNormalClearing,
+	}
+	f.tracker.Handle(cleared)
+	mp.Publish(cleared)
+
+	r, found := f.recordings[uniqueID]
+	if !found {
+		return
+	}
+	if !ok {
+		call = r.call
+	}
+	if r.forking {
+		// Whether there is any media to upload is only known with the reply
+		r.hungUp = true
+		r.call = call
+		return
+	}
+	delete(f.recordings, uniqueID)
+
+	log.Printf("Stopping recording of call <%s> at <%s>\n", callID, mp.Extension())
+	f.finishRecording(r, call)
+}
+
+// startRecording starts a recorder and lets FreeSWITCH fork the media of a channel to it, the
+// recording is given up if the media command fails
+func (f *FreeSWITCH) startRecording(uniqueID string, callID string, mp *pbx.DeviceMonitorPoint) {
+	f.mutex.Lock()
+	recorderPool := f.recorderPool
+	f.mutex.Unlock()
+	if recorderPool == nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: no recorders available\n", callID, mp.Extension())
+		return
+	}
+
+	recorder, err := recorderPool.GetRecorder()
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", callID, mp.Extension(), err)
+		return
+	}
+
+	host, port, err := mediaHost(recorder)
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", callID, mp.Extension(), err)
+		return
+	}
+
+	filePath, err := pbx.StartRecording(recorder)
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", callID, mp.Extension(), err)
+		return
+	}
+
+	log.Printf("Recording call <%s> at <%s> with local recording endpoint <%s> in file \"%s\"\n",
+		callID, mp.Extension(), net.JoinHostPort(host, port), filePath)
+	call, _ := f.tracker.Call(callID)
+	r := &recording{recorder: recorder, filePath: filePath, callID: callID, call: call, forking: true}
+	f.recordings[uniqueID] = r
+
+	command := mediaCommand(viper.GetString("freeswitch.media.start_command"), uniqueID, host, port)
+	conn, forks := f.conn, f.forks
+	go func() {
+		_, err := conn.API(command)
+		select {
+		case forks <- mediaFork{uniqueID: uniqueID, recording: r, err: err}:
+		case <-conn.Closed():
+		}
+	}()
+}
+
+// forked gives up a recording whose media couldn't be forked and finishes the recordings
+// whose channels hung up while forking
+func (f *FreeSWITCH) forked(fork mediaFork) {
+	r := fork.recording
+	if f.recordings[fork.uniqueID] != r {
+		return
+	}
+	r.forking = false
+
+	if fork.err != nil {
+		log.Printf("Failed to fork the media of call <%s>: %s\n", r.callID, fork.err)
+		delete(f.recordings, fork.uniqueID)
+		r.recorder.StopRecording()
+		os.Remove(r.filePath)
+		return
+	}
+
+	if r.hungUp {
+		delete(f.recordings, fork.uniqueID)
+		log.Printf("Stopping recording of call <%s>\n", r.callID)
+		f.finishRecording(r, r.call)
+	}
+}
+
+// stopAllRecordings finishes all recordings, the media forks are stopped if the connection is
+// still up. No more events are handled at that point, nothing waits for the replies.
+func (f *FreeSWITCH) stopAllRecordings(stopMedia bool) {
+	command := viper.GetString("freeswitch.media.stop_command")
+
+	for uniqueID, r := range f.recordings {
+		delete(f.recordings, uniqueID)
+
+		if stopMedia && command != "" && !r.hungUp {
+			_, err := f.conn.API(mediaCommand(command, uniqueID, "", ""))
+			if err != nil {
+				log.Printf("Failed to stop forking the media of channel <%s>: %s\n", uniqueID, err)
+			}
+		}
+
+		call := r.call
+		if tracked, ok := f.tracker.Call(r.callID); ok {
+			call = tracked
+		}
+		f.finishRecording(r, call)
+	}
+}
+
+// finishRecording stops the recorder of a recording and passes the recording on to be uploaded
+func (f *FreeSWITCH) finishRecording(r *recording, call pbx.Call) {
+	pbx.FinishRecording(r.recorder, r.filePath, call, f.OnRecordingFinished)
+}
+
+// callID returns the ID of the call a channel belongs to, bridged channels share the UUID of the calling channel
+func callID(event esl.Event) string {
+	if id := event["Channel-Call-UUID"]; id != "" {
+		return id
+	}
+	return event["Unique-ID"]
+}
+
+// endpoint returns the extension of a channel name, e.g. 1001 for sofia/internal/1001@pbx.example.com
+// or sofia/internal/sip:1001@192.168.1.20:5060
+func endpoint(channelName string) string {
+	parts := strings.SplitN(channelName, "/", 3)
+	if len(parts) != 3 || parts[0] == "loopback" {
+		return ""
+	}
+
+	user := strings.TrimPrefix(parts[2], "sip:")
+	if i := strings.Index(user, "@"); i >= 0 {
+		user = user[:i]
+	}
+	return user
+}
+
+// mediaCommand fills in the placeholders of a media command
+func mediaCommand(template string, uniqueID string, host string, port string) string {
+	return strings.NewReplacer(
+		"{uuid}", uniqueID,
+		"{host}", host,
+		"{port}", port,
+		"{codec}", viper.GetString("freeswitch.media.codec"),
+	).Replace(template)
+}
+
+// mediaHost returns the host and port FreeSWITCH sends the media of a recorder to
+func mediaHost(recorder rtp.Recorder) (string, string, error) {
+	addr, ok := recorder.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", "", fmt.Errorf("recorder doesn't listen on UDP")
+	}
+
+	host := viper.GetString("freeswitch.media_address")
+	if host == "" {
+		if addr.IP.IsUnspecified() {
+			return "", "", fmt.Errorf("recorders listen on all addresses, freeswitch.media_address must be set")
+		}
+		host = addr.IP.String()
+	}
+	return host, fmt.Sprintf("%d", addr.Port), nil
+}
+
+func connectionID(callID string, device string) csta.ConnectionID {
+	return csta.ConnectionID{
+		CallID:   callID,
+		DeviceID: &csta.LocalDeviceID{Device: device, TypeOfNumber: "dialingNumber"},
+	}
+}
+
+func subjectDeviceID(device string) csta.SubjectDeviceID {
+	return csta.SubjectDeviceID{
+		ExtendedDeviceID: csta.ExtendedDeviceID{
+			DeviceIdentifier: csta.DeviceID{Device: device, TypeOfNumber: "dialingNumber"},
+		},
+	}
+}
@@ -0,0 +1,255 @@
+package freeswitch
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/freeswitch/freeswitchtest"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/pbxtest"
+	"github.com/spf13/viper"
+)
+
+// connectTestServer connects a FreeSWITCH to a server, finished recordings are sent to records
+func connectTestServer(t *testing.T, s *freeswitchtest.Server, ctx context.Context) (*FreeSWITCH, *pbxtest.Recorder, pbxtest.Records) {
+	viper.Set("freeswitch.address", s.Addr())
+	viper.Set("freeswitch.media_address", "")
+	viper.Set("freeswitch.media.start_command", "uuid_rtp_fork {uuid} start {host} {port} {codec}")
+	viper.Set("freeswitch.media.stop_command", "uuid_rtp_fork {uuid} stop")
+
+	records := pbxtest.NewRecords()
+	recorder := pbxtest.NewRecorder()
+	f := &FreeSWITCH{
+		recorderPool:        &pbxtest.RecorderPool{Recorder: recorder},
+		OnRecordingFinished: records.Finish,
+	}
+	f.SetContext(ctx)
+
+	_, err := f.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions := s.Commands("event ")
+	if len(subscriptions) != 1 || subscriptions[0] != "event plain CHANNEL_ANSWER CHANNEL_HANGUP_COMPLETE" {
+		t.Fatalf("unexpected subscriptions %q", subscriptions)
+	}
+	return f, recorder, records
+}
+
+// replay sends the events of a file in testdata
+func replay(t *testing.T, s *freeswitchtest.Server, name string) {
+	t.Helper()
+
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := s.Replay(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordInboundCall(t *testing.T) {
+	s, err := freeswitchtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, recorder, records := connectTestServer(t, s, ctx)
+	defer f.Close()
+
+	mp, err := f.MonitorStart("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := mp.Events()
+
+	replay(t, s, "inbound_call.esl")
+
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "7f0c2a51-1b2c-4d3e-8f40-0000000000a1" || record.CallerNumber != "5551234" || record.CalleeNumber != "1001" || record.End.Before(record.Begin) {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	if recorder.IsRecording() {
+		t.Fail()
+	}
+
+	// Only the channel of the extension is forked, the fork ends with the channel
+	forks := s.Commands("api uuid_rtp_fork")
+	if len(forks) != 1 || forks[0] != "api uuid_rtp_fork 7f0c2a51-1b2c-4d3e-8f40-0000000000b1 start 127.0.0.1 40000 PCMU" {
+		t.Fatalf("unexpected media commands %q", forks)
+	}
+
+	// The monitor point sees the call as CSTA events
+	for _, messageType := range []csta.MessageType{csta.MessageTypeEstablishedEvent, csta.MessageTypeConnectionClearedEvent} {
+		select {
+		case event := <-events:
+			if event.Type() != messageType {
+				t.Fatalf("unexpected event %+v", event)
+			}
+		case <-time.After(pbxtest.Timeout):
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func TestRecordOutboundCallUntilClose(t *testing.T) {
+	s, err := freeswitchtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, recorder, records := connectTestServer(t, s, ctx)
+
+	_, err = f.MonitorStart("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay(t, s, "outbound_call.esl")
+
+	_, err = s.WaitForCommand("api uuid_rtp_fork", 1, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing stops the media fork and finishes the recording
+	f.Close()
+
+	record := records.Wait(t, 1)[0]
+	if record.CallID != "3c9d1e72-5a6b-4c7d-8e9f-0000000000c1" || record.CallerNumber != "1001" || record.CalleeNumber != "5559876" {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	if recorder.IsRecording() {
+		t.Fail()
+	}
+
+	forks := s.Commands("api uuid_rtp_fork")
+	if len(forks) != 2 || forks[1] != "api uuid_rtp_fork 3c9d1e72-5a6b-4c7d-8e9f-0000000000c1 stop" {
+		t.Fatalf("unexpected media commands %q", forks)
+	}
+}
+
+func TestRecordUntilDisconnect(t *testing.T) {
+	s, err := freeswitchtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, _, records := connectTestServer(t, s, ctx)
+
+	_, err = f.MonitorStart("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay(t, s, "outbound_call.esl")
+
+	_, err = s.WaitForCommand("api uuid_rtp_fork", 1, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the connection finishes the recording
+	s.Disconnect()
+	records.Wait(t, 1)
+
+	select {
+	case <-f.done:
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("connection wasn't closed")
+	}
+	f.Close()
+}
+
+func TestFailedMediaFork(t *testing.T) {
+	s, err := freeswitchtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.HandleAPI("uuid_rtp_fork", func(args string) string {
+		return "-ERR no such channel"
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, recorder, records := connectTestServer(t, s, ctx)
+	defer f.Close()
+
+	mp, err := f.MonitorStart("1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := mp.Events()
+
+	replay(t, s, "inbound_call.esl")
+
+	// The call is still reported, but nothing was recorded
+	for _, messageType := range []csta.MessageType{csta.MessageTypeEstablishedEvent, csta.MessageTypeConnectionClearedEvent} {
+		select {
+		case event := <-events:
+			if event.Type() != messageType {
+				t.Fatalf("unexpected event %+v", event)
+			}
+		case <-time.After(pbxtest.Timeout):
+			t.Fatal("no event received")
+		}
+	}
+	recorder.WaitForRecording(t, false)
+	select {
+	case record := <-records:
+		t.Fatalf("unexpected upload record %+v", record)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	s, err := freeswitchtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetPassword("other")
+
+	viper.Set("freeswitch.address", s.Addr())
+	viper.Set("freeswitch.media.start_command", "uuid_rtp_fork {uuid} start {host} {port} {codec}")
+
+	f := &FreeSWITCH{}
+	f.SetContext(context.Background())
+	if _, err := f.Connect(); err == nil {
+		t.Fatal("connected with the wrong password")
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for name, expected := range map[string]string{
+		"sofia/internal/1001@pbx.example.com":        "1001",
+		"sofia/internal/sip:1002@192.168.1.20:5060":  "1002",
+		"loopback/1001-a":                            "",
+		"sofia/external/5551234@carrier.example.com": "5551234",
+		"error/user_not_registered":                  "",
+	} {
+		if e := endpoint(name); e != expected {
+			t.Errorf("endpoint(%q) = %q, expected %q", name, e, expected)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package genericcsta
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("generic_csta.protocol_version", "http://www.ecma-international.org/standards/ecma-323/csta/ed4")
+	viper.SetDefault("generic_csta.login.element", "")
+	viper.SetDefault("generic_csta.login.user_element", "user")
+	viper.SetDefault("generic_csta.login.password_element", "password")
+	viper.SetDefault("generic_csta.type_of_number", "dialingNumber")
+	viper.SetDefault("generic_csta.keepalive_interval", 30*time.Second)
+	viper.SetDefault("generic_csta.recording.start_events", []string{string(csta.MessageTypeEstablishedEvent)})
+	viper.SetDefault("generic_csta.recording.stop_events", []string{
+		string(csta.MessageTypeConnectionClearedEvent),
+		string(csta.MessageTypeCallClearedEvent),
+	})
+}
+
+// config describes the dialect of CSTA a switch speaks, e.g. for a Mitel MiVoice link:
+//
+//	generic_csta:
+//	  server_addresses:
+//	    - mivb.example.com:3211
+//	  protocol_version: http://www.ecma-international.org/standards/ecma-323/csta/ed3
+//	  username: cra
+//	  password: secret
+//	  login:
+//	    element: loginInfo       # wraps the credentials, none by default
+//	    user_element: userName   # default: user
+//	    password_element: password
+//	  type_of_number: dialingNumber
+//	  keepalive_interval: 30s    # 0 disables resetting the application session timer
+//	  recording:
+//	    start_events: [EstablishedEvent, RetrievedEvent]
+//	    stop_events: [ConnectionClearedEvent, CallClearedEvent, HeldEvent]
+//	    media_addresses:         # where the switch sends the media of each recorded device
+//	      "4711": 0.0.0.0:40000
+//	      "4712": 0.0.0.0:40002
+type config struct {
+	protocolVersion   string
+	login             loginInfo
+	typeOfNumber      string
+	keepaliveInterval time.Duration
+	startEvents       map[csta.MessageType]bool
+	stopEvents        map[csta.MessageType]bool
+	mediaAddresses    map[string]string // UDP addresses the media of the devices arrives at, by extension
+}
+
+func loadConfig() (*config, error) {
+	c := &config{
+		protocolVersion: viper.GetString("generic_csta.protocol_version"),
+		login: loginInfo{
+			element:         viper.GetString("generic_csta.login.element"),
+			userElement:     viper.GetString("generic_csta.login.user_element"),
+			passwordElement: viper.GetString("generic_csta.login.password_element"),
+			user:            viper.GetString("generic_csta.username"),
+			password:        viper.GetString("generic_csta.password"),
+		},
+		typeOfNumber:      viper.GetString("generic_csta.type_of_number"),
+		keepaliveInterval: viper.GetDuration("generic_csta.keepalive_interval"),
+		mediaAddresses:    viper.GetStringMapString("generic_csta.recording.media_addresses"),
+	}
+
+	if c.login.userElement == "" || c.login.passwordElement == "" {
+		return nil, fmt.Errorf("generic_csta.login needs a user_element and a password_element")
+	}
+
+	var err error
+	c.startEvents, err = eventTypes("generic_csta.recording.start_events")
+	if err != nil {
+		return nil, err
+	}
+	c.stopEvents, err = eventTypes("generic_csta.recording.stop_events")
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// eventTypes reads a list of event types, e.g. EstablishedEvent, from the configuration
+func eventTypes(key string) (map[csta.MessageType]bool, error) {
+	types := make(map[csta.MessageType]bool)
+	for _, name := range viper.GetStringSlice(key) {
+		messageType := csta.MessageType(name)
+		if !csta.IsMessageType(messageType) {
+			return nil, fmt.Errorf("unknown event type <%s> in %s", name, key)
+		}
+		if !callEvents[messageType] {
+			return nil, fmt.Errorf("event type <%s> in %s doesn't refer to a call", name, key)
+		}
+		types[messageType] = true
+	}
+	return types, nil
+}
+
+// loginInfo is the applicationSpecificInfo of the StartApplicationSession request, whose
+// element names differ between switches:
+//
+//	<loginInfo><userName>cra</userName><password>secret</password></loginInfo>
+type loginInfo struct {
+	element         string // Optional element wrapping the credentials
+	userElement     string
+	passwordElement string
+	user            string
+	password        string
+}
+
+func (l loginInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	elements := []xml.StartElement{start}
+	if l.element != "" {
+		elements = append(elements, xml.StartElement{Name: xml.Name{Local: l.element}})
+	}
+
+	for _, element := range elements {
+		if err := e.EncodeToken(element); err != nil {
+			return err
+		}
+	}
+
+	err := e.EncodeElement(l.user, xml.StartElement{Name: xml.Name{Local: l.userElement}})
+	if err != nil {
+		return err
+	}
+	err = e.EncodeElement(l.password, xml.StartElement{Name: xml.Name{Local: l.passwordElement}})
+	if err != nil {
+		return err
+	}
+
+	for i := len(elements) - 1; i >= 0; i-- {
+		if err := e.EncodeToken(elements[i].End()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
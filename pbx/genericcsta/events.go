@@ -0,0 +1,60 @@
+package genericcsta
+
+import (
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+)
+
+// callEvents are the call control events that can start or stop a recording
+var callEvents = map[csta.MessageType]bool{
+	csta.MessageTypeServiceInitiatedEvent:  true,
+	csta.MessageTypeOriginatedEvent:        true,
+	csta.MessageTypeDeliveredEvent:         true,
+	csta.MessageTypeEstablishedEvent:       true,
+	csta.MessageTypeConnectionClearedEvent: true,
+	csta.MessageTypeHeldEvent:              true,
+	csta.MessageTypeRetrievedEvent:         true,
+	csta.MessageTypeTransferredEvent:       true,
+	csta.MessageTypeConferencedEvent:       true,
+	csta.MessageTypeDivertedEvent:          true,
+	csta.MessageTypeFailedEvent:            true,
+	csta.MessageTypeQueuedEvent:            true,
+	csta.MessageTypeCallClearedEvent:       true,
+	csta.MessageTypeDigitsDissipatedEvent:  true,
+}
+
+// eventConnections returns the connections an event reports on. For transfers and
+// conferences these are the connections of the resulting call.
+func eventConnections(message csta.Message) []csta.ConnectionID {
+	switch e := message.(type) {
+	case *csta.ServiceInitiatedEvent:
+		return []csta.ConnectionID{e.InitiatedConnection}
+	case *csta.OriginatedEvent:
+		return []csta.ConnectionID{e.OriginatedConnection}
+	case *csta.DeliveredEvent:
+		return []csta.ConnectionID{e.Connection}
+	case *csta.EstablishedEvent:
+		return []csta.ConnectionID{e.EstablishedConnection}
+	case *csta.ConnectionClearedEvent:
+		return []csta.ConnectionID{e.DroppedConnection}
+	case *csta.HeldEvent:
+		return []csta.ConnectionID{e.HeldConnection}
+	case *csta.RetrievedEvent:
+		return []csta.ConnectionID{e.RetrievedConnection}
+	case *csta.DivertedEvent:
+		return []csta.ConnectionID{e.Connection}
+	case *csta.FailedEvent:
+		return []csta.ConnectionID{e.FailedConnection}
+	case *csta.QueuedEvent:
+		return []csta.ConnectionID{e.QueuedConnection}
+	case *csta.CallClearedEvent:
+		return []csta.ConnectionID{e.ClearedCall}
+	case *csta.DigitsDissipatedEvent:
+		return []csta.ConnectionID{e.DissipatingConnection}
+	}
+
+	if _, callID, ok := pbx.MergedCalls(message); ok {
+		return []csta.ConnectionID{{CallID: callID}}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+// Package genericcsta connects to switches that speak plain ECMA-323 CSTA, e.g. Mitel MiVoice,
+// Panasonic KX-NS or Unify OpenScape Voice. What differs between them, like the login and
+// the events that start and stop a recording, is read from the generic_csta section of the
+// configuration.
+//
+// Plain CSTA has no service to request the media of a call, the switch has to be set up to
+// send the media of each recorded device to a fixed address, e.g. with a port mirror or the
+// recording trunk of the switch. The driver listens at the media address configured for a
+// device and records what arrives there while a call of the device is recorded. Devices
+// without a media address are monitored but not recorded.
+package genericcsta
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/spf13/viper"
+)
+
+type GenericCSTA struct {
+	ctx           context.Context
+	session       *pbx.ApplicationSession
+	sessionId     string
+	conn          csta.Conn
+	config        *config
+	monitorPoints pbx.MonitorPoints
+	mutex         sync.Mutex                  // Guards recorders and recordings, which event handlers access concurrently
+	recorders     map[string]rtp.Recorder     // Recorders listening at the media addresses of the devices, by extension
+	recordings    map[recordingKey]*recording // Recordings going on
+	tracker       *pbx.CallTracker
+
+	// OnRecordingFinished is called with each finished recording,
+	// the default queues the recording for upload
+	OnRecordingFinished func(record *models.UploadRecord)
+}
+
+// recordingKey identifies the recording of a call at a monitored device
+type recordingKey struct {
+	crossReferenceID string
+	callID           string
+}
+
+type recording struct {
+	recorder rtp.Recorder
+	filePath string
+	call     pbx.Call // Snapshot for calls the tracker forgot when the recording stops
+}
+
+func (g *GenericCSTA) SetContext(ctx context.Context) {
+	g.ctx = ctx
+}
+
+// Connect dials the connection and establishes an application session
+func (g *GenericCSTA) Connect() (csta.Conn, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.listenForMedia(config.mediaAddresses)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &pbx.ApplicationSession{
+		ApplicationID:           viper.GetString("application_id"),
+		ApplicationSpecificInfo: config.login,
+		ProtocolVersion:         config.protocolVersion,
+	}
+	cstaConn, sessionId, err := pbx.DialCSTA("generic_csta", g.ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Application session started with session id <%s>\n", sessionId)
+
+	// Monitor points of a previous connection are gone, possibly with the node they were started on
+	g.monitorPoints.Reset()
+
+	// Events of calls that were recorded with the previous connection are gone as well
+	g.stopAllRecordings()
+
+	g.config = config
+	g.conn = cstaConn
+	g.session = session
+	g.sessionId = sessionId
+	if g.tracker == nil {
+		g.tracker = pbx.NewCallTracker()
+	} else {
+		g.tracker.Reset()
+	}
+	g.setupHandlers(cstaConn)
+
+	if config.keepaliveInterval > 0 {
+		go session.KeepAlive(g.ctx, cstaConn, sessionId, config.keepaliveInterval)
+	}
+
+	return cstaConn, nil
+}
+
+// listenForMedia starts a recorder at the media address of each device, the recorders
+// of earlier connections keep listening
+func (g *GenericCSTA) listenForMedia(mediaAddresses map[string]string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.recorders == nil {
+		g.recorders = make(map[string]rtp.Recorder)
+	}
+	for extension, address := range mediaAddresses {
+		if _, ok := g.recorders[extension]; ok {
+			continue
+		}
+
+		recorder, err := rtp.NewRecorder(address, g.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to receive the media of <%s>: %w", extension, err)
+		}
+		go recorder.Start()
+		g.recorders[extension] = recorder
+	}
+
+	if len(g.recorders) == 0 {
+		log.Printf("No media addresses are configured, calls won't be recorded\n")
+	}
+	return nil
+}
+
+func (g *GenericCSTA) ConnectionState() pbx.ConnectionState {
+	switch g.conn.State() {
+	case csta.ConnectionStateActive:
+		return pbx.ConnectionStateConnected
+	case csta.ConnectionStateError:
+		return pbx.ConnectionStateError
+	}
+
+	return pbx.ConnectionStateDisconnected
+}
+
+// Close finishes the recordings and closes the TCP connection after it stopped the application session
+func (g *GenericCSTA) Close() error {
+	g.stopAllRecordings()
+
+	return g.session.Close(g.conn, g.sessionId)
+}
+
+func (g *GenericCSTA) MonitorStart(deviceId string) (pbx.MonitorPoint, error) {
+	log.Printf("MonitorStart(<%s>)", deviceId)
+
+	response, err := g.conn.Do(g.ctx, csta.MonitorStart{
+		MonitorObject: csta.CSTAObject{
+			DeviceObject: &csta.DeviceID{Device: deviceId, TypeOfNumber: g.config.typeOfNumber},
+		},
+		MonitorType: csta.MonitorTypeDevice,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to monitor device <%s>: %w", deviceId, err)
+	}
+
+	resp, ok := response.(*csta.MonitorStartResponse)
+	if !ok {
+		return nil, fmt.Errorf("failed to monitor device <%s>, unexpected response %s", deviceId, response.Type())
+	}
+
+	mp := pbx.NewDeviceMonitorPoint(resp.MonitorCrossRefID, pbx.MonitoredDevice{Extension: deviceId})
+	g.monitorPoints.Add(mp)
+	g.tracker.Monitor(resp.MonitorCrossRefID, deviceId)
+
+	log.Printf("Monitoring <%s> with CrossRefID <%s>\n", deviceId, mp.CrossReferenceID())
+
+	return mp, nil
+}
+
+// Serve monitors the configured devices. The recorders of the pool aren't used, the media
+// of each device arrives at the recorder of its media address.
+func (g *GenericCSTA) Serve(recorderPool rtp.RecorderPool) error {
+	defer g.Close()
+	log.Printf("Handling PBX connection\n")
+
+	// Get access to the persistence layer
+	db, err := models.NewDatabase()
+	if err != nil {
+		return err
+	}
+
+	monitoredDevices := db.GetMonitoredDevices()
+	log.Printf("%d devices are configured to be monitored\n", len(monitoredDevices))
+
+	for _, d := range monitoredDevices {
+		mp, err := g.MonitorStart(d.Extension)
+		if err != nil {
+			log.Printf("Failed to start monitoring <%s>: %s", d.Extension, err)
+			continue
+		}
+
+		d.CrossReferenceID = mp.CrossReferenceID()
+		db.Save(d)
+	}
+
+	// Handlers will run in the background, wait for anything to fail/end
+	select {
+	case <-g.ctx.Done():
+		return nil
+	case <-g.conn.Closed():
+		return io.EOF
+	}
+}
+
+func (g *GenericCSTA) setupHandlers(conn csta.Conn) {
+	for messageType := range callEvents {
+		conn.Handle(messageType, g.onCallControlEvent)
+	}
+}
+
+// onCallControlEvent updates the tracked calls, passes the event on to its monitor point
+// and starts or stops recordings if the event type is configured to
+func (g *GenericCSTA) onCallControlEvent(c *csta.Context) {
+	g.tracker.Handle(c.Message)
+
+	crossRefID, ok := pbx.MonitorCrossRefID(c.Message)
+	if !ok {
+		return
+	}
+	mp := g.monitorPoints.Get(crossRefID)
+	if mp == nil {
+		return
+	}
+	mp.Publish(c.Message)
+
+	if previousCallIDs, callID, ok := pbx.MergedCalls(c.Message); ok {
+		g.moveRecordings(mp, previousCallIDs, callID)
+	}
+
+	messageType := c.Message.Type()
+	for _, connection := range eventConnections(c.Message) {
+		if g.config.stopEvents[messageType] {
+			g.stopRecording(mp, connection)
+		}
+		if g.config.startEvents[messageType] {
+			g.startRecording(mp, connection.CallID)
+		}
+	}
+}
+
+// startRecording starts the recorder at the media address of a monitored device for a call,
+// unless the device has no media address or the recorder is busy with another call
+func (g *GenericCSTA) startRecording(mp *pbx.DeviceMonitorPoint, callID string) {
+	key := recordingKey{crossReferenceID: mp.CrossReferenceID(), callID: callID}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.recordings[key]; ok {
+		return
+	}
+	recorder, ok := g.recorders[mp.Extension()]
+	if !ok {
+		log.Printf("Not recording call <%s> at <%s>: no media address configured\n", callID, mp.Extension())
+		return
+	}
+	if recorder.IsRecording() {
+		log.Printf("Not recording call <%s> at <%s>: another call of the device is recorded\n", callID, mp.Extension())
+		return
+	}
+
+	filePath, err := pbx.StartRecording(recorder)
+	if err != nil {
+		log.Printf("Failed to start recording of call <%s> at <%s>: %s\n", callID, mp.Extension(), err)
+		return
+	}
+
+	call, ok := g.tracker.Call(callID)
+	if !ok {
+		call = pbx.Call{ID: callID, Started: time.Now()}
+	}
+
+	log.Printf("Recording call <%s> at <%s> with local recording endpoint <%s> in file \"%s\"\n",
+		callID, mp.Extension(), recorder.LocalAddr().String(), filePath)
+	if g.recordings == nil {
+		g.recordings = make(map[recordingKey]*recording)
+	}
+	g.recordings[key] = &recording{recorder: recorder, filePath: filePath, call: call}
+}
+
+// stopRecording stops the recording of a call at a monitored device. Events about other parties
+// only stop it if the monitored device isn't connected to the call anymore, e.g. when the
+// other party of a two-party call hangs up.
+func (g *GenericCSTA) stopRecording(mp *pbx.DeviceMonitorPoint, connection csta.ConnectionID) {
+	if connection.DeviceID != nil && !pbx.SameDevice(connection.DeviceID.Device, mp.Extension()) {
+		if call, ok := g.tracker.Call(connection.CallID); ok && call.Party(mp.Extension()) != nil {
+			return
+		}
+	}
+
+	r := g.takeRecording(recordingKey{crossReferenceID: mp.CrossReferenceID(), callID: connection.CallID})
+	if r == nil {
+		return
+	}
+	log.Printf("Stopping recording of call <%s> at <%s>\n", connection.CallID, mp.Extension())
+	g.finishRecording(r, connection.CallID)
+}
+
+// moveRecordings keeps recording calls that were merged by a transfer or conference as the
+// resulting call, as long as the monitored device is a party of it
+func (g *GenericCSTA) moveRecordings(mp *pbx.DeviceMonitorPoint, previousCallIDs []string, callID string) {
+	key := recordingKey{crossReferenceID: mp.CrossReferenceID(), callID: callID}
+	finished := make(map[string]*recording)
+
+	g.mutex.Lock()
+	for _, previousCallID := range previousCallIDs {
+		previous := recordingKey{crossReferenceID: mp.CrossReferenceID(), callID: previousCallID}
+		r, ok := g.recordings[previous]
+		if !ok {
+			continue
+		}
+		delete(g.recordings, previous)
+
+		if _, ok := g.recordings[key]; ok {
+			// The device was connected to both calls, e.g. the conferencing device
+			finished[previousCallID] = r
+			continue
+		}
+		g.recordings[key] = r
+	}
+	g.mutex.Unlock()
+
+	for previousCallID, r := range finished {
+		g.finishRecording(r, previousCallID)
+	}
+
+	// The transferring device leaves the call
+	if call, ok := g.tracker.Call(callID); !ok || call.Party(mp.Extension()) == nil {
+		if r := g.takeRecording(key); r != nil {
+			log.Printf("Stopping recording of call <%s> at <%s>, the device left it\n", callID, mp.Extension())
+			g.finishRecording(r, callID)
+		}
+	}
+}
+
+// takeRecording removes a recording from the ones going on, it returns nil if there is none
+func (g *GenericCSTA) takeRecording(key recordingKey) *recording {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	r, ok := g.recordings[key]
+	if !ok {
+		return nil
+	}
+	delete(g.recordings, key)
+	return r
+}
+
+// stopAllRecordings finishes all recordings, e.g. when the connection to the switch is lost
+func (g *GenericCSTA) stopAllRecordings() {
+	g.mutex.Lock()
+	recordings := g.recordings
+	g.recordings = make(map[recordingKey]*recording)
+	g.mutex.Unlock()
+
+	for key, r := range recordings {
+		g.finishRecording(r, key.callID)
+	}
+}
+
+// finishRecording stops a recorder and passes the recording on to be uploaded
+func (g *GenericCSTA) finishRecording(r *recording, callID string) {
+	call, ok := g.tracker.Call(callID)
+	if !ok {
+		call = r.call
+		call.ID = callID
+	}
+
+	pbx.FinishRecording(r.recorder, r.filePath, call, g.OnRecordingFinished)
+}
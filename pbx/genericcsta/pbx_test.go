@@ -0,0 +1,278 @@
+package genericcsta
+
+import (
+	"context"
+	"encoding/xml"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/csta/cstatest"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/pbxtest"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/spf13/viper"
+)
+
+// connectTestSwitch connects a GenericCSTA to a switch that starts and stops recordings
+// with the given events, finished recordings are sent to records
+func connectTestSwitch(t *testing.T, s *cstatest.Switch, ctx context.Context, startEvents []string, stopEvents []string) (*GenericCSTA, *pbxtest.Recorder, pbxtest.Records) {
+	viper.Set("generic_csta.server_addresses", []string{s.Addr()})
+	viper.Set("generic_csta.username", "cra")
+	viper.Set("generic_csta.password", "secret")
+	viper.Set("generic_csta.type_of_number", "deviceNumber")
+	viper.Set("generic_csta.keepalive_interval", 0)
+	viper.Set("generic_csta.recording.start_events", startEvents)
+	viper.Set("generic_csta.recording.stop_events", stopEvents)
+	viper.Set("generic_csta.recording.media_addresses", map[string]string{})
+
+	// The media of 4711 arrives at the recorder
+	records := pbxtest.NewRecords()
+	recorder := pbxtest.NewRecorder()
+	g := &GenericCSTA{
+		recorders:           map[string]rtp.Recorder{"4711": recorder},
+		OnRecordingFinished: records.Finish,
+	}
+	g.SetContext(ctx)
+
+	_, err := g.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.sessionId != "session-1" {
+		t.Fatalf("unexpected session ID <%s>", g.sessionId)
+	}
+	return g, recorder, records
+}
+
+func TestLoginInfo(t *testing.T) {
+	body, err := xml.Marshal(csta.StartApplicationSession{
+		ApplicationID: "cra",
+		ApplicationSpecificInfo: loginInfo{
+			element:         "loginInfo",
+			userElement:     "userName",
+			passwordElement: "password",
+			user:            "cra",
+			password:        "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<applicationSpecificInfo><loginInfo><userName>cra</userName><password>secret</password></loginInfo></applicationSpecificInfo>"
+	if !strings.Contains(string(body), expected) {
+		t.Fatalf("unexpected login %s", body)
+	}
+
+	body, err = xml.Marshal(csta.StartApplicationSession{
+		ApplicationID:           "cra",
+		ApplicationSpecificInfo: loginInfo{userElement: "user", passwordElement: "password", user: "cra", password: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = "<applicationSpecificInfo><user>cra</user><password>secret</password></applicationSpecificInfo>"
+	if !strings.Contains(string(body), expected) {
+		t.Fatalf("unexpected login %s", body)
+	}
+}
+
+func TestRecordConfiguredEvents(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Calls on hold aren't recorded
+	g, recorder, records := connectTestSwitch(t, s, ctx,
+		[]string{"EstablishedEvent", "RetrievedEvent"},
+		[]string{"ConnectionClearedEvent", "HeldEvent"})
+
+	mp, err := g.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitorStart := s.Requests(csta.MessageTypeMonitorStart)
+	if len(monitorStart) != 1 || monitorStart[0].(*csta.MonitorStart).MonitorObject.DeviceObject.TypeOfNumber != "deviceNumber" {
+		t.Fatalf("unexpected MonitorStart %+v", monitorStart)
+	}
+
+	err = s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.WaitForRecording(t, true)
+
+	err = s.Held(mp.CrossReferenceID(), "1", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := records.Wait(t, 1)[0]; record.CallID != "1" || record.CallerNumber != "100" || record.CalleeNumber != "4711" {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+
+	err = s.Retrieved(mp.CrossReferenceID(), "1", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.WaitForRecording(t, true)
+
+	// The other party hanging up ends the call
+	err = s.ConnectionCleared(mp.CrossReferenceID(), "1", "100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := records.Wait(t, 1)[0]; record.CallID != "1" || record.End.Before(record.Begin) {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+}
+
+func TestRecordTransferredCall(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, recorder, records := connectTestSwitch(t, s, ctx,
+		[]string{"EstablishedEvent"},
+		[]string{"ConnectionClearedEvent", "CallClearedEvent"})
+
+	mp, err := g.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4711 answers a call and transfers the caller to 4712 after consulting it
+	err = s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.WaitForRecording(t, true)
+
+	err = s.Held(mp.CrossReferenceID(), "1", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Transferred(mp.CrossReferenceID(), "1", "2", "4711", "100", "4712")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recording at 4711 ends with the transfer
+	if record := records.Wait(t, 1)[0]; record.CallID != "2" || record.CallerNumber != "100" {
+		t.Fatalf("unexpected upload record %+v", record)
+	}
+	if recorder.IsRecording() {
+		t.Fail()
+	}
+}
+
+func TestMediaAddresses(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, recorder, _ := connectTestSwitch(t, s, ctx,
+		[]string{"EstablishedEvent"},
+		[]string{"ConnectionClearedEvent"})
+
+	err = g.listenForMedia(map[string]string{"4712": "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := g.recorders["4712"].LocalAddr().(*net.UDPAddr); !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+		t.Fatalf("unexpected media address %v", g.recorders["4712"].LocalAddr())
+	}
+
+	// The media of 4713 doesn't arrive anywhere
+	unrecorded, err := g.MonitorStart("4713")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := g.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Established(unrecorded.CrossReferenceID(), "1", "100", "4713")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Established(mp.CrossReferenceID(), "2", "100", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.WaitForRecording(t, true)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.recordings[recordingKey{crossReferenceID: unrecorded.CrossReferenceID(), callID: "1"}]; ok || len(g.recordings) != 1 {
+		t.Fatalf("unexpected recordings %+v", g.recordings)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	viper.Set("generic_csta.server_addresses", []string{s.Addr()})
+	viper.Set("generic_csta.keepalive_interval", 10*time.Millisecond)
+	viper.Set("generic_csta.recording.start_events", []string{"EstablishedEvent"})
+	viper.Set("generic_csta.recording.stop_events", []string{"ConnectionClearedEvent"})
+
+	g := &GenericCSTA{}
+	g.SetContext(ctx)
+	_, err = g.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := s.WaitForRequest(csta.MessageTypeResetApplicationSessionTimer, 2, pbxtest.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.(*csta.ResetApplicationSessionTimer).SessionID != "session-1" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+}
+
+func TestUnknownEventType(t *testing.T) {
+	viper.Set("generic_csta.recording.start_events", []string{"EstablishedEvent"})
+	viper.Set("generic_csta.recording.stop_events", []string{"ConnectionClearedEvnt"})
+
+	_, err := loadConfig()
+	if err == nil || !strings.Contains(err.Error(), "ConnectionClearedEvnt") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Events that don't refer to a call can't start a recording
+	viper.Set("generic_csta.recording.stop_events", []string{"ConnectionClearedEvent"})
+	viper.Set("generic_csta.recording.start_events", []string{"BackInServiceEvent"})
+
+	_, err = loadConfig()
+	if err == nil || !strings.Contains(err.Error(), "BackInServiceEvent") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -1,9 +1,120 @@
 package pbx
 
-import "github.com/psco-tech/gw-coach-recording-agent/csta"
+import (
+	"context"
+	"sync"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+)
 
 type MonitorPoint interface {
 	Device() Device
 	CrossReferenceID() string
+
+	// Events returns a channel receiving the events of the monitor point until it is unsubscribed
 	Events() <-chan csta.Message
+
+	// Subscribe returns a channel receiving the events of the monitor point until the context is done
+	Subscribe(ctx context.Context) <-chan csta.Message
+
+	// Unsubscribe ends a subscription and closes its channel
+	Unsubscribe(events <-chan csta.Message)
+}
+
+// MonitoredDevice is a device a driver monitors
+type MonitoredDevice struct {
+	Extension       string
+	ID              string                 // Device ID the switch knows the device by, the extension if empty
+	RecordingMethod models.RecordingMethod // How the calls of the device are recorded, for drivers that offer several methods
+}
+
+func (d *MonitoredDevice) DeviceID() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return d.Extension
+}
+
+// DeviceMonitorPoint is the monitor point of a single device that publishes the events
+// the driver receives for it
+type DeviceMonitorPoint struct {
+	*EventBus
+	crossReferenceID string
+	device           *MonitoredDevice
+}
+
+func NewDeviceMonitorPoint(crossReferenceID string, device MonitoredDevice) *DeviceMonitorPoint {
+	return &DeviceMonitorPoint{
+		EventBus:         NewEventBus(),
+		crossReferenceID: crossReferenceID,
+		device:           &device,
+	}
+}
+
+func (mp *DeviceMonitorPoint) CrossReferenceID() string {
+	return mp.crossReferenceID
+}
+
+func (mp *DeviceMonitorPoint) Device() Device {
+	return mp.device
+}
+
+// Extension returns the extension of the monitored device
+func (mp *DeviceMonitorPoint) Extension() string {
+	return mp.device.Extension
+}
+
+// MonitoredDevice returns the monitored device, which doesn't change
+func (mp *DeviceMonitorPoint) MonitoredDevice() MonitoredDevice {
+	return *mp.device
+}
+
+// MonitorPoints holds the monitor points of a driver by their cross reference IDs,
+// event handlers may look them up concurrently
+type MonitorPoints struct {
+	mutex  sync.Mutex
+	points map[string]*DeviceMonitorPoint
+}
+
+func (m *MonitorPoints) Add(mp *DeviceMonitorPoint) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.points == nil {
+		m.points = make(map[string]*DeviceMonitorPoint)
+	}
+	m.points[mp.crossReferenceID] = mp
+}
+
+// Get returns the monitor point with a cross reference ID, or nil
+func (m *MonitorPoints) Get(crossReferenceID string) *DeviceMonitorPoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.points[crossReferenceID]
+}
+
+// All returns the monitor points in no particular order
+func (m *MonitorPoints) All() []*DeviceMonitorPoint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	points := make([]*DeviceMonitorPoint, 0, len(m.points))
+	for _, mp := range m.points {
+		points = append(points, mp)
+	}
+	return points
+}
+
+// Reset closes and forgets all monitor points, e.g. the ones of a lost connection
+func (m *MonitorPoints) Reset() {
+	m.mutex.Lock()
+	points := m.points
+	m.points = nil
+	m.mutex.Unlock()
+
+	for _, mp := range points {
+		mp.Close()
+	}
 }
@@ -0,0 +1,269 @@
+package osbiz
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// OpenScape Business can't send the media of a device to the agent, with passive_capture
+	// the calls are recorded by the passive monitoring of passive_monitoring.interface_name
+	// and attributed to the monitored devices by their CSTA events
+	viper.SetDefault("osbiz.passive_capture", false)
+
+	// How far the captured media and the CSTA events of a call may be apart in time
+	viper.SetDefault("osbiz.capture_match_window", 30*time.Second)
+
+	// The capture records every call on the network segment, recordings of calls without
+	// monitored devices are deleted unless they are kept for troubleshooting the matching
+	viper.SetDefault("osbiz.keep_unattributed_captures", false)
+}
+
+// trackedEvents are the call control events besides EstablishedEvent that the calls are tracked with
+var trackedEvents = []csta.MessageType{
+	csta.MessageTypeServiceInitiatedEvent,
+	csta.MessageTypeOriginatedEvent,
+	csta.MessageTypeDeliveredEvent,
+	csta.MessageTypeConnectionClearedEvent,
+	csta.MessageTypeHeldEvent,
+	csta.MessageTypeRetrievedEvent,
+	csta.MessageTypeTransferredEvent,
+	csta.MessageTypeConferencedEvent,
+	csta.MessageTypeDivertedEvent,
+	csta.MessageTypeFailedEvent,
+	csta.MessageTypeQueuedEvent,
+	csta.MessageTypeCallClearedEvent,
+}
+
+// capturedCall is a call of monitored devices, kept for a while after it ended as the
+// passive capture may finish its recording later
+type capturedCall struct {
+	call       pbx.Call
+	extensions []string        // Monitored extensions that were parties of the call
+	attributed map[string]bool // Extensions a recording was attributed to already
+}
+
+// followCalls keeps the calls of the monitored devices up to date until the events are closed
+func (o *OSBiz) followCalls(events <-chan pbx.CallEvent) {
+	for event := range events {
+		o.followCall(event)
+	}
+}
+
+func (o *OSBiz) followCall(event pbx.CallEvent) {
+	o.captureMutex.Lock()
+	defer o.captureMutex.Unlock()
+
+	if o.capturedCalls == nil {
+		o.capturedCalls = make(map[string]*capturedCall)
+	}
+	o.pruneCapturedCalls(time.Now())
+
+	c, ok := o.capturedCalls[event.Call.ID]
+	if !ok {
+		c = &capturedCall{attributed: make(map[string]bool)}
+	}
+
+	// Transfers and conferences continue the merged calls
+	for _, id := range event.PreviousCallIDs {
+		if previous, ok := o.capturedCalls[id]; ok {
+			for _, extension := range previous.extensions {
+				c.addExtension(extension)
+			}
+			delete(o.capturedCalls, id)
+		}
+	}
+
+	for _, party := range event.Call.Parties {
+		if extension := o.monitoredExtension(party.DeviceID); extension != "" {
+			c.addExtension(extension)
+		}
+	}
+	if extension := o.monitoredExtension(event.Device); extension != "" {
+		c.addExtension(extension)
+	}
+
+	if len(c.extensions) == 0 {
+		return
+	}
+	c.call = event.Call
+	o.capturedCalls[event.Call.ID] = c
+}
+
+// RecordingCaptured attributes a recording of the passive capture to the monitored device
+// whose call it belongs to and passes it on with the parties of the CSTA call. Recordings
+// that can't be attributed are deleted unless osbiz.keep_unattributed_captures is set.
+func (o *OSBiz) RecordingCaptured(record *models.UploadRecord) {
+	call, extension, ok := o.matchCapturedCall(record)
+	if !ok && viper.GetBool("osbiz.keep_unattributed_captures") {
+		log.Printf("Keeping the recording of <%s> to <%s> at <%s>, it can't be attributed to a monitored device\n",
+			record.CallerNumber, record.CalleeNumber, record.FilePath)
+		return
+	}
+	if !ok {
+		log.Printf("Discarding the recording of <%s> to <%s>, it can't be attributed to a monitored device\n",
+			record.CallerNumber, record.CalleeNumber)
+		os.Remove(record.FilePath)
+		return
+	}
+
+	// The capture knows when the media was sent, the CSTA call may have started ringing earlier
+	begin, end := record.Begin, record.End
+	call.Annotate(record)
+	record.Begin, record.End = begin, end
+	record.Extension = extension
+
+	log.Printf("Captured call <%s> at <%s>\n", record.CallID, extension)
+	o.saveLastRecordedCall(extension, end)
+
+	pbx.DeliverRecording(record, o.OnRecordingFinished)
+}
+
+// matchCapturedCall finds the call of a monitored device that was going on while a recording
+// was captured and one of whose SIP parties is the device or the calling or called number of
+// the CSTA call, e.g. the DID of the device or the external party. Devices that have no
+// recording of the call yet come first, e.g. for internal calls of two monitored devices,
+// then devices that are SIP parties themselves, then the call answered closest to the
+// start of the recording.
+func (o *OSBiz) matchCapturedCall(record *models.UploadRecord) (pbx.Call, string, bool) {
+	o.captureMutex.Lock()
+	defer o.captureMutex.Unlock()
+
+	window := o.captureMatchWindow
+
+	o.pruneCapturedCalls(time.Now())
+
+	var match *capturedCall
+	var matchExtension string
+	var matchDistance time.Duration
+	var matchDirect bool
+	for _, c := range o.capturedCalls {
+		begin := c.call.Answered
+		if begin.IsZero() {
+			begin = c.call.Started
+		}
+		if begin.After(record.End.Add(window)) || (!c.call.Ended.IsZero() && c.call.Ended.Add(window).Before(record.Begin)) {
+			continue
+		}
+
+		distance := begin.Sub(record.Begin)
+		if distance < 0 {
+			distance = -distance
+		}
+
+		viaCall := c.hasNumber(record.CallerNumber) || c.hasNumber(record.CalleeNumber)
+		for _, extension := range c.extensions {
+			direct := sameNumber(extension, record.CallerNumber) || sameNumber(extension, record.CalleeNumber)
+			if !direct && !viaCall {
+				continue
+			}
+
+			better := match == nil
+			if !better && match.attributed[matchExtension] != c.attributed[extension] {
+				better = !c.attributed[extension]
+			} else if !better && matchDirect != direct {
+				better = direct
+			} else if !better {
+				better = distance < matchDistance
+			}
+			if better {
+				match, matchExtension, matchDistance, matchDirect = c, extension, distance, direct
+			}
+		}
+	}
+
+	if match == nil {
+		return pbx.Call{}, "", false
+	}
+	match.attributed[matchExtension] = true
+	return match.call, matchExtension, true
+}
+
+// pruneCapturedCalls forgets the calls that ended longer than the match window ago,
+// the mutex must be held
+func (o *OSBiz) pruneCapturedCalls(now time.Time) {
+	for id, c := range o.capturedCalls {
+		if !c.call.Ended.IsZero() && now.Sub(c.call.Ended) > o.captureMatchWindow {
+			delete(o.capturedCalls, id)
+		}
+	}
+}
+
+// monitoredExtension returns the extension of a monitored device, or an empty string
+func (o *OSBiz) monitoredExtension(deviceID string) string {
+	if deviceID == "" {
+		return ""
+	}
+
+	for _, mp := range o.monitorPoints.All() {
+		if pbx.SameDevice(mp.Extension(), deviceID) {
+			return mp.Extension()
+		}
+	}
+	return ""
+}
+
+// saveLastRecordedCall stores the time of the latest recording of a device from the Device table
+func (o *OSBiz) saveLastRecordedCall(extension string, end time.Time) {
+	o.mutex.Lock()
+	var device models.Device
+	d, ok := o.devices[extension]
+	if ok {
+		d.LastRecordedCall = end
+		device = *d
+	}
+	o.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	db, err := models.NewDatabase()
+	if err != nil {
+		log.Printf("Failed to save the last recorded call of <%s>: %s\n", extension, err)
+		return
+	}
+	db.Save(&device)
+}
+
+// hasNumber tells whether a number of the capture is the calling or called number of the call
+func (c *capturedCall) hasNumber(number string) bool {
+	return sameNumber(c.call.CallingDevice, number) || sameNumber(c.call.CalledDevice, number)
+}
+
+// sameNumber tells whether two numbers refer to the same party, where one may be in a longer
+// form than the other, e.g. an extension and its DID in E.164 format
+func sameNumber(a string, b string) bool {
+	a, b = normalizeNumber(a), normalizeNumber(b)
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.HasSuffix(a, b) || strings.HasSuffix(b, a)
+}
+
+// normalizeNumber removes everything but the digits of a number and the zeros of its
+// trunk or international prefix
+func normalizeNumber(number string) string {
+	var digits strings.Builder
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	return strings.TrimLeft(digits.String(), "0")
+}
+
+func (c *capturedCall) addExtension(extension string) {
+	for _, e := range c.extensions {
+		if e == extension {
+			return
+		}
+	}
+	c.extensions = append(c.extensions, extension)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/psco-tech/gw-coach-recording-agent/csta"
 	"github.com/psco-tech/gw-coach-recording-agent/models"
@@ -14,13 +15,23 @@ import (
 	"github.com/spf13/viper"
 )
 
-const defaultEventBufferSize = 100
-
 type OSBiz struct {
 	ctx           context.Context
 	sessionId     string
 	conn          csta.Conn
-	monitorPoints map[string]*monitorPoint
+	monitorPoints pbx.MonitorPoints
+	mutex         sync.Mutex                // Guards devices, which event handlers read concurrently
+	devices       map[string]*models.Device // Monitored devices by extension
+	tracker       *pbx.CallTracker
+
+	// Calls of the monitored devices the recordings of the passive capture are matched with
+	captureMutex       sync.Mutex
+	capturedCalls      map[string]*capturedCall
+	captureMatchWindow time.Duration
+
+	// OnRecordingFinished is called with each recording of the passive capture that was
+	// attributed to a monitored device, the default queues the recording for upload
+	OnRecordingFinished func(record *models.UploadRecord)
 }
 
 func (pbx *OSBiz) SetContext(ctx context.Context) {
@@ -40,7 +51,8 @@ func (pbx *OSBiz) Serve(recorderPool rtp.RecorderPool) error {
 	monitoredDevices := db.GetMonitoredDevices()
 	log.Printf("%d devices are configured to be monitored\n", len(monitoredDevices))
 
-	for _, d := range monitoredDevices {
+	for i := range monitoredDevices {
+		d := &monitoredDevices[i]
 		mp, err := pbx.MonitorStart(d.Extension)
 		if err != nil {
 			log.Printf("Failed to start monitoring <%s>: %s", d.Extension, err)
@@ -49,6 +61,10 @@ func (pbx *OSBiz) Serve(recorderPool rtp.RecorderPool) error {
 
 		d.CrossReferenceID = mp.CrossReferenceID()
 		db.Save(d)
+
+		pbx.mutex.Lock()
+		pbx.devices[d.Extension] = d
+		pbx.mutex.Unlock()
 	}
 
 	// Add additional actions to do on newly established PBX connection here
@@ -62,74 +78,79 @@ func (pbx *OSBiz) Serve(recorderPool rtp.RecorderPool) error {
 	}
 }
 
-func (pbx *OSBiz) Connect() (csta.Conn, error) {
-	cstaConn, err := csta.Dial("tcp", viper.GetString("osbiz.server_address"), pbx.ctx, nil)
+func (osbiz *OSBiz) Connect() (csta.Conn, error) {
+	cstaConn, sessionId, err := pbx.DialCSTA("osbiz", osbiz.ctx, &pbx.ApplicationSession{
+		ApplicationID: viper.GetString("application_id"),
+		ApplicationSpecificInfo: struct {
+			User     string `xml:"user"`
+			Password string `xml:"password"`
+		}{
+			User:     viper.GetString("osbiz.username"),
+			Password: viper.GetString("osbiz.password"),
+		},
+		ProtocolVersion: "http://www.ecma-international.org/standards/ecma-323/csta/ed4",
+	})
 	if err != nil {
 		return nil, err
 	}
+	log.Printf("Application session started with session id <%s>\n", sessionId)
+
+	// Monitor points of a previous connection are gone, possibly with the node they were started on
+	osbiz.monitorPoints.Reset()
+	osbiz.mutex.Lock()
+	osbiz.devices = make(map[string]*models.Device)
+	osbiz.mutex.Unlock()
+
+	osbiz.captureMutex.Lock()
+	osbiz.captureMatchWindow = viper.GetDuration("osbiz.capture_match_window")
+	osbiz.captureMutex.Unlock()
+
+	// Calls of a previous connection ended without their events
+	if osbiz.tracker == nil {
+		osbiz.tracker = pbx.NewCallTracker()
+		go osbiz.followCalls(osbiz.tracker.Subscribe(osbiz.ctx))
+	} else {
+		osbiz.tracker.Reset()
+	}
 
-	pbx.setupHandlers(cstaConn)
-
-	var wg sync.WaitGroup
-
-	pbx.conn = cstaConn
-
-	wg.Add(1)
-	err = cstaConn.StartApplicationSession(viper.GetString("application_id"), struct {
-		User     string `xml:"user"`
-		Password string `xml:"password"`
-	}{
-		User:     viper.GetString("osbiz.username"),
-		Password: viper.GetString("osbiz.password"),
-	}, "http://www.ecma-international.org/standards/ecma-323/csta/ed4",
-		func(ctx *csta.Context) {
-			defer wg.Done()
-			if ctx.Error != nil {
-				err = ctx.Error
-				log.Printf("Error starting application session: %s\n", err)
-				return
-			}
-			if r, ok := ctx.Message.(*csta.StartApplicationSessionPosResponse); ok {
-				log.Printf("Application session started with session id <%s>\n", r.SessionID)
-				pbx.sessionId = r.SessionID
-			}
-		})
-
-	wg.Wait()
+	osbiz.setupHandlers(cstaConn)
 
-	if err != nil {
-		return nil, err
-	}
+	osbiz.conn = cstaConn
+	osbiz.sessionId = sessionId
 
 	return cstaConn, nil
 }
 
-func (pbx *OSBiz) getMonitorPoint(crossReferenceId string) *monitorPoint {
-	if mp, ok := pbx.monitorPoints[crossReferenceId]; ok {
-		return mp
-	}
-	return nil
-}
-
 func (o *OSBiz) setupHandlers(conn csta.Conn) {
 	conn.Handle(csta.MessageTypeEstablishedEvent, func(c *csta.Context) {
 		if e, ok := (c.Message).(*csta.EstablishedEvent); ok {
-			mp := o.getMonitorPoint(e.MonitorCrossRefID)
-			mp.dispatchEvent(e)
+			o.tracker.Handle(e)
+			if mp := o.monitorPoints.Get(e.MonitorCrossRefID); mp != nil {
+				mp.Publish(e)
+			}
 		}
 	})
 
+	// The other call control events only feed the calls the passive capture is matched with
+	for _, messageType := range trackedEvents {
+		conn.Handle(messageType, func(c *csta.Context) {
+			o.tracker.Handle(c.Message)
+		})
+	}
+
 	conn.Handle(csta.MessageTypeOutOfServiceEvent, func(c *csta.Context) {
 		if e, ok := (c.Message).(*csta.OutOfServiceEvent); ok {
-			mp := o.getMonitorPoint(e.MonitorCrossRefID)
-			mp.dispatchEvent(e)
+			if mp := o.monitorPoints.Get(e.MonitorCrossRefID); mp != nil {
+				mp.Publish(e)
+			}
 		}
 	})
 
 	conn.Handle(csta.MessageTypeBackInServiceEvent, func(c *csta.Context) {
 		if e, ok := (c.Message).(*csta.BackInServiceEvent); ok {
-			mp := o.getMonitorPoint(e.MonitorCrossRefID)
-			mp.dispatchEvent(e)
+			if mp := o.monitorPoints.Get(e.MonitorCrossRefID); mp != nil {
+				mp.Publish(e)
+			}
 		}
 	})
 }
@@ -146,94 +167,40 @@ func (osbiz *OSBiz) ConnectionState() pbx.ConnectionState {
 }
 
 func (pbx *OSBiz) Close() error {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	pbx.conn.Request(csta.StopApplicationSession{
+	_, err := pbx.conn.Do(context.Background(), csta.StopApplicationSession{
 		SessionID:        pbx.sessionId,
 		SessionEndReason: "Application Shutdown",
-	}, func(c *csta.Context) {
-		wg.Done()
 	})
-	wg.Wait()
+	if err != nil {
+		log.Printf("Failed to stop the application session: %s\n", err)
+	}
 
 	return pbx.conn.Close()
 }
 
-func (osbiz *OSBiz) MonitorStart(deviceId string) (mp pbx.MonitorPoint, err error) {
+func (osbiz *OSBiz) MonitorStart(deviceId string) (pbx.MonitorPoint, error) {
 	log.Printf("MonitorStart(<%s>)", deviceId)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	err = osbiz.conn.MonitorStart(csta.CSTAObject{
-		DeviceObject: &csta.DeviceID{Device: deviceId, TypeOfNumber: "dialingNumber"},
-	}, csta.MonitorTypeDevice, func(c *csta.Context) {
-		defer wg.Done()
-
-		if c.Error != nil {
-			err = c.Error
-			return
-		}
-
-		if resp, ok := (c.Message).(*csta.MonitorStartResponse); ok {
-			if osbiz.monitorPoints == nil {
-				osbiz.monitorPoints = make(map[string]*monitorPoint)
-			}
-			osbiz.monitorPoints[resp.MonitorCrossRefID] = &monitorPoint{
-				crossReferenceID: resp.MonitorCrossRefID,
-				device: &device{
-					extension: deviceId,
-				},
-			}
-			mp = osbiz.monitorPoints[resp.MonitorCrossRefID]
-			return
-		}
-
-		err = fmt.Errorf("failed to monitor device, unknown error")
+	response, err := osbiz.conn.Do(osbiz.ctx, csta.MonitorStart{
+		MonitorObject: csta.CSTAObject{
+			DeviceObject: &csta.DeviceID{Device: deviceId, TypeOfNumber: "dialingNumber"},
+		},
+		MonitorType: csta.MonitorTypeDevice,
 	})
-
-	wg.Wait()
-
-	if err == nil {
-		log.Printf("Monitoring <%s> with CrossRefID <%s>\n", deviceId, mp.CrossReferenceID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to monitor device <%s>: %w", deviceId, err)
 	}
 
-	return
-}
-
-type monitorPoint struct {
-	crossReferenceID string
-	device           *device
-	subscribers      []chan csta.Message
-}
-
-func (mp *monitorPoint) CrossReferenceID() string {
-	return mp.crossReferenceID
-}
-
-func (mp *monitorPoint) Device() pbx.Device {
-	return mp.device
-}
-
-func (mp *monitorPoint) Events() <-chan csta.Message {
-	if mp.subscribers == nil {
-		mp.subscribers = make([]chan csta.Message, 0)
+	resp, ok := response.(*csta.MonitorStartResponse)
+	if !ok {
+		return nil, fmt.Errorf("failed to monitor device <%s>, unexpected response %s", deviceId, response.Type())
 	}
-	subscriberChannel := make(chan csta.Message, defaultEventBufferSize)
-	mp.subscribers = append(mp.subscribers, subscriberChannel)
-	return subscriberChannel
-}
 
-func (mp *monitorPoint) dispatchEvent(e csta.Message) {
-	for _, subscriber := range mp.subscribers {
-		subscriber <- e
-	}
-}
+	mp := pbx.NewDeviceMonitorPoint(resp.MonitorCrossRefID, pbx.MonitoredDevice{Extension: deviceId})
+	osbiz.monitorPoints.Add(mp)
+	osbiz.tracker.Monitor(resp.MonitorCrossRefID, deviceId)
 
-type device struct {
-	extension string
-}
+	log.Printf("Monitoring <%s> with CrossRefID <%s>\n", deviceId, mp.CrossReferenceID())
 
-func (d *device) DeviceID() string {
-	return d.extension
+	return mp, nil
 }
@@ -0,0 +1,349 @@
+package osbiz
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/csta"
+	"github.com/psco-tech/gw-coach-recording-agent/csta/cstatest"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/pbx/pbxtest"
+	"github.com/spf13/viper"
+)
+
+func TestMonitorAndReconnect(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	viper.Set("osbiz.server_address", s.Addr())
+	viper.Set("osbiz.username", "AMHOST")
+	viper.Set("osbiz.password", "77777")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	osbiz := &OSBiz{}
+	osbiz.SetContext(ctx)
+
+	conn, err := osbiz.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if osbiz.sessionId != "session-1" {
+		t.Fatalf("unexpected session ID <%s>", osbiz.sessionId)
+	}
+
+	mp, err := osbiz.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := mp.Events()
+
+	err = s.Established(mp.CrossReferenceID(), "1", "100", "4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-events:
+		if e, ok := event.(*csta.EstablishedEvent); !ok || e.EstablishedConnection.CallID != "1" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("no event received")
+	}
+
+	// The switch restarts, the connection is closed and established again
+	s.Disconnect()
+	select {
+	case <-conn.Closed():
+	case <-time.After(pbxtest.Timeout):
+		t.Fatal("connection wasn't closed")
+	}
+
+	_, err = osbiz.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if osbiz.sessionId != "session-2" {
+		t.Fatalf("unexpected session ID <%s> after reconnecting", osbiz.sessionId)
+	}
+
+	_, err = osbiz.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Requests(csta.MessageTypeMonitorStart)) != 2 {
+		t.Fail()
+	}
+}
+
+// waitForCapturedCall waits until the capture knows a call, optionally only once it ended
+func waitForCapturedCall(t *testing.T, o *OSBiz, callID string, ended bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(pbxtest.Timeout)
+	for time.Now().Before(deadline) {
+		o.captureMutex.Lock()
+		c, ok := o.capturedCalls[callID]
+		done := ok && (!ended || !c.call.Ended.IsZero())
+		o.captureMutex.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("call <%s> wasn't tracked", callID)
+}
+
+func TestAttributeCapturedRecordings(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	viper.Set("osbiz.server_address", s.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := pbxtest.NewRecords()
+	osbiz := &OSBiz{OnRecordingFinished: records.Finish}
+	osbiz.SetContext(ctx)
+
+	_, err = osbiz.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp, err := osbiz.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An inbound call to the monitored device that ended before its capture finished
+	begin := time.Now()
+	if err := s.Established(mp.CrossReferenceID(), "1", "100", "4711"); err != nil {
+		t.Fatal(err)
+	}
+	waitForCapturedCall(t, osbiz, "1", false)
+	if err := s.ConnectionCleared(mp.CrossReferenceID(), "1", "100"); err != nil {
+		t.Fatal(err)
+	}
+	waitForCapturedCall(t, osbiz, "1", true)
+
+	osbiz.RecordingCaptured(&models.UploadRecord{
+		FilePath:     "captured-1.wav",
+		Begin:        begin,
+		End:          time.Now(),
+		CallerNumber: "0100",
+		CalleeNumber: "4711",
+	})
+
+	select {
+	case record := <-records:
+		if record.CallID != "1" || record.Extension != "4711" || record.CallerNumber != "100" || record.CalleeNumber != "4711" || !record.Begin.Equal(begin) {
+			t.Fatalf("unexpected upload record %+v", record)
+		}
+	default:
+		t.Fatal("recording wasn't attributed")
+	}
+
+	// A call that is still going on when its capture finishes
+	if err := s.Established(mp.CrossReferenceID(), "2", "4711", "200"); err != nil {
+		t.Fatal(err)
+	}
+	waitForCapturedCall(t, osbiz, "2", false)
+
+	osbiz.RecordingCaptured(&models.UploadRecord{
+		FilePath:     "captured-2.wav",
+		Begin:        time.Now(),
+		End:          time.Now(),
+		CallerNumber: "4711",
+		CalleeNumber: "200",
+	})
+
+	select {
+	case record := <-records:
+		if record.CallID != "2" || record.Extension != "4711" || record.CallerNumber != "4711" || record.CalleeNumber != "200" {
+			t.Fatalf("unexpected upload record %+v", record)
+		}
+	default:
+		t.Fatal("recording wasn't attributed")
+	}
+
+	// An external call to the DID of the device, whose SIP parties are in E.164 format
+	if err := s.Established(mp.CrossReferenceID(), "3", "0891234567", "4711"); err != nil {
+		t.Fatal(err)
+	}
+	waitForCapturedCall(t, osbiz, "3", false)
+
+	osbiz.RecordingCaptured(&models.UploadRecord{
+		FilePath:     "captured-3.wav",
+		Begin:        time.Now(),
+		End:          time.Now(),
+		CallerNumber: "+49 89 1234567",
+		CalleeNumber: "+49 89 1234-4711",
+	})
+
+	select {
+	case record := <-records:
+		if record.CallID != "3" || record.Extension != "4711" || record.CallerNumber != "0891234567" {
+			t.Fatalf("unexpected upload record %+v", record)
+		}
+	default:
+		t.Fatal("recording wasn't attributed")
+	}
+
+	// The SIP party of the device is the number of its hunt group, but the caller matches
+	if err := s.Established(mp.CrossReferenceID(), "4", "004930123456", "4711"); err != nil {
+		t.Fatal(err)
+	}
+	waitForCapturedCall(t, osbiz, "4", false)
+
+	osbiz.RecordingCaptured(&models.UploadRecord{
+		FilePath:     "captured-4.wav",
+		Begin:        time.Now(),
+		End:          time.Now(),
+		CallerNumber: "+4930123456",
+		CalleeNumber: "+49891235000",
+	})
+
+	select {
+	case record := <-records:
+		if record.CallID != "4" || record.Extension != "4711" {
+			t.Fatalf("unexpected upload record %+v", record)
+		}
+	default:
+		t.Fatal("recording wasn't attributed")
+	}
+}
+
+func TestDiscardUnmonitoredCapture(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	viper.Set("osbiz.server_address", s.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	osbiz := &OSBiz{
+		OnRecordingFinished: func(record *models.UploadRecord) {
+			t.Errorf("unexpected upload record %+v", record)
+		},
+	}
+	osbiz.SetContext(ctx)
+
+	_, err = osbiz.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp, err := osbiz.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Established(mp.CrossReferenceID(), "1", "100", "4711"); err != nil {
+		t.Fatal(err)
+	}
+	waitForCapturedCall(t, osbiz, "1", false)
+
+	// Captured at the same time, but between two devices that aren't monitored
+	captureUnmonitored := func() string {
+		file, err := os.CreateTemp(t.TempDir(), "*.wav")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		osbiz.RecordingCaptured(&models.UploadRecord{
+			FilePath:     file.Name(),
+			Begin:        time.Now(),
+			End:          time.Now(),
+			CallerNumber: "300",
+			CalleeNumber: "301",
+		})
+		return file.Name()
+	}
+
+	if _, err := os.Stat(captureUnmonitored()); !os.IsNotExist(err) {
+		t.Fatal("recording wasn't discarded")
+	}
+
+	// Unless they are kept on purpose
+	viper.Set("osbiz.keep_unattributed_captures", true)
+	defer viper.Set("osbiz.keep_unattributed_captures", false)
+	if _, err := os.Stat(captureUnmonitored()); err != nil {
+		t.Fatalf("recording wasn't kept: %s", err)
+	}
+}
+
+func TestAbandonedSubscriberDoesNotStall(t *testing.T) {
+	s, err := cstatest.NewSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	viper.Set("osbiz.server_address", s.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	osbiz := &OSBiz{}
+	osbiz.SetContext(ctx)
+
+	_, err = osbiz.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp, err := osbiz.MonitorStart("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Never read, its queue fills up and drops the oldest events
+	abandoned := mp.Events()
+
+	for i := 0; i < 2*viper.GetInt("monitor_events.buffer_size"); i++ {
+		if err := s.Established(mp.CrossReferenceID(), fmt.Sprintf("%d", i), "100", "4711"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscriberCtx, unsubscribe := context.WithCancel(ctx)
+	events := mp.Subscribe(subscriberCtx)
+	if err := s.Established(mp.CrossReferenceID(), "last", "100", "4711"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events of the flood may still be handled, the last one has to arrive nonetheless
+	timeout := time.After(pbxtest.Timeout)
+	for received := false; !received; {
+		select {
+		case event := <-events:
+			e, ok := event.(*csta.EstablishedEvent)
+			received = ok && e.EstablishedConnection.CallID == "last"
+		case <-timeout:
+			t.Fatal("event wasn't received")
+		}
+	}
+
+	unsubscribe()
+	mp.Unsubscribe(abandoned)
+	for range abandoned {
+	}
+}
@@ -0,0 +1,131 @@
+// Package pbxtest provides the recorders and helpers the tests of the PBX drivers share.
+package pbxtest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+)
+
+// Timeout is how long tests wait for a driver to react
+const Timeout = 5 * time.Second
+
+// Recorder records nothing but tracks whether it was started
+type Recorder struct {
+	mutex     sync.Mutex
+	recording bool
+	file      *os.File
+	stopped   chan struct{}
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{stopped: make(chan struct{}, 10)}
+}
+
+func (r *Recorder) IsRecording() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.recording
+}
+
+func (r *Recorder) StartRecording(writer *os.File) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.recording = true
+	r.file = writer
+	return nil
+}
+
+// StopRecording removes the file of the recording, tests don't upload it
+func (r *Recorder) StopRecording() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.recording {
+		return nil
+	}
+	r.recording = false
+	r.file.Close()
+	os.Remove(r.file.Name())
+
+	select {
+	case r.stopped <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (r *Recorder) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (r *Recorder) Stats() rtp.StreamStats      { return rtp.StreamStats{} }
+func (r *Recorder) DTMFEvents() []rtp.DTMFEvent { return nil }
+func (r *Recorder) Start()                      {}
+
+// Stopped receives whenever a recording was stopped
+func (r *Recorder) Stopped() <-chan struct{} {
+	return r.stopped
+}
+
+// WaitForRecording waits for the recorder to be started or stopped
+func (r *Recorder) WaitForRecording(t *testing.T, recording bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		if r.IsRecording() == recording {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("recorder didn't change to recording=%t", recording)
+}
+
+// RecorderPool hands out a single recorder
+type RecorderPool struct {
+	Recorder *Recorder
+}
+
+func (p *RecorderPool) GetRecorder() (rtp.Recorder, error) {
+	if p.Recorder.IsRecording() {
+		return nil, fmt.Errorf("no idle recorder available")
+	}
+	return p.Recorder, nil
+}
+
+func (p *RecorderPool) GetAllRecorders() []rtp.Recorder { return []rtp.Recorder{p.Recorder} }
+func (p *RecorderPool) Start() error                    { return nil }
+
+// Records collects the finished recordings of a driver
+type Records chan *models.UploadRecord
+
+func NewRecords() Records {
+	return make(Records, 10)
+}
+
+// Finish receives a finished recording, it is meant to be the OnRecordingFinished of a driver
+func (r Records) Finish(record *models.UploadRecord) {
+	r <- record
+}
+
+// Wait waits for n finished recordings
+func (r Records) Wait(t *testing.T, n int) []*models.UploadRecord {
+	t.Helper()
+
+	received := make([]*models.UploadRecord, 0, n)
+	for len(received) < n {
+		select {
+		case record := <-r:
+			received = append(received, record)
+		case <-time.After(Timeout):
+			t.Fatalf("%d of %d recordings finished", len(received), n)
+		}
+	}
+	return received
+}
@@ -0,0 +1,74 @@
+package pbx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/psco-tech/gw-coach-recording-agent/uploader"
+)
+
+// StartRecording starts a recorder on a new temporary file, it returns the path of the file
+func StartRecording(recorder rtp.Recorder) (string, error) {
+	file, err := ioutil.TempFile(os.TempDir(), "*.wav")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a temporary recording file: %w", err)
+	}
+
+	err = recorder.StartRecording(file)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// FinishRecording stops the recorder of a call and hands the recording to finished,
+// see DeliverRecording
+func FinishRecording(recorder rtp.Recorder, filePath string, call Call, finished func(record *models.UploadRecord)) {
+	err := recorder.StopRecording()
+	if err != nil {
+		log.Printf("Failed to stop recording of call <%s>: %s\n", call.ID, err)
+		return
+	}
+
+	stats, err := json.Marshal(recorder.Stats())
+	if err != nil {
+		log.Printf("Failed to encode stream statistics: %s\n", err)
+	}
+
+	dtmf, err := json.Marshal(recorder.DTMFEvents())
+	if err != nil {
+		log.Printf("Failed to encode DTMF events: %s\n", err)
+	}
+
+	record := &models.UploadRecord{
+		FilePath:    filePath,
+		Type:        models.UploadRecordTypeCFS_AUDIO,
+		ContentType: "audio/wav",
+		StreamStats: string(stats),
+		DTMFEvents:  string(dtmf),
+	}
+	call.Annotate(record)
+
+	DeliverRecording(record, finished)
+}
+
+// DeliverRecording hands a finished recording to finished, e.g. the OnRecordingFinished
+// of a driver, or queues it for upload if finished is nil
+func DeliverRecording(record *models.UploadRecord, finished func(record *models.UploadRecord)) {
+	if finished != nil {
+		finished(record)
+		return
+	}
+
+	err := uploader.Enqueue(record)
+	if err != nil {
+		log.Printf("Failed to queue the recording of call <%s>: %s\n", record.CallID, err)
+	}
+}
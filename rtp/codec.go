@@ -0,0 +1,155 @@
+package rtp
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pd0mz/go-g711"
+	"github.com/pion/sdp"
+)
+
+// TelephoneEvent is the encoding name of RFC 4733 telephone-events, e.g. DTMF digits
+const TelephoneEvent = "telephone-event"
+
+// Decoder decodes the payload of an RTP packet into 16 bit samples. Decoders
+// may keep state between packets, so every stream needs its own instance.
+type Decoder interface {
+	Decode(payload []byte) []int
+}
+
+// Codec describes an RTP payload format
+type Codec struct {
+	// Encoding name as used in SDP a=rtpmap attributes, e.g. "PCMU"
+	Name string
+
+	// Clock rate of the RTP timestamps
+	ClockRate int
+
+	// Sample rate of the decoded audio, G.722 for example runs
+	// at 16kHz but uses an 8kHz RTP clock (RFC 3551 section 4.5.2)
+	SampleRate int
+
+	// NewDecoder creates a decoder for one stream, it is nil for
+	// payload formats that can't be turned into audio samples
+	NewDecoder func() Decoder
+}
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = make(map[string]*Codec)
+
+	// Payload types with a static assignment (RFC 3551 section 6)
+	staticPayloadTypes = map[uint8]string{
+		0:  "PCMU",
+		2:  "G726-32", // Dropped from RFC 3551 but still sent by some devices
+		8:  "PCMA",
+		9:  "G722",
+		18: "G729",
+	}
+)
+
+func init() {
+	RegisterCodec(&Codec{Name: "PCMU", ClockRate: 8000, SampleRate: 8000, NewDecoder: func() Decoder { return g711Decoder(g711.MLawDecode) }})
+	RegisterCodec(&Codec{Name: "PCMA", ClockRate: 8000, SampleRate: 8000, NewDecoder: func() Decoder { return g711Decoder(g711.ALawDecode) }})
+	RegisterCodec(&Codec{Name: "G722", ClockRate: 8000, SampleRate: 16000, NewDecoder: func() Decoder { return newG722Decoder() }})
+
+	for _, bits := range []int{2, 3, 4, 5} {
+		bits := bits
+		rate := strconv.Itoa(bits * 8)
+		RegisterCodec(&Codec{Name: "G726-" + rate, ClockRate: 8000, SampleRate: 8000, NewDecoder: func() Decoder { return newG726Decoder(bits, false) }})
+		RegisterCodec(&Codec{Name: "AAL2-G726-" + rate, ClockRate: 8000, SampleRate: 8000, NewDecoder: func() Decoder { return newG726Decoder(bits, true) }})
+	}
+
+	// There is no G.729 decoder, the codec is known so that it can be reported
+	RegisterCodec(&Codec{Name: "G729", ClockRate: 8000, SampleRate: 8000})
+
+	// Telephone-events carry no audio, they are handled by the playout itself
+	RegisterCodec(&Codec{Name: TelephoneEvent, ClockRate: 8000})
+}
+
+// RegisterCodec makes a codec available by its encoding name
+func RegisterCodec(codec *Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[strings.ToUpper(codec.Name)] = codec
+}
+
+// CodecByName returns the codec registered for the encoding name, or nil
+func CodecByName(name string) *Codec {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	return codecs[strings.ToUpper(name)]
+}
+
+// PayloadTypes maps the RTP payload types of a stream to their codecs
+type PayloadTypes map[uint8]*Codec
+
+// DefaultPayloadTypes returns the codecs of the static payload types
+func DefaultPayloadTypes() PayloadTypes {
+	types := make(PayloadTypes)
+	for payloadType, name := range staticPayloadTypes {
+		if codec := CodecByName(name); codec != nil {
+			types[payloadType] = codec
+		}
+	}
+	return types
+}
+
+// PayloadTypesFromSDP resolves the formats of an SDP media description, dynamic payload
+// types are looked up by the encoding name of their a=rtpmap attribute
+func PayloadTypesFromSDP(media *sdp.MediaDescription) PayloadTypes {
+	types := DefaultPayloadTypes()
+	if media == nil {
+		return types
+	}
+
+	for _, attribute := range media.Attributes {
+		if attribute.Key != "rtpmap" {
+			continue
+		}
+
+		// <payload type> <encoding name>/<clock rate>[/<encoding parameters>]
+		format, encoding, ok := strings.Cut(attribute.Value, " ")
+		if !ok {
+			continue
+		}
+		payloadType, err := strconv.ParseUint(format, 10, 7)
+		if err != nil {
+			continue
+		}
+		name, clockRate, _ := strings.Cut(encoding, "/")
+		clockRate, _, _ = strings.Cut(clockRate, "/")
+
+		if codec := CodecByName(name); codec != nil {
+			if rate, err := strconv.Atoi(clockRate); err == nil && codec.Name == TelephoneEvent && rate != codec.ClockRate {
+				// Telephone-events use the clock of the audio they accompany, e.g. 16kHz for wideband codecs
+				codec = &Codec{Name: codec.Name, ClockRate: rate}
+			}
+			types[uint8(payloadType)] = codec
+		} else {
+			// Don't fall back to a static assignment the SDP overrides
+			delete(types, uint8(payloadType))
+		}
+	}
+
+	return types
+}
+
+// Lookup returns the codec of payloadType, or nil if it is unknown
+func (t PayloadTypes) Lookup(payloadType uint8) *Codec {
+	return t[payloadType]
+}
+
+type g711Decoder func([]byte) []int16
+
+func (d g711Decoder) Decode(payload []byte) []int {
+	decoded := d(payload)
+	samples := make([]int, len(decoded))
+	for i, sample := range decoded {
+		samples[i] = int(sample)
+	}
+	return samples
+}
@@ -0,0 +1,148 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/sdp"
+)
+
+func TestPayloadTypesFromSDP(t *testing.T) {
+	media := &sdp.MediaDescription{}
+	media.WithValueAttribute("rtpmap", "96 G726-32/8000")
+	media.WithValueAttribute("rtpmap", "97 telephone-event/8000")
+	media.WithValueAttribute("rtpmap", "8 PCMA/8000")
+	media.WithValueAttribute("rtpmap", "2 AAL2-G726-32/8000")
+
+	types := PayloadTypesFromSDP(media)
+
+	for payloadType, name := range map[uint8]string{0: "PCMU", 2: "AAL2-G726-32", 8: "PCMA", 9: "G722", 18: "G729", 96: "G726-32"} {
+		if codec := types.Lookup(payloadType); codec == nil || codec.Name != name {
+			t.Logf("payload type %d: expected %s, got %+v\n", payloadType, name, codec)
+			t.Fail()
+		}
+	}
+
+	if codec := types.Lookup(97); codec == nil || codec.Name != TelephoneEvent {
+		t.Fail()
+	}
+
+	if types.Lookup(98) != nil {
+		t.Fail()
+	}
+
+	if CodecByName("g722").SampleRate != 16000 || CodecByName("G729").NewDecoder != nil {
+		t.Fail()
+	}
+}
+
+// The reference vectors are a tone, quiet noise, an overloading square wave, random codewords
+// and runs of every codeword, decoded by implementations independent of this package:
+// spandsp for G.722 and a word by word implementation of the arithmetic of the ITU-T
+// recommendation for G.726. Samples are 16 bit little endian.
+
+// readSamples returns the samples of a reference vector
+func readSamples(t *testing.T, name string) []int {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make([]int, len(data)/2)
+	for i := range samples {
+		samples[i] = int(int16(binary.LittleEndian.Uint16(data[2*i:])))
+	}
+	return samples
+}
+
+// compareSamples fails the test at the first sample that differs from the reference
+func compareSamples(t *testing.T, name string, expected, decoded []int) {
+	t.Helper()
+
+	if len(decoded) != len(expected) {
+		t.Fatalf("%s: expected %d samples, got %d", name, len(expected), len(decoded))
+	}
+	for i := range expected {
+		if decoded[i] != expected[i] {
+			t.Fatalf("%s: sample %d is %d, expected %d", name, i, decoded[i], expected[i])
+		}
+	}
+}
+
+// repackAAL2 converts codewords packed starting at the least significant bit to the AAL2
+// packing starting at the most significant bit
+func repackAAL2(payload []byte, bits int) []byte {
+	repacked := make([]byte, 0, len(payload))
+	in, inBuffered := 0, 0
+	out, outBuffered := 0, 0
+	for _, b := range payload {
+		in |= int(b) << inBuffered
+		inBuffered += 8
+
+		for inBuffered >= bits {
+			out = out<<bits | in&(1<<bits-1)
+			outBuffered += bits
+			in >>= bits
+			inBuffered -= bits
+
+			for outBuffered >= 8 {
+				repacked = append(repacked, byte(out>>(outBuffered-8)))
+				outBuffered -= 8
+				out &= 1<<outBuffered - 1
+			}
+		}
+	}
+	return repacked
+}
+
+func TestG726ReferenceVectors(t *testing.T) {
+	for _, rate := range []int{16, 24, 32, 40} {
+		name := fmt.Sprintf("g726-%d", rate)
+		bits := rate / 8
+
+		payload, err := os.ReadFile(filepath.Join("testdata", name+".bit"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := readSamples(t, name+".pcm")
+
+		compareSamples(t, name, expected, newG726Decoder(bits, false).Decode(payload))
+		compareSamples(t, "AAL2-"+name, expected, newG726Decoder(bits, true).Decode(repackAAL2(payload, bits)))
+
+		// The state carries over between packets
+		decoder := newG726Decoder(bits, false)
+		decoded := make([]int, 0, len(expected))
+		for start := 0; start < len(payload); start += bits * 20 {
+			end := start + bits*20
+			if end > len(payload) {
+				end = len(payload)
+			}
+			decoded = append(decoded, decoder.Decode(payload[start:end])...)
+		}
+		compareSamples(t, name+" in packets", expected, decoded)
+	}
+}
+
+func TestG722ReferenceVectors(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "g722.bit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := readSamples(t, "g722.pcm")
+
+	decoder := newG722Decoder()
+	decoded := make([]int, 0, len(expected))
+	for start := 0; start < len(payload); start += 160 {
+		end := start + 160
+		if end > len(payload) {
+			end = len(payload)
+		}
+		decoded = append(decoded, decoder.Decode(payload[start:end])...)
+	}
+	compareSamples(t, "g722", expected, decoded)
+}
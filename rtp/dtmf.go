@@ -0,0 +1,275 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// Masking of DTMF digits, "none", "all" or "trigger"
+	viper.SetDefault("rtp.dtmf_masking.mode", string(MaskingNone))
+
+	// Digit sequences that open an entry window in "trigger" mode, e.g. the code
+	// an agent dials before transferring the caller to a payment IVR
+	viper.SetDefault("rtp.dtmf_masking.triggers", []string{})
+
+	// How long an entry window stays open at most
+	viper.SetDefault("rtp.dtmf_masking.window", 60*time.Second)
+
+	// Digit that closes an entry window early, empty to only close on timeout
+	viper.SetDefault("rtp.dtmf_masking.terminator", "#")
+}
+
+const (
+	// Tones are silenced a little longer than their duration to cover the decay
+	// of the in-band tone and senders that stop the event early
+	dtmfMaskMargin = 50 * time.Millisecond
+
+	// Samples are held back this long before being written while masking is enabled,
+	// a tone's telephone-event may arrive after the first audio packet carrying it
+	dtmfMaskHoldBack = 200 * time.Millisecond
+)
+
+// RFC 4733 section 3.2, events 0-15 are DTMF digits
+const dtmfDigits = "0123456789*#ABCD"
+
+// MaskingMode selects which DTMF digits are masked
+type MaskingMode string
+
+const (
+	// MaskingNone records all digits and leaves the audio untouched
+	MaskingNone MaskingMode = "none"
+
+	// MaskingAll drops every digit and silences the audio of its tone
+	MaskingAll MaskingMode = "all"
+
+	// MaskingTrigger drops the digits and silences all audio during entry windows,
+	// which are opened by one of the trigger sequences
+	MaskingTrigger MaskingMode = "trigger"
+)
+
+// MaskingOptions configure the masking of DTMF digits in recordings
+type MaskingOptions struct {
+	Mode MaskingMode
+
+	// Digit sequences opening an entry window in MaskingTrigger mode
+	Triggers []string
+
+	// Maximum length of an entry window
+	Window time.Duration
+
+	// Digit closing an entry window early, it is masked itself
+	Terminator string
+}
+
+// MaskingOptionsFromConfig returns the masking options configured in the rtp.dtmf_masking section
+func MaskingOptionsFromConfig() *MaskingOptions {
+	return &MaskingOptions{
+		Mode:       MaskingMode(strings.ToLower(viper.GetString("rtp.dtmf_masking.mode"))),
+		Triggers:   viper.GetStringSlice("rtp.dtmf_masking.triggers"),
+		Window:     viper.GetDuration("rtp.dtmf_masking.window"),
+		Terminator: viper.GetString("rtp.dtmf_masking.terminator"),
+	}
+}
+
+// DTMFEvent is a DTMF digit received as RFC 4733 telephone-event
+type DTMFEvent struct {
+	Digit    string `json:"digit"`
+	Channel  int    `json:"channel"`
+	Offset   int    `json:"offset_ms"`   // Start of the tone in the recording
+	Duration int    `json:"duration_ms"` // Length of the tone, 0 if its end was never received
+}
+
+// telephoneEvent is the payload of an RFC 4733 telephone-event packet
+type telephoneEvent struct {
+	event    uint8
+	end      bool
+	duration uint16 // In RTP timestamp units
+}
+
+func parseTelephoneEvent(payload []byte) (telephoneEvent, bool) {
+	// Event (8 bits), E, R, volume (6 bits), duration (16 bits)
+	if len(payload) < 4 {
+		return telephoneEvent{}, false
+	}
+
+	return telephoneEvent{
+		event:    payload[0],
+		end:      payload[1]&0x80 != 0,
+		duration: binary.BigEndian.Uint16(payload[2:4]),
+	}, true
+}
+
+// tone is a DTMF digit reported by the playout, positions are in samples played out.
+// Each tone is reported twice: once when it starts and once when it has ended.
+type tone struct {
+	digit  byte
+	start  int
+	length int
+	ended  bool
+}
+
+// mask is a range of recording samples that is silenced on all channels
+type mask struct {
+	start, end int
+	open       bool // The end is not known yet, everything from start on is silenced
+	window     bool // An entry window rather than a single tone
+}
+
+type toneKey struct {
+	channel int
+	start   int
+}
+
+// activeTone links a started tone to what has to be updated once it ends
+type activeTone struct {
+	event int   // Index in events, -1 if the digit was dropped
+	mask  *mask // Nil if the tone is not masked
+}
+
+// dtmfMasker collects the DTMF digits of a recording and decides what has to be masked.
+// All positions are in samples of the recording.
+type dtmfMasker struct {
+	options MaskingOptions
+
+	events []DTMFEvent
+	masks  []*mask // Masks that may still cover samples to be written
+	active map[toneKey]activeTone
+
+	digits string // Latest digits received outside of entry windows, to match the triggers
+}
+
+func newDTMFMasker(options *MaskingOptions) *dtmfMasker {
+	if options == nil {
+		options = &MaskingOptions{Mode: MaskingNone}
+	}
+
+	return &dtmfMasker{
+		options: *options,
+		events:  make([]DTMFEvent, 0),
+		masks:   make([]*mask, 0),
+		active:  make(map[toneKey]activeTone),
+	}
+}
+
+// enabled returns true if the masker may silence audio
+func (m *dtmfMasker) enabled() bool {
+	return m.options.Mode == MaskingAll || m.options.Mode == MaskingTrigger
+}
+
+// started handles a tone that started at position on channel
+func (m *dtmfMasker) started(channel int, digit byte, position int, rate int) {
+	active := activeTone{event: -1}
+
+	switch {
+	case m.options.Mode == MaskingAll:
+		active.mask = m.addMask(mask{start: position, open: true})
+	case m.options.Mode == MaskingTrigger && m.window(position) != nil:
+		window := m.window(position)
+		if m.options.Terminator != "" && string(digit) == m.options.Terminator {
+			// The window closes once the terminator has ended
+			window.open = true
+			active.mask = window
+		} else {
+			active.mask = m.addMask(mask{start: position, open: true})
+		}
+	default:
+		active.event = len(m.events)
+		m.events = append(m.events, DTMFEvent{
+			Digit:   string(digit),
+			Channel: channel,
+			Offset:  position * 1000 / rate,
+		})
+
+		if m.options.Mode == MaskingTrigger {
+			m.digits += string(digit)
+			longest := 0
+			for _, trigger := range m.options.Triggers {
+				if trigger != "" && strings.HasSuffix(m.digits, trigger) {
+					m.digits = ""
+					m.addMask(mask{start: position, end: position + int(m.options.Window*time.Duration(rate)/time.Second), window: true})
+					break
+				}
+				if len(trigger) > longest {
+					longest = len(trigger)
+				}
+			}
+
+			// Only the end of the digits can still become part of a trigger
+			if len(m.digits) > longest {
+				m.digits = m.digits[len(m.digits)-longest:]
+			}
+		}
+	}
+
+	m.active[toneKey{channel, position}] = active
+}
+
+// ended handles the end of a tone that started at position on channel
+func (m *dtmfMasker) ended(channel int, position int, length int, rate int) {
+	key := toneKey{channel, position}
+	active, ok := m.active[key]
+	if !ok {
+		return
+	}
+	delete(m.active, key)
+
+	if active.event >= 0 {
+		m.events[active.event].Duration = length * 1000 / rate
+	}
+	if active.mask != nil {
+		active.mask.open = false
+		active.mask.end = position + length + int(dtmfMaskMargin*time.Duration(rate)/time.Second)
+	}
+}
+
+// window returns the entry window open at position, or nil
+func (m *dtmfMasker) window(position int) *mask {
+	for _, mask := range m.masks {
+		if mask.window && position >= mask.start && (mask.open || position < mask.end) {
+			return mask
+		}
+	}
+	return nil
+}
+
+func (m *dtmfMasker) addMask(mask mask) *mask {
+	m.masks = append(m.masks, &mask)
+	return &mask
+}
+
+// apply silences the masked samples of buffer, which starts at position
+func (m *dtmfMasker) apply(buffer []int, position int) {
+	for _, mask := range m.masks {
+		start, end := mask.start-position, mask.end-position
+		if mask.open {
+			end = len(buffer)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		for i := start; i < end; i++ {
+			buffer[i] = 0
+		}
+	}
+}
+
+// prune forgets the masks that ended before position, no samples before it are written anymore
+func (m *dtmfMasker) prune(position int) {
+	masks := m.masks[:0]
+	for _, mask := range m.masks {
+		if mask.open || mask.end > position {
+			masks = append(masks, mask)
+		}
+	}
+	for i := len(masks); i < len(m.masks); i++ {
+		m.masks[i] = nil
+	}
+	m.masks = masks
+}
@@ -0,0 +1,208 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// recordDigits records 2s of loud PCMU audio on a single channel with digits starting
+// every 200ms, digits maps the start of each tone in milliseconds to its event.
+// It returns the recorded samples.
+func recordDigits(t *testing.T, options *MaskingOptions, digits map[int]byte) ([]int16, []DTMFEvent) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "recording.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := NewMultichannelRecorder(file, 1)
+	recorder.SetMasking(options)
+	recorder.SetPayloadTypes(0, PayloadTypes{0: CodecByName("PCMU"), 101: CodecByName(TelephoneEvent)})
+
+	begin := time.Now()
+	seq := uint16(0)
+	send := func(payloadType uint8, timestamp uint32, payload []byte) {
+		packet := &rtp.Packet{Header: rtp.Header{PayloadType: payloadType, SSRC: 1, SequenceNumber: seq, Timestamp: timestamp}, Payload: payload}
+		seq++
+
+		err := recorder.RecordPacket(packet, 0, begin.Add(time.Duration(timestamp/8)*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		timestamp := uint32(i * 160)
+
+		// 0x80 is the loudest positive PCMU sample
+		payload := make([]byte, 160)
+		for j := range payload {
+			payload[j] = 0x80
+		}
+		send(0, timestamp, payload)
+
+		if event, ok := digits[i*20]; ok {
+			// 60ms tone, the end is sent three times
+			for _, duration := range []uint16{160, 320, 480, 480, 480} {
+				payload := []byte{event, 10, 0, 0}
+				if duration == 480 {
+					payload[1] |= 0x80
+				}
+				binary.BigEndian.PutUint16(payload[2:], duration)
+				send(101, timestamp, payload)
+			}
+		}
+	}
+
+	err = recorder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make([]int16, (len(data)-44)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[44+i*2:]))
+	}
+
+	return samples, recorder.DTMFEvents()
+}
+
+// silent returns true if the samples between from and to milliseconds are all silence
+func silent(samples []int16, from, to int) bool {
+	for _, sample := range samples[from*8 : to*8] {
+		if sample != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// audible returns true if none of the samples between from and to milliseconds are silence
+func audible(samples []int16, from, to int) bool {
+	for _, sample := range samples[from*8 : to*8] {
+		if sample == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Event codes of "*7", "12#" and "5"
+var testDigits = map[int]byte{200: 10, 400: 7, 600: 1, 800: 2, 1000: 11, 1400: 5}
+
+func TestDTMFEvents(t *testing.T) {
+	samples, events := recordDigits(t, &MaskingOptions{Mode: MaskingNone}, testDigits)
+
+	expected := []DTMFEvent{
+		{Digit: "*", Offset: 200, Duration: 60},
+		{Digit: "7", Offset: 400, Duration: 60},
+		{Digit: "1", Offset: 600, Duration: 60},
+		{Digit: "2", Offset: 800, Duration: 60},
+		{Digit: "#", Offset: 1000, Duration: 60},
+		{Digit: "5", Offset: 1400, Duration: 60},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected, events)
+		}
+	}
+
+	if len(samples) != 16000 || !audible(samples, 0, 2000) {
+		t.Logf("Unmasked recording is %d samples long\n", len(samples))
+		t.Fail()
+	}
+}
+
+func TestDTMFMaskingAll(t *testing.T) {
+	samples, events := recordDigits(t, &MaskingOptions{Mode: MaskingAll}, testDigits)
+
+	if len(events) != 0 {
+		t.Logf("Masked digits were recorded: %+v\n", events)
+		t.Fail()
+	}
+
+	// Each tone plus the margin is silenced
+	for start := range testDigits {
+		if !silent(samples, start, start+110) || !audible(samples, start+110, start+200) {
+			t.Logf("Tone at %dms wasn't masked\n", start)
+			t.Fail()
+		}
+	}
+}
+
+func TestDTMFMaskingTrigger(t *testing.T) {
+	options := &MaskingOptions{Mode: MaskingTrigger, Triggers: []string{"*7"}, Window: 30 * time.Second, Terminator: "#"}
+	samples, events := recordDigits(t, options, testDigits)
+
+	// The trigger and the digits after the window are kept
+	expected := []string{"*", "7", "5"}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got %+v", expected, events)
+	}
+	for i := range expected {
+		if events[i].Digit != expected[i] {
+			t.Fatalf("expected %v, got %+v", expected, events)
+		}
+	}
+
+	// The window opens with the trigger and closes after the terminator
+	if !audible(samples, 0, 400) || !silent(samples, 400, 1110) || !audible(samples, 1110, 2000) {
+		t.Fail()
+	}
+
+	// Without a terminator the window stays open until it times out
+	options.Terminator = ""
+	options.Window = time.Second
+	samples, _ = recordDigits(t, options, testDigits)
+
+	if !audible(samples, 0, 400) || !silent(samples, 400, 1400) || !audible(samples, 1400, 2000) {
+		t.Fail()
+	}
+}
+
+func TestDTMFMasksArePruned(t *testing.T) {
+	masker := newDTMFMasker(&MaskingOptions{Mode: MaskingTrigger, Triggers: []string{"*7", "99"}, Window: time.Second, Terminator: "#"})
+
+	// An hour of digits, each tone lasts 60ms and the trigger opens a window every 10s
+	sequence := "1234*7567#8"
+	for position := 0; position < 3600*8000; position += 800 {
+		i := position / 800
+		digit := sequence[i%len(sequence)]
+		masker.started(0, digit, position, 8000)
+		masker.ended(0, position, 480, 8000)
+
+		buffer := make([]int, 800)
+		masker.apply(buffer, position)
+		masker.prune(position + len(buffer))
+
+		if len(masker.masks) > 2 || len(masker.digits) > 2 {
+			t.Fatalf("%d masks and %d digits kept after %ds", len(masker.masks), len(masker.digits), position/8000)
+		}
+	}
+
+	// Masks are kept until all of their samples are written, 50ms margin included
+	masker = newDTMFMasker(&MaskingOptions{Mode: MaskingAll})
+	masker.started(0, '5', 800, 8000)
+	masker.prune(1000)
+	masker.ended(0, 800, 480, 8000)
+	masker.prune(1600)
+	if len(masker.masks) != 1 {
+		t.Fatal("mask was dropped too early")
+	}
+	masker.prune(1680)
+	if len(masker.masks) != 0 {
+		t.Fatal("mask wasn't dropped")
+	}
+}
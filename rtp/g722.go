@@ -0,0 +1,237 @@
+package rtp
+
+// G.722 64 kbit/s wideband decoder (ITU-T G.722), each octet carries a 6 bit lower
+// and a 2 bit higher sub-band code and decodes into two samples at 16kHz.
+// This follows the structure and block names of the ITU-T reference implementation.
+
+var (
+	g722QM2 = [4]int{-7408, -1616, 7408, 1616}
+	g722QM4 = [16]int{
+		0, -20456, -12896, -8968,
+		-6288, -4240, -2584, -1200,
+		20456, 12896, 8968, 6288,
+		4240, 2584, 1200, 0,
+	}
+	g722QM6 = [64]int{
+		-136, -136, -136, -136,
+		-24808, -21904, -19008, -16704,
+		-14984, -13512, -12280, -11192,
+		-10232, -9360, -8576, -7856,
+		-7192, -6576, -6000, -5456,
+		-4944, -4464, -4008, -3576,
+		-3168, -2776, -2400, -2032,
+		-1688, -1360, -1040, -728,
+		24808, 21904, 19008, 16704,
+		14984, 13512, 12280, 11192,
+		10232, 9360, 8576, 7856,
+		7192, 6576, 6000, 5456,
+		4944, 4464, 4008, 3576,
+		3168, 2776, 2400, 2032,
+		1688, 1360, 1040, 728,
+		432, 136, -432, -136,
+	}
+	g722ILB = [32]int{
+		2048, 2093, 2139, 2186, 2233, 2282, 2332,
+		2383, 2435, 2489, 2543, 2599, 2656, 2714,
+		2774, 2834, 2896, 2960, 3025, 3091, 3158,
+		3228, 3298, 3371, 3444, 3520, 3597, 3676,
+		3756, 3838, 3922, 4008,
+	}
+	g722WL   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+	g722RL42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+	g722WH   = [3]int{0, -214, 798}
+	g722RH2  = [4]int{2, 1, 2, 1}
+
+	// Coefficients of the quadrature mirror filter
+	g722QMF = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+)
+
+// g722Band is the adaptive predictor state of one sub-band
+type g722Band struct {
+	s   int
+	sp  int
+	sz  int
+	r   [3]int
+	a   [3]int
+	ap  [3]int
+	p   [3]int
+	d   [7]int
+	b   [7]int
+	bp  [7]int
+	sg  [7]int
+	nb  int
+	det int
+}
+
+type g722Decoder struct {
+	band [2]g722Band
+	x    [24]int
+}
+
+func newG722Decoder() *g722Decoder {
+	d := &g722Decoder{}
+	d.band[0].det = 32
+	d.band[1].det = 8
+	return d
+}
+
+func (d *g722Decoder) Decode(payload []byte) []int {
+	samples := make([]int, 0, 2*len(payload))
+
+	for _, code := range payload {
+		ilow := int(code & 0x3f)
+		ihigh := int(code>>6) & 0x03
+
+		low := &d.band[0]
+
+		// Block 5L, INVQBL and RECONS
+		rlow := clamp(low.s+(low.det*g722QM6[ilow])>>15, -16384, 16383)
+
+		// Block 2L, INVQAL
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+
+		// Block 3L, LOGSCL and SCALEL
+		low.nb = clamp((low.nb*127)>>7+g722WL[g722RL42[ril]], 0, 18432)
+		low.det = g722Scale(low.nb, 8)
+
+		low.update(dlow)
+
+		high := &d.band[1]
+
+		// Block 2H, INVQAH and Block 5H, RECONS
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		rhigh := clamp(dhigh+high.s, -16384, 16383)
+
+		// Block 3H, LOGSCH and SCALEH
+		high.nb = clamp((high.nb*127)>>7+g722WH[g722RH2[ihigh]], 0, 22528)
+		high.det = g722Scale(high.nb, 10)
+
+		high.update(dhigh)
+
+		// Receive QMF
+		copy(d.x[:22], d.x[2:])
+		d.x[22] = rlow + rhigh
+		d.x[23] = rlow - rhigh
+
+		xout1, xout2 := 0, 0
+		for i := 0; i < 12; i++ {
+			xout2 += d.x[2*i] * g722QMF[i]
+			xout1 += d.x[2*i+1] * g722QMF[11-i]
+		}
+
+		samples = append(samples, saturate(xout1>>11), saturate(xout2>>11))
+	}
+
+	return samples
+}
+
+// g722Scale computes the quantizer scale factor from the logarithmic one
+func g722Scale(nb int, shift int) int {
+	wd1 := (nb >> 6) & 31
+	wd2 := shift - (nb >> 11)
+	if wd2 < 0 {
+		return (g722ILB[wd1] << -wd2) << 2
+	}
+	return (g722ILB[wd1] >> wd2) << 2
+}
+
+// update runs block 4, the adaptive predictor, with the quantized difference signal d
+func (s *g722Band) update(d int) {
+	// RECONS
+	s.d[0] = d
+	s.r[0] = saturate(s.s + d)
+
+	// PARREC
+	s.p[0] = saturate(s.sz + d)
+
+	// UPPOL2
+	for i := 0; i < 3; i++ {
+		s.sg[i] = s.p[i] >> 15
+	}
+	wd1 := saturate(s.a[1] << 2)
+	wd2 := wd1
+	if s.sg[0] == s.sg[1] {
+		wd2 = -wd1
+	}
+	if wd2 > 32767 {
+		wd2 = 32767
+	}
+	wd3 := wd2 >> 7
+	if s.sg[0] == s.sg[2] {
+		wd3 += 128
+	} else {
+		wd3 -= 128
+	}
+	wd3 += (s.a[2] * 32512) >> 15
+	s.ap[2] = clamp(wd3, -12288, 12288)
+
+	// UPPOL1
+	s.sg[0] = s.p[0] >> 15
+	s.sg[1] = s.p[1] >> 15
+	wd1 = -192
+	if s.sg[0] == s.sg[1] {
+		wd1 = 192
+	}
+	wd2 = (s.a[1] * 32640) >> 15
+	s.ap[1] = saturate(wd1 + wd2)
+	wd3 = saturate(15360 - s.ap[2])
+	s.ap[1] = clamp(s.ap[1], -wd3, wd3)
+
+	// UPZERO
+	wd1 = 128
+	if d == 0 {
+		wd1 = 0
+	}
+	s.sg[0] = d >> 15
+	for i := 1; i < 7; i++ {
+		s.sg[i] = s.d[i] >> 15
+		wd2 = -wd1
+		if s.sg[i] == s.sg[0] {
+			wd2 = wd1
+		}
+		wd3 = (s.b[i] * 32640) >> 15
+		s.bp[i] = saturate(wd2 + wd3)
+	}
+
+	// DELAYA
+	for i := 6; i > 0; i-- {
+		s.d[i] = s.d[i-1]
+		s.b[i] = s.bp[i]
+	}
+	for i := 2; i > 0; i-- {
+		s.r[i] = s.r[i-1]
+		s.p[i] = s.p[i-1]
+		s.a[i] = s.ap[i]
+	}
+
+	// FILTEP
+	wd1 = (s.a[1] * saturate(s.r[1]+s.r[1])) >> 15
+	wd2 = (s.a[2] * saturate(s.r[2]+s.r[2])) >> 15
+	s.sp = saturate(wd1 + wd2)
+
+	// FILTEZ
+	s.sz = 0
+	for i := 6; i > 0; i-- {
+		s.sz += (s.b[i] * saturate(s.d[i]+s.d[i])) >> 15
+	}
+	s.sz = saturate(s.sz)
+
+	// PREDIC
+	s.s = saturate(s.sp + s.sz)
+}
+
+// saturate limits v to the range of a 16 bit sample
+func saturate(v int) int {
+	return clamp(v, -32768, 32767)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,408 @@
+package rtp
+
+// G.726 ADPCM decoder (ITU-T G.726) for 16, 24, 32 and 40 kbit/s, i.e. 2 to 5 bits per
+// sample at 8kHz. This follows the structure and block names of the CCITT reference
+// implementation. Codewords are packed into octets starting at the least significant bit
+// (RFC 3551 section 4.5.4), or starting at the most significant bit for the AAL2 variants.
+
+var g726Power2 = [15]int{1, 2, 4, 8, 0x10, 0x20, 0x40, 0x80, 0x100, 0x200, 0x400, 0x800, 0x1000, 0x2000, 0x4000}
+
+// g726Tables are the quantizer tables of one bit rate
+type g726Tables struct {
+	dqln []int // Log of the quantized difference magnitude per codeword
+	wi   []int // Scale factor multiplier per codeword
+	fi   []int // Rate of change of the scale factor per codeword
+}
+
+var g726TablesByBits = map[int]*g726Tables{
+	2: {
+		dqln: []int{116, 365, 365, 116},
+		wi:   []int{-704, 14048, 14048, -704},
+		fi:   []int{0, 0xE00, 0xE00, 0},
+	},
+	3: {
+		dqln: []int{-2048, 135, 273, 373, 373, 273, 135, -2048},
+		wi:   []int{-128, 960, 4384, 18624, 18624, 4384, 960, -128},
+		fi:   []int{0, 0x200, 0x400, 0xE00, 0xE00, 0x400, 0x200, 0},
+	},
+	4: {
+		dqln: []int{-2048, 4, 135, 213, 273, 323, 373, 425, 425, 373, 323, 273, 213, 135, 4, -2048},
+		wi: []int{-12 << 5, 18 << 5, 41 << 5, 64 << 5, 112 << 5, 198 << 5, 355 << 5, 1122 << 5,
+			1122 << 5, 355 << 5, 198 << 5, 112 << 5, 64 << 5, 41 << 5, 18 << 5, -12 << 5},
+		fi: []int{0, 0, 0, 0x200, 0x200, 0x200, 0x600, 0xE00, 0xE00, 0x600, 0x200, 0x200, 0x200, 0, 0, 0},
+	},
+	5: {
+		dqln: []int{-2048, -66, 28, 104, 169, 224, 274, 318, 358, 395, 429, 459, 488, 514, 539, 566,
+			566, 539, 514, 488, 459, 429, 395, 358, 318, 274, 224, 169, 104, 28, -66, -2048},
+		wi: []int{448, 448, 768, 1248, 1280, 1312, 1856, 3200, 4512, 5728, 7008, 8960, 11456, 14080, 16928, 22272,
+			22272, 16928, 14080, 11456, 8960, 7008, 5728, 4512, 3200, 1856, 1312, 1280, 1248, 768, 448, 448},
+		fi: []int{0, 0, 0, 0, 0, 0x200, 0x200, 0x200, 0x200, 0x200, 0x400, 0x600, 0x800, 0xA00, 0xC00, 0xC00,
+			0xC00, 0xC00, 0xA00, 0x800, 0x600, 0x400, 0x200, 0x200, 0x200, 0x200, 0x200, 0, 0, 0, 0, 0},
+	},
+}
+
+// g726State is the adaptive quantizer and predictor state
+type g726State struct {
+	yl  int    // Locked or steady state step size multiplier
+	yu  int    // Unlocked or non-steady state step size multiplier
+	dms int    // Short term energy estimate
+	dml int    // Long term energy estimate
+	ap  int    // Linear weighting coefficient of yl and yu
+	a   [2]int // Coefficients of the pole portion of the prediction filter
+	b   [6]int // Coefficients of the zero portion of the prediction filter
+	pk  [2]int // Signs of the previous two partially reconstructed samples
+	dq  [6]int // Previous quantized differences in the internal floating point format
+	sr  [2]int // Previous reconstructed samples in the internal floating point format
+	td  int    // Delayed tone detect
+}
+
+func newG726State() g726State {
+	return g726State{
+		yl: 34816,
+		yu: 544,
+		sr: [2]int{32, 32},
+		dq: [6]int{32, 32, 32, 32, 32, 32},
+	}
+}
+
+type g726Decoder struct {
+	state  g726State
+	tables *g726Tables
+	bits   int
+	aal2   bool
+}
+
+func newG726Decoder(bits int, aal2 bool) *g726Decoder {
+	return &g726Decoder{
+		state:  newG726State(),
+		tables: g726TablesByBits[bits],
+		bits:   bits,
+		aal2:   aal2,
+	}
+}
+
+func (d *g726Decoder) Decode(payload []byte) []int {
+	samples := make([]int, 0, len(payload)*8/d.bits)
+	mask := 1<<d.bits - 1
+
+	buffer, buffered := 0, 0
+	for _, b := range payload {
+		if d.aal2 {
+			buffer = buffer<<8 | int(b)
+		} else {
+			buffer |= int(b) << buffered
+		}
+		buffered += 8
+
+		for buffered >= d.bits {
+			var code int
+			if d.aal2 {
+				code = (buffer >> (buffered - d.bits)) & mask
+			} else {
+				code = buffer & mask
+				buffer >>= d.bits
+			}
+			buffered -= d.bits
+			if d.aal2 {
+				buffer &= 1<<buffered - 1
+			}
+
+			samples = append(samples, saturate(d.decode(code)<<2))
+		}
+	}
+
+	return samples
+}
+
+// decode returns the 14 bit sample of a single codeword
+func (d *g726Decoder) decode(code int) int {
+	s := &d.state
+
+	// ACCUM, ADDB and ADDC wrap around at 16 bits like all words of the recommendation,
+	// which matters when the predictor is overloaded
+	sezi := int(int16(s.predictorZero()))
+	sez := sezi >> 1
+	se := int(int16(sezi+s.predictorPole())) >> 1
+
+	y := s.stepSize()
+	dq := g726Reconstruct(code&(1<<(d.bits-1)) != 0, d.tables.dqln[code], y)
+
+	dqi := dq
+	if dq < 0 {
+		dqi = -(dq & 0x7FFF)
+	}
+	sr := int(int16(se + dqi))
+
+	s.update(d.bits, y, d.tables.wi[code], d.tables.fi[code], dq, sr, int(int16(dqi+sez)))
+	return sr
+}
+
+// g726Quan returns the index of the first entry of table greater than val
+func g726Quan(val int, table []int) int {
+	for i, t := range table {
+		if val < t {
+			return i
+		}
+	}
+	return len(table)
+}
+
+// g726FMult multiplies an with srn, which is in the internal floating point format
+func g726FMult(an, srn int) int {
+	anmag := an
+	if an <= 0 {
+		anmag = (-an) & 0x1FFF
+	}
+	anexp := g726Quan(anmag, g726Power2[:]) - 6
+
+	var anmant int
+	switch {
+	case anmag == 0:
+		anmant = 32
+	case anexp >= 0:
+		anmant = anmag >> anexp
+	default:
+		anmant = anmag << -anexp
+	}
+
+	wanexp := anexp + ((srn >> 6) & 0xF) - 13
+	wanmant := (anmant*(srn&0x3F) + 0x30) >> 4
+
+	var retval int
+	if wanexp >= 0 {
+		retval = (wanmant << wanexp) & 0x7FFF
+	} else {
+		retval = wanmant >> -wanexp
+	}
+
+	if (an ^ srn) < 0 {
+		return -retval
+	}
+	return retval
+}
+
+func (s *g726State) predictorZero() int {
+	sezi := 0
+	for i := 0; i < 6; i++ {
+		sezi += g726FMult(s.b[i]>>2, s.dq[i])
+	}
+	return sezi
+}
+
+func (s *g726State) predictorPole() int {
+	return g726FMult(s.a[1]>>2, s.sr[1]) + g726FMult(s.a[0]>>2, s.sr[0])
+}
+
+func (s *g726State) stepSize() int {
+	if s.ap >= 256 {
+		return s.yu
+	}
+
+	y := s.yl >> 6
+	dif := s.yu - y
+	al := s.ap >> 2
+	if dif > 0 {
+		y += (dif * al) >> 6
+	} else if dif < 0 {
+		y += (dif*al + 0x3F) >> 6
+	}
+	return y
+}
+
+// g726Reconstruct computes the quantized difference signal from its log magnitude,
+// negative values are returned offset by -0x8000
+func g726Reconstruct(sign bool, dqln int, y int) int {
+	// ADDA
+	dql := dqln + (y >> 2)
+
+	if dql < 0 {
+		if sign {
+			return -0x8000
+		}
+		return 0
+	}
+
+	// ANTILOG
+	dex := (dql >> 7) & 15
+	dqt := 128 + (dql & 127)
+	dq := (dqt << 7) >> (14 - dex)
+	if sign {
+		return dq - 0x8000
+	}
+	return dq
+}
+
+// g726FloatFormat converts a magnitude into the 4 bit exponent, 6 bit mantissa format
+func g726FloatFormat(mag int, negative bool) int {
+	exp := g726Quan(mag, g726Power2[:])
+	v := (exp << 6) + ((mag << 6) >> exp)
+	if negative {
+		v -= 0x400
+	}
+	return v
+}
+
+func (s *g726State) update(bits, y, wi, fi, dq, sr, dqsez int) {
+	pk0 := 0
+	if dqsez < 0 {
+		pk0 = 1
+	}
+
+	mag := dq & 0x7FFF
+
+	// TRANS
+	ylint := s.yl >> 15
+	ylfrac := (s.yl >> 10) & 0x1F
+	thr1 := (32 + ylfrac) << ylint
+	thr2 := thr1
+	if ylint > 9 {
+		thr2 = 31 << 10
+	}
+	dqthr := (thr2 + (thr2 >> 1)) >> 1
+	tr := s.td != 0 && mag > dqthr
+
+	// FUNCTW, FILTD, DELAY and LIMB
+	s.yu = clamp(y+((wi-y)>>5), 544, 5120)
+
+	// FILTE and DELAY
+	s.yl += s.yu + ((-s.yl) >> 6)
+
+	a2p := 0
+	if tr {
+		// Reset the predictor for modem signals
+		s.a = [2]int{}
+		s.b = [6]int{}
+	} else {
+		// UPA2
+		pks1 := pk0 ^ s.pk[0]
+
+		a2p = s.a[1] - (s.a[1] >> 7)
+		if dqsez != 0 {
+			fa1 := -s.a[0]
+			if pks1 != 0 {
+				fa1 = s.a[0]
+			}
+			if fa1 < -8191 {
+				a2p -= 0x100
+			} else if fa1 > 8191 {
+				a2p += 0xFF
+			} else {
+				a2p += fa1 >> 5
+			}
+
+			// LIMC
+			if pk0^s.pk[1] != 0 {
+				if a2p <= -12160 {
+					a2p = -12288
+				} else if a2p >= 12416 {
+					a2p = 12288
+				} else {
+					a2p -= 0x80
+				}
+			} else if a2p <= -12416 {
+				a2p = -12288
+			} else if a2p >= 12160 {
+				a2p = 12288
+			} else {
+				a2p += 0x80
+			}
+		}
+
+		// TRIGB and DELAY
+		s.a[1] = a2p
+
+		// UPA1
+		s.a[0] -= s.a[0] >> 8
+		if dqsez != 0 {
+			if pks1 == 0 {
+				s.a[0] += 192
+			} else {
+				s.a[0] -= 192
+			}
+		}
+
+		// LIMD
+		a1ul := 15360 - a2p
+		s.a[0] = clamp(s.a[0], -a1ul, a1ul)
+
+		// UPB
+		for i := 0; i < 6; i++ {
+			if bits == 5 {
+				s.b[i] -= s.b[i] >> 9
+			} else {
+				s.b[i] -= s.b[i] >> 8
+			}
+			if mag != 0 {
+				if (dq ^ s.dq[i]) >= 0 {
+					s.b[i] += 128
+				} else {
+					s.b[i] -= 128
+				}
+			}
+			// Like the other words of the recommendation the coefficients wrap around at 16 bits
+			s.b[i] = int(int16(s.b[i]))
+		}
+	}
+
+	copy(s.dq[1:], s.dq[:5])
+
+	// FLOAT A
+	if mag == 0 {
+		if dq >= 0 {
+			s.dq[0] = 0x20
+		} else {
+			s.dq[0] = -992 // 0xFC20
+		}
+	} else {
+		s.dq[0] = g726FloatFormat(mag, dq < 0)
+	}
+
+	// FLOAT B
+	s.sr[1] = s.sr[0]
+	switch {
+	case sr == 0:
+		s.sr[0] = 0x20
+	case sr > 0:
+		s.sr[0] = g726FloatFormat(sr, false)
+	case sr > -32768:
+		s.sr[0] = g726FloatFormat(-sr, true)
+	default:
+		s.sr[0] = -992 // 0xFC20
+	}
+
+	// DELAY A
+	s.pk[1] = s.pk[0]
+	s.pk[0] = pk0
+
+	// TONE
+	if tr {
+		s.td = 0
+	} else if a2p < -11776 {
+		s.td = 1
+	} else {
+		s.td = 0
+	}
+
+	// Adaptation speed control, FILTA and FILTB
+	s.dms += (fi - s.dms) >> 5
+	s.dml += ((fi << 2) - s.dml) >> 7
+
+	// SUBTC
+	switch {
+	case tr:
+		s.ap = 256
+	case y < 1536, s.td == 1:
+		s.ap += (0x200 - s.ap) >> 4
+	case abs((s.dms<<2)-s.dml) >= (s.dml >> 3):
+		s.ap += (0x200 - s.ap) >> 4
+	default:
+		s.ap += (-s.ap) >> 4
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
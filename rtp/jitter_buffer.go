@@ -0,0 +1,146 @@
+package rtp
+
+import (
+	"sort"
+
+	"github.com/pion/rtp"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// Number of packets held back to put reordered packets into place,
+	// at 20ms per packet the default allows for 200ms of reordering
+	viper.SetDefault("rtp.jitter_buffer_depth", 10)
+}
+
+// StreamStats are the reception counters of a single RTP stream
+type StreamStats struct {
+	Channel    int `json:"channel"`
+	Received   int `json:"received"`   // Packets received, including late and duplicate ones
+	Lost       int `json:"lost"`       // Packets that never arrived
+	Late       int `json:"late"`       // Packets that arrived after their slot was played out
+	Duplicates int `json:"duplicates"` // Packets that were received more than once
+}
+
+// Frame is a packet released by the JitterBuffer in playout order
+type Frame struct {
+	Packet *rtp.Packet
+
+	// Number of packets that are missing right before Packet
+	Lost int
+}
+
+type bufferedPacket struct {
+	seq    int64 // Extended sequence number, not wrapping at 65535
+	packet *rtp.Packet
+}
+
+// JitterBuffer puts the packets of a single RTP stream back into sequence number
+// order. Up to depth packets are held back waiting for missing ones, after that
+// the missing packets are considered lost.
+type JitterBuffer struct {
+	depth   int
+	packets []bufferedPacket
+
+	started bool
+	ssrc    uint32
+	highest int64 // Highest extended sequence number received
+	next    int64 // Extended sequence number of the next packet to be played out
+
+	stats StreamStats
+}
+
+// NewJitterBuffer creates a JitterBuffer holding back up to depth packets
+func NewJitterBuffer(depth int) *JitterBuffer {
+	if depth < 0 {
+		depth = 0
+	}
+	return &JitterBuffer{
+		depth:   depth,
+		packets: make([]bufferedPacket, 0, depth+1),
+	}
+}
+
+// Push adds packet to the buffer and returns the frames that are ready to be played out
+func (b *JitterBuffer) Push(packet *rtp.Packet) []Frame {
+	b.stats.Received++
+
+	var frames []Frame
+	if b.started && packet.SSRC != b.ssrc {
+		// A new source took over the stream, e.g. after a transfer
+		frames = b.Flush()
+		b.started = false
+	}
+
+	if !b.started {
+		b.started = true
+		b.ssrc = packet.SSRC
+		b.highest = int64(packet.SequenceNumber)
+		b.next = b.highest
+	}
+
+	seq := b.extend(packet.SequenceNumber)
+	if seq > b.highest {
+		b.highest = seq
+	}
+
+	if seq < b.next {
+		b.stats.Late++
+		return frames
+	}
+
+	i := sort.Search(len(b.packets), func(i int) bool { return b.packets[i].seq >= seq })
+	if i < len(b.packets) && b.packets[i].seq == seq {
+		b.stats.Duplicates++
+		return frames
+	}
+
+	b.packets = append(b.packets, bufferedPacket{})
+	copy(b.packets[i+1:], b.packets[i:])
+	b.packets[i] = bufferedPacket{seq: seq, packet: packet}
+
+	for len(b.packets) > 0 && (b.packets[0].seq == b.next || len(b.packets) > b.depth) {
+		frames = append(frames, b.pop())
+	}
+
+	return frames
+}
+
+// Flush returns all buffered frames, e.g. when the recording ends
+func (b *JitterBuffer) Flush() []Frame {
+	frames := make([]Frame, 0, len(b.packets))
+	for len(b.packets) > 0 {
+		frames = append(frames, b.pop())
+	}
+	return frames
+}
+
+// Stats returns the reception counters so far
+func (b *JitterBuffer) Stats() StreamStats {
+	return b.stats
+}
+
+func (b *JitterBuffer) pop() Frame {
+	p := b.packets[0]
+	b.packets = b.packets[1:]
+
+	lost := int(p.seq - b.next)
+	b.stats.Lost += lost
+	b.next = p.seq + 1
+
+	return Frame{Packet: p.packet, Lost: lost}
+}
+
+// extend returns the extended sequence number closest to the highest one received
+func (b *JitterBuffer) extend(seq uint16) int64 {
+	cycle := b.highest &^ 0xffff
+	extended := cycle | int64(seq)
+
+	if extended-b.highest > 0x8000 {
+		extended -= 0x10000
+	} else if b.highest-extended > 0x8000 {
+		extended += 0x10000
+	}
+
+	return extended
+}
@@ -0,0 +1,82 @@
+package rtp
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func testPacket(seq uint16, timestamp uint32) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 0, SSRC: 1, SequenceNumber: seq, Timestamp: timestamp},
+		Payload: make([]byte, 160),
+	}
+}
+
+func TestJitterBufferReorder(t *testing.T) {
+	b := NewJitterBuffer(3)
+
+	played := make([]uint16, 0)
+	for _, seq := range []uint16{65534, 0, 0, 65535, 1, 2, 3} {
+		for _, frame := range b.Push(testPacket(seq, uint32(seq)*160)) {
+			played = append(played, frame.Packet.SequenceNumber)
+		}
+	}
+	for _, frame := range b.Flush() {
+		played = append(played, frame.Packet.SequenceNumber)
+	}
+
+	expected := []uint16{65534, 65535, 0, 1, 2, 3}
+	if len(played) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, played)
+	}
+	for i := range expected {
+		if played[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, played)
+		}
+	}
+
+	stats := b.Stats()
+	if stats.Received != 7 || stats.Duplicates != 1 || stats.Lost != 0 || stats.Late != 0 {
+		t.Logf("%+v\n", stats)
+		t.Fail()
+	}
+}
+
+func TestJitterBufferLossAndLate(t *testing.T) {
+	b := NewJitterBuffer(2)
+
+	frames := make([]Frame, 0)
+	// 3 is lost, 4 arrives after 5, 6 and 7 which pushes it out of the buffer
+	for _, seq := range []uint16{1, 2, 5, 6, 7, 4} {
+		frames = append(frames, b.Push(testPacket(seq, uint32(seq)*160))...)
+	}
+	frames = append(frames, b.Flush()...)
+
+	if len(frames) != 5 || frames[2].Packet.SequenceNumber != 5 || frames[2].Lost != 2 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+
+	stats := b.Stats()
+	if stats.Received != 6 || stats.Lost != 2 || stats.Late != 1 {
+		t.Logf("%+v\n", stats)
+		t.Fail()
+	}
+}
+
+func TestPlayoutFillsGaps(t *testing.T) {
+	p := newPlayout()
+	p.jitter = NewJitterBuffer(0)
+
+	samples := 0
+	// Packet 2 is lost, and the sender paused between 3 and 4 without losing packets
+	for _, packet := range []*rtp.Packet{testPacket(0, 0), testPacket(1, 160), testPacket(3, 480), testPacket(4, 1280)} {
+		samples += len(p.push(packet))
+	}
+	samples += len(p.flush())
+
+	if samples != 1280+160 {
+		t.Logf("expected %d samples, got %d\n", 1280+160, samples)
+		t.Fail()
+	}
+}
@@ -0,0 +1,253 @@
+package rtp
+
+import (
+	"os"
+	"time"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+	"github.com/pion/rtp"
+)
+
+const (
+	// Sample rate of recordings without any decodable audio
+	defaultSampleRate = 8000
+
+	// A channel that falls this far behind the others, e.g. because only one
+	// party is talking or sending audio at all, is padded with silence
+	maxChannelSkew = 2 * time.Second
+)
+
+// MultichannelRecorder records several RTP streams into the channels of a single
+// WAV file, e.g. both directions of a call into a stereo file. The sample rate of
+// the file is the one of the first codec decoded. DTMF digits are collected
+// and masked according to the rtp.dtmf_masking configuration.
+type MultichannelRecorder struct {
+	// Encoder is created once the sample rate is known
+	Encoder *wav.Encoder
+	File    *os.File
+
+	channels []*recorderChannel
+	rate     int       // Sample rate of the file, 0 until the first audio was decoded
+	begin    time.Time // Arrival of the first packet on any channel
+	written  int       // Number of samples written per channel
+	dtmf     *dtmfMasker
+}
+
+type recorderChannel struct {
+	playout *playout
+	buffer  []int
+
+	started      bool
+	firstArrival time.Time
+	origin       int    // Position of the channel's first sample in the recording
+	tones        []tone // Tones received before the channel started
+}
+
+// NewMultichannelRecorder creates a recorder writing a WAV file with the given number of channels
+func NewMultichannelRecorder(file *os.File, channels int) *MultichannelRecorder {
+	recorder := &MultichannelRecorder{
+		File:     file,
+		channels: make([]*recorderChannel, channels),
+		dtmf:     newDTMFMasker(MaskingOptionsFromConfig()),
+	}
+
+	for i := 0; i < channels; i++ {
+		recorder.channels[i] = &recorderChannel{
+			playout: newPlayout(),
+			buffer:  make([]int, 0),
+		}
+	}
+
+	return recorder
+}
+
+// SetPayloadTypes sets the codecs of the payload types used on channel, by default
+// only the static payload types are known
+func (r *MultichannelRecorder) SetPayloadTypes(channel int, types PayloadTypes) {
+	r.channels[channel].playout.setPayloadTypes(types)
+}
+
+// SetMasking replaces the DTMF masking options taken from the configuration,
+// it must be called before the first packet is recorded
+func (r *MultichannelRecorder) SetMasking(options *MaskingOptions) {
+	r.dtmf = newDTMFMasker(options)
+}
+
+// RecordPacket adds a packet that arrived at the given time to channel and writes out all
+// samples that are available on every channel. The arrival time is used to align the
+// start of the channels with each other.
+func (r *MultichannelRecorder) RecordPacket(packet *rtp.Packet, channel int, arrival time.Time) error {
+	if r.begin.IsZero() {
+		r.begin = arrival
+	}
+
+	c := r.channels[channel]
+	if c.firstArrival.IsZero() {
+		c.firstArrival = arrival
+	}
+
+	r.append(c, c.playout.push(packet))
+	r.handleTones(channel, c.playout.takeTones())
+	return r.write(false)
+}
+
+// DTMFEvents returns the DTMF digits received on all channels that were not masked
+func (r *MultichannelRecorder) DTMFEvents() []DTMFEvent {
+	return r.dtmf.events
+}
+
+// Stats returns the reception counters of each channel's stream
+func (r *MultichannelRecorder) Stats() []StreamStats {
+	stats := make([]StreamStats, len(r.channels))
+	for i, c := range r.channels {
+		stats[i] = c.playout.stats()
+		stats[i].Channel = i
+	}
+	return stats
+}
+
+// append adds decoded samples to a channel, the first samples of a channel are
+// preceded by silence for the time between the start of the recording and their arrival
+func (r *MultichannelRecorder) append(c *recorderChannel, samples []int) {
+	if len(samples) == 0 {
+		return
+	}
+
+	if r.rate == 0 {
+		// All channels are played out at the rate of the first decoded audio
+		r.rate = c.playout.rate
+		for _, other := range r.channels {
+			if other != c {
+				other.playout.rate = r.rate
+			}
+		}
+	}
+
+	if !c.started {
+		c.started = true
+		offset := int(c.firstArrival.Sub(r.begin) * time.Duration(r.rate) / time.Second)
+		if padding := offset - r.written - len(c.buffer); padding > 0 {
+			c.buffer = append(c.buffer, make([]int, padding)...)
+		}
+		c.origin = r.written + len(c.buffer)
+	}
+
+	c.buffer = append(c.buffer, samples...)
+}
+
+// handleTones passes the tones of a channel on to the masker once the position
+// of the channel in the recording is known
+func (r *MultichannelRecorder) handleTones(channel int, tones []tone) {
+	c := r.channels[channel]
+	c.tones = append(c.tones, tones...)
+	if !c.started {
+		return
+	}
+
+	for _, t := range c.tones {
+		if t.ended {
+			r.dtmf.ended(channel, c.origin+t.start, t.length, r.rate)
+		} else {
+			r.dtmf.started(channel, t.digit, c.origin+t.start, r.rate)
+		}
+	}
+	c.tones = nil
+}
+
+// write interleaves and writes the samples available on every channel. Channels lagging
+// too far behind are padded with silence first, or all of them if final is set.
+func (r *MultichannelRecorder) write(final bool) error {
+	longest := 0
+	for _, c := range r.channels {
+		if len(c.buffer) > longest {
+			longest = len(c.buffer)
+		}
+	}
+
+	length := longest - int(maxChannelSkew*time.Duration(r.rate)/time.Second)
+	if final {
+		length = longest
+	}
+
+	samples := longest
+	for _, c := range r.channels {
+		if len(c.buffer) < length {
+			c.buffer = append(c.buffer, make([]int, length-len(c.buffer))...)
+		}
+		if len(c.buffer) < samples {
+			samples = len(c.buffer)
+		}
+	}
+
+	if r.dtmf.enabled() && !final {
+		// Leave time for masks of tones whose events arrive late
+		samples -= int(dtmfMaskHoldBack * time.Duration(r.rate) / time.Second)
+	}
+
+	if samples <= 0 {
+		return nil
+	}
+
+	for _, c := range r.channels {
+		r.dtmf.apply(c.buffer[:samples], r.written)
+	}
+
+	if r.Encoder == nil {
+		r.Encoder = wav.NewEncoder(r.File, r.rate, 16, len(r.channels), 1)
+	}
+
+	interleaved := &audio.IntBuffer{
+		Data:           make([]int, 0, samples*len(r.channels)),
+		Format:         &audio.Format{NumChannels: len(r.channels), SampleRate: r.rate},
+		SourceBitDepth: 16,
+	}
+
+	for i := 0; i < samples; i++ {
+		for _, c := range r.channels {
+			interleaved.Data = append(interleaved.Data, c.buffer[i])
+		}
+	}
+
+	for _, c := range r.channels {
+		c.buffer = c.buffer[samples:]
+	}
+	r.written += samples
+	r.dtmf.prune(r.written)
+
+	return r.Encoder.Write(interleaved)
+}
+
+// Close writes out the remaining samples, finalizes the WAV file and closes it
+func (r *MultichannelRecorder) Close() error {
+	for i, c := range r.channels {
+		r.append(c, c.playout.flush())
+		r.handleTones(i, c.playout.takeTones())
+	}
+
+	if r.rate == 0 {
+		r.rate = defaultSampleRate
+	}
+	for i, c := range r.channels {
+		if !c.started && len(c.tones) > 0 {
+			// Tones but no audio, place them by their arrival
+			c.started = true
+			c.origin = int(c.firstArrival.Sub(r.begin) * time.Duration(r.rate) / time.Second)
+			r.handleTones(i, nil)
+		}
+	}
+
+	err := r.write(true)
+	if err == nil && r.Encoder == nil {
+		// Nothing was recorded, still leave a valid file
+		r.Encoder = wav.NewEncoder(r.File, r.rate, 16, len(r.channels), 1)
+		err = r.Encoder.Write(&audio.IntBuffer{Format: &audio.Format{NumChannels: len(r.channels), SampleRate: r.rate}, SourceBitDepth: 16})
+	}
+	r.Encoder.Close()
+	if err != nil {
+		r.File.Close()
+		return err
+	}
+
+	return r.File.Close()
+}
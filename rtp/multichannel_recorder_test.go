@@ -0,0 +1,60 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestMultichannelRecorderSampleRate(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "recording.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := NewMultichannelRecorder(file, 2)
+	recorder.SetPayloadTypes(0, DefaultPayloadTypes())
+
+	begin := time.Now()
+	for i := 0; i < 50; i++ {
+		arrival := begin.Add(time.Duration(i) * 20 * time.Millisecond)
+
+		// 20ms of G.722 on the first and PCMU on the second channel
+		g722 := &rtp.Packet{Header: rtp.Header{PayloadType: 9, SSRC: 1, SequenceNumber: uint16(i), Timestamp: uint32(i * 160)}, Payload: make([]byte, 160)}
+		pcmu := &rtp.Packet{Header: rtp.Header{PayloadType: 0, SSRC: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 160)}, Payload: make([]byte, 160)}
+
+		err = recorder.RecordPacket(g722, 0, arrival)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = recorder.RecordPacket(pcmu, 1, arrival)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = recorder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rate := binary.LittleEndian.Uint32(data[24:28]); rate != 16000 {
+		t.Logf("expected a sample rate of 16000, got %d\n", rate)
+		t.Fail()
+	}
+
+	// One second of 16kHz stereo 16 bit samples
+	if len(data) != 44+16000*2*2 {
+		t.Logf("Recording has %d bytes\n", len(data))
+		t.Fail()
+	}
+}
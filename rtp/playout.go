@@ -0,0 +1,248 @@
+package rtp
+
+import (
+	"log"
+
+	"github.com/pion/rtp"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Jumps in the RTP timestamps larger than this (10s at 8kHz) are treated as
+	// a discontinuity, e.g. a reset timestamp, rather than missing audio
+	maxTimestampGap = 80000
+
+	// Lost packets are concealed by fading out the previous frame for at most 60ms,
+	// anything beyond that becomes silence
+	maxConcealment = 60
+)
+
+// playout turns the packets of a single RTP stream into a continuous sequence of
+// samples. Packets are reordered by the jitter buffer and gaps in the RTP timestamps
+// are filled: with silence where the sender paused (e.g. silence suppression) and
+// with a concealment of the previous frame where packets were lost.
+type playout struct {
+	jitter *JitterBuffer
+
+	payloadTypes PayloadTypes
+	decoders     map[uint8]Decoder
+	unsupported  map[uint8]bool // Payload types that have already been reported
+
+	// Sample rate of the samples played out, 0 until set or taken from the first codec
+	rate int
+
+	started       bool
+	nextTimestamp uint32 // RTP timestamp of the sample following the last one played out
+	last          []int  // Last played out frame, used for concealment
+	position      int    // Number of samples played out so far
+
+	tone          *tone  // Last telephone-event received
+	toneTimestamp uint32 // RTP timestamp identifying the last telephone-event
+	tones         []tone // Started and ended tones not yet taken by the recorder
+}
+
+func newPlayout() *playout {
+	return &playout{
+		jitter:       NewJitterBuffer(viper.GetInt("rtp.jitter_buffer_depth")),
+		payloadTypes: DefaultPayloadTypes(),
+		decoders:     make(map[uint8]Decoder),
+		unsupported:  make(map[uint8]bool),
+	}
+}
+
+// setPayloadTypes replaces the payload type mapping, e.g. with the one negotiated in SDP
+func (p *playout) setPayloadTypes(types PayloadTypes) {
+	p.payloadTypes = types
+	p.decoders = make(map[uint8]Decoder)
+}
+
+// push adds a received packet and returns the samples that are ready
+func (p *playout) push(packet *rtp.Packet) []int {
+	return p.play(p.jitter.Push(packet))
+}
+
+// flush returns the samples of all packets still held in the jitter buffer
+func (p *playout) flush() []int {
+	samples := p.play(p.jitter.Flush())
+	p.endTone()
+	return samples
+}
+
+// takeTones returns the DTMF tones that started or ended since the last call
+func (p *playout) takeTones() []tone {
+	tones := p.tones
+	p.tones = nil
+	return tones
+}
+
+func (p *playout) stats() StreamStats {
+	return p.jitter.Stats()
+}
+
+func (p *playout) play(frames []Frame) []int {
+	samples := make([]int, 0)
+	defer func() { p.position += len(samples) }()
+
+	for _, frame := range frames {
+		if codec := p.payloadTypes.Lookup(frame.Packet.PayloadType); codec != nil && codec.Name == TelephoneEvent {
+			p.event(frame.Packet, codec, len(samples))
+			continue
+		}
+
+		codec, decoded := p.decode(frame.Packet)
+		if decoded == nil {
+			// Not audio we can decode, e.g. comfort noise. The gap it leaves in the
+			// timestamps is filled once the next audio packet arrives.
+			continue
+		}
+
+		if p.rate == 0 {
+			p.rate = codec.SampleRate
+		}
+
+		timestamp := frame.Packet.Timestamp
+		duration := uint32(len(decoded) * codec.ClockRate / codec.SampleRate)
+		decoded = resample(decoded, codec.SampleRate, p.rate)
+
+		if p.started {
+			gap := int32(timestamp - p.nextTimestamp)
+			switch {
+			case gap > maxTimestampGap || gap < -maxTimestampGap:
+				// Discontinuity, continue right after what was played out
+			case gap > 0:
+				samples = append(samples, p.fill(int(gap)*p.rate/codec.ClockRate, frame.Lost > 0)...)
+			case gap < 0:
+				// Overlaps with samples that were already played out
+				overlap := int(-gap) * p.rate / codec.ClockRate
+				if overlap >= len(decoded) {
+					continue
+				}
+				decoded = decoded[overlap:]
+			}
+		}
+
+		p.started = true
+		p.nextTimestamp = timestamp + duration
+		p.last = decoded
+		samples = append(samples, decoded...)
+	}
+
+	return samples
+}
+
+// decode returns the codec and the samples of packet, or nil if it can't be decoded
+func (p *playout) decode(packet *rtp.Packet) (*Codec, []int) {
+	codec := p.payloadTypes.Lookup(packet.PayloadType)
+	if codec == nil || codec.NewDecoder == nil {
+		if !p.unsupported[packet.PayloadType] {
+			p.unsupported[packet.PayloadType] = true
+			if codec == nil {
+				log.Printf("Unhandled RTP Payload Type: %d\n", packet.PayloadType)
+			} else {
+				log.Printf("No decoder for %s (RTP Payload Type %d), the stream is recorded as silence\n", codec.Name, packet.PayloadType)
+			}
+		}
+		return nil, nil
+	}
+
+	decoder, ok := p.decoders[packet.PayloadType]
+	if !ok {
+		decoder = codec.NewDecoder()
+		p.decoders[packet.PayloadType] = decoder
+	}
+
+	decoded := decoder.Decode(packet.Payload)
+	if len(decoded) == 0 {
+		return nil, nil
+	}
+	return codec, decoded
+}
+
+// event tracks the tones of an RFC 4733 telephone-event stream, played is the
+// number of samples played out by the current call to play so far
+func (p *playout) event(packet *rtp.Packet, codec *Codec, played int) {
+	event, ok := parseTelephoneEvent(packet.Payload)
+	if !ok || int(event.event) >= len(dtmfDigits) {
+		// Not a DTMF digit, e.g. a hook flash
+		return
+	}
+
+	rate := p.rate
+	if rate == 0 {
+		rate = codec.ClockRate
+	}
+
+	// All packets of an event carry the timestamp of its start (RFC 4733 section 2.5.1)
+	if p.tone == nil || packet.Timestamp != p.toneTimestamp {
+		p.endTone()
+
+		start := p.position + played
+		if p.started {
+			start += int(int32(packet.Timestamp-p.nextTimestamp)) * rate / codec.ClockRate
+		}
+
+		p.tone = &tone{digit: dtmfDigits[event.event], start: start}
+		p.toneTimestamp = packet.Timestamp
+		p.tones = append(p.tones, *p.tone)
+	}
+
+	if p.tone.ended {
+		// The end of an event is sent several times
+		return
+	}
+
+	p.tone.length = int(event.duration) * rate / codec.ClockRate
+	if event.end {
+		p.endTone()
+	}
+}
+
+// endTone reports the end of the current tone, if it hasn't ended yet
+func (p *playout) endTone() {
+	if p.tone == nil || p.tone.ended {
+		return
+	}
+
+	p.tone.ended = true
+	p.tones = append(p.tones, *p.tone)
+}
+
+// fill returns n samples to fill a gap, concealing the start of it if packets were lost
+func (p *playout) fill(n int, lost bool) []int {
+	samples := make([]int, n)
+	if !lost || len(p.last) == 0 {
+		return samples
+	}
+
+	concealed := maxConcealment * p.rate / 1000
+	if concealed > n {
+		concealed = n
+	}
+
+	// Repeat the last frame, fading out linearly
+	for i := 0; i < concealed; i++ {
+		samples[i] = p.last[i%len(p.last)] * (concealed - i) / concealed
+	}
+
+	return samples
+}
+
+// resample converts samples between sample rates by linear interpolation
+func resample(samples []int, from, to int) []int {
+	if from == to || len(samples) == 0 {
+		return samples
+	}
+
+	n := len(samples) * to / from
+	resampled := make([]int, n)
+	for i := range resampled {
+		position := i * from
+		j, fraction := position/to, position%to
+		if j+1 < len(samples) {
+			resampled[i] = samples[j] + (samples[j+1]-samples[j])*fraction/to
+		} else {
+			resampled[i] = samples[len(samples)-1]
+		}
+	}
+	return resampled
+}
@@ -2,13 +2,13 @@ package rtp
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
-	"github.com/pd0mz/go-g711"
 	"github.com/pion/rtp"
 )
 
@@ -26,31 +26,62 @@ type Recorder interface {
 
 	LocalAddr() net.Addr
 
+	// Stats returns the reception counters of the current or last recording
+	Stats() StreamStats
+
+	// DTMFEvents returns the unmasked DTMF digits of the current or last recording
+	DTMFEvents() []DTMFEvent
+
 	// Start starts listening for data and background processing
 	Start()
 }
 
 type rtpRecorder struct {
-	conn    net.PacketConn
-	ctx     context.Context
-	record  bool
-	encoder *wav.Encoder
-	file    *os.File
+	conn     net.PacketConn
+	ctx      context.Context
+	mutex    sync.Mutex
+	record   bool
+	recorder *MultichannelRecorder
+}
+
+// NewRecorder creates a recorder listening at a fixed address, e.g. one a switch is configured
+// to send the media of a device to. Like the recorders of a pool it needs to be started.
+func NewRecorder(address string, ctx context.Context) (Recorder, error) {
+	conn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for RTP at %s: %w", address, err)
+	}
+	return &rtpRecorder{conn: conn, ctx: ctx}, nil
 }
 
 // StartRecording starts the recording on this receiver to the filePath specified
 func (r *rtpRecorder) StartRecording(writer *os.File) error {
-	r.encoder = wav.NewEncoder(writer, 8000, 16, 1, 1)
-	r.file = writer
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.recorder = NewMultichannelRecorder(writer, 1)
 	r.record = true
 	return nil
 }
 
 // StopRecording stops the recording on this receiver and closes the file
 func (r *rtpRecorder) StopRecording() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.record {
+		return nil
+	}
+
 	r.record = false
-	r.encoder.Close()
-	r.file.Close()
+	err := r.recorder.Close()
+	if err != nil {
+		log.Printf("Failed to write payload: %s\n", err)
+	}
+
+	stats := r.recorder.Stats()[0]
+	log.Printf("Stopped recording at %s, %d packets received, %d lost, %d late\n", r.conn.LocalAddr(), stats.Received, stats.Lost, stats.Late)
+
 	return nil
 }
 
@@ -59,7 +90,6 @@ func (r *rtpRecorder) Start() {
 	log.Printf("Listening for incoming RTP data at %s\n", r.conn.LocalAddr().String())
 
 	buf := make([]byte, defaultReceiveBufferSize)
-	packet := rtp.Packet{}
 
 	// TODO implement receiving data
 	for {
@@ -71,57 +101,60 @@ func (r *rtpRecorder) Start() {
 		default:
 		}
 
-		if r.record {
+		if r.IsRecording() {
 			n, remote, err := r.conn.ReadFrom(buf)
 			if err != nil {
 				log.Printf("Failed to read from RTP stream: %s\n", err)
 				return
 			}
 
-			err = packet.Unmarshal(buf[0:n])
+			// The jitter buffer holds on to the packet, so it must not share buf
+			packet := &rtp.Packet{}
+			err = packet.Unmarshal(append([]byte(nil), buf[0:n]...))
 			if err != nil {
 				log.Printf("Failed to unmarshal packet from %s: %s\n", remote.String(), err)
 				continue
 			}
 
-			log.Printf("%+v\n", packet)
-
-			switch packet.PayloadType {
-			case 0: // PCMU
-				err = r.encoder.Write(toIntBuffer(g711.MLawDecode(packet.Payload)))
+			r.mutex.Lock()
+			if r.record {
+				err = r.recorder.RecordPacket(packet, 0, time.Now())
 				if err != nil {
 					log.Printf("Failed to write payload: %s\n", err)
 				}
-			case 8: // PCMA
-				err = r.encoder.Write(toIntBuffer(g711.MLawDecode(packet.Payload)))
-				if err != nil {
-					log.Printf("Failed to write payload: %s\n", err)
-				}
-			default:
-				log.Printf("Unhandled RTP Payload Type: %d\n", packet.PayloadType)
 			}
+			r.mutex.Unlock()
 		}
 	}
 }
 
 func (r *rtpRecorder) IsRecording() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	return r.record
 }
 
-func (r *rtpRecorder) LocalAddr() net.Addr {
-	return r.conn.LocalAddr()
-}
+func (r *rtpRecorder) Stats() StreamStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-func toIntBuffer(payload []int16) *audio.IntBuffer {
-	buffer := &audio.IntBuffer{
-		Data:           make([]int, len(payload)),
-		Format:         &audio.Format{NumChannels: 1, SampleRate: 8000},
-		SourceBitDepth: 16,
+	if r.recorder == nil {
+		return StreamStats{}
 	}
+	return r.recorder.Stats()[0]
+}
+
+func (r *rtpRecorder) DTMFEvents() []DTMFEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	for i, sample := range payload {
-		buffer.Data[i] = int(sample)
+	if r.recorder == nil {
+		return nil
 	}
+	return r.recorder.DTMFEvents()
+}
 
-	return buffer
+func (r *rtpRecorder) LocalAddr() net.Addr {
+	return r.conn.LocalAddr()
 }
@@ -0,0 +1,143 @@
+package siprec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const maxMessageSize = 65535
+
+// parseMessage decodes a single, complete SIP message
+func parseMessage(data []byte) (*layers.SIP, error) {
+	sip := layers.NewSIP()
+	err := sip.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SIP message: %w", err)
+	}
+
+	// Trim anything after the body, e.g. padding in a datagram. Content-Length is
+	// optional on UDP, without it the rest of the datagram is the body.
+	if sip.GetFirstHeader("content-length") == "" {
+		return sip, nil
+	}
+	if length := sip.GetContentLength(); length >= 0 && int64(len(sip.Payload())) > length {
+		sip.BaseLayer.Payload = sip.BaseLayer.Payload[:length]
+	}
+
+	return sip, nil
+}
+
+// readMessage reads one SIP message from a stream transport, using the
+// Content-Length header to find the end of the body
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	message := new(bytes.Buffer)
+	contentLength := 0
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip keep-alive CRLFs between messages (RFC 5626)
+		if message.Len() == 0 && len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		message.Write(line)
+		if message.Len() > maxMessageSize {
+			return nil, fmt.Errorf("SIP message exceeds %d bytes", maxMessageSize)
+		}
+
+		header := bytes.TrimSpace(line)
+		if len(header) == 0 {
+			break
+		}
+
+		if name, value, ok := strings.Cut(string(header), ":"); ok {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "content-length" || name == "l" {
+				contentLength, err = strconv.Atoi(strings.TrimSpace(value))
+				if err != nil || contentLength < 0 || contentLength > maxMessageSize {
+					return nil, fmt.Errorf("invalid Content-Length: %s", value)
+				}
+			}
+		}
+	}
+
+	body := make([]byte, contentLength)
+	_, err := io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	message.Write(body)
+
+	return message.Bytes(), nil
+}
+
+type header struct {
+	name  string
+	value string
+}
+
+// response is a SIP response under construction
+type response struct {
+	code    int
+	reason  string
+	headers []header
+	body    []byte
+}
+
+// newResponse creates a response to request and copies the headers RFC 3261 section 8.2.6.2
+// requires, a To tag is added if the request didn't carry one already
+func newResponse(request *layers.SIP, code int, reason string, toTag string) *response {
+	r := &response{
+		code:   code,
+		reason: reason,
+	}
+
+	for _, via := range request.GetHeader("via") {
+		r.addHeader("Via", via)
+	}
+
+	r.addHeader("From", request.GetFrom())
+
+	to := request.GetTo()
+	if toTag != "" && !strings.Contains(to, ";tag=") {
+		to = fmt.Sprintf("%s;tag=%s", to, toTag)
+	}
+	r.addHeader("To", to)
+
+	r.addHeader("Call-ID", request.GetCallID())
+	r.addHeader("CSeq", request.GetFirstHeader("cseq"))
+
+	return r
+}
+
+func (r *response) addHeader(name string, value string) {
+	r.headers = append(r.headers, header{name: name, value: value})
+}
+
+func (r *response) setBody(contentType string, body []byte) {
+	r.addHeader("Content-Type", contentType)
+	r.body = body
+}
+
+// Bytes serializes the response for the wire
+func (r *response) Bytes() []byte {
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "SIP/2.0 %d %s\r\n", r.code, r.reason)
+	for _, h := range r.headers {
+		fmt.Fprintf(buffer, "%s: %s\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(buffer, "Content-Length: %d\r\n\r\n", len(r.body))
+	buffer.Write(r.body)
+	return buffer.Bytes()
+}
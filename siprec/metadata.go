@@ -0,0 +1,119 @@
+package siprec
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// recordingMetadata is the subset of the RFC 7865 recording metadata that is needed to
+// attribute the recorded streams to the participants of the call
+type recordingMetadata struct {
+	XMLName      xml.Name                 `xml:"recording"`
+	DataMode     string                   `xml:"datamode"`
+	Participants []metadataParticipant    `xml:"participant"`
+	Streams      []metadataStream         `xml:"stream"`
+	Associations []participantStreamAssoc `xml:"participantstreamassoc"`
+}
+
+type metadataParticipant struct {
+	ParticipantID string `xml:"participant_id,attr"`
+	// Older drafts of the metadata model, still sent by some SRCs, use "id"
+	ID     string `xml:"id,attr"`
+	NameID struct {
+		AOR  string `xml:"aor,attr"`
+		Name string `xml:"name"`
+	} `xml:"nameID"`
+	// Older drafts list the streams a participant sends in the participant itself
+	Send []string `xml:"send"`
+}
+
+func (p *metadataParticipant) id() string {
+	if p.ParticipantID != "" {
+		return p.ParticipantID
+	}
+	return p.ID
+}
+
+// Number returns the user part of the participant's address of record
+func (p *metadataParticipant) Number() string {
+	aor := p.NameID.AOR
+	for _, scheme := range []string{"sips:", "sip:", "tel:"} {
+		if len(aor) >= len(scheme) && strings.EqualFold(aor[:len(scheme)], scheme) {
+			aor = aor[len(scheme):]
+			break
+		}
+	}
+	aor, _, _ = strings.Cut(aor, "@")
+	aor, _, _ = strings.Cut(aor, ";")
+	return aor
+}
+
+// Name returns the display name of the participant
+func (p *metadataParticipant) Name() string {
+	return strings.TrimSpace(p.NameID.Name)
+}
+
+type metadataStream struct {
+	StreamID string `xml:"stream_id,attr"`
+	ID       string `xml:"id,attr"`
+	Label    string `xml:"label"`
+}
+
+func (s *metadataStream) id() string {
+	if s.StreamID != "" {
+		return s.StreamID
+	}
+	return s.ID
+}
+
+type participantStreamAssoc struct {
+	ParticipantID string   `xml:"participant_id,attr"`
+	Send          []string `xml:"send"`
+}
+
+func parseMetadata(data []byte) (*recordingMetadata, error) {
+	metadata := &recordingMetadata{}
+	err := xml.Unmarshal(data, metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recording metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// SenderOf returns the participant that sends the stream with the SDP label, or nil if
+// the metadata doesn't tell
+func (m *recordingMetadata) SenderOf(label string) *metadataParticipant {
+	streamID := ""
+	for _, s := range m.Streams {
+		if strings.TrimSpace(s.Label) == label {
+			streamID = s.id()
+			break
+		}
+	}
+	if streamID == "" {
+		return nil
+	}
+
+	participantID := ""
+	for _, a := range m.Associations {
+		for _, send := range a.Send {
+			if strings.TrimSpace(send) == streamID {
+				participantID = a.ParticipantID
+			}
+		}
+	}
+
+	for i, p := range m.Participants {
+		if participantID != "" && p.id() == participantID {
+			return &m.Participants[i]
+		}
+		for _, send := range p.Send {
+			if strings.TrimSpace(send) == streamID {
+				return &m.Participants[i]
+			}
+		}
+	}
+
+	return nil
+}
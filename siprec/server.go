@@ -0,0 +1,443 @@
+package siprec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/pion/sdp"
+	"github.com/psco-tech/gw-coach-recording-agent/uploader"
+	"github.com/spf13/viper"
+)
+
+const allowedMethods = "INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO"
+const sessionCheckInterval = 10 * time.Second
+
+type Recorder interface {
+	ListenAndRecord(ctx context.Context) error // Accept SIPREC sessions and record them
+}
+
+// NewRecordingServer creates a SIPREC recording server (SRS) that will listen on address
+// for both UDP and TCP once ListenAndRecord is called
+func NewRecordingServer(address string) (Recorder, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid listen address <%s>: %w", address, err)
+	}
+
+	return &recordingServer{
+		address:  address,
+		sessions: make(map[string]*session),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+type recordingServer struct {
+	address  string
+	mutex    sync.Mutex
+	sessions map[string]*session
+	conns    map[net.Conn]struct{}
+}
+
+func (s *recordingServer) ListenAndRecord(ctx context.Context) error {
+	udpConn, err := net.ListenPacket("udp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SIP over UDP: %w", err)
+	}
+
+	tcpListener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen for SIP over TCP: %w", err)
+	}
+
+	log.Printf("Accepting SIPREC sessions at %s\n", s.address)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.serveUDP(udpConn)
+	}()
+	go func() {
+		defer wg.Done()
+		s.serveTCP(tcpListener)
+	}()
+
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Shutting down SIPREC recording server\n")
+			udpConn.Close()
+			tcpListener.Close()
+
+			s.mutex.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.mutex.Unlock()
+
+			wg.Wait()
+
+			// Finish whatever is still being recorded so it isn't lost
+			s.mutex.Lock()
+			sessions := s.sessions
+			s.sessions = make(map[string]*session)
+			s.mutex.Unlock()
+
+			for _, sess := range sessions {
+				s.finishSession(sess)
+			}
+			return nil
+		case <-ticker.C:
+			s.expireSessions()
+		}
+	}
+}
+
+func (s *recordingServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, remote, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		s.handleMessage(data, remote, "udp", func(response []byte) error {
+			_, err := conn.WriteTo(response, remote)
+			return err
+		})
+	}
+}
+
+func (s *recordingServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *recordingServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := readMessage(reader)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("Failed to read SIP message from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		s.handleMessage(data, conn.RemoteAddr(), "tcp", func(response []byte) error {
+			_, err := conn.Write(response)
+			return err
+		})
+	}
+}
+
+func (s *recordingServer) handleMessage(data []byte, remote net.Addr, transport string, reply func([]byte) error) {
+	sip, err := parseMessage(data)
+	if err != nil {
+		log.Printf("Ignoring invalid SIP message from %s: %s\n", remote, err)
+		return
+	}
+
+	// We never send requests, so there is nothing to do with responses
+	if sip.IsResponse {
+		return
+	}
+
+	var resp *response
+	switch sip.Method {
+	case layers.SIPMethodInvite:
+		resp = s.handleInvite(sip, remote, transport)
+	case layers.SIPMethodAck:
+		return
+	case layers.SIPMethodBye:
+		if s.endSession(sip.GetCallID()) {
+			resp = newResponse(sip, 200, "OK", "")
+		} else {
+			// A BYE outside of a dialog (RFC 3261 section 15.1.2)
+			resp = newResponse(sip, 481, "Call/Transaction Does Not Exist", "")
+		}
+	case layers.SIPMethodCancel:
+		// INVITEs are answered right away, so a CANCEL can only arrive after the final
+		// response and has no effect on the session (RFC 3261 section 9.2)
+		resp = newResponse(sip, 200, "OK", "")
+	case layers.SIPMethodUpdate, layers.SIPMethodInfo:
+		s.handleMetadataUpdate(sip)
+		resp = newResponse(sip, 200, "OK", "")
+	case layers.SIPMethodOptions:
+		resp = newResponse(sip, 200, "OK", "")
+		resp.addHeader("Allow", allowedMethods)
+		resp.addHeader("Accept", "application/sdp, application/rs-metadata+xml, multipart/mixed")
+	default:
+		resp = newResponse(sip, 405, "Method Not Allowed", "")
+		resp.addHeader("Allow", allowedMethods)
+	}
+
+	err = reply(resp.Bytes())
+	if err != nil {
+		log.Printf("Failed to send SIP response to %s: %s\n", remote, err)
+	}
+}
+
+func (s *recordingServer) handleInvite(invite *layers.SIP, remote net.Addr, transport string) *response {
+	callID := invite.GetCallID()
+
+	offer, metadataXML, err := parseBody(invite)
+	if err != nil {
+		log.Printf("Rejecting SIPREC session <%s>: %s\n", callID, err)
+		return newResponse(invite, 400, "Bad Request", "")
+	}
+
+	var metadata *recordingMetadata
+	if len(metadataXML) > 0 {
+		metadata, err = parseMetadata(metadataXML)
+		if err != nil {
+			log.Printf("Ignoring recording metadata of session <%s>: %s\n", callID, err)
+		}
+	}
+
+	mediaIP, err := s.mediaAddress(remote)
+	if err != nil {
+		log.Printf("Rejecting SIPREC session <%s>: %s\n", callID, err)
+		return newResponse(invite, 500, "Server Internal Error", "")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[callID]
+	if ok {
+		// Retransmission or re-INVITE, the media streams stay the same
+		if metadata != nil {
+			sess.updateMetadata(metadata, string(metadataXML))
+		}
+	} else {
+		if offer == nil {
+			log.Printf("Rejecting SIPREC session <%s>: no SDP offer\n", callID)
+			return newResponse(invite, 488, "Not Acceptable Here", "")
+		}
+
+		sess, err = newSession(callID, offer, metadata, string(metadataXML), mediaIP)
+		if err != nil {
+			log.Printf("Rejecting SIPREC session <%s>: %s\n", callID, err)
+			return newResponse(invite, 488, "Not Acceptable Here", "")
+		}
+
+		err = sess.start()
+		if err != nil {
+			sess.closeStreams()
+			log.Printf("Failed to start recording SIPREC session <%s>: %s\n", callID, err)
+			return newResponse(invite, 500, "Server Internal Error", "")
+		}
+
+		s.sessions[callID] = sess
+		log.Printf("SIPREC session started: %s\n", callID)
+	}
+
+	resp := newResponse(invite, 200, "OK", sess.toTag)
+	resp.addHeader("Contact", s.contact(mediaIP, transport))
+	resp.addHeader("Allow", allowedMethods)
+	resp.setBody("application/sdp", sess.answer)
+	return resp
+}
+
+func (s *recordingServer) handleMetadataUpdate(request *layers.SIP) {
+	_, metadataXML, err := parseBody(request)
+	if err != nil || len(metadataXML) == 0 {
+		return
+	}
+
+	metadata, err := parseMetadata(metadataXML)
+	if err != nil {
+		log.Printf("Ignoring recording metadata update of session <%s>: %s\n", request.GetCallID(), err)
+		return
+	}
+
+	s.mutex.Lock()
+	sess, ok := s.sessions[request.GetCallID()]
+	s.mutex.Unlock()
+
+	if ok {
+		sess.updateMetadata(metadata, string(metadataXML))
+	}
+}
+
+// endSession removes the session from the active sessions and finishes its recording,
+// it returns false if there is no such session
+func (s *recordingServer) endSession(callID string) bool {
+	s.mutex.Lock()
+	sess, ok := s.sessions[callID]
+	delete(s.sessions, callID)
+	s.mutex.Unlock()
+
+	if ok {
+		log.Printf("SIPREC session ended: %s\n", callID)
+		s.finishSession(sess)
+	}
+	return ok
+}
+
+// expireSessions ends all sessions that stopped receiving media
+func (s *recordingServer) expireSessions() {
+	timeout := viper.GetDuration("siprec.media_timeout")
+
+	s.mutex.Lock()
+	expired := make([]*session, 0)
+	for callID, sess := range s.sessions {
+		if time.Since(sess.idleSince()) > timeout {
+			expired = append(expired, sess)
+			delete(s.sessions, callID)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, sess := range expired {
+		log.Printf("SIPREC session timed out without media: %s\n", sess.callID)
+		s.finishSession(sess)
+	}
+}
+
+func (s *recordingServer) finishSession(sess *session) {
+	record, err := sess.finish()
+	if err != nil {
+		log.Printf("Failed to finish SIPREC session <%s>: %s\n", sess.callID, err)
+		return
+	}
+
+	// Enqueue uploading the newly recorded file
+	err = uploader.Enqueue(record)
+	if err != nil {
+		log.Printf("Failed to queue recording of SIPREC session <%s>: %s\n", sess.callID, err)
+	}
+}
+
+// mediaAddress returns the IP address to announce in SDP answers to remote
+func (s *recordingServer) mediaAddress(remote net.Addr) (net.IP, error) {
+	if configured := viper.GetString("siprec.media_address"); configured != "" {
+		ip := net.ParseIP(configured)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid siprec.media_address <%s>", configured)
+		}
+		return ip, nil
+	}
+
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Connecting a UDP socket sends nothing, it only selects the local address
+	// the system would use to reach the remote side
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "5060"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find local address towards %s: %w", host, err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func (s *recordingServer) contact(ip net.IP, transport string) string {
+	_, port, _ := net.SplitHostPort(s.address)
+	contact := fmt.Sprintf("<sip:govworx@%s>", net.JoinHostPort(ip.String(), port))
+	if transport == "tcp" {
+		contact = fmt.Sprintf("<sip:govworx@%s;transport=tcp>", net.JoinHostPort(ip.String(), port))
+	}
+	return contact
+}
+
+// parseBody extracts the SDP offer and recording metadata from a SIPREC request body,
+// which is either plain SDP or a multipart body carrying both (RFC 7866 section 9)
+func parseBody(request *layers.SIP) (offer *sdp.SessionDescription, metadata []byte, err error) {
+	contentType := request.GetFirstHeader("content-type")
+	if contentType == "" {
+		return nil, nil, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Content-Type <%s>: %w", contentType, err)
+	}
+
+	body := request.Payload()
+
+	switch {
+	case mediaType == "application/sdp":
+		offer, err = parseSDP(body)
+		return offer, nil, err
+	case mediaType == "application/rs-metadata+xml":
+		return nil, body, nil
+	case strings.HasPrefix(mediaType, "multipart/"):
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid multipart body: %w", err)
+			}
+
+			content, err := io.ReadAll(part)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid multipart body: %w", err)
+			}
+
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			switch partType {
+			case "application/sdp":
+				offer, err = parseSDP(content)
+				if err != nil {
+					return nil, nil, err
+				}
+			case "application/rs-metadata+xml":
+				metadata = content
+			}
+		}
+		return offer, metadata, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported Content-Type <%s>", mediaType)
+}
+
+func parseSDP(body []byte) (*sdp.SessionDescription, error) {
+	description := &sdp.SessionDescription{}
+	err := description.Unmarshal(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SDP: %w", err)
+	}
+	return description, nil
+}
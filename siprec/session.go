@@ -0,0 +1,316 @@
+package siprec
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	pionrtp "github.com/pion/rtp"
+	"github.com/pion/sdp"
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/psco-tech/gw-coach-recording-agent/rtp"
+	"github.com/spf13/viper"
+)
+
+const defaultReceiveBufferSize = 4096
+
+// mediaStream is one of the forked RTP streams of a recording session
+type mediaStream struct {
+	label        string
+	channel      int
+	conn         net.PacketConn
+	payloadTypes rtp.PayloadTypes
+}
+
+// session is one SIPREC recording session (RFC 7866), the SRC forks both directions
+// of the recorded call into separate streams which are recorded into a stereo file
+type session struct {
+	callID   string
+	toTag    string
+	answer   []byte
+	metadata *recordingMetadata
+	details  string
+
+	mutex      sync.Mutex
+	wg         sync.WaitGroup
+	recorder   *rtp.MultichannelRecorder
+	streams    []*mediaStream
+	begin      time.Time
+	lastPacket time.Time
+}
+
+// newSession opens an RTP listener for each offered audio stream and prepares the SDP answer
+func newSession(callID string, offer *sdp.SessionDescription, metadata *recordingMetadata, details string, mediaIP net.IP) (*session, error) {
+	s := &session{
+		callID:     callID,
+		toTag:      strconv.FormatUint(rand.Uint64(), 36),
+		metadata:   metadata,
+		details:    details,
+		begin:      time.Now(),
+		lastPacket: time.Now(),
+	}
+
+	addressType := "IP4"
+	if mediaIP.To4() == nil {
+		addressType = "IP6"
+	}
+
+	answer := &sdp.SessionDescription{
+		Origin: sdp.Origin{
+			Username:       "govworx",
+			SessionID:      uint64(time.Now().Unix()),
+			SessionVersion: uint64(time.Now().Unix()),
+			NetworkType:    "IN",
+			AddressType:    addressType,
+			UnicastAddress: mediaIP.String(),
+		},
+		SessionName: "GovWorx SIPREC",
+		ConnectionInformation: &sdp.ConnectionInformation{
+			NetworkType: "IN",
+			AddressType: addressType,
+			Address:     &sdp.Address{IP: mediaIP},
+		},
+		TimeDescriptions: []sdp.TimeDescription{{Timing: sdp.Timing{}}},
+	}
+
+	for _, md := range offer.MediaDescriptions {
+		label, _ := md.Attribute("label")
+
+		answered := &sdp.MediaDescription{
+			MediaName: sdp.MediaName{
+				Media:  md.MediaName.Media,
+				Protos: md.MediaName.Protos,
+			},
+		}
+		if label != "" {
+			answered.WithValueAttribute("label", label)
+		}
+
+		// Accept all offered formats we can decode and telephone-events for the DTMF digits
+		payloadTypes := rtp.PayloadTypesFromSDP(md)
+		formats := make([]string, 0)
+		audio := false
+		for _, f := range md.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(f, 10, 7)
+			if err != nil {
+				continue
+			}
+			codec := payloadTypes.Lookup(uint8(payloadType))
+			if codec != nil && (codec.NewDecoder != nil || codec.Name == rtp.TelephoneEvent) {
+				formats = append(formats, f)
+				audio = audio || codec.NewDecoder != nil
+			}
+		}
+
+		// Only the first two audio streams fit into the stereo recording, reject anything
+		// else by answering with port 0 (RFC 3264 section 6)
+		if md.MediaName.Media != "audio" || !audio || len(s.streams) >= 2 {
+			answered.MediaName.Formats = md.MediaName.Formats
+			answer.MediaDescriptions = append(answer.MediaDescriptions, answered)
+			continue
+		}
+
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(viper.GetString("siprec.rtp_address"), "0"))
+		if err != nil {
+			s.closeStreams()
+			return nil, fmt.Errorf("failed to open RTP listener: %w", err)
+		}
+
+		s.streams = append(s.streams, &mediaStream{
+			label:        label,
+			conn:         conn,
+			payloadTypes: payloadTypes,
+		})
+
+		answered.MediaName.Port = sdp.RangedPort{Value: conn.LocalAddr().(*net.UDPAddr).Port}
+		for _, f := range formats {
+			payloadType, _ := strconv.ParseUint(f, 10, 7)
+			codec := payloadTypes.Lookup(uint8(payloadType))
+			answered.MediaName.Formats = append(answered.MediaName.Formats, f)
+			answered.WithValueAttribute("rtpmap", fmt.Sprintf("%s %s/%d", f, codec.Name, codec.ClockRate))
+			if codec.Name == rtp.TelephoneEvent {
+				answered.WithValueAttribute("fmtp", f+" 0-15")
+			}
+		}
+		answered.WithPropertyAttribute("recvonly")
+		answer.MediaDescriptions = append(answer.MediaDescriptions, answered)
+	}
+
+	if len(s.streams) == 0 {
+		return nil, fmt.Errorf("no supported audio stream offered")
+	}
+
+	s.assignChannels()
+	s.answer = []byte(answer.Marshal())
+
+	return s, nil
+}
+
+// assignChannels maps the streams onto the same channel layout the passive recorder
+// uses: channel 0 holds what the caller hears, channel 1 what the callee hears.
+// The caller is taken to be the participant sending the first stream.
+func (s *session) assignChannels() {
+	caller := s.sender(0)
+
+	for i, stream := range s.streams {
+		sender := s.sender(i)
+		if (caller != nil && sender == caller) || (sender == nil && i == 0) {
+			stream.channel = 1
+		} else {
+			stream.channel = 0
+		}
+	}
+}
+
+// sender returns the participant that sends stream i, if the metadata tells
+func (s *session) sender(i int) *metadataParticipant {
+	if s.metadata == nil || i >= len(s.streams) {
+		return nil
+	}
+	return s.metadata.SenderOf(s.streams[i].label)
+}
+
+// start creates the recording file and starts receiving on all streams
+func (s *session) start() error {
+	recordingFile, err := os.CreateTemp(os.TempDir(), "*.wav")
+	if err != nil {
+		return fmt.Errorf("failed to open file for recording: %w", err)
+	}
+
+	s.recorder = rtp.NewMultichannelRecorder(recordingFile, 2)
+
+	for _, stream := range s.streams {
+		s.recorder.SetPayloadTypes(stream.channel, stream.payloadTypes)
+	}
+
+	for _, stream := range s.streams {
+		s.wg.Add(1)
+		go s.receive(stream)
+	}
+
+	return nil
+}
+
+func (s *session) receive(stream *mediaStream) {
+	defer s.wg.Done()
+
+	buf := make([]byte, defaultReceiveBufferSize)
+	for {
+		n, remote, err := stream.conn.ReadFrom(buf)
+		if err != nil {
+			// The listener is closed when the session ends
+			return
+		}
+
+		// The jitter buffer holds on to the packet, so it must not share buf
+		packet := &pionrtp.Packet{}
+		err = packet.Unmarshal(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			log.Printf("Failed to unmarshal RTP packet from %s: %s\n", remote, err)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.lastPacket = time.Now()
+		err = s.recorder.RecordPacket(packet, stream.channel, s.lastPacket)
+		s.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("Failed to record RTP packet for session <%s>: %s\n", s.callID, err)
+		}
+	}
+}
+
+// updateMetadata replaces the metadata after the SRC sent an update, e.g. in a re-INVITE
+func (s *session) updateMetadata(metadata *recordingMetadata, details string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.metadata = metadata
+	s.details = details
+}
+
+// idleSince returns the time the last RTP packet was received
+func (s *session) idleSince() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastPacket
+}
+
+func (s *session) closeStreams() {
+	for _, stream := range s.streams {
+		stream.conn.Close()
+	}
+}
+
+// finish stops receiving, closes the recording and returns the record to be uploaded
+func (s *session) finish() (*models.UploadRecord, error) {
+	s.closeStreams()
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.recorder == nil {
+		return nil, fmt.Errorf("session was never started")
+	}
+
+	err := s.recorder.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close recording: %w", err)
+	}
+
+	stats, err := json.Marshal(s.recorder.Stats())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode stream statistics: %w", err)
+	}
+
+	dtmf, err := json.Marshal(s.recorder.DTMFEvents())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode DTMF events: %w", err)
+	}
+
+	record := &models.UploadRecord{
+		FilePath:    s.recorder.File.Name(),
+		Type:        models.UploadRecordTypeCFS_AUDIO,
+		ContentType: "audio/wav",
+		Details:     s.details,
+		Begin:       s.begin,
+		End:         time.Now(),
+		StreamStats: string(stats),
+		DTMFEvents:  string(dtmf),
+	}
+
+	caller, callee := s.sender(0), s.sender(1)
+	if s.metadata != nil && len(s.metadata.Participants) >= 2 {
+		if caller == nil {
+			caller = &s.metadata.Participants[0]
+		}
+		if callee == nil || callee == caller {
+			for i := range s.metadata.Participants {
+				if &s.metadata.Participants[i] != caller {
+					callee = &s.metadata.Participants[i]
+					break
+				}
+			}
+		}
+	}
+
+	if caller != nil {
+		record.CallerName = caller.Name()
+		record.CallerNumber = caller.Number()
+	}
+	if callee != nil {
+		record.CalleeName = callee.Name()
+		record.CalleeNumber = callee.Number()
+	}
+
+	return record, nil
+}
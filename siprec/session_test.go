@@ -0,0 +1,223 @@
+package siprec
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	pionrtp "github.com/pion/rtp"
+)
+
+var siprecInvite = []byte("INVITE sip:srs@192.0.2.10:5060 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-524287-1\r\n" +
+	"From: <sip:src@192.0.2.1>;tag=35a5bd\r\n" +
+	"To: <sip:srs@192.0.2.10>\r\n" +
+	"Call-ID: 5c4ac6a0@192.0.2.1\r\n" +
+	"CSeq: 101 INVITE\r\n" +
+	"Contact: <sip:src@192.0.2.1:5060>;+sip.src\r\n" +
+	"Require: siprec\r\n" +
+	"Content-Type: multipart/mixed;boundary=foobar\r\n" +
+	"\r\n" +
+	"--foobar\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"\r\n" +
+	"v=0\r\n" +
+	"o=SRC 1 1 IN IP4 192.0.2.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.0.2.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 10000 RTP/AVP 0 8 18 101\r\n" +
+	"a=rtpmap:101 telephone-event/8000\r\n" +
+	"a=label:1\r\n" +
+	"a=sendonly\r\n" +
+	"m=audio 10002 RTP/AVP 0 8 18\r\n" +
+	"a=label:2\r\n" +
+	"a=sendonly\r\n" +
+	"\r\n" +
+	"--foobar\r\n" +
+	"Content-Type: application/rs-metadata+xml\r\n" +
+	"Content-Disposition: recording-session\r\n" +
+	"\r\n" +
+	"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\r\n" +
+	"<recording xmlns=\"urn:ietf:params:xml:ns:recording:1\">\r\n" +
+	"<datamode>complete</datamode>\r\n" +
+	"<session session_id=\"hVpd7YQgRW2nD22h7q60JQ==\"></session>\r\n" +
+	"<participant participant_id=\"srfBElmCRp2QB23b7Mpk0w==\"><nameID aor=\"sip:+15125550100@198.51.100.7\"><name xml:lang=\"en\">Jane Caller</name></nameID></participant>\r\n" +
+	"<participant participant_id=\"zSfPoSvdSDCmU3A3TRDxAw==\"><nameID aor=\"sip:4711@192.0.2.20;user=phone\"><name>Dispatch 4711</name></nameID></participant>\r\n" +
+	"<stream stream_id=\"UAAMm5GRQKSCMVvLyl4rFw==\" session_id=\"hVpd7YQgRW2nD22h7q60JQ==\"><label>2</label></stream>\r\n" +
+	"<stream stream_id=\"i1Pz3to5hGk8fuXl+PbwCw==\" session_id=\"hVpd7YQgRW2nD22h7q60JQ==\"><label>1</label></stream>\r\n" +
+	"<participantstreamassoc participant_id=\"srfBElmCRp2QB23b7Mpk0w==\"><send>i1Pz3to5hGk8fuXl+PbwCw==</send><recv>UAAMm5GRQKSCMVvLyl4rFw==</recv></participantstreamassoc>\r\n" +
+	"<participantstreamassoc participant_id=\"zSfPoSvdSDCmU3A3TRDxAw==\"><send>UAAMm5GRQKSCMVvLyl4rFw==</send><recv>i1Pz3to5hGk8fuXl+PbwCw==</recv></participantstreamassoc>\r\n" +
+	"</recording>\r\n" +
+	"--foobar--\r\n")
+
+func TestParseInviteBody(t *testing.T) {
+	invite, err := parseMessage(siprecInvite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if invite.Method != layers.SIPMethodInvite {
+		t.Fail()
+	}
+
+	offer, metadataXML, err := parseBody(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer == nil || len(offer.MediaDescriptions) != 2 {
+		t.Fatalf("expected an SDP offer with two streams")
+	}
+
+	metadata, err := parseMetadata(metadataXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := metadata.SenderOf("1")
+	if sender == nil || sender.Number() != "+15125550100" || sender.Name() != "Jane Caller" {
+		t.Logf("%+v\n", sender)
+		t.Fail()
+	}
+
+	sender = metadata.SenderOf("2")
+	if sender == nil || sender.Number() != "4711" || sender.Name() != "Dispatch 4711" {
+		t.Logf("%+v\n", sender)
+		t.Fail()
+	}
+}
+
+func TestSessionRecording(t *testing.T) {
+	invite, err := parseMessage(siprecInvite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, metadataXML, err := parseBody(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := parseMetadata(metadataXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := newSession(invite.GetCallID(), offer, metadata, string(metadataXML), net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(sess.answer), "a=recvonly") || !strings.Contains(string(sess.answer), "m=audio") {
+		t.Logf("%s\n", sess.answer)
+		t.Fail()
+	}
+
+	// Telephone-events are accepted for the DTMF digits, G.729 can't be decoded
+	if !strings.Contains(string(sess.answer), "RTP/AVP 0 8 101\r\n") || !strings.Contains(string(sess.answer), "a=rtpmap:101 telephone-event/8000\r\n") {
+		t.Logf("%s\n", sess.answer)
+		t.Fail()
+	}
+
+	// The caller sends the first stream, which the callee hears on channel 1
+	if sess.streams[0].channel != 1 || sess.streams[1].channel != 0 {
+		t.Fail()
+	}
+
+	err = sess.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range sess.streams {
+		conn, err := net.Dial("udp", stream.conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			packet := pionrtp.Packet{
+				Header:  pionrtp.Header{Version: 2, PayloadType: 0, SequenceNumber: uint16(i), Timestamp: uint32(i * 160)},
+				Payload: make([]byte, 160),
+			}
+			data, _ := packet.Marshal()
+			conn.Write(data)
+		}
+		conn.Close()
+	}
+
+	// Give the receivers a moment to drain the sockets
+	time.Sleep(100 * time.Millisecond)
+
+	record, err := sess.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(record.FilePath)
+
+	if record.CallerNumber != "+15125550100" || record.CallerName != "Jane Caller" {
+		t.Fail()
+	}
+	if record.CalleeNumber != "4711" || record.CalleeName != "Dispatch 4711" {
+		t.Fail()
+	}
+
+	info, err := os.Stat(record.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WAV header plus 10 packets of 160 stereo 16 bit samples
+	if info.Size() < 44+10*160*2*2 {
+		t.Logf("Recording has %d bytes\n", info.Size())
+		t.Fail()
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	invite, err := parseMessage(siprecInvite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := string(newResponse(invite, 200, "OK", "abc").Bytes())
+	for _, expected := range []string{
+		"SIP/2.0 200 OK\r\n",
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-524287-1\r\n",
+		"To: <sip:srs@192.0.2.10>;tag=abc\r\n",
+		"Call-ID: 5c4ac6a0@192.0.2.1\r\n",
+		"CSeq: 101 INVITE\r\n",
+		"Content-Length: 0\r\n\r\n",
+	} {
+		if !strings.Contains(resp, expected) {
+			t.Logf("missing %q in\n%s\n", expected, resp)
+			t.Fail()
+		}
+	}
+}
+
+func TestByeWithoutSession(t *testing.T) {
+	s := &recordingServer{sessions: make(map[string]*session)}
+
+	bye := []byte("BYE sip:srs@192.0.2.10:5060 SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK-524287-2\r\n" +
+		"From: <sip:src@192.0.2.1>;tag=35a5bd\r\n" +
+		"To: <sip:srs@192.0.2.10>;tag=abc\r\n" +
+		"Call-ID: unknown@192.0.2.1\r\n" +
+		"CSeq: 102 BYE\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n")
+
+	var resp string
+	s.handleMessage(bye, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5060}, "udp", func(response []byte) error {
+		resp = string(response)
+		return nil
+	})
+
+	if !strings.HasPrefix(resp, "SIP/2.0 481 Call/Transaction Does Not Exist\r\n") {
+		t.Fatalf("unexpected response\n%s", resp)
+	}
+}
@@ -0,0 +1,21 @@
+package siprec
+
+import "github.com/spf13/viper"
+
+const PBXType = "siprec"
+
+func init() {
+	// Address the SIP user agent server listens on for both UDP and TCP
+	viper.SetDefault("siprec.listen_address", ":5060")
+
+	// Local IP address to bind RTP listeners to, empty means all interfaces
+	viper.SetDefault("siprec.rtp_address", "")
+
+	// IP address announced in the SDP answer, if empty the address
+	// of the interface that routes to the recording client is used
+	viper.SetDefault("siprec.media_address", "")
+
+	// Recording sessions without any RTP for this long are considered dead
+	// and will be finished as if a BYE had been received
+	viper.SetDefault("siprec.media_timeout", "60s")
+}
@@ -44,11 +44,11 @@ func (a *AppConnect) makeRequest(path string, method string, body interface{}, r
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("X-AGENT-AUTHORIZATION", "Bearer "+a.AgentToken)
 
-	log.Default().Printf("Request INFO: ", req)
+	log.Default().Printf("Request INFO: %v", req)
 
 	resp, err := a.client.Do(req)
 	if err != nil {
-		log.Default().Printf("Request ERROR: ", err)
+		log.Default().Printf("Request ERROR: %s", err)
 		return err
 	}
 
@@ -61,7 +61,7 @@ func (a *AppConnect) makeRequest(path string, method string, body interface{}, r
 	defer resp.Body.Close()
 
 	if respData != nil {
-		log.Default().Printf("RESPONSE DATA : ", respData)
+		log.Default().Printf("RESPONSE DATA : %v", respData)
 		err = json.NewDecoder(resp.Body).Decode(respData)
 		if err != nil {
 			return err
@@ -28,114 +28,229 @@ func generateSixDigitGUID() string {
 	return string(guid)
 }
 
+func init() {
+	// How often the queue is checked for uploads without being notified
+	viper.SetDefault("uploader.poll_interval", "1m")
+
+	// Failed uploads are retried with exponential backoff, starting at retry_initial_delay
+	// and doubling with every attempt up to retry_max_delay. After max_attempts failed
+	// attempts the record is marked UPLOAD_FAILED and only retried manually.
+	viper.SetDefault("uploader.max_attempts", 8)
+	viper.SetDefault("uploader.retry_initial_delay", "30s")
+	viper.SetDefault("uploader.retry_max_delay", "1h")
+}
+
 var (
-	fileChan   chan models.UploadRecord
-	once       sync.Once
-	appConnect AppConnect
+	wakeup chan struct{}
+	once   sync.Once
 )
 
+// Start starts the background upload worker. The queue lives in the database, so
+// uploads that were pending when the agent stopped are resumed.
 func Start() {
 	once.Do(func() {
-		fileChan = make(chan models.UploadRecord)
-		go uploader(fileChan)
+		wakeup = make(chan struct{}, 1)
+		go uploader()
 	})
 }
 
-func GetUploadRecordChannel() chan models.UploadRecord {
-	return fileChan
-}
+// Enqueue persists ur with status QUEUED so the upload worker will pick it up, it
+// doesn't block even if the worker is busy or not running
+func Enqueue(ur *models.UploadRecord) error {
+	database, err := models.NewDatabase()
+	if err != nil {
+		return fmt.Errorf("failed to enqueue upload: %w", err)
+	}
 
-func uploader(uploadRecords chan models.UploadRecord) {
-	for ur := range uploadRecords {
+	ur.Status = models.UploadStatusQueued
+	ur.Attempts = 0
+	ur.LastError = ""
+	ur.NextAttemptAt = time.Time{}
+	ur.ObjectKey = ""
+	err = database.Save(ur).Error
+	if err != nil {
+		return fmt.Errorf("failed to enqueue upload: %w", err)
+	}
 
-		database, err := models.NewDatabase()
-		appConfig, err := database.GetAppConfig()
-		if err != nil || appConfig.AgentToken == "" {
-			log.Printf("Could not get app Config: %s", err.Error())
-			continue
-		}
+	log.Printf("Queued upload record %d for %s", ur.ID, ur.FilePath)
 
-		appConnect := NewAppConnect(appConfig.AgentToken, viper.GetString("app_connect_host"))
+	// Notify the worker, if there is a notification pending already it will see this record too
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
 
-		filename := filepath.Base(ur.FilePath)
+	return nil
+}
 
-		ur.Status = models.UploadStatusStarting
-		database.Save(ur)
-		log.Printf("Starting upload for record %d", ur.ID)
+func uploader() {
+	for {
+		wait := viper.GetDuration("uploader.poll_interval")
 
-		var tempUploadRequest = *new(TempUploadUrlRequest)
-		// Make sure filename is sufficiently unique
-		tempUploadRequest.Filename = generateSixDigitGUID() + "_" + filename
-		tempUploadRequest.ContentType = ur.ContentType
+		database, err := models.NewDatabase()
+		if err != nil {
+			log.Printf("Could not open database: %s", err)
+		} else {
+			records, err := database.GetPendingUploads()
+			if err != nil {
+				log.Printf("Could not get pending uploads: %s", err)
+			}
 
-		tempUploadResponse, err := appConnect.GetTempUpload(tempUploadRequest)
-		if err != nil || tempUploadResponse.URL == "" {
-			log.Printf("Could not get temp upload URL")
-			continue
-		}
+			for i := range records {
+				ur := &records[i]
 
-		log.Printf("Temp Upload URL is: %s", tempUploadResponse.URL)
-		ur.Status = models.UploadStatusUploading
-		database.Save(ur)
-		log.Printf("Starting to upload data for for record %d", ur.ID)
+				// Wake up again in time for the earliest retry
+				if untilDue := time.Until(ur.NextAttemptAt); untilDue > 0 {
+					if untilDue < wait {
+						wait = untilDue
+					}
+					continue
+				}
 
-		uploadFile, err := os.Open(ur.FilePath)
-		if err != nil {
-			log.Printf("Could not open file for upload: %s", err.Error())
-			continue
+				err = upload(database, ur)
+				if err != nil {
+					recordFailure(database, ur, err)
+				}
+			}
 		}
-		defer uploadFile.Close()
-		info, err := uploadFile.Stat()
 
-		fileContent, err := ioutil.ReadFile(ur.FilePath)
-		if err != nil {
-			fmt.Printf("Error reading file: %v\n", err)
-			continue
+		select {
+		case <-wakeup:
+		case <-time.After(wait):
 		}
+	}
+}
 
-		// Create an HTTP PUT request with the file content
-		req, err := http.NewRequest(http.MethodPut, tempUploadResponse.URL, bytes.NewReader(fileContent))
-		req.Header.Set("Content-Type", ur.ContentType)
-		req.Header.Set("Content-Length", fmt.Sprintf("%d", info.Size()))
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Printf("Error uploading file: %v", err)
-			continue
+// recordFailure stores the error of a failed attempt and schedules the next one, or marks
+// the record as failed once the maximum number of attempts is reached
+func recordFailure(database *models.DB, ur *models.UploadRecord, err error) {
+	ur.Attempts++
+	ur.LastError = err.Error()
+
+	if ur.Attempts >= viper.GetInt("uploader.max_attempts") {
+		ur.Status = models.UploadStatusFailed
+		log.Printf("Upload of record %d failed after %d attempts, giving up: %s", ur.ID, ur.Attempts, err)
+	} else {
+		// A transferred file is only finalized again, the other steps start over
+		if ur.Status != models.UploadStatusUploadTransferred || ur.ObjectKey == "" {
+			ur.Status = models.UploadStatusQueued
 		}
-		defer resp.Body.Close()
+		ur.NextAttemptAt = time.Now().Add(retryDelay(ur.Attempts))
+		log.Printf("Upload of record %d failed (attempt %d), retrying at %s: %s", ur.ID, ur.Attempts, ur.NextAttemptAt.Format(time.RFC3339), err)
+	}
 
-		ur.Status = models.UploadStatusUploadTransferred
-		database.Save(ur)
-		log.Printf("Data all transferred for record %d", ur.ID)
+	database.Save(ur)
+}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := ioutil.ReadAll(resp.Body)
-			log.Printf("Error uploading file, status: %d, response: %s", resp.StatusCode, string(body))
-			continue
-		}
+// retryDelay returns how long to wait before the next attempt after the given number of failed attempts
+func retryDelay(attempts int) time.Duration {
+	delay := viper.GetDuration("uploader.retry_initial_delay")
+	maxDelay := viper.GetDuration("uploader.retry_max_delay")
 
-		switch ur.Type {
-		case models.UploadRecordTypeCFS_AUDIO:
-			var cfsAudio = *new(models.CFSAudio)
-			cfsAudio.CallId = fmt.Sprintf("%d", ur.ID)
-			cfsAudio, err := appConnect.FinalizeCFSUpload(tempUploadResponse.ObjectKey, cfsAudio)
-			if err != nil {
-				log.Printf("Error finalize file: ERROR: %s", err.Error())
-				continue
-			}
-			break
-		case models.UploadRecordTypeCAD:
-			break
-		}
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
 
-		ur.Status = models.UploadStatusUploadFinalized
-		database.Save(ur)
-		log.Printf("Upload complete for record %d", ur.ID)
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func upload(database *models.DB, ur *models.UploadRecord) error {
+	appConfig, err := database.GetAppConfig()
+	if err != nil {
+		return fmt.Errorf("could not get app config: %w", err)
+	}
+	if appConfig.AgentToken == "" {
+		return fmt.Errorf("no agent token configured")
+	}
+
+	appConnect := NewAppConnect(appConfig.AgentToken, viper.GetString("app_connect_host"))
+
+	// The file was transferred before, e.g. when the agent stopped before finalizing it
+	if ur.Status == models.UploadStatusUploadTransferred && ur.ObjectKey != "" {
+		return finalize(database, appConnect, ur)
+	}
+
+	filename := filepath.Base(ur.FilePath)
+
+	ur.Status = models.UploadStatusStarting
+	database.Save(ur)
+	log.Printf("Starting upload for record %d", ur.ID)
+
+	var tempUploadRequest = *new(TempUploadUrlRequest)
+	// Make sure filename is sufficiently unique
+	tempUploadRequest.Filename = generateSixDigitGUID() + "_" + filename
+	tempUploadRequest.ContentType = ur.ContentType
+
+	tempUploadResponse, err := appConnect.GetTempUpload(tempUploadRequest)
+	if err != nil {
+		return fmt.Errorf("could not get temp upload URL: %w", err)
+	}
+	if tempUploadResponse.URL == "" {
+		return fmt.Errorf("could not get temp upload URL")
+	}
+
+	log.Printf("Temp Upload URL is: %s", tempUploadResponse.URL)
+	ur.Status = models.UploadStatusUploading
+	database.Save(ur)
+	log.Printf("Starting to upload data for for record %d", ur.ID)
 
-		// Remove the file after successful upload
-		err = os.Remove(ur.FilePath)
+	fileContent, err := ioutil.ReadFile(ur.FilePath)
+	if err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+
+	// Create an HTTP PUT request with the file content
+	req, err := http.NewRequest(http.MethodPut, tempUploadResponse.URL, bytes.NewReader(fileContent))
+	if err != nil {
+		return fmt.Errorf("error creating upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", ur.ContentType)
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(fileContent)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error uploading file, status: %d, response: %s", resp.StatusCode, string(body))
+	}
+
+	ur.Status = models.UploadStatusUploadTransferred
+	ur.ObjectKey = tempUploadResponse.ObjectKey
+	database.Save(ur)
+	log.Printf("Data all transferred for record %d", ur.ID)
+
+	return finalize(database, appConnect, ur)
+}
+
+// finalize finishes the upload of a transferred file and removes the file
+func finalize(database *models.DB, appConnect *AppConnect, ur *models.UploadRecord) error {
+	switch ur.Type {
+	case models.UploadRecordTypeCFS_AUDIO:
+		var cfsAudio = *new(models.CFSAudio)
+		cfsAudio.CallId = fmt.Sprintf("%d", ur.ID)
+		_, err := appConnect.FinalizeCFSUpload(ur.ObjectKey, cfsAudio)
 		if err != nil {
-			fmt.Printf("Error removing file: %v\n", err)
+			return fmt.Errorf("error finalizing file: %w", err)
 		}
+	case models.UploadRecordTypeCAD:
 	}
+
+	ur.Status = models.UploadStatusUploadFinalized
+	ur.LastError = ""
+	database.Save(ur)
+	log.Printf("Upload complete for record %d", ur.ID)
+
+	// Remove the file after successful upload
+	err := os.Remove(ur.FilePath)
+	if err != nil {
+		log.Printf("Error removing file: %v", err)
+	}
+
+	return nil
 }
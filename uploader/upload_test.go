@@ -0,0 +1,183 @@
+package uploader
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/psco-tech/gw-coach-recording-agent/models"
+	"github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	// The queue lives in the database, keep it away from the configuration of the agent
+	dir, err := os.MkdirTemp("", "uploader")
+	if err != nil {
+		panic(err)
+	}
+	viper.Set("config_path", filepath.Join(dir, "config.db"))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestRetryDelay(t *testing.T) {
+	viper.Set("uploader.retry_initial_delay", "30s")
+	viper.Set("uploader.retry_max_delay", "5m")
+
+	expected := []time.Duration{
+		30 * time.Second,
+		60 * time.Second,
+		120 * time.Second,
+		240 * time.Second,
+		5 * time.Minute,
+		5 * time.Minute,
+	}
+
+	for i, e := range expected {
+		if d := retryDelay(i + 1); d != e {
+			t.Logf("attempt %d: expected %s, got %s\n", i+1, e, d)
+			t.Fail()
+		}
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	viper.Set("uploader.max_attempts", 3)
+	viper.Set("uploader.retry_initial_delay", "30s")
+	viper.Set("uploader.retry_max_delay", "5m")
+
+	database, err := models.NewDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ur := &models.UploadRecord{FilePath: "failing.wav", Status: models.UploadStatusQueued}
+	database.Save(ur)
+
+	for attempt := 1; attempt < 3; attempt++ {
+		before := time.Now()
+		recordFailure(database, ur, errors.New("connection refused"))
+
+		saved := database.GetUploadRecordById(int(ur.ID))
+		if saved.Status != models.UploadStatusQueued || saved.Attempts != attempt || saved.LastError != "connection refused" {
+			t.Fatalf("attempt %d: unexpected record %+v", attempt, saved)
+		}
+		if saved.NextAttemptAt.Before(before.Add(retryDelay(attempt))) {
+			t.Fatalf("attempt %d: retry scheduled too early at %s", attempt, saved.NextAttemptAt)
+		}
+	}
+
+	recordFailure(database, ur, errors.New("bad gateway"))
+
+	saved := database.GetUploadRecordById(int(ur.ID))
+	if saved.Status != models.UploadStatusFailed || saved.Attempts != 3 || saved.LastError != "bad gateway" {
+		t.Fatalf("expected the record to fail after max_attempts, got %+v", saved)
+	}
+
+	pending, err := database.GetPendingUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pending {
+		if p.ID == ur.ID {
+			t.Fatal("failed record is still pending")
+		}
+	}
+}
+
+func TestEnqueueResetsRetries(t *testing.T) {
+	database, err := models.NewDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ur := &models.UploadRecord{
+		FilePath:      "retried.wav",
+		Status:        models.UploadStatusFailed,
+		Attempts:      8,
+		LastError:     "bad gateway",
+		NextAttemptAt: time.Now().Add(time.Hour),
+	}
+	database.Save(ur)
+
+	err = Enqueue(ur)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := database.GetUploadRecordById(int(ur.ID))
+	if saved.Status != models.UploadStatusQueued || saved.Attempts != 0 || saved.LastError != "" || !saved.NextAttemptAt.IsZero() {
+		t.Fatalf("expected a fresh queued record, got %+v", saved)
+	}
+}
+
+func TestResumeTransferredUpload(t *testing.T) {
+	database, err := models.NewDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Save(&models.AppConfig{AgentToken: "token"})
+
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	viper.Set("app_connect_host", server.URL)
+
+	file, err := os.CreateTemp(t.TempDir(), "*.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// The agent stopped after the file was transferred
+	ur := &models.UploadRecord{
+		FilePath:  file.Name(),
+		Type:      models.UploadRecordTypeCFS_AUDIO,
+		Status:    models.UploadStatusUploadTransferred,
+		ObjectKey: "key-1",
+	}
+	database.Save(ur)
+
+	pending, err := database.GetPendingUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, p := range pending {
+		found = found || p.ID == ur.ID
+	}
+	if !found {
+		t.Fatal("transferred record isn't pending")
+	}
+
+	// Only the finalization is left
+	err = upload(database, ur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 || requested[0] != "/u/agent/upload/cfsaudio/key-1" {
+		t.Fatalf("unexpected requests %v", requested)
+	}
+	if saved := database.GetUploadRecordById(int(ur.ID)); saved.Status != models.UploadStatusUploadFinalized {
+		t.Fatalf("unexpected record %+v", saved)
+	}
+	if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Fatal("file wasn't removed")
+	}
+
+	// A failed finalization is retried without transferring the file again
+	ur.Status = models.UploadStatusUploadTransferred
+	recordFailure(database, ur, errors.New("bad gateway"))
+	if saved := database.GetUploadRecordById(int(ur.ID)); saved.Status != models.UploadStatusUploadTransferred || saved.ObjectKey != "key-1" {
+		t.Fatalf("unexpected record %+v", saved)
+	}
+}